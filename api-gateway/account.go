@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/mail"
+	"gobuild/api-gateway/quota"
+	"gobuild/api-gateway/users"
+	"gobuild/api-gateway/webhooks"
+	"gobuild/shared/audit"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+)
+
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+	accountDeletionTTL   = time.Hour
+	// accountMailInterval limits how often reset and verification mails are
+	// sent to one user
+	accountMailInterval = time.Minute
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type DeleteAccountRequest struct {
+	// Password is required for accounts that have one
+	Password string `json:"password"`
+	// Token confirms the deletion of an account without password; a request
+	// without it mails the token to the user
+	Token string `json:"token"`
+}
+
+// AccountAPI lets users manage their own account: password change and reset,
+// email verification and deletion
+type AccountAPI struct {
+	users         *users.UserStore
+	tokens        *users.TokenStore
+	sessions      *auth.SessionStore
+	orgs          *users.OrgStore
+	projects      *ProjectAPI
+	hooks         *webhooks.Store
+	quotas        *quota.Store
+	mailer        mail.Sender
+	audit         *audit.Recorder
+	kafkaProducer kafka.Publisher
+	issueTokens   func(ctx context.Context, user *users.User) (*auth.TokenPair, error)
+	// appURL is the dashboard, publicURL the gateway as browsers reach them
+	appURL    string
+	publicURL string
+}
+
+func NewAccountAPI(userStore *users.UserStore, tokens *users.TokenStore, sessions *auth.SessionStore, orgs *users.OrgStore, projectAPI *ProjectAPI, hooks *webhooks.Store, quotas *quota.Store, mailer mail.Sender, recorder *audit.Recorder, kafkaProducer kafka.Publisher, issueTokens func(ctx context.Context, user *users.User) (*auth.TokenPair, error), appURL, publicURL string) *AccountAPI {
+	return &AccountAPI{
+		users:         userStore,
+		tokens:        tokens,
+		sessions:      sessions,
+		orgs:          orgs,
+		projects:      projectAPI,
+		hooks:         hooks,
+		quotas:        quotas,
+		mailer:        mailer,
+		audit:         recorder,
+		kafkaProducer: kafkaProducer,
+		issueTokens:   issueTokens,
+		appURL:        appURL,
+		publicURL:     publicURL,
+	}
+}
+
+// RegisterRoutes adds the account endpoints. Password reset and email
+// verification work without login, AuthMiddleware lets them through.
+func (a *AccountAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/account", a.GetAccount).Methods("GET")
+	r.HandleFunc("/api/account", a.DeleteAccount).Methods("DELETE")
+	r.HandleFunc("/api/account/password", a.ChangePassword).Methods("POST")
+	r.HandleFunc("/api/account/verification", a.SendVerification).Methods("POST")
+
+	r.HandleFunc("/api/account/password-reset", a.RequestPasswordReset).Methods("POST")
+	r.HandleFunc("/api/account/password-reset/confirm", a.ConfirmPasswordReset).Methods("POST")
+	r.HandleFunc("/api/account/verify-email", a.VerifyEmail).Methods("GET", "POST")
+}
+
+// sessionUser loads the logged-in user. Personal access tokens cannot manage
+// the account. It writes an error response and returns nil otherwise.
+func (a *AccountAPI) sessionUser(w http.ResponseWriter, r *http.Request) (*auth.UserClaims, *users.User) {
+	userClaims, ok := auth.UserClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+	if userClaims.IsPersonalToken() {
+		http.Error(w, "Personal access tokens cannot manage the account", http.StatusForbidden)
+		return nil, nil
+	}
+
+	user, err := a.users.GetByID(r.Context(), userClaims.ID)
+	if err == users.ErrUserNotFound {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load user %s: %v", userClaims.ID, err)
+		http.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return nil, nil
+	}
+	return userClaims, user
+}
+
+// GetAccount returns the logged-in user
+func (a *AccountAPI) GetAccount(w http.ResponseWriter, r *http.Request) {
+	_, user := a.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*users.User
+		HasPassword bool `json:"has_password"`
+	}{User: user, HasPassword: user.HasPassword()})
+}
+
+// ChangePassword replaces the password after checking the current one. All
+// other sessions end and personal access tokens are revoked; the response
+// carries a new token pair for this session.
+func (a *AccountAPI) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userClaims, user := a.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+	// SSO accounts set their first password through the reset mail, so a
+	// stolen access token alone cannot add a password login
+	if !user.HasPassword() {
+		http.Error(w, "This account has no password yet, request a password reset to set one", http.StatusBadRequest)
+		return
+	}
+	if err := user.CheckPassword(req.CurrentPassword); err != nil {
+		event := actorEvent(userClaims, audit.ActionPasswordChange, audit.TargetUser, user.ID)
+		event.Outcome = audit.OutcomeFailure
+		event.Details["reason"] = "invalid_credentials"
+		a.audit.Record(r, event)
+		http.Error(w, "Current password is wrong", http.StatusUnauthorized)
+		return
+	}
+
+	if err := a.setPassword(r.Context(), user, req.NewPassword); err != nil {
+		log.Printf("❌ Failed to change password of %s: %v", user.Email, err)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := a.issueTokens(r.Context(), user)
+	if err != nil {
+		log.Printf("❌ Failed to generate token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 %s changed their password", user.Email)
+	a.audit.Record(r, actorEvent(userClaims, audit.ActionPasswordChange, audit.TargetUser, user.ID))
+	mail.SendAsync(a.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Your gobuild password was changed",
+		Body: "The password of your gobuild account was just changed, all sessions were logged out and your personal access tokens revoked.\n\n" +
+			"If this was not you, reset your password at " + a.appURL + "/reset-password right away.",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLoginResponse(user, tokens))
+}
+
+// setPassword stores a new password, invalidates pending reset links and ends
+// all sessions. Personal access tokens are revoked too: whoever knew the old
+// password may have created some.
+func (a *AccountAPI) setPassword(ctx context.Context, user *users.User, password string) error {
+	if err := a.users.SetPassword(ctx, user, password); err != nil {
+		return err
+	}
+	if err := a.users.RevokeAccountTokens(ctx, users.PurposePasswordReset, user.ID); err != nil {
+		return err
+	}
+	if err := a.tokens.RevokeAll(ctx, user.ID); err != nil {
+		return err
+	}
+	return a.sessions.RevokeAllSessions(ctx, user.ID)
+}
+
+// RequestPasswordReset mails a reset link if an account with the email exists.
+// The response is the same either way, so it does not reveal accounts.
+func (a *AccountAPI) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.sendPasswordReset(r, req.Email); err != nil {
+		log.Printf("❌ Failed to start password reset for %s: %v", req.Email, err)
+		http.Error(w, "Failed to request password reset", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *AccountAPI) sendPasswordReset(r *http.Request, email string) error {
+	user, err := a.users.GetByEmail(r.Context(), email)
+	if err == users.ErrUserNotFound {
+		a.audit.Record(r, message.AuditEventMessage{
+			Action:     audit.ActionPasswordResetRequest,
+			Outcome:    audit.OutcomeFailure,
+			ActorEmail: email,
+			Details:    map[string]string{"reason": "unknown_email"},
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return nil
+	}
+
+	allowed, err := a.users.ThrottleAccountMail(r.Context(), users.PurposePasswordReset, user.ID, accountMailInterval)
+	if err != nil || !allowed {
+		return err
+	}
+	token, err := a.users.IssueAccountToken(r.Context(), users.PurposePasswordReset, user.ID, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("🔑 Password reset requested for %s", user.Email)
+	a.audit.Record(r, message.AuditEventMessage{
+		Action:     audit.ActionPasswordResetRequest,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+	})
+	mail.SendAsync(a.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your gobuild password",
+		Body: "Someone asked to reset the password of your gobuild account. To choose a new password, open\n\n" +
+			a.appURL + "/reset-password?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link works once and expires in one hour. If you did not ask for it, ignore this mail.",
+	})
+	return nil
+}
+
+// ConfirmPasswordReset sets a new password with the token from a reset mail.
+// Following the link proves the email, so it also counts as verified.
+func (a *AccountAPI) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req ConfirmPasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.NewPassword == "" {
+		http.Error(w, "Token and new password are required", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := a.consumeAccountToken(w, r, users.PurposePasswordReset, req.Token)
+	if !ok {
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	}
+
+	user.EmailVerified = true
+	if err := a.setPassword(r.Context(), user, req.NewPassword); err != nil {
+		log.Printf("❌ Failed to reset password of %s: %v", user.Email, err)
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 %s reset their password", user.Email)
+	a.audit.Record(r, message.AuditEventMessage{
+		Action:     audit.ActionPasswordReset,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// consumeAccountToken redeems a mailed token and loads its user. It writes an
+// error response and returns false if that failed.
+func (a *AccountAPI) consumeAccountToken(w http.ResponseWriter, r *http.Request, purpose, token string) (*users.User, bool) {
+	userID, err := a.users.ConsumeAccountToken(r.Context(), purpose, token)
+	if err == users.ErrInvalidAccountToken {
+		http.Error(w, "The link is invalid or has expired", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to redeem %s token: %v", purpose, err)
+		http.Error(w, "Failed to redeem token", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	user, err := a.users.GetByID(r.Context(), userID)
+	if err == users.ErrUserNotFound {
+		http.Error(w, "The link is invalid or has expired", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load user %s: %v", userID, err)
+		http.Error(w, "Failed to redeem token", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// SendVerification mails the logged-in user a link that verifies their email
+func (a *AccountAPI) SendVerification(w http.ResponseWriter, r *http.Request) {
+	_, user := a.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email address is already verified", http.StatusConflict)
+		return
+	}
+
+	if err := a.sendVerification(r.Context(), user); err != nil {
+		log.Printf("❌ Failed to send verification mail to %s: %v", user.Email, err)
+		http.Error(w, "Failed to send verification mail", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerification mails a verification link unless one was sent within
+// accountMailInterval
+func (a *AccountAPI) sendVerification(ctx context.Context, user *users.User) error {
+	allowed, err := a.users.ThrottleAccountMail(ctx, users.PurposeEmailVerification, user.ID, accountMailInterval)
+	if err != nil || !allowed {
+		return err
+	}
+	token, err := a.users.IssueAccountToken(ctx, users.PurposeEmailVerification, user.ID, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	mail.SendAsync(a.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your gobuild email address",
+		Body: "Please confirm that this is your email address by opening\n\n" +
+			a.publicURL + "/api/account/verify-email?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link expires in two days.",
+	})
+	return nil
+}
+
+// VerifyEmail marks the email as verified with the token from a verification
+// mail, given as ?token= when the link is opened or in the JSON body
+func (a *AccountAPI) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == "POST" {
+		var req VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := a.consumeAccountToken(w, r, users.PurposeEmailVerification, token)
+	if !ok {
+		return
+	}
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		if err := a.users.Update(r.Context(), user); err != nil {
+			log.Printf("❌ Failed to verify email of %s: %v", user.Email, err)
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := a.users.RevokeAccountTokens(r.Context(), users.PurposeEmailVerification, user.ID); err != nil {
+		log.Printf("⚠️ Failed to revoke verification links of %s: %v", user.Email, err)
+	}
+
+	log.Printf("✅ %s verified their email address", user.Email)
+	a.audit.Record(r, message.AuditEventMessage{
+		Action:     audit.ActionEmailVerify,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+	})
+
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "Your email address is verified, you can close this page.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAccount deletes the logged-in user together with their personal
+// projects, webhooks, tokens and sessions. The orchestrator removes their
+// builds and artifacts after the user-deletions event. Organisations the
+// user is the only owner of must be handed over or deleted first. Accounts
+// without password confirm with a mailed token, so a stolen access token
+// alone cannot delete them.
+func (a *AccountAPI) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userClaims, user := a.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// The body is optional for accounts without password
+	var req DeleteAccountRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case user.HasPassword():
+		if err := user.CheckPassword(req.Password); err != nil {
+			event := actorEvent(userClaims, audit.ActionAccountDelete, audit.TargetUser, user.ID)
+			event.Outcome = audit.OutcomeFailure
+			event.Details["reason"] = "invalid_credentials"
+			a.audit.Record(r, event)
+			http.Error(w, "Password is wrong", http.StatusUnauthorized)
+			return
+		}
+	case req.Token == "":
+		if err := a.sendDeletionConfirmation(r.Context(), user); err != nil {
+			log.Printf("❌ Failed to send deletion confirmation to %s: %v", user.Email, err)
+			http.Error(w, "Failed to send confirmation mail", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		userID, err := a.users.ConsumeAccountToken(r.Context(), users.PurposeAccountDeletion, req.Token)
+		if err == users.ErrInvalidAccountToken || (err == nil && userID != user.ID) {
+			http.Error(w, "The link is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("❌ Failed to redeem %s token: %v", users.PurposeAccountDeletion, err)
+			http.Error(w, "Failed to redeem token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Leaving the organisations first fails without changes if one would be left without owner
+	memberships, err := a.orgs.LeaveAll(r.Context(), user.ID)
+	if err != nil {
+		if errors.Is(err, users.ErrLastOwner) {
+			http.Error(w, fmt.Sprintf("You are the only owner of an organisation (%v), add another owner or delete it first", err), http.StatusConflict)
+			return
+		}
+		log.Printf("❌ Failed to remove %s from their organisations: %v", user.Email, err)
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	deletedMsg := message.UserDeletedMessage{
+		UserID:    user.ID,
+		DeletedAt: time.Now(),
+	}
+	sendCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if err := a.kafkaProducer.SendMessageSync(sendCtx, kafka.TopicUserDeletions, user.ID, deletedMsg); err != nil {
+		log.Printf("❌ Failed to send user deletion to Kafka: %v", err)
+		// Nothing is deleted yet, the account stays as it was
+		if err := a.orgs.Rejoin(r.Context(), user.ID, memberships); err != nil {
+			log.Printf("❌ Failed to restore the memberships of %s: %v", user.Email, err)
+		}
+		http.Error(w, "Failed to delete account", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := a.deleteUserData(r.Context(), user); err != nil {
+		log.Printf("❌ Failed to delete account %s: %v", user.Email, err)
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🗑️ %s deleted their account", user.Email)
+	a.audit.Record(r, actorEvent(userClaims, audit.ActionAccountDelete, audit.TargetUser, user.ID))
+	mail.SendAsync(a.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Your gobuild account was deleted",
+		Body:    "Your gobuild account, your personal projects, builds and artifacts were deleted.",
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendDeletionConfirmation mails the token that confirms the deletion of an
+// account without password, unless one was sent within accountMailInterval
+func (a *AccountAPI) sendDeletionConfirmation(ctx context.Context, user *users.User) error {
+	allowed, err := a.users.ThrottleAccountMail(ctx, users.PurposeAccountDeletion, user.ID, accountMailInterval)
+	if err != nil || !allowed {
+		return err
+	}
+	token, err := a.users.IssueAccountToken(ctx, users.PurposeAccountDeletion, user.ID, accountDeletionTTL)
+	if err != nil {
+		return err
+	}
+
+	mail.SendAsync(a.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "Confirm the deletion of your gobuild account",
+		Body: "Someone asked to delete your gobuild account together with your personal projects, builds and artifacts. To confirm, open\n\n" +
+			a.appURL + "/delete-account?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link works once and expires in one hour. If you did not ask for it, ignore this mail and log out all sessions.",
+	})
+	return nil
+}
+
+// deleteUserData removes everything the gateway keeps for the user. Each step
+// can be repeated, so a failed deletion can simply be retried.
+func (a *AccountAPI) deleteUserData(ctx context.Context, user *users.User) error {
+	owned, err := a.projects.projects.List(ctx, user.ID, nil, false)
+	if err != nil {
+		return err
+	}
+	for _, project := range owned {
+		if project.OrgID != "" || project.OwnerID != user.ID {
+			continue
+		}
+		if err := a.projects.projects.Delete(ctx, project); err != nil {
+			return err
+		}
+		if err := a.projects.secrets.DeleteAll(ctx, project.ID); err != nil {
+			return err
+		}
+	}
+	if err := a.projects.projects.ForgetOwner(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := a.hooks.DeleteAll(ctx, user.ID); err != nil {
+		return err
+	}
+	if err := a.tokens.RevokeAll(ctx, user.ID); err != nil {
+		return err
+	}
+	if err := a.quotas.DeleteOverride(ctx, user.ID); err != nil {
+		return err
+	}
+	for _, purpose := range []string{users.PurposePasswordReset, users.PurposeEmailVerification, users.PurposeAccountDeletion} {
+		if err := a.users.RevokeAccountTokens(ctx, purpose, user.ID); err != nil {
+			return err
+		}
+	}
+	if err := a.sessions.RevokeAllSessions(ctx, user.ID); err != nil {
+		return err
+	}
+	return a.users.Delete(ctx, user)
+}
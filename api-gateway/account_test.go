@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/mail"
+	"gobuild/api-gateway/projects"
+	"gobuild/api-gateway/quota"
+	"gobuild/api-gateway/secrets"
+	"gobuild/api-gateway/users"
+	"gobuild/api-gateway/webhooks"
+	"gobuild/shared/audit"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/repository"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+// recordingSender keeps the mails sent through it
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, msg mail.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+// waitFor returns the first mail to to, which SendAsync delivers in the background
+func (s *recordingSender) waitFor(t *testing.T, to string) mail.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for _, msg := range s.sent {
+			if msg.To == to {
+				s.mu.Unlock()
+				return msg
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No mail was sent to %s", to)
+	return mail.Message{}
+}
+
+// testPublisher publishes to the in-memory bus until err is set
+type testPublisher struct {
+	kafka.Publisher
+	err error
+}
+
+func (p *testPublisher) SendMessageSync(ctx context.Context, topic string, key string, event message.Event) error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.Publisher.SendMessageSync(ctx, topic, key, event)
+}
+
+// testGateway serves the gateway's user facing routes on a test database,
+// with Kafka replaced by an in-memory bus
+type testGateway struct {
+	router      *mux.Router
+	redis       *redis.Client
+	bus         *kafka.MemoryBus
+	publisher   *testPublisher
+	mailer      *recordingSender
+	users       *users.UserStore
+	tokens      *users.TokenStore
+	sessions    *auth.SessionStore
+	orgs        *users.OrgStore
+	audit       *audit.Recorder
+	issueTokens func(ctx context.Context, user *users.User) (*auth.TokenPair, error)
+}
+
+func newTestGateway(t *testing.T) *testGateway {
+	t.Helper()
+	client := testRedis(t)
+	ctx := context.Background()
+
+	keys, err := auth.NewKeyStore(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	secretStore, err := secrets.NewStore(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &testGateway{
+		router:   mux.NewRouter(),
+		redis:    client,
+		bus:      kafka.NewMemoryBus(1),
+		mailer:   &recordingSender{},
+		users:    users.NewUserStore(client),
+		tokens:   users.NewTokenStore(client),
+		sessions: auth.NewSessionStore(client, keys),
+		orgs:     users.NewOrgStore(client),
+	}
+	g.issueTokens = newTokenIssuer(g.sessions, g.orgs)
+	g.publisher = &testPublisher{Publisher: g.bus.Publisher()}
+	g.audit = audit.NewRecorder(g.publisher, "api-gateway")
+	projectStore := projects.NewProjectStore(client)
+	projectAPI := NewProjectAPI(projectStore, g.orgs, secretStore, repository.NewPolicy(nil, nil), "http://127.0.0.1:1")
+
+	g.router.Use(auth.AuthMiddleware(g.sessions, newPersonalTokenVerifier(g.tokens, g.users, g.orgs)))
+	NewAccountAPI(g.users, g.tokens, g.sessions, g.orgs, projectAPI, webhooks.NewStore(client), quota.NewStore(client),
+		g.mailer, g.audit, g.publisher, g.issueTokens, "http://app.test", "http://api.test").RegisterRoutes(g.router)
+	NewOrgAPI(g.orgs, g.users, projectStore).RegisterRoutes(g.router)
+	return g
+}
+
+// createUser stores a user; without password it is an SSO account
+func (g *testGateway) createUser(t *testing.T, email, password string, verified bool) *users.User {
+	t.Helper()
+	user := &users.User{
+		ID:            uuid.New().String(),
+		Email:         email,
+		Password:      password,
+		Role:          auth.RoleUser,
+		EmailVerified: verified,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	if err := g.users.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	return user
+}
+
+// login returns an access token of a new session of user
+func (g *testGateway) login(t *testing.T, user *users.User) string {
+	t.Helper()
+	tokens, err := g.issueTokens(context.Background(), user)
+	if err != nil {
+		t.Fatalf("issueTokens() = %v", err)
+	}
+	return tokens.AccessToken
+}
+
+// do sends a request with token as bearer token and body as JSON
+func (g *testGateway) do(t *testing.T, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	g.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestChangePasswordKeepsNewSession(t *testing.T) {
+	g := newTestGateway(t)
+	user := g.createUser(t, "alice@example.com", "old password", true)
+	oldToken := g.login(t, user)
+
+	rec := g.do(t, "POST", "/api/account/password", oldToken, ChangePasswordRequest{CurrentPassword: "old password", NewPassword: "new password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /api/account/password = %d %s, want %d", rec.Code, rec.Body, http.StatusOK)
+	}
+	var resp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The returned token is used right away, within the second of the change
+	if rec := g.do(t, "GET", "/api/account", resp.Token, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /api/account with the new token = %d %s, want %d", rec.Code, rec.Body, http.StatusOK)
+	}
+	if rec := g.do(t, "GET", "/api/account", oldToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /api/account with the old token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, err := g.users.Authenticate(context.Background(), user.Email, "new password"); err != nil {
+		t.Errorf("Authenticate() with the new password = %v", err)
+	}
+}
+
+func TestSetPasswordRevokesPersonalTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, g *testGateway, user *users.User) *httptest.ResponseRecorder
+	}{
+		{"change", func(t *testing.T, g *testGateway, user *users.User) *httptest.ResponseRecorder {
+			return g.do(t, "POST", "/api/account/password", g.login(t, user), ChangePasswordRequest{CurrentPassword: "old password", NewPassword: "new password"})
+		}},
+		{"reset", func(t *testing.T, g *testGateway, user *users.User) *httptest.ResponseRecorder {
+			token, err := g.users.IssueAccountToken(context.Background(), users.PurposePasswordReset, user.ID, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return g.do(t, "POST", "/api/account/password-reset/confirm", "", ConfirmPasswordResetRequest{Token: token, NewPassword: "new password"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t)
+			ctx := context.Background()
+			user := g.createUser(t, "alice@example.com", "old password", true)
+			pat, _, err := g.tokens.Create(ctx, user.ID, "ci", []string{auth.ScopeBuildsRead}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rec := tt.change(t, g, user); rec.Code >= 300 {
+				t.Fatalf("Password %s = %d %s", tt.name, rec.Code, rec.Body)
+			}
+			if _, err := g.tokens.Authenticate(ctx, pat); err != users.ErrTokenNotFound {
+				t.Errorf("Authenticate() of a personal access token after the password %s = %v, want %v", tt.name, err, users.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+	g := newTestGateway(t)
+	ctx := context.Background()
+	user := g.createUser(t, "sso@example.com", "", true)
+	other := g.createUser(t, "other@example.com", "", true)
+	token := g.login(t, user)
+
+	if rec := g.do(t, "DELETE", "/api/account", token, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("DELETE /api/account without token = %d %s, want %d", rec.Code, rec.Body, http.StatusAccepted)
+	}
+	if _, err := g.users.GetByID(ctx, user.ID); err != nil {
+		t.Fatalf("GetByID() before confirmation = %v", err)
+	}
+	body := g.mailer.waitFor(t, user.Email).Body
+	_, link, _ := strings.Cut(body, "/delete-account?token=")
+	confirmation, err := url.QueryUnescape(strings.Fields(link)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherToken, err := g.users.IssueAccountToken(ctx, users.PurposeAccountDeletion, other.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"wrong token", "invalid", http.StatusBadRequest},
+		{"token of another user", otherToken, http.StatusBadRequest},
+		{"mailed token", confirmation, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := g.do(t, "DELETE", "/api/account", token, DeleteAccountRequest{Token: tt.token})
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: DELETE /api/account = %d %s, want %d", tt.name, rec.Code, rec.Body, tt.wantCode)
+		}
+	}
+	if _, err := g.users.GetByID(ctx, user.ID); err != users.ErrUserNotFound {
+		t.Errorf("GetByID() after confirmation = %v, want %v", err, users.ErrUserNotFound)
+	}
+}
+
+func TestDeleteAccountKeepsMembershipsWhenNotPublished(t *testing.T) {
+	g := newTestGateway(t)
+	ctx := context.Background()
+	owner := g.createUser(t, "owner@example.com", "password", true)
+	user := g.createUser(t, "alice@example.com", "password", true)
+	org, err := g.orgs.Create(ctx, "acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := g.orgs.Invite(ctx, org.ID, user.Email, users.OrgRoleMaintainer, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.orgs.AcceptInvitation(ctx, invitation.ID, user); err != nil {
+		t.Fatal(err)
+	}
+
+	g.publisher.err = errors.New("kafka unavailable")
+	rec := g.do(t, "DELETE", "/api/account", g.login(t, user), DeleteAccountRequest{Password: "password"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("DELETE /api/account = %d %s, want %d", rec.Code, rec.Body, http.StatusServiceUnavailable)
+	}
+
+	if role, err := g.orgs.Role(ctx, org.ID, user.ID); err != nil || role != users.OrgRoleMaintainer {
+		t.Errorf("Role() after the failed deletion = %q, %v, want %q", role, err, users.OrgRoleMaintainer)
+	}
+	if orgIDs, err := g.orgs.OrgIDs(ctx, user.ID); err != nil || len(orgIDs) != 1 || orgIDs[0] != org.ID {
+		t.Errorf("OrgIDs() after the failed deletion = %v, %v, want [%s]", orgIDs, err, org.ID)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/quota"
+	"gobuild/api-gateway/users"
+)
+
+type UserListResponse struct {
+	Users  []*users.User `json:"users"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// LimitsResponse shows the limits that apply to a user and where they come from
+type LimitsResponse struct {
+	Limits   quota.Limits  `json:"limits"`
+	Override *quota.Limits `json:"override,omitempty"`
+	Default  quota.Limits  `json:"role_default"`
+}
+
+// AdminAPI serves the admin-only user management and build endpoints
+type AdminAPI struct {
+	userStore            *users.UserStore
+	sessions             *auth.SessionStore
+	keys                 *auth.KeyStore
+	quotas               *quota.Store
+	buildOrchestratorURL string
+}
+
+func NewAdminAPI(userStore *users.UserStore, sessions *auth.SessionStore, keys *auth.KeyStore, quotas *quota.Store, buildOrchestratorURL string) *AdminAPI {
+	return &AdminAPI{
+		userStore:            userStore,
+		sessions:             sessions,
+		keys:                 keys,
+		quotas:               quotas,
+		buildOrchestratorURL: buildOrchestratorURL,
+	}
+}
+
+// RegisterRoutes adds the admin endpoints below /api/admin, each guarded by its permission
+func (a *AdminAPI) RegisterRoutes(r *mux.Router) {
+	admin := r.PathPrefix("/api/admin").Subrouter()
+
+	userRoutes := admin.PathPrefix("/users").Subrouter()
+	userRoutes.Use(auth.RequirePermission(auth.PermissionManageUsers))
+	userRoutes.HandleFunc("", a.ListUsers).Methods("GET")
+	userRoutes.HandleFunc("/{userId}", a.GetUser).Methods("GET")
+	userRoutes.HandleFunc("/{userId}/role", a.SetRole).Methods("PUT")
+	userRoutes.HandleFunc("/{userId}/disable", a.DisableUser).Methods("POST")
+	userRoutes.HandleFunc("/{userId}/enable", a.EnableUser).Methods("POST")
+	userRoutes.HandleFunc("/{userId}/limits", a.GetLimits).Methods("GET")
+	userRoutes.HandleFunc("/{userId}/limits", a.SetLimits).Methods("PUT")
+	userRoutes.HandleFunc("/{userId}/limits", a.ResetLimits).Methods("DELETE")
+
+	buildRoutes := admin.PathPrefix("/builds").Subrouter()
+	buildRoutes.Use(auth.RequirePermission(auth.PermissionViewAllBuilds))
+	buildRoutes.HandleFunc("/{buildId}", a.GetBuild).Methods("GET")
+
+	keyRoutes := admin.PathPrefix("/signing-keys").Subrouter()
+	keyRoutes.Use(auth.RequirePermission(auth.PermissionManageKeys))
+	keyRoutes.HandleFunc("", a.ListSigningKeys).Methods("GET")
+	keyRoutes.HandleFunc("/rotate", a.RotateSigningKey).Methods("POST")
+}
+
+// ListSigningKeys lists the published access token signing keys
+func (a *AdminAPI) ListSigningKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.keys.Keys())
+}
+
+// RotateSigningKey creates a new signing key ahead of schedule. Like scheduled
+// keys it is published first and signs tokens a few minutes later.
+func (a *AdminAPI) RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+
+	key, err := a.keys.Rotate(r.Context())
+	if err != nil {
+		log.Printf("❌ Failed to rotate signing key: %v", err)
+		http.Error(w, "Failed to rotate signing key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🛡️ %s rotated the signing key, new key %s", claims.Email, key.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// ListUsers lists users; ?q= searches by email, ?offset= and ?limit= page the result
+func (a *AdminAPI) ListUsers(w http.ResponseWriter, r *http.Request) {
+	opts := users.ListOptions{
+		Query: r.URL.Query().Get("q"),
+		Limit: 50,
+	}
+	if offset, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && offset > 0 {
+		opts.Offset = offset
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 && limit <= 500 {
+		opts.Limit = limit
+	}
+
+	list, total, err := a.userStore.List(r.Context(), opts)
+	if err != nil {
+		log.Printf("❌ Failed to list users: %v", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserListResponse{
+		Users:  list,
+		Total:  total,
+		Offset: opts.Offset,
+		Limit:  opts.Limit,
+	})
+}
+
+// loadUser writes an error response and returns nil if the user cannot be loaded
+func (a *AdminAPI) loadUser(w http.ResponseWriter, r *http.Request) *users.User {
+	user, err := a.userStore.GetByID(r.Context(), mux.Vars(r)["userId"])
+	if err == users.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load user: %v", err)
+		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		return nil
+	}
+	return user
+}
+
+func (a *AdminAPI) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// SetRole changes the role of a user. The user's sessions are revoked so the
+// new role applies right away instead of after the access token expired.
+func (a *AdminAPI) SetRole(w http.ResponseWriter, r *http.Request) {
+	var roleReq RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&roleReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !auth.ValidRole(roleReq.Role) {
+		http.Error(w, "Unknown role: "+roleReq.Role, http.StatusBadRequest)
+		return
+	}
+
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	if user.ID == claims.ID && roleReq.Role != auth.RoleAdmin {
+		http.Error(w, "Admins cannot remove their own admin role", http.StatusBadRequest)
+		return
+	}
+
+	if a.updateUser(w, r, user, func(u *users.User) { u.Role = roleReq.Role }) {
+		log.Printf("🛡️ %s changed role of %s to %s", claims.Email, user.Email, roleReq.Role)
+	}
+}
+
+func (a *AdminAPI) DisableUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	if user.ID == claims.ID {
+		http.Error(w, "Admins cannot disable themselves", http.StatusBadRequest)
+		return
+	}
+
+	if a.updateUser(w, r, user, func(u *users.User) { u.Disabled = true }) {
+		log.Printf("🛡️ %s disabled user %s", claims.Email, user.Email)
+	}
+}
+
+func (a *AdminAPI) EnableUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	if a.updateUser(w, r, user, func(u *users.User) { u.Disabled = false }) {
+		log.Printf("🛡️ %s enabled user %s", claims.Email, user.Email)
+	}
+}
+
+// updateUser applies change, saves the user, ends all of its sessions and writes
+// the user to w. It returns false if an error response was written instead.
+func (a *AdminAPI) updateUser(w http.ResponseWriter, r *http.Request, user *users.User, change func(*users.User)) bool {
+	change(user)
+
+	if err := a.userStore.Update(r.Context(), user); err != nil {
+		log.Printf("❌ Failed to update user %s: %v", user.ID, err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return false
+	}
+	if err := a.sessions.RevokeAllSessions(r.Context(), user.ID); err != nil {
+		log.Printf("❌ Failed to revoke sessions of user %s: %v", user.ID, err)
+		http.Error(w, "User updated, but revoking sessions failed", http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+	return true
+}
+
+// GetLimits returns the build limits of a user
+func (a *AdminAPI) GetLimits(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	a.writeLimits(w, r, user)
+}
+
+// SetLimits overrides the role's build limits for a user; 0 means unlimited.
+// The new limits apply to the next build request.
+func (a *AdminAPI) SetLimits(w http.ResponseWriter, r *http.Request) {
+	var limits quota.Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := a.quotas.SetOverride(r.Context(), user.ID, limits)
+	if err == quota.ErrInvalidLimits {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to set limits of user %s: %v", user.ID, err)
+		http.Error(w, "Failed to set limits", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	log.Printf("🛡️ %s set limits of %s to %+v", claims.Email, user.Email, limits)
+	a.writeLimits(w, r, user)
+}
+
+// ResetLimits removes a user's override so the role defaults apply again
+func (a *AdminAPI) ResetLimits(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := a.quotas.DeleteOverride(r.Context(), user.ID); err != nil {
+		log.Printf("❌ Failed to reset limits of user %s: %v", user.ID, err)
+		http.Error(w, "Failed to reset limits", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	log.Printf("🛡️ %s reset limits of %s", claims.Email, user.Email)
+	a.writeLimits(w, r, user)
+}
+
+func (a *AdminAPI) writeLimits(w http.ResponseWriter, r *http.Request, user *users.User) {
+	override, err := a.quotas.Override(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("❌ Failed to load limits of user %s: %v", user.ID, err)
+		http.Error(w, "Failed to load limits", http.StatusInternalServerError)
+		return
+	}
+
+	resp := LimitsResponse{
+		Override: override,
+		Default:  a.quotas.RoleDefault(user.Role),
+	}
+	resp.Limits = resp.Default
+	if override != nil {
+		resp.Limits = *override
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetBuild returns any build, regardless of who started it
+func (a *AdminAPI) GetBuild(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.UserClaimsFromContext(r.Context())
+	build := loadVisibleBuild(w, r, a.buildOrchestratorURL, mux.Vars(r)["buildId"], claims)
+	if build == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(build)
+}
+
+// bootstrapAdmin makes sure the user configured by ADMIN_EMAIL and ADMIN_PASSWORD
+// exists and is an enabled admin. An existing account is only promoted if its
+// email is verified. Without ADMIN_EMAIL nothing happens.
+func bootstrapAdmin(ctx context.Context, userStore *users.UserStore) error {
+	email := os.Getenv("ADMIN_EMAIL")
+	if email == "" {
+		return nil
+	}
+
+	user, err := userStore.GetByEmail(ctx, email)
+	if err == users.ErrUserNotFound {
+		password := os.Getenv("ADMIN_PASSWORD")
+		if password == "" {
+			log.Printf("⚠️ ADMIN_EMAIL is set but ADMIN_PASSWORD is empty, not creating admin %s", email)
+			return nil
+		}
+
+		err = userStore.Create(ctx, &users.User{
+			ID:            uuid.New().String(),
+			Email:         email,
+			EmailVerified: true,
+			Password:      password,
+			Role:          auth.RoleAdmin,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("✅ Created admin user %s", email)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Role == auth.RoleAdmin && !user.Disabled {
+		return nil
+	}
+	// Anyone can register an address, only promote it once its owner proved it
+	if !user.EmailVerified {
+		log.Printf("⚠️ Not promoting %s to admin: the account exists but its email address is not verified", email)
+		return nil
+	}
+	user.Role = auth.RoleAdmin
+	user.Disabled = false
+	if err := userStore.Update(ctx, user); err != nil {
+		return err
+	}
+	log.Printf("✅ Promoted %s to admin", email)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auditlog"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/users"
+	"gobuild/shared/audit"
+	"gobuild/shared/message"
+)
+
+type AuditListResponse struct {
+	Events []*message.AuditEventMessage `json:"events"`
+	Offset int                          `json:"offset"`
+	Limit  int                          `json:"limit"`
+}
+
+// AuditAPI stores the audit events of all services and lets admins query them
+type AuditAPI struct {
+	store *auditlog.Store
+}
+
+func NewAuditAPI(store *auditlog.Store) *AuditAPI {
+	return &AuditAPI{
+		store: store,
+	}
+}
+
+func (a *AuditAPI) RegisterRoutes(r *mux.Router) {
+	auditRoutes := r.PathPrefix("/api/admin/audit").Subrouter()
+	auditRoutes.Use(auth.RequirePermission(auth.PermissionViewAuditLog))
+	auditRoutes.HandleFunc("", a.ListEvents).Methods("GET")
+}
+
+// Store persists an event consumed from the audit topic
+func (a *AuditAPI) Store(ctx context.Context, event message.AuditEventMessage) error {
+	if event.ID == "" || event.Action == "" {
+		log.Printf("⚠️ Dropping audit event without ID or action")
+		return nil
+	}
+	return a.store.Append(ctx, &event)
+}
+
+// ListEvents lists audit entries, newest first. ?actor= (user ID or email),
+// ?action=, ?from= and ?to= (RFC 3339) filter, ?offset= and ?limit= page.
+func (a *AuditAPI) ListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := auditlog.QueryOptions{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Limit:  100,
+	}
+	for name, bound := range map[string]*time.Time{"from": &opts.From, "to": &opts.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid "+name+" time, use RFC 3339", http.StatusBadRequest)
+			return
+		}
+		*bound = t
+	}
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil && offset > 0 {
+		opts.Offset = offset
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && limit <= 1000 {
+		opts.Limit = limit
+	}
+
+	events, err := a.store.Query(r.Context(), opts)
+	if err != nil {
+		log.Printf("❌ Failed to query audit log: %v", err)
+		http.Error(w, "Failed to query audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuditListResponse{
+		Events: events,
+		Offset: opts.Offset,
+		Limit:  opts.Limit,
+	})
+}
+
+// actorEvent starts an audit entry for an action of the authenticated user
+func actorEvent(claims *auth.UserClaims, action, targetType, targetID string) message.AuditEventMessage {
+	event := message.AuditEventMessage{
+		Action:     action,
+		ActorID:    claims.ID,
+		ActorEmail: claims.Email,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    map[string]string{},
+	}
+	if claims.IsPersonalToken() {
+		event.Details["personal_token_id"] = claims.PersonalTokenID
+	}
+	return event
+}
+
+func loginSuccess(user *users.User, method string) message.AuditEventMessage {
+	return message.AuditEventMessage{
+		Action:     audit.ActionLogin,
+		ActorID:    user.ID,
+		ActorEmail: user.Email,
+		TargetType: audit.TargetUser,
+		TargetID:   user.ID,
+		Details:    map[string]string{"method": method},
+	}
+}
+
+// loginFailure records a failed login of email, which may not belong to any user
+func loginFailure(email, method, reason string) message.AuditEventMessage {
+	return message.AuditEventMessage{
+		Action:     audit.ActionLogin,
+		Outcome:    audit.OutcomeFailure,
+		ActorEmail: email,
+		Details:    map[string]string{"method": method, "reason": reason},
+	}
+}
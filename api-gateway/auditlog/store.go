@@ -0,0 +1,153 @@
+// Package auditlog stores the audit events the services publish and answers
+// queries on them. Entries are never changed or removed once stored.
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gobuild/shared/message"
+)
+
+// queryBatch is how many entries Query reads from an index at a time
+const queryBatch = 200
+
+// QueryOptions filters and pages the entries returned by Query. Actor matches
+// the actor's user ID or email; zero times leave the range open.
+type QueryOptions struct {
+	Actor  string
+	Action string
+	From   time.Time
+	To     time.Time
+	Offset int
+	Limit  int
+}
+
+type Store struct {
+	redisClient *redis.Client
+}
+
+func NewStore(redisClient *redis.Client) *Store {
+	return &Store{
+		redisClient: redisClient,
+	}
+}
+
+func eventKey(id string) string {
+	return "audit:event:" + id
+}
+
+// Entries are indexed by time in sorted sets, all of them and per actor and action
+const allIndex = "audit:events"
+
+func actorIndex(actor string) string {
+	return "audit:actor:" + strings.ToLower(actor)
+}
+
+func actionIndex(action string) string {
+	return "audit:action:" + action
+}
+
+// Append stores an entry. Storing an entry again, as happens when Kafka
+// redelivers it, leaves the stored entry unchanged.
+func (s *Store) Append(ctx context.Context, event *message.AuditEventMessage) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	member := &redis.Z{Score: float64(event.Timestamp.UnixMilli()), Member: event.ID}
+	pipe := s.redisClient.TxPipeline()
+	pipe.SetNX(ctx, eventKey(event.ID), eventJSON, 0)
+	pipe.ZAdd(ctx, allIndex, member)
+	pipe.ZAdd(ctx, actionIndex(event.Action), member)
+	if event.ActorID != "" {
+		pipe.ZAdd(ctx, actorIndex(event.ActorID), member)
+	}
+	if event.ActorEmail != "" {
+		pipe.ZAdd(ctx, actorIndex(event.ActorEmail), member)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func scoreBound(t time.Time, open string) string {
+	if t.IsZero() {
+		return open
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// Query returns the entries matching opts, newest first
+func (s *Store) Query(ctx context.Context, opts QueryOptions) ([]*message.AuditEventMessage, error) {
+	// Read the smallest index that covers the filter and check the rest per entry
+	index := allIndex
+	switch {
+	case opts.Actor != "":
+		index = actorIndex(opts.Actor)
+	case opts.Action != "":
+		index = actionIndex(opts.Action)
+	}
+
+	// Entries stored while the query pages through the index must not shift it
+	to := opts.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	scoreRange := &redis.ZRangeBy{
+		Min:   scoreBound(opts.From, "-inf"),
+		Max:   scoreBound(to, "+inf"),
+		Count: queryBatch,
+	}
+
+	events := make([]*message.AuditEventMessage, 0)
+	skipped := 0
+	for ; ; scoreRange.Offset += queryBatch {
+		ids, err := s.redisClient.ZRevRangeByScore(ctx, index, scoreRange).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return events, nil
+		}
+
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = eventKey(id)
+		}
+		values, err := s.redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, value := range values {
+			eventJSON, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var event message.AuditEventMessage
+			if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+				continue
+			}
+			if opts.Action != "" && event.Action != opts.Action {
+				continue
+			}
+			if skipped < opts.Offset {
+				skipped++
+				continue
+			}
+			events = append(events, &event)
+			if len(events) >= opts.Limit {
+				return events, nil
+			}
+		}
+
+		if len(ids) < queryBatch {
+			return events, nil
+		}
+	}
+}
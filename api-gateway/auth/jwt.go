@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"os"
@@ -9,13 +10,13 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"gobuild/shared/access"
 )
 
-var (
-	jwtSecretKey = []byte(getEnv("JWT_SECRET", "your-secret-key-change-in-production"))
+// AccessTokenTTL is the lifetime of an access token; clients renew it with a refresh token
+const AccessTokenTTL = 15 * time.Minute
 
-	ErrInvalidToken = errors.New("invalid token")
-)
+var ErrInvalidToken = errors.New("invalid token")
 
 func getEnv(key, fallback string) string {
 	value := os.Getenv(key)
@@ -29,17 +30,32 @@ type UserClaims struct {
 	ID    string `json:"id"`
 	Email string `json:"email"`
 	Role  string `json:"role"`
+	// Teams (organisation IDs) whose shared builds the user may see
+	Teams []string `json:"teams,omitempty"`
+	// Scopes and PersonalTokenID are only set for personal access tokens
+	Scopes          []string `json:"scopes,omitempty"`
+	PersonalTokenID string   `json:"-"`
+	// Generation is the user's session generation at issue time; revoking all
+	// sessions moves it on
+	Generation int64 `json:"gen,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID, email, role string) (string, error) {
-	// Token expires in 24 hours
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateToken signs an access token of the given session generation with the
+// current signing key
+func (s *KeyStore) GenerateToken(userID, email, role string, teams []string, generation int64) (string, error) {
+	key := s.signingKey()
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+	expirationTime := time.Now().Add(AccessTokenTTL)
 
 	claims := UserClaims{
-		ID:    userID,
-		Email: email,
-		Role:  role,
+		ID:         userID,
+		Email:      email,
+		Role:       role,
+		Teams:      teams,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -50,8 +66,9 @@ func GenerateToken(userID, email, role string) (string, error) {
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecretKey)
+	token := jwt.NewWithClaims(signingMethods[key.Algorithm], claims)
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
@@ -59,33 +76,55 @@ func GenerateToken(userID, email, role string) (string, error) {
 	return tokenString, nil
 }
 
-func ValidateToken(tokenString string) (*UserClaims, error) {
+// ValidateToken checks an access token signed by any gateway. Service tokens
+// are rejected: the public routes are for users, services only call the
+// internal listener.
+func (s *KeyStore) ValidateToken(ctx context.Context, tokenString string) (*UserClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
 			return nil, errors.New("unexpected signing method")
 		}
-		return jwtSecretKey, nil
-	})
+		return key.private.Public(), nil
+	}, jwt.WithValidMethods([]string{AlgEdDSA, AlgRS256}))
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid {
+	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid && claims.Role != access.RoleService {
 		return claims, nil
 	}
 
 	return nil, ErrInvalidToken
 }
 
-// AuthMiddleware validates JWT tokens
-func AuthMiddleware(next http.Handler) http.Handler {
+// AuthMiddleware validates JWT tokens, rejecting revoked ones, and personal access tokens
+func AuthMiddleware(sessions *SessionStore, verifyPersonalToken PersonalTokenFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return authMiddleware(sessions, verifyPersonalToken, next)
+	}
+}
+
+func authMiddleware(sessions *SessionStore, verifyPersonalToken PersonalTokenFunc, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for OPTIONS, login, register, and health check endpoints
+		// Skip auth for OPTIONS, login, register, token refresh, and health check endpoints.
+		// Webhook deliveries are authenticated by their signature instead, SSO
+		// logins by the identity provider, password resets and email
+		// verification by the mailed token.
 		if r.Method == "OPTIONS" ||
 			r.URL.Path == "/api/login" ||
 			r.URL.Path == "/api/register" ||
+			r.URL.Path == "/api/token/refresh" ||
+			strings.HasPrefix(r.URL.Path, "/api/hooks/") ||
+			strings.HasPrefix(r.URL.Path, "/api/oidc/") ||
+			strings.HasPrefix(r.URL.Path, "/api/account/password-reset") ||
+			r.URL.Path == "/api/account/verify-email" ||
+			r.URL.Path == "/.well-known/jwks.json" ||
 			r.URL.Path == "/health" {
 			next.ServeHTTP(w, r)
 			return
@@ -103,12 +142,36 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		claims, err := ValidateToken(tokenParts[1])
+		if strings.HasPrefix(tokenParts[1], PersonalTokenPrefix) {
+			claims, err := verifyPersonalToken(r.Context(), tokenParts[1])
+			if errors.Is(err, ErrInvalidToken) {
+				http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithUserClaims(r.Context(), claims)))
+			return
+		}
+
+		claims, err := sessions.keys.ValidateToken(r.Context(), tokenParts[1])
 		if err != nil {
 			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
 
+		revoked, err := sessions.IsRevoked(r.Context(), claims)
+		if err != nil {
+			http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
 		ctx := r.Context()
 		ctx = ContextWithUserClaims(ctx, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
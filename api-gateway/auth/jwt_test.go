@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateToken(t *testing.T) {
+	key := testSigningKey(t, "k1", AlgEdDSA, time.Hour)
+	store := testKeyStore(key)
+	other := testKeyStore(testSigningKey(t, "k1", AlgEdDSA, time.Hour))
+	now := time.Now()
+	sign := func(method jwt.SigningMethod, signer crypto.Signer, kid string, claims UserClaims) string {
+		t.Helper()
+		if claims.ExpiresAt == nil {
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Minute))
+		}
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	otherToken, _ := other.GenerateToken("u1", "", RoleUser, nil, 0)
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, UserClaims{
+		ID:               "builder",
+		Role:             "service",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))},
+	}).SignedString([]byte("service-secret"))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign(jwt.SigningMethodEdDSA, key.private, "k1", UserClaims{ID: "u1", Role: RoleUser}), false},
+		{"expired", sign(jwt.SigningMethodEdDSA, key.private, "k1", UserClaims{ID: "u1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))}}), true},
+		{"unknown key", sign(jwt.SigningMethodEdDSA, key.private, "k2", UserClaims{ID: "u1"}), true},
+		{"signed by another key with the same ID", otherToken, true},
+		{"service role", sign(jwt.SigningMethodEdDSA, key.private, "k1", UserClaims{ID: "builder", Role: "service"}), true},
+		{"service token", hmacToken, true},
+	}
+	for _, tt := range tests {
+		claims, err := store.ValidateToken(context.Background(), tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateToken() = %+v, %v, want error %v", tt.name, claims, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"gobuild/shared/jwks"
+)
+
+// Algorithms access tokens can be signed with
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+const (
+	// keyPublishLead is how long a new key is published before it signs tokens,
+	// so other gateways and the services' cached key sets know it by then
+	keyPublishLead = 2 * time.Minute
+	// keyCheckInterval is how often Run reloads, rotates and prunes keys
+	keyCheckInterval = time.Minute
+	// keyReloadInterval limits how often an unknown key ID reloads the keys
+	keyReloadInterval = 10 * time.Second
+	rotationLockTTL   = 30 * time.Second
+)
+
+var signingMethods = map[string]jwt.SigningMethod{
+	AlgEdDSA: jwt.SigningMethodEdDSA,
+	AlgRS256: jwt.SigningMethodRS256,
+}
+
+// SigningKey describes a key without its private part
+type SigningKey struct {
+	ID        string    `json:"id"`
+	Algorithm string    `json:"algorithm"`
+	CreatedAt time.Time `json:"created_at"`
+	// Signing marks the key new tokens are signed with
+	Signing bool `json:"signing"`
+}
+
+type signingKeyStorage struct {
+	ID         string    `json:"id"`
+	Algorithm  string    `json:"algorithm"`
+	PrivateKey []byte    `json:"private_key"` // PKCS #8
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type signingKey struct {
+	signingKeyStorage
+	private crypto.Signer
+}
+
+// KeyStore keeps the access token signing keys in Redis, shared by all gateway
+// replicas. A new key is created every rotation interval; old keys stay
+// published until the tokens they signed have expired.
+type KeyStore struct {
+	redisClient *redis.Client
+	algorithm   string
+	rotation    time.Duration
+
+	mu       sync.RWMutex
+	keys     []*signingKey // oldest first
+	loadedAt time.Time
+}
+
+// NewKeyStore creates a key store signing with JWT_SIGNING_ALG (EdDSA or RS256)
+// and rotating keys every JWT_KEY_ROTATION_HOURS
+func NewKeyStore(redisClient *redis.Client) (*KeyStore, error) {
+	algorithm := getEnv("JWT_SIGNING_ALG", AlgEdDSA)
+	if _, ok := signingMethods[algorithm]; !ok {
+		return nil, fmt.Errorf("JWT_SIGNING_ALG must be %s or %s, got %q", AlgEdDSA, AlgRS256, algorithm)
+	}
+	hours, err := strconv.Atoi(getEnv("JWT_KEY_ROTATION_HOURS", "24"))
+	if err != nil || hours < 1 {
+		return nil, fmt.Errorf("JWT_KEY_ROTATION_HOURS must be a positive number of hours, got %q", os.Getenv("JWT_KEY_ROTATION_HOURS"))
+	}
+
+	return &KeyStore{
+		redisClient: redisClient,
+		algorithm:   algorithm,
+		rotation:    time.Duration(hours) * time.Hour,
+	}, nil
+}
+
+// retention is how long a key is kept: it signs for one rotation interval and
+// its tokens are valid for AccessTokenTTL after that
+func (s *KeyStore) retention() time.Duration {
+	return keyPublishLead + s.rotation + AccessTokenTTL + time.Minute
+}
+
+func generateKey(algorithm string) (crypto.Signer, error) {
+	if algorithm == AlgRS256 {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// load replaces the cached keys with the ones in Redis
+func (s *KeyStore) load(ctx context.Context) error {
+	values, err := s.redisClient.HGetAll(ctx, "auth:signing_keys").Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*signingKey, 0, len(values))
+	for id, keyJSON := range values {
+		var key signingKey
+		if err := json.Unmarshal([]byte(keyJSON), &key.signingKeyStorage); err != nil {
+			log.Printf("⚠️ Skipping unreadable signing key %s: %v", id, err)
+			continue
+		}
+		if _, ok := signingMethods[key.Algorithm]; !ok {
+			log.Printf("⚠️ Skipping signing key %s with unsupported algorithm %s", id, key.Algorithm)
+			continue
+		}
+		private, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+		if err != nil {
+			log.Printf("⚠️ Skipping unreadable signing key %s: %v", id, err)
+			continue
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			log.Printf("⚠️ Skipping signing key %s of unsupported type %T", id, private)
+			continue
+		}
+		key.private = signer
+		keys = append(keys, &key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	s.mu.Lock()
+	s.keys = keys
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// Rotate creates a new key, which starts signing after keyPublishLead
+func (s *KeyStore) Rotate(ctx context.Context) (*SigningKey, error) {
+	private, err := generateKey(s.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := signingKeyStorage{
+		ID:         id[:16],
+		Algorithm:  s.algorithm,
+		PrivateKey: der,
+		CreatedAt:  time.Now(),
+	}
+	keyJSON, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redisClient.HSet(ctx, "auth:signing_keys", stored.ID, keyJSON).Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("🔑 Created %s signing key %s", stored.Algorithm, stored.ID)
+
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: stored.ID, Algorithm: stored.Algorithm, CreatedAt: stored.CreatedAt}, nil
+}
+
+// due reports whether keys need a new key or contain keys to remove
+func (s *KeyStore) due(keys []*signingKey) (rotate bool, prune bool) {
+	rotate = len(keys) == 0 || time.Since(keys[len(keys)-1].CreatedAt) >= s.rotation
+	// The oldest key is the first to expire, unless it is the only one
+	prune = len(keys) > 1 && time.Since(keys[0].CreatedAt) >= s.retention()
+	return rotate, prune
+}
+
+// maintain rotates the keys when the newest one is due and removes keys no
+// valid token can have been signed with. Only one gateway does so at a time.
+func (s *KeyStore) maintain(ctx context.Context) error {
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+	if rotate, prune := s.due(s.loadedKeys()); !rotate && !prune {
+		return nil
+	}
+
+	locked, err := s.redisClient.SetNX(ctx, "auth:signing_keys:lock", "1", rotationLockTTL).Result()
+	if err != nil || !locked {
+		return err
+	}
+	defer s.redisClient.Del(ctx, "auth:signing_keys:lock")
+
+	// Another gateway may have rotated in the meantime
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+	keys := s.loadedKeys()
+	if rotate, _ := s.due(keys); rotate {
+		if _, err := s.Rotate(ctx); err != nil {
+			return err
+		}
+	}
+
+	signing := s.signingKey()
+	for _, key := range keys {
+		if key.ID != signing.ID && time.Since(key.CreatedAt) >= s.retention() {
+			if err := s.redisClient.HDel(ctx, "auth:signing_keys", key.ID).Err(); err != nil {
+				return err
+			}
+			log.Printf("🗑️ Removed expired signing key %s", key.ID)
+		}
+	}
+	return s.load(ctx)
+}
+
+func (s *KeyStore) loadedKeys() []*signingKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+// Init loads the keys, creating the first one if there is none. A gateway
+// starting at the same time as another waits for the other's first key.
+func (s *KeyStore) Init(ctx context.Context) error {
+	for attempt := 0; attempt < 10; attempt++ {
+		if err := s.maintain(ctx); err != nil {
+			return err
+		}
+		if len(s.loadedKeys()) > 0 {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("no signing key was created")
+}
+
+// Run rotates and prunes keys until ctx is done
+func (s *KeyStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.maintain(ctx); err != nil {
+				log.Printf("⚠️ Failed to maintain signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// signingKey returns the newest key published for at least keyPublishLead,
+// or the oldest key while every key is still new
+func (s *KeyStore) signingKey() *signingKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.keys) == 0 {
+		return nil
+	}
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if time.Since(s.keys[i].CreatedAt) >= keyPublishLead {
+			return s.keys[i]
+		}
+	}
+	return s.keys[0]
+}
+
+// key returns the key with id, reloading the keys if another gateway rotated
+func (s *KeyStore) key(ctx context.Context, id string) (*signingKey, error) {
+	find := func() (*signingKey, time.Time) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for _, key := range s.keys {
+			if key.ID == id {
+				return key, s.loadedAt
+			}
+		}
+		return nil, s.loadedAt
+	}
+
+	key, loadedAt := find()
+	if key == nil && time.Since(loadedAt) > keyReloadInterval {
+		if err := s.load(ctx); err != nil {
+			return nil, err
+		}
+		key, _ = find()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// Keys lists the keys, oldest first
+func (s *KeyStore) Keys() []SigningKey {
+	signing := s.signingKey()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]SigningKey, len(s.keys))
+	for i, key := range s.keys {
+		list[i] = SigningKey{ID: key.ID, Algorithm: key.Algorithm, CreatedAt: key.CreatedAt, Signing: signing != nil && key.ID == signing.ID}
+	}
+	return list
+}
+
+// JWKS returns the public keys for /.well-known/jwks.json
+func (s *KeyStore) JWKS() (*jwks.Set, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	set := &jwks.Set{Keys: make([]jwks.Key, 0, len(s.keys))}
+	for _, key := range s.keys {
+		jwk, err := jwks.NewKey(key.ID, key.Algorithm, key.private.Public())
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+// unreachableRedis is a client for tests that must not touch Redis
+func unreachableRedis() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+}
+
+func testSigningKey(t *testing.T, id, algorithm string, age time.Duration) *signingKey {
+	t.Helper()
+	private, err := generateKey(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKey{
+		signingKeyStorage: signingKeyStorage{ID: id, Algorithm: algorithm, PrivateKey: der, CreatedAt: time.Now().Add(-age)},
+		private:           private,
+	}
+}
+
+// testKeyStore returns a store holding keys, oldest first, without Redis
+func testKeyStore(keys ...*signingKey) *KeyStore {
+	return &KeyStore{
+		redisClient: unreachableRedis(),
+		algorithm:   AlgEdDSA,
+		rotation:    24 * time.Hour,
+		keys:        keys,
+		loadedAt:    time.Now(),
+	}
+}
+
+func TestNewKeyStore(t *testing.T) {
+	tests := []struct {
+		alg     string
+		hours   string
+		wantErr bool
+	}{
+		{"", "", false},
+		{AlgRS256, "1", false},
+		{"HS256", "", true},
+		{"none", "", true},
+		{"", "0", true},
+		{"", "1.5", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("JWT_SIGNING_ALG", tt.alg)
+		t.Setenv("JWT_KEY_ROTATION_HOURS", tt.hours)
+		if _, err := NewKeyStore(nil); (err != nil) != tt.wantErr {
+			t.Errorf("NewKeyStore() with %q and %q hours = %v, want error %v", tt.alg, tt.hours, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSigningKeyWaitsForPublishLead(t *testing.T) {
+	old := testSigningKey(t, "old", AlgEdDSA, 25*time.Hour)
+	published := testSigningKey(t, "published", AlgEdDSA, keyPublishLead+time.Second)
+	fresh := testSigningKey(t, "fresh", AlgEdDSA, time.Second)
+
+	tests := []struct {
+		name string
+		keys []*signingKey
+		want string
+	}{
+		{"newest published key", []*signingKey{old, published, fresh}, "published"},
+		{"fresh key is not used yet", []*signingKey{old, fresh}, "old"},
+		{"first key of a new gateway", []*signingKey{fresh}, "fresh"},
+	}
+	for _, tt := range tests {
+		store := testKeyStore(tt.keys...)
+		if got := store.signingKey(); got.ID != tt.want {
+			t.Errorf("%s: signingKey() = %s, want %s", tt.name, got.ID, tt.want)
+		}
+		for _, key := range store.Keys() {
+			if key.Signing != (key.ID == tt.want) {
+				t.Errorf("%s: Keys() marks %s as signing %v", tt.name, key.ID, key.Signing)
+			}
+		}
+	}
+
+	if key := testKeyStore().signingKey(); key != nil {
+		t.Errorf("signingKey() without keys = %s, want nil", key.ID)
+	}
+}
+
+func TestDue(t *testing.T) {
+	store := testKeyStore()
+	retention := store.retention()
+
+	tests := []struct {
+		name       string
+		ages       []time.Duration
+		wantRotate bool
+		wantPrune  bool
+	}{
+		{"no keys", nil, true, false},
+		{"new key", []time.Duration{time.Hour}, false, false},
+		{"rotation due", []time.Duration{24 * time.Hour}, true, false},
+		{"only key is never pruned", []time.Duration{retention + time.Hour}, true, false},
+		{"old key still verifies tokens", []time.Duration{retention - time.Minute, time.Hour}, false, false},
+		{"old key expired", []time.Duration{retention, time.Hour}, false, true},
+	}
+	for _, tt := range tests {
+		keys := make([]*signingKey, len(tt.ages))
+		for i, age := range tt.ages {
+			keys[i] = &signingKey{signingKeyStorage: signingKeyStorage{CreatedAt: time.Now().Add(-age)}}
+		}
+		if rotate, prune := store.due(keys); rotate != tt.wantRotate || prune != tt.wantPrune {
+			t.Errorf("%s: due() = %v, %v, want %v, %v", tt.name, rotate, prune, tt.wantRotate, tt.wantPrune)
+		}
+	}
+}
+
+// TestJWKSVerifiesTokens checks that every published key verifies the
+// tokens it signed, so services can check tokens across a rotation
+func TestJWKSVerifiesTokens(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			old := testSigningKey(t, "old", alg, 2*time.Hour)
+			store := testKeyStore(old)
+			token, err := store.GenerateToken("u1", "u1@example.com", RoleUser, nil, 0)
+			if err != nil {
+				t.Fatalf("GenerateToken() = %v", err)
+			}
+
+			store.keys = append(store.keys, testSigningKey(t, "new", alg, time.Hour))
+			set, err := store.JWKS()
+			if err != nil {
+				t.Fatalf("JWKS() = %v", err)
+			}
+			if len(set.Keys) != 2 || set.Keys[0].Kid != "old" || set.Keys[1].Kid != "new" {
+				t.Fatalf("JWKS() = %+v, want the old and the new key", set.Keys)
+			}
+			public, err := set.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := &UserClaims{}
+			if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+				return public, nil
+			}, jwt.WithValidMethods([]string{alg})); err != nil || claims.ID != "u1" {
+				t.Errorf("token does not verify with the published key: %v", err)
+			}
+
+			// The gateway still accepts it after the new key took over
+			if _, err := store.ValidateToken(context.Background(), token); err != nil {
+				t.Errorf("ValidateToken() after rotation = %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	client := testRedis(t)
+	ctx := context.Background()
+	store := &KeyStore{redisClient: client, algorithm: AlgEdDSA, rotation: time.Hour}
+
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	first := store.Keys()
+	if len(first) != 1 || !first[0].Signing {
+		t.Fatalf("Keys() after Init = %+v, want one signing key", first)
+	}
+	token, err := store.GenerateToken("u1", "u1@example.com", RoleUser, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second gateway uses the key the first one created
+	replica := &KeyStore{redisClient: client, algorithm: AlgEdDSA, rotation: time.Hour}
+	if err := replica.Init(ctx); err != nil {
+		t.Fatalf("Init() of a second gateway = %v", err)
+	}
+	if keys := replica.Keys(); len(keys) != 1 || keys[0].ID != first[0].ID {
+		t.Errorf("Keys() of a second gateway = %+v, want %s", keys, first[0].ID)
+	}
+
+	rotated, err := store.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Rotate() = %v", err)
+	}
+	keys := store.Keys()
+	if len(keys) != 2 || !keys[0].Signing || keys[1].ID != rotated.ID {
+		t.Errorf("Keys() after Rotate = %+v, want the old key signing until the new one is published", keys)
+	}
+	// The replica learns about the new key once a token names it
+	replica.loadedAt = time.Time{}
+	if _, err := replica.key(ctx, rotated.ID); err != nil {
+		t.Errorf("key() of a rotated key on a second gateway = %v", err)
+	}
+	if _, err := replica.ValidateToken(ctx, token); err != nil {
+		t.Errorf("ValidateToken() after rotation = %v", err)
+	}
+
+}
+
+func TestMaintainPrunesExpiredKeys(t *testing.T) {
+	client := testRedis(t)
+	ctx := context.Background()
+	store := &KeyStore{redisClient: client, algorithm: AlgEdDSA, rotation: 24 * time.Hour}
+
+	expired := testSigningKey(t, "expired", AlgEdDSA, store.retention()+time.Minute)
+	current := testSigningKey(t, "current", AlgEdDSA, time.Hour)
+	for _, key := range []*signingKey{expired, current} {
+		keyJSON, _ := json.Marshal(key.signingKeyStorage)
+		client.HSet(ctx, "auth:signing_keys", key.ID, keyJSON)
+	}
+
+	if err := store.maintain(ctx); err != nil {
+		t.Fatalf("maintain() = %v", err)
+	}
+	keys := store.Keys()
+	if len(keys) != 1 || keys[0].ID != "current" || !keys[0].Signing {
+		t.Errorf("Keys() after maintain = %+v, want only the current key", keys)
+	}
+	if exists, _ := client.HExists(ctx, "auth:signing_keys", "expired").Result(); exists {
+		t.Error("maintain() kept the expired key in Redis")
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+)
+
+// PersonalTokenPrefix marks personal access tokens so they can be told apart from JWTs
+const PersonalTokenPrefix = "gbp_"
+
+// Scopes that can be granted to a personal access token
+const (
+	ScopeBuildsWrite   = "builds:write"
+	ScopeBuildsRead    = "builds:read"
+	ScopeArtifactsRead = "artifacts:read"
+	ScopeProjectsWrite = "projects:write"
+	ScopeProjectsRead  = "projects:read"
+	ScopeOrgsWrite     = "orgs:write"
+	ScopeOrgsRead      = "orgs:read"
+)
+
+var validScopes = map[string]bool{
+	ScopeBuildsWrite:   true,
+	ScopeBuildsRead:    true,
+	ScopeArtifactsRead: true,
+	ScopeProjectsWrite: true,
+	ScopeProjectsRead:  true,
+	ScopeOrgsWrite:     true,
+	ScopeOrgsRead:      true,
+}
+
+// ValidScope reports whether scope can be granted to a personal access token
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// PersonalTokenFunc resolves a personal access token to the claims of its user
+type PersonalTokenFunc func(ctx context.Context, token string) (*UserClaims, error)
+
+// IsPersonalToken reports whether the request was authenticated with a personal access token
+func (c *UserClaims) IsPersonalToken() bool {
+	return c.PersonalTokenID != ""
+}
+
+// HasScope reports whether the claims allow scope. Login sessions have every
+// scope, personal access tokens only the ones they were created with.
+func (c *UserClaims) HasScope(scope string) bool {
+	if !c.IsPersonalToken() {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
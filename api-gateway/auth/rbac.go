@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Permissions granted through roles
+const (
+	PermissionManageUsers     = "users:manage"
+	PermissionViewAllBuilds   = "builds:view_all"
+	PermissionCancelAllBuilds = "builds:cancel_all"
+	PermissionManageProjects  = "projects:manage_all"
+	PermissionManageKeys      = "keys:manage"
+	PermissionViewAuditLog    = "audit:view"
+)
+
+var rolePermissions = map[string][]string{
+	RoleUser:  {},
+	RoleAdmin: {PermissionManageUsers, PermissionViewAllBuilds, PermissionCancelAllBuilds, PermissionManageProjects, PermissionManageKeys, PermissionViewAuditLog},
+}
+
+// ValidRole reports whether role exists
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether the user's role grants permission. Personal
+// access tokens are limited to their scopes and never carry role permissions.
+func (c *UserClaims) HasPermission(permission string) bool {
+	if c.IsPersonalToken() {
+		return false
+	}
+	for _, p := range rolePermissions[c.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission only lets requests through whose user has permission.
+// It must run after AuthMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := UserClaimsFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasPermission(permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RefreshTokenTTL is how long a refresh token can be used; every use rotates it
+const RefreshTokenTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// TokenPair is a short-lived access token and the refresh token to renew it
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64 // access token lifetime in seconds
+}
+
+type refreshSession struct {
+	UserID     string    `json:"user_id"`
+	Generation int64     `json:"generation"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SessionStore keeps refresh tokens and revoked access tokens in Redis.
+// Refresh tokens are only stored as SHA-256 hashes. Every session belongs to a
+// generation of the user's sessions, kept in auth:generation:<user>;
+// revoking all sessions starts the next generation.
+type SessionStore struct {
+	redisClient *redis.Client
+	keys        *KeyStore
+}
+
+func NewSessionStore(redisClient *redis.Client, keys *KeyStore) *SessionStore {
+	return &SessionStore{
+		redisClient: redisClient,
+		keys:        keys,
+	}
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IssueTokens starts a new session for the user. teams are only part of the
+// access token, refreshing it picks up membership changes.
+func (s *SessionStore) IssueTokens(ctx context.Context, userID, email, role string, teams []string) (*TokenPair, error) {
+	generation, err := s.generation(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := s.keys.GenerateToken(userID, email, role, teams, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	hash := hashRefreshToken(refreshToken)
+
+	sessionJSON, err := json.Marshal(refreshSession{UserID: userID, Generation: generation, CreatedAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, "refresh:"+hash, sessionJSON, RefreshTokenTTL)
+	pipe.SAdd(ctx, "refresh:user:"+userID, hash)
+	pipe.Expire(ctx, "refresh:user:"+userID, RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// generation returns the user's current session generation
+func (s *SessionStore) generation(ctx context.Context, userID string) (int64, error) {
+	generation, err := s.redisClient.Get(ctx, "auth:generation:"+userID).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// ConsumeRefreshToken invalidates a refresh token and returns its user, who then
+// gets a new token pair. Presenting an already used token means it was stolen,
+// so all sessions of the user are revoked. A token of an earlier generation,
+// stored while its sessions were being revoked, is invalid.
+func (s *SessionStore) ConsumeRefreshToken(ctx context.Context, refreshToken string) (string, error) {
+	hash := hashRefreshToken(refreshToken)
+
+	sessionJSON, err := s.redisClient.GetDel(ctx, "refresh:"+hash).Result()
+	if err == redis.Nil {
+		userID, err := s.redisClient.Get(ctx, "refresh:used:"+hash).Result()
+		if err == redis.Nil {
+			return "", ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return "", err
+		}
+
+		log.Printf("⚠️ Refresh token reuse detected for user %s, revoking all sessions", userID)
+		if err := s.RevokeAllSessions(ctx, userID); err != nil {
+			return "", err
+		}
+		return "", ErrRefreshTokenReused
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var session refreshSession
+	if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
+		return "", err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.SRem(ctx, "refresh:user:"+session.UserID, hash)
+	pipe.Set(ctx, "refresh:used:"+hash, session.UserID, RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+
+	generation, err := s.generation(ctx, session.UserID)
+	if err != nil {
+		return "", err
+	}
+	if session.Generation < generation {
+		return "", ErrInvalidRefreshToken
+	}
+	return session.UserID, nil
+}
+
+// RevokeRefreshToken ends the session of a refresh token
+func (s *SessionStore) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	hash := hashRefreshToken(refreshToken)
+
+	sessionJSON, err := s.redisClient.GetDel(ctx, "refresh:"+hash).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var session refreshSession
+	if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
+		return err
+	}
+	return s.redisClient.SRem(ctx, "refresh:user:"+session.UserID, hash).Err()
+}
+
+// RevokeToken puts the jti of an access token on the denylist until it expires
+func (s *SessionStore) RevokeToken(ctx context.Context, claims *UserClaims) error {
+	if claims.ExpiresAt == nil {
+		return nil
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.redisClient.Set(ctx, "auth:denylist:"+claims.RegisteredClaims.ID, "1", ttl).Err()
+}
+
+// RevokeAllSessions invalidates every refresh token of the user and every access
+// token issued until now. Tokens issued afterwards, even within the same
+// second, belong to the next generation and stay valid.
+func (s *SessionStore) RevokeAllSessions(ctx context.Context, userID string) error {
+	hashes, err := s.redisClient.SMembers(ctx, "refresh:user:"+userID).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	// Access tokens of earlier generations are rejected. The counter does not
+	// expire: refresh sessions of an earlier generation may live on for
+	// RefreshTokenTTL.
+	pipe.Incr(ctx, "auth:generation:"+userID)
+	for _, hash := range hashes {
+		pipe.Del(ctx, "refresh:"+hash)
+	}
+	pipe.Del(ctx, "refresh:user:"+userID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// IsRevoked reports whether the access token was revoked on its own or together
+// with all sessions of its user
+func (s *SessionStore) IsRevoked(ctx context.Context, claims *UserClaims) (bool, error) {
+	values, err := s.redisClient.MGet(ctx,
+		"auth:denylist:"+claims.RegisteredClaims.ID,
+		"auth:generation:"+claims.ID,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if values[0] != nil {
+		return true, nil
+	}
+
+	if value, ok := values[1].(string); ok {
+		generation, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		if claims.Generation < generation {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRevokeAllSessions(t *testing.T) {
+	client := testRedis(t)
+	ctx := context.Background()
+	keys := &KeyStore{redisClient: client, algorithm: AlgEdDSA, rotation: time.Hour}
+	if err := keys.Init(ctx); err != nil {
+		t.Fatalf("Init() = %v", err)
+	}
+	sessions := NewSessionStore(client, keys)
+
+	revoked, err := sessions.IssueTokens(ctx, "u1", "u1@example.com", RoleUser, nil)
+	if err != nil {
+		t.Fatalf("IssueTokens() = %v", err)
+	}
+	other, err := sessions.IssueTokens(ctx, "u2", "u2@example.com", RoleUser, nil)
+	if err != nil {
+		t.Fatalf("IssueTokens() = %v", err)
+	}
+	if err := sessions.RevokeAllSessions(ctx, "u1"); err != nil {
+		t.Fatalf("RevokeAllSessions() = %v", err)
+	}
+	// Issued within the same second as the revocation
+	fresh, err := sessions.IssueTokens(ctx, "u1", "u1@example.com", RoleUser, nil)
+	if err != nil {
+		t.Fatalf("IssueTokens() = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		pair        *TokenPair
+		wantRevoked bool
+	}{
+		{"session from before", revoked, true},
+		{"session from right after", fresh, false},
+		{"session of another user", other, false},
+	}
+	for _, tt := range tests {
+		claims, err := keys.ValidateToken(ctx, tt.pair.AccessToken)
+		if err != nil {
+			t.Fatalf("%s: ValidateToken() = %v", tt.name, err)
+		}
+		if got, err := sessions.IsRevoked(ctx, claims); err != nil || got != tt.wantRevoked {
+			t.Errorf("%s: IsRevoked() = %v, %v, want %v", tt.name, got, err, tt.wantRevoked)
+		}
+
+		_, err = sessions.ConsumeRefreshToken(ctx, tt.pair.RefreshToken)
+		if tt.wantRevoked && err != ErrInvalidRefreshToken {
+			t.Errorf("%s: ConsumeRefreshToken() = %v, want %v", tt.name, err, ErrInvalidRefreshToken)
+		}
+		if !tt.wantRevoked && err != nil {
+			t.Errorf("%s: ConsumeRefreshToken() = %v, want nil", tt.name, err)
+		}
+	}
+}
+
+// TestRefreshTokenOfEarlierGeneration covers a refresh token stored while all
+// sessions of its user were being revoked
+func TestRefreshTokenOfEarlierGeneration(t *testing.T) {
+	client := testRedis(t)
+	ctx := context.Background()
+	sessions := NewSessionStore(client, nil)
+
+	if err := sessions.RevokeAllSessions(ctx, "u1"); err != nil {
+		t.Fatalf("RevokeAllSessions() = %v", err)
+	}
+	sessionJSON, _ := json.Marshal(refreshSession{UserID: "u1", Generation: 0, CreatedAt: time.Now()})
+	if err := client.Set(ctx, "refresh:"+hashRefreshToken("late"), sessionJSON, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.ConsumeRefreshToken(ctx, "late"); err != ErrInvalidRefreshToken {
+		t.Errorf("ConsumeRefreshToken() = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
@@ -0,0 +1,175 @@
+// Package mail sends the gateway's emails through SMTP, or writes them to files
+// or the log for local development
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sendTimeout limits how long Send may take when run in the background
+const sendTimeout = 30 * time.Second
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers emails
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// FromEnv creates the sender MAIL_TRANSPORT selects: smtp, file or log (default)
+func FromEnv() (Sender, error) {
+	from := getEnv("MAIL_FROM", "gobuild@localhost")
+
+	switch transport := getEnv("MAIL_TRANSPORT", "log"); transport {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for MAIL_TRANSPORT=smtp")
+		}
+		return NewSMTPSender(host, getEnv("SMTP_PORT", "587"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	case "file":
+		return NewFileSender(getEnv("MAIL_DIR", "/tmp/gobuild-mail"), from)
+	case "log":
+		return NewLogSender(from), nil
+	default:
+		return nil, fmt.Errorf("MAIL_TRANSPORT must be smtp, file or log, got %q", transport)
+	}
+}
+
+// SendAsync sends msg in the background, so requests do not wait for the mail server
+func SendAsync(sender Sender, msg Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		if err := sender.Send(ctx, msg); err != nil {
+			log.Printf("❌ Failed to send mail %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// format renders msg as an RFC 5322 message
+func format(from string, msg Message) ([]byte, error) {
+	for _, value := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header contains a line break")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+// SMTPSender delivers through an SMTP server, using STARTTLS when the server
+// offers it and authenticating when a username is set
+type SMTPSender struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPSender(host, port, username, password, from string) *SMTPSender {
+	return &SMTPSender{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		username: username,
+		password: password,
+		from:     from,
+	}
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.from, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	// smtp.SendMail cannot be cancelled, so ctx only bounds the wait
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, s.from, []string{msg.To}, data)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileSender writes each email to its own .eml file in a directory
+type FileSender struct {
+	dir  string
+	from string
+}
+
+func NewFileSender(dir, from string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSender{dir: dir, from: from}, nil
+}
+
+func (s *FileSender) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.from, msg)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), strings.ReplaceAll(msg.To, "/", "_"))
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	log.Printf("📧 Wrote mail %q to %s", msg.Subject, path)
+	return nil
+}
+
+// LogSender only logs emails. The log then contains their links, so it is
+// only meant for local development.
+type LogSender struct {
+	from string
+}
+
+func NewLogSender(from string) *LogSender {
+	return &LogSender{from: from}
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	log.Printf("📧 Mail from %s to %s: %s\n%s", s.from, msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -3,20 +3,38 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auditlog"
 	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/mail"
+	"gobuild/api-gateway/oidc"
+	"gobuild/api-gateway/projects"
+	"gobuild/api-gateway/quota"
+	"gobuild/api-gateway/secrets"
 	"gobuild/api-gateway/users"
+	"gobuild/api-gateway/webhooks"
+	"gobuild/shared/access"
+	"gobuild/shared/audit"
 	"gobuild/shared/kafka"
 	"gobuild/shared/message"
+	"gobuild/shared/model"
+	"gobuild/shared/repository"
+	"gobuild/shared/tracing"
 )
 
 type RegisterRequest struct {
@@ -30,18 +48,48 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	User         struct {
 		ID    string `json:"id"`
 		Email string `json:"email"`
 		Role  string `json:"role"`
 	} `json:"user"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	AllSessions  bool   `json:"all_sessions"`
+}
+
+type CreateTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type CreateTokenResponse struct {
+	Token string `json:"token"`
+	*users.PersonalToken
+}
+
+// Personal access token lifetime in days when none or too much is requested
+const (
+	defaultTokenDays = 30
+	maxTokenDays     = 365
+)
+
 type BuildRequest struct {
 	RepositoryURL string `json:"repository_url"`
 	Branch        string `json:"branch"`
 	CommitHash    string `json:"commit_hash"`
+	// ProjectID builds a project; repository_url may then be left out
+	ProjectID string `json:"project_id"`
 }
 
 type BuildResponse struct {
@@ -49,11 +97,156 @@ type BuildResponse struct {
 	Message string `json:"message"`
 }
 
+func newLoginResponse(user *users.User, tokens *auth.TokenPair) LoginResponse {
+	resp := LoginResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}
+	resp.User.ID = user.ID
+	resp.User.Email = user.Email
+	resp.User.Role = user.Role
+	return resp
+}
+
+// newTokenIssuer returns a function that starts a session whose access token
+// lists the user's organisations as teams
+func newTokenIssuer(sessions *auth.SessionStore, orgStore *users.OrgStore) func(ctx context.Context, user *users.User) (*auth.TokenPair, error) {
+	return func(ctx context.Context, user *users.User) (*auth.TokenPair, error) {
+		teams, err := orgStore.OrgIDs(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return sessions.IssueTokens(ctx, user.ID, user.Email, user.Role, teams)
+	}
+}
+
+// newPersonalTokenVerifier returns the check of personal access tokens for
+// AuthMiddleware. Tokens of disabled or deleted users are invalid.
+func newPersonalTokenVerifier(tokenStore *users.TokenStore, userStore *users.UserStore, orgStore *users.OrgStore) auth.PersonalTokenFunc {
+	return func(ctx context.Context, token string) (*auth.UserClaims, error) {
+		pat, err := tokenStore.Authenticate(ctx, token)
+		if err == users.ErrTokenNotFound || err == users.ErrTokenExpired {
+			return nil, fmt.Errorf("%w: %v", auth.ErrInvalidToken, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := userStore.GetByID(ctx, pat.UserID)
+		if err == users.ErrUserNotFound {
+			return nil, fmt.Errorf("%w: %v", auth.ErrInvalidToken, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.Disabled {
+			return nil, fmt.Errorf("%w: %v", auth.ErrInvalidToken, users.ErrUserDisabled)
+		}
+		teams, err := orgStore.OrgIDs(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &auth.UserClaims{
+			ID:              user.ID,
+			Email:           user.Email,
+			Role:            user.Role,
+			Teams:           teams,
+			Scopes:          pat.Scopes,
+			PersonalTokenID: pat.ID,
+		}, nil
+	}
+}
+
+var errBuildNotFound = errors.New("build not found")
+
+// fetchBuildStatus loads a build from the orchestrator. The gateway authenticates
+// as a service, so the caller has to check whether the user may see the build.
+func fetchBuildStatus(ctx context.Context, buildOrchestratorURL, buildID string) (*model.BuildStatus, error) {
+	url := fmt.Sprintf("%s/api/builds/%s", buildOrchestratorURL, buildID)
+
+	client := tracing.NewHTTPClient(5 * time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := access.SetServiceToken(req, "api-gateway"); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBuildNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("orchestrator returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var build model.BuildStatus
+	if err := json.NewDecoder(resp.Body).Decode(&build); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// loadVisibleBuild fetches a build and checks that the user may see it. Builds
+// of other users are reported as not found so their IDs cannot be probed.
+// It writes an error response and returns nil otherwise.
+func loadVisibleBuild(w http.ResponseWriter, r *http.Request, buildOrchestratorURL, buildID string, userClaims *auth.UserClaims) *model.BuildStatus {
+	build, err := fetchBuildStatus(r.Context(), buildOrchestratorURL, buildID)
+	if err == errBuildNotFound {
+		log.Printf("⚠️ Build not found: %s", buildID)
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to fetch build status from orchestrator: %v", err)
+		http.Error(w, "Failed to fetch build status", http.StatusInternalServerError)
+		return nil
+	}
+
+	if !userClaims.HasPermission(auth.PermissionViewAllBuilds) && !build.Public &&
+		!access.IsOwnerOrTeamMember(userClaims.ID, userClaims.Teams, build) {
+		log.Printf("🚫 %s is not allowed to see build %s", userClaims.Email, buildID)
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return nil
+	}
+
+	return build
+}
+
+// writeQuotaError answers with 429 and Retry-After if err is a *quota.LimitError
+// and with 500 otherwise
+func writeQuotaError(w http.ResponseWriter, err error) {
+	var limitErr *quota.LimitError
+	if !errors.As(err, &limitErr) {
+		log.Printf("❌ Failed to check build quota: %v", err)
+		http.Error(w, "Failed to check build quota", http.StatusInternalServerError)
+		return
+	}
+
+	retryAfter := int(math.Ceil(limitErr.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, limitErr.Reason, http.StatusTooManyRequests)
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -68,21 +261,57 @@ func main() {
 		port = "8081"
 	}
 
+	// Service tokens signed with a missing or well-known secret could be forged
+	if err := access.CheckServiceSecret(); err != nil {
+		log.Fatalf("❌ Refusing to start: %v", err)
+	}
+
+	// The builder fetches build secrets on this port, which must not be published
+	internalPort := os.Getenv("INTERNAL_PORT")
+	if internalPort == "" {
+		internalPort = "8091"
+	}
+
 	buildOrchestratorURL := os.Getenv("BUILD_ORCHESTRATOR_URL")
 	if buildOrchestratorURL == "" {
 		buildOrchestratorURL = "http://build-orchestrator:8082"
 	}
 
+	storageURL := os.Getenv("STORAGE_URL")
+	if storageURL == "" {
+		storageURL = "http://storage:8084"
+	}
+
+	// Links in mails point to the dashboard and to the gateway as browsers reach them
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8081"
+	}
+
+	// Builds may only clone from the allowed schemes and hosts
+	repoPolicy := repository.PolicyFromEnv()
+
 	log.Println("🚀 Starting API Gateway...")
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init("api-gateway")
+	if err != nil {
+		log.Fatalf("❌ Failed to initialise tracing: %v", err)
+	}
+
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: "redis:6379",
 	})
-	defer redisClient.Close()
 	log.Println("✅ Redis client created")
 
 	// Test Redis connection
-	_, err := redisClient.Ping(context.Background()).Result()
+	_, err = redisClient.Ping(ctx).Result()
 	if err != nil {
 		log.Fatalf("❌ Failed to connect to Redis: %v", err)
 	}
@@ -90,25 +319,108 @@ func main() {
 
 	userStore := users.NewUserStore(redisClient)
 
-	kafkaProducer, err := kafka.NewProducer("kafka:29092")
+	if added, err := userStore.IndexExisting(ctx); err != nil {
+		log.Printf("⚠️ Failed to index existing users: %v", err)
+	} else if added > 0 {
+		log.Printf("✅ Indexed %d existing users", added)
+	}
+
+	if err := bootstrapAdmin(ctx, userStore); err != nil {
+		log.Fatalf("❌ Failed to bootstrap admin user: %v", err)
+	}
+	keys, err := auth.NewKeyStore(redisClient)
+	if err != nil {
+		log.Fatalf("❌ Invalid signing key configuration: %v", err)
+	}
+	if err := keys.Init(ctx); err != nil {
+		log.Fatalf("❌ Failed to load signing keys: %v", err)
+	}
+	go keys.Run(ctx)
+	log.Println("✅ Signing keys loaded")
+
+	sessions := auth.NewSessionStore(redisClient, keys)
+	tokenStore := users.NewTokenStore(redisClient)
+	quotas := quota.NewStore(redisClient)
+	orgStore := users.NewOrgStore(redisClient)
+	projectStore := projects.NewProjectStore(redisClient)
+
+	masterKey, err := secrets.MasterKeyFromEnv()
+	if err != nil {
+		log.Fatalf("❌ Invalid secrets master key: %v", err)
+	}
+	secretStore, err := secrets.NewStore(redisClient, masterKey)
+	if err != nil {
+		log.Fatalf("❌ Invalid secrets master key: %v", err)
+	}
+	if !secretStore.Enabled() {
+		log.Println("⚠️ SECRETS_MASTER_KEY not set, project secrets are disabled")
+	}
+
+	projectAPI := NewProjectAPI(projectStore, orgStore, secretStore, repoPolicy, buildOrchestratorURL)
+
+	issueTokens := newTokenIssuer(sessions, orgStore)
+	verifyPersonalToken := newPersonalTokenVerifier(tokenStore, userStore, orgStore)
+
+	if err := kafka.EnsureTopics(ctx, "kafka:29092", kafka.Topics); err != nil {
+		log.Fatalf("❌ Failed to ensure Kafka topics: %v", err)
+	}
+	log.Println("✅ Kafka topics ensured")
+
+	var kafkaProducer kafka.Publisher
+	kafkaProducer, err = kafka.NewProducer("kafka:29092")
 	if err != nil {
 		log.Fatalf("❌ Failed to create Kafka producer: %v", err)
 	}
-	defer kafkaProducer.Close()
 	log.Println("✅ Kafka producer created")
 
+	auditRecorder := audit.NewRecorder(kafkaProducer, "api-gateway")
+	auditAPI := NewAuditAPI(auditlog.NewStore(redisClient))
+
+	mailer, err := mail.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ Invalid mail configuration: %v", err)
+	}
+	hookStore := webhooks.NewStore(redisClient)
+	accountAPI := NewAccountAPI(userStore, tokenStore, sessions, orgStore, projectAPI, hookStore, quotas, mailer, auditRecorder, kafkaProducer, issueTokens, appURL, publicURL)
+
+	// The gateways store the audit events of all services, sharing the topic's partitions
+	var auditConsumer kafka.Subscriber
+	auditConsumer, err = kafka.NewConsumer("kafka:29092", "api-gateway-audit",
+		kafka.WithManualCommit(5, time.Second),
+		kafka.WithDeadLetterQueue(kafkaProducer))
+	if err != nil {
+		log.Fatalf("❌ Failed to create Kafka consumer: %v", err)
+	}
+	if err := auditConsumer.Subscribe([]string{kafka.TopicAuditEvents}); err != nil {
+		log.Fatalf("❌ Failed to subscribe to audit events: %v", err)
+	}
+	dispatcher := kafka.NewDispatcher()
+	kafka.On(dispatcher, auditAPI.Store)
+
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		if err := auditConsumer.ConsumeMessages(ctx, dispatcher.HandleMessage); err != nil {
+			log.Printf("❌ Audit consumer stopped: %v", err)
+			stop()
+		}
+	}()
+	log.Println("✅ Consuming audit events")
+
 	r := mux.NewRouter()
 
+	r.Use(tracing.Middleware)
 	r.Use(corsMiddleware)
 
 	r.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
 		w.WriteHeader(http.StatusOK)
 	})
 
-	r.Use(auth.AuthMiddleware)
+	r.Use(auth.AuthMiddleware(sessions, verifyPersonalToken))
 
 	r.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("📝 Received registration request")
@@ -129,7 +441,7 @@ func main() {
 			ID:        uuid.New().String(),
 			Email:     regReq.Email,
 			Password:  regReq.Password,
-			Role:      "user",
+			Role:      auth.RoleUser,
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		}
@@ -138,6 +450,12 @@ func main() {
 		if err != nil {
 			if err == users.ErrUserAlreadyExists {
 				log.Printf("⚠️ User already exists: %s", regReq.Email)
+				auditRecorder.Record(r, message.AuditEventMessage{
+					Action:     audit.ActionRegister,
+					Outcome:    audit.OutcomeFailure,
+					ActorEmail: regReq.Email,
+					Details:    map[string]string{"reason": "email_taken"},
+				})
 				http.Error(w, "User with this email already exists", http.StatusConflict)
 				return
 			}
@@ -146,21 +464,26 @@ func main() {
 			return
 		}
 
-		token, err := auth.GenerateToken(user.ID, user.Email, user.Role)
+		tokens, err := issueTokens(r.Context(), user)
 		if err != nil {
 			log.Printf("❌ Failed to generate token: %v", err)
 			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 			return
 		}
 
-		resp := LoginResponse{
-			Token: token,
-		}
-		resp.User.ID = user.ID
-		resp.User.Email = user.Email
-		resp.User.Role = user.Role
+		resp := newLoginResponse(user, tokens)
 
 		log.Printf("✅ User registered successfully: %s", user.Email)
+		auditRecorder.Record(r, message.AuditEventMessage{
+			Action:     audit.ActionRegister,
+			ActorID:    user.ID,
+			ActorEmail: user.Email,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID,
+		})
+		if err := accountAPI.sendVerification(r.Context(), user); err != nil {
+			log.Printf("⚠️ Failed to send verification mail to %s: %v", user.Email, err)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}).Methods("POST")
@@ -184,33 +507,212 @@ func main() {
 		if err != nil {
 			if err == users.ErrUserNotFound || err == users.ErrInvalidCredentials {
 				log.Printf("⚠️ Authentication failed for: %s", loginReq.Email)
+				auditRecorder.Record(r, loginFailure(loginReq.Email, "password", "invalid_credentials"))
 				http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 				return
 			}
+			if err == users.ErrUserDisabled {
+				log.Printf("⚠️ Login attempt for disabled user: %s", loginReq.Email)
+				auditRecorder.Record(r, loginFailure(loginReq.Email, "password", "account_disabled"))
+				http.Error(w, "Account is disabled", http.StatusForbidden)
+				return
+			}
 			log.Printf("❌ Authentication error: %v", err)
 			http.Error(w, "Authentication failed", http.StatusInternalServerError)
 			return
 		}
 
-		token, err := auth.GenerateToken(user.ID, user.Email, user.Role)
+		tokens, err := issueTokens(r.Context(), user)
 		if err != nil {
 			log.Printf("❌ Failed to generate token: %v", err)
 			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 			return
 		}
 
-		resp := LoginResponse{
-			Token: token,
-		}
-		resp.User.ID = user.ID
-		resp.User.Email = user.Email
-		resp.User.Role = user.Role
+		resp := newLoginResponse(user, tokens)
 
 		log.Printf("✅ User logged in successfully: %s", user.Email)
+		auditRecorder.Record(r, loginSuccess(user, "password"))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}).Methods("POST")
 
+	r.HandleFunc("/api/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var refreshReq RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&refreshReq); err != nil || refreshReq.RefreshToken == "" {
+			http.Error(w, "Refresh token is required", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := sessions.ConsumeRefreshToken(r.Context(), refreshReq.RefreshToken)
+		if err != nil {
+			if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+				log.Printf("⚠️ Token refresh rejected: %v", err)
+				http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+				return
+			}
+			log.Printf("❌ Failed to refresh token: %v", err)
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+
+		user, err := userStore.GetByID(r.Context(), userID)
+		if err != nil {
+			if err == users.ErrUserNotFound {
+				http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+				return
+			}
+			log.Printf("❌ Failed to load user %s: %v", userID, err)
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			http.Error(w, "Account is disabled", http.StatusForbidden)
+			return
+		}
+
+		tokens, err := issueTokens(r.Context(), user)
+		if err != nil {
+			log.Printf("❌ Failed to generate token: %v", err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newLoginResponse(user, tokens))
+	}).Methods("POST")
+
+	r.HandleFunc("/api/logout", func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if userClaims.IsPersonalToken() {
+			http.Error(w, "Personal access tokens are revoked via /api/tokens", http.StatusBadRequest)
+			return
+		}
+
+		// The body is optional, a bare logout only revokes the access token
+		var logoutReq LogoutRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&logoutReq); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var err error
+		if logoutReq.AllSessions {
+			err = sessions.RevokeAllSessions(r.Context(), userClaims.ID)
+		} else {
+			err = sessions.RevokeToken(r.Context(), userClaims)
+			if err == nil && logoutReq.RefreshToken != "" {
+				err = sessions.RevokeRefreshToken(r.Context(), logoutReq.RefreshToken)
+			}
+		}
+		if err != nil {
+			log.Printf("❌ Failed to log out user %s: %v", userClaims.ID, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("👋 User logged out: %s (all sessions: %v)", userClaims.Email, logoutReq.AllSessions)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// A token must not be able to mint tokens with more scopes than itself
+		if userClaims.IsPersonalToken() {
+			http.Error(w, "Personal access tokens can only be created after logging in", http.StatusForbidden)
+			return
+		}
+
+		var tokenReq CreateTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if tokenReq.Name == "" || len(tokenReq.Scopes) == 0 {
+			http.Error(w, "Name and at least one scope are required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range tokenReq.Scopes {
+			if !auth.ValidScope(scope) {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+		}
+		if tokenReq.ExpiresInDays <= 0 {
+			tokenReq.ExpiresInDays = defaultTokenDays
+		}
+		if tokenReq.ExpiresInDays > maxTokenDays {
+			http.Error(w, fmt.Sprintf("Tokens can be valid for at most %d days", maxTokenDays), http.StatusBadRequest)
+			return
+		}
+
+		token, pat, err := tokenStore.Create(r.Context(), userClaims.ID, tokenReq.Name, tokenReq.Scopes,
+			time.Duration(tokenReq.ExpiresInDays)*24*time.Hour)
+		if err != nil {
+			log.Printf("❌ Failed to create personal access token: %v", err)
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🔑 Personal access token %q created for %s", pat.Name, userClaims.Email)
+		event := actorEvent(userClaims, audit.ActionTokenCreate, audit.TargetToken, pat.ID)
+		event.Details["name"] = pat.Name
+		event.Details["scopes"] = strings.Join(pat.Scopes, " ")
+		auditRecorder.Record(r, event)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateTokenResponse{Token: token, PersonalToken: pat})
+	}).Methods("POST")
+
+	r.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		tokens, err := tokenStore.List(r.Context(), userClaims.ID)
+		if err != nil {
+			log.Printf("❌ Failed to list personal access tokens: %v", err)
+			http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/tokens/{tokenId}", func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		err := tokenStore.Revoke(r.Context(), userClaims.ID, mux.Vars(r)["tokenId"])
+		if err == users.ErrTokenNotFound {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("❌ Failed to revoke personal access token: %v", err)
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
 	r.HandleFunc("/api/builds", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("🏗️ Received build request")
 
@@ -222,6 +724,11 @@ func main() {
 		}
 		log.Printf("👤 User: %s (%s)", userClaims.Email, userClaims.ID)
 
+		if !userClaims.HasScope(auth.ScopeBuildsWrite) {
+			http.Error(w, "Token is missing the "+auth.ScopeBuildsWrite+" scope", http.StatusForbidden)
+			return
+		}
+
 		var buildReq BuildRequest
 		if err := json.NewDecoder(r.Body).Decode(&buildReq); err != nil {
 			log.Printf("❌ Invalid build request body: %v", err)
@@ -230,9 +737,38 @@ func main() {
 		}
 		log.Printf("📋 Build request: %+v", buildReq)
 
-		if buildReq.RepositoryURL == "" {
-			log.Println("❌ Repository URL is required")
-			http.Error(w, "Repository URL is required", http.StatusBadRequest)
+		// Builds of a project always clone its stored repository, so the
+		// project's secrets cannot be handed to another one. The branch
+		// defaults to the project's.
+		var project *projects.Project
+		if buildReq.ProjectID != "" {
+			project = projectAPI.loadProject(w, r, userClaims, buildReq.ProjectID, users.OrgRoleMaintainer)
+			if project == nil {
+				return
+			}
+			if buildReq.RepositoryURL != "" {
+				requested, err := repoPolicy.Normalize(buildReq.RepositoryURL)
+				if err != nil || requested != project.RepositoryURL {
+					log.Printf("❌ Rejected repository URL %q for project %s", buildReq.RepositoryURL, project.ID)
+					http.Error(w, errRepositoryMismatch.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			buildReq.RepositoryURL = project.RepositoryURL
+		}
+
+		repositoryURL, err := repoPolicy.Normalize(buildReq.RepositoryURL)
+		if err != nil {
+			log.Printf("❌ Rejected repository URL %q: %v", buildReq.RepositoryURL, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if buildReq.CommitHash != "" && !repository.ValidCommitHash(buildReq.CommitHash) {
+			http.Error(w, "Invalid commit hash", http.StatusBadRequest)
+			return
+		}
+		if buildReq.Branch != "" && !repository.ValidRefName(buildReq.Branch) {
+			http.Error(w, "Invalid branch", http.StatusBadRequest)
 			return
 		}
 
@@ -240,22 +776,56 @@ func main() {
 
 		buildMsg := message.BuildRequestMessage{
 			ID:            buildID,
-			RepositoryURL: buildReq.RepositoryURL,
+			RepositoryURL: repositoryURL,
 			Branch:        buildReq.Branch,
 			CommitHash:    buildReq.CommitHash,
 			UserID:        userClaims.ID,
 			CreatedAt:     time.Now(),
 		}
+		if project != nil {
+			if err := applyProject(&buildMsg, project); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		limits, err := quotas.Limits(r.Context(), userClaims.ID, userClaims.Role)
+		if err != nil {
+			writeQuotaError(w, err)
+			return
+		}
+		if err := quotas.Admit(r.Context(), userClaims.ID, buildID, limits); err != nil {
+			log.Printf("🚦 Build request of %s rejected: %v", userClaims.Email, err)
+			writeQuotaError(w, err)
+			return
+		}
+		if err := issueSecretsToken(r.Context(), secretStore, &buildMsg); err != nil {
+			log.Printf("❌ Failed to issue secrets token for build %s: %v", buildID, err)
+			quotas.Withdraw(context.Background(), userClaims.ID, buildID)
+			http.Error(w, "Failed to process build request", http.StatusInternalServerError)
+			return
+		}
+
 		log.Printf("📤 Sending build request message to Kafka for: %+v", buildMsg.RepositoryURL)
 
-		err := kafkaProducer.SendMessage("build-requests", buildID, buildMsg)
+		// Only hand out the build ID once Kafka acknowledged the request
+		sendCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		err = kafkaProducer.SendMessageSync(sendCtx, kafka.TopicBuildRequests, buildID, buildMsg)
 		if err != nil {
 			log.Printf("❌ Failed to send build request to Kafka: %v", err)
-			http.Error(w, "Failed to process build request", http.StatusInternalServerError)
+			revokeSecretsToken(secretStore, &buildMsg)
+			quotas.Withdraw(context.Background(), userClaims.ID, buildID)
+			http.Error(w, "Failed to process build request", http.StatusServiceUnavailable)
 			return
 		}
 
-		log.Printf("✅ Successfully sent build request to Kafka: %s", buildID)
+		tracing.Logf(r.Context(), "✅ Build request persisted in Kafka: %s", buildID)
+		event := actorEvent(userClaims, audit.ActionBuildSubmit, audit.TargetBuild, buildID)
+		event.Details["repository_url"] = buildMsg.RepositoryURL
+		if buildMsg.ProjectID != "" {
+			event.Details["project_id"] = buildMsg.ProjectID
+		}
+		auditRecorder.Record(r, event)
 
 		response := BuildResponse{
 			BuildID: buildID,
@@ -272,49 +842,221 @@ func main() {
 		buildID := vars["buildId"]
 		log.Printf("🔍 Fetching build status for: %s", buildID)
 
-		url := fmt.Sprintf("%s/api/builds/%s", buildOrchestratorURL, buildID)
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !userClaims.HasScope(auth.ScopeBuildsRead) {
+			http.Error(w, "Token is missing the "+auth.ScopeBuildsRead+" scope", http.StatusForbidden)
+			return
+		}
 
-		client := &http.Client{
-			Timeout: 5 * time.Second,
+		build := loadVisibleBuild(w, r, buildOrchestratorURL, buildID, userClaims)
+		if build == nil {
+			return
 		}
 
-		resp, err := client.Get(url)
-		if err != nil {
-			log.Printf("❌ Failed to fetch build status from orchestrator: %v", err)
-			http.Error(w, "Failed to fetch build status", http.StatusInternalServerError)
+		log.Printf("✅ Returning build status for %s", buildID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(build)
+	}).Methods("GET")
+
+	// Cancelling publishes a cancel event; the orchestrator records the build as
+	// cancelled and the builder stops it or skips it if it is still queued
+	r.HandleFunc("/api/builds/{buildId}", func(w http.ResponseWriter, r *http.Request) {
+		buildID := mux.Vars(r)["buildId"]
+
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !userClaims.HasScope(auth.ScopeBuildsWrite) {
+			http.Error(w, "Token is missing the "+auth.ScopeBuildsWrite+" scope", http.StatusForbidden)
 			return
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusNotFound {
-			log.Printf("⚠️ Build not found: %s", buildID)
-			http.Error(w, "Build not found", http.StatusNotFound)
+		build := loadVisibleBuild(w, r, buildOrchestratorURL, buildID, userClaims)
+		if build == nil {
+			return
+		}
+		// Team members may watch a build, but only its owner and the maintainers
+		// of its project can stop it
+		if build.UserID != userClaims.ID && !userClaims.HasPermission(auth.PermissionCancelAllBuilds) {
+			maintainer := false
+			if build.ProjectID != "" {
+				var err error
+				maintainer, err = projectAPI.maintainsProject(r.Context(), userClaims, build.ProjectID)
+				if err != nil {
+					log.Printf("❌ Failed to check project role: %v", err)
+					http.Error(w, "Failed to cancel build", http.StatusInternalServerError)
+					return
+				}
+			}
+			if !maintainer {
+				http.Error(w, "Only the owner can cancel this build", http.StatusForbidden)
+				return
+			}
+		}
+		if build.Finished() {
+			http.Error(w, fmt.Sprintf("Build already %s", build.Status), http.StatusConflict)
 			return
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Printf("❌ Orchestrator returned error %d: %s", resp.StatusCode, string(body))
-			http.Error(w, string(body), resp.StatusCode)
+		cancelMsg := message.BuildCancelMessage{
+			BuildID:     buildID,
+			RequestedBy: userClaims.ID,
+			RequestedAt: time.Now(),
+		}
+		sendCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if err := kafkaProducer.SendMessageSync(sendCtx, kafka.TopicBuildCancellations, buildID, cancelMsg); err != nil {
+			log.Printf("❌ Failed to send build cancellation to Kafka: %v", err)
+			http.Error(w, "Failed to cancel build", http.StatusServiceUnavailable)
 			return
 		}
+		log.Printf("🛑 %s cancelled build %s", userClaims.Email, buildID)
+		auditRecorder.Record(r, actorEvent(userClaims, audit.ActionBuildCancel, audit.TargetBuild, buildID))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"build_id": buildID,
+			"status":   "cancelling",
+		})
+	}).Methods("DELETE")
 
-		body, err := io.ReadAll(resp.Body)
+	r.HandleFunc("/api/artifacts/{buildId}", func(w http.ResponseWriter, r *http.Request) {
+		buildID := mux.Vars(r)["buildId"]
+
+		userClaims, ok := auth.UserClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !userClaims.HasScope(auth.ScopeArtifactsRead) {
+			http.Error(w, "Token is missing the "+auth.ScopeArtifactsRead+" scope", http.StatusForbidden)
+			return
+		}
+		if loadVisibleBuild(w, r, buildOrchestratorURL, buildID, userClaims) == nil {
+			return
+		}
+
+		// Artifacts can be large, so no overall timeout
+		client := tracing.NewHTTPClient(0)
+
+		req, err := http.NewRequestWithContext(r.Context(), "GET", fmt.Sprintf("%s/artifacts/%s", storageURL, buildID), nil)
 		if err != nil {
-			log.Printf("❌ Failed to read response body: %v", err)
-			http.Error(w, "Failed to read build status", http.StatusInternalServerError)
+			log.Printf("❌ Failed to create storage request: %v", err)
+			http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
+			return
+		}
+		if err := access.SetServiceToken(req, "api-gateway"); err != nil {
+			log.Printf("❌ Failed to create service token: %v", err)
+			http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("✅ Returning build status for %s", buildID)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("❌ Failed to fetch artifact from storage: %v", err)
+			http.Error(w, "Failed to fetch artifact", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Storage does not record downloads it serves to the gateway
+		if resp.StatusCode == http.StatusOK {
+			auditRecorder.Record(r, actorEvent(userClaims, audit.ActionArtifactDownload, audit.TargetArtifact, buildID))
+		}
+
+		for _, header := range []string{"Content-Type", "Content-Length", "Content-Disposition"} {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}).Methods("GET")
+
+	NewAdminAPI(userStore, sessions, keys, quotas, buildOrchestratorURL).RegisterRoutes(r)
+	auditAPI.RegisterRoutes(r)
+	accountAPI.RegisterRoutes(r)
+	NewWebhookAPI(hookStore, userStore, projectAPI, quotas, repoPolicy, secretStore, kafkaProducer, auditRecorder).RegisterRoutes(r)
+	projectAPI.RegisterRoutes(r)
+	secretAPI := NewSecretAPI(secretStore, projectAPI, buildOrchestratorURL)
+	secretAPI.RegisterRoutes(r)
+	NewOrgAPI(orgStore, userStore, projectStore).RegisterRoutes(r)
+
+	oidcConfig, err := oidc.ConfigFromEnv(auth.ValidRole)
+	if err != nil {
+		log.Fatalf("❌ Invalid OIDC configuration: %v", err)
+	}
+	if oidcConfig != nil {
+		NewSSOAPI(oidc.NewProvider(oidcConfig), oidc.NewLoginStore(redisClient), userStore, tokenStore, sessions, issueTokens, auditRecorder).RegisterRoutes(r)
+		log.Printf("✅ SSO login enabled with %s", oidcConfig.IssuerURL)
+	}
+
+	// Other services verify access tokens with these keys
+	r.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		set, err := keys.JWKS()
+		if err != nil {
+			log.Printf("❌ Failed to encode signing keys: %v", err)
+			http.Error(w, "Failed to encode keys", http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(body)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		json.NewEncoder(w).Encode(set)
 	}).Methods("GET")
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	log.Printf("🌐 API Gateway Service is running on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		log.Printf("🌐 API Gateway Service is running on port %s...", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("❌ HTTP server failed: %v", err)
+			stop()
+		}
+	}()
+
+	// Endpoints for other services only, on a port that is not published
+	internal := mux.NewRouter()
+	internal.Use(tracing.Middleware)
+	secretAPI.RegisterInternalRoutes(internal)
+	internalServer := &http.Server{Addr: ":" + internalPort, Handler: internal}
+	go func() {
+		log.Printf("🔒 Internal API is running on port %s...", internalPort)
+		if err := internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("❌ Internal HTTP server failed: %v", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("🛑 Shutting down API Gateway...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ HTTP server shutdown: %v", err)
+	}
+	if err := internalServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ Internal HTTP server shutdown: %v", err)
+	}
+
+	<-consumerDone
+	auditConsumer.Close()
+
+	// In-flight requests are done, flush pending build requests and audit events before closing Redis
+	kafkaProducer.Close()
+	redisClient.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("⚠️ Failed to flush traces: %v", err)
+	}
+	log.Println("👋 API Gateway stopped")
 }
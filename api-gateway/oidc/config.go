@@ -0,0 +1,100 @@
+// Package oidc implements login with an OpenID Connect identity provider using
+// the authorization code flow with PKCE.
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config configures the identity provider and how its users become gobuild users
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// GroupsClaim names the ID token claim listing the user's groups, nested
+	// claims are separated by dots, like realm_access.roles
+	GroupsClaim string
+	// GroupRoles maps groups to roles; the first entry the user is a member of wins
+	GroupRoles []GroupRole
+	// DefaultRole is given to users in none of the mapped groups
+	DefaultRole string
+	// PostLoginURL receives the tokens in its fragment after login. Without it
+	// the callback responds with JSON.
+	PostLoginURL string
+}
+
+// GroupRole maps an identity provider group to a role
+type GroupRole struct {
+	Group string
+	Role  string
+}
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// ConfigFromEnv reads the OIDC_* variables. It returns nil if OIDC_ISSUER_URL is
+// not set. validRole checks the roles of OIDC_GROUP_ROLES and OIDC_DEFAULT_ROLE.
+func ConfigFromEnv(validRole func(string) bool) (*Config, error) {
+	issuerURL := os.Getenv("OIDC_ISSUER_URL")
+	if issuerURL == "" {
+		return nil, nil
+	}
+
+	config := &Config{
+		IssuerURL:    strings.TrimSuffix(issuerURL, "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  getEnv("OIDC_REDIRECT_URL", "http://localhost:8081/api/oidc/callback"),
+		Scopes:       strings.Fields(getEnv("OIDC_SCOPES", "openid email profile")),
+		GroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		DefaultRole:  getEnv("OIDC_DEFAULT_ROLE", "user"),
+		PostLoginURL: os.Getenv("OIDC_POST_LOGIN_URL"),
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required")
+	}
+	if !validRole(config.DefaultRole) {
+		return nil, fmt.Errorf("OIDC_DEFAULT_ROLE: unknown role %q", config.DefaultRole)
+	}
+
+	// OIDC_GROUP_ROLES=gobuild-admins=admin,developers=user
+	for _, entry := range strings.Split(os.Getenv("OIDC_GROUP_ROLES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(entry, "=")
+		if !ok || group == "" {
+			return nil, fmt.Errorf("OIDC_GROUP_ROLES: expected group=role, got %q", entry)
+		}
+		if !validRole(role) {
+			return nil, fmt.Errorf("OIDC_GROUP_ROLES: unknown role %q", role)
+		}
+		config.GroupRoles = append(config.GroupRoles, GroupRole{Group: group, Role: role})
+	}
+
+	return config, nil
+}
+
+// RoleFor returns the role of a user in groups
+func (c *Config) RoleFor(groups []string) string {
+	member := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		member[group] = true
+	}
+	for _, mapping := range c.GroupRoles {
+		if member[mapping.Group] {
+			return mapping.Role
+		}
+	}
+	return c.DefaultRole
+}
@@ -0,0 +1,65 @@
+package oidc
+
+import "testing"
+
+func TestRoleFor(t *testing.T) {
+	config := &Config{
+		GroupRoles: []GroupRole{
+			{Group: "gobuild-admins", Role: "admin"},
+			{Group: "developers", Role: "user"},
+		},
+		DefaultRole: "viewer",
+	}
+
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"developers"}, "user"},
+		// The first mapping the user matches wins
+		{[]string{"developers", "gobuild-admins"}, "admin"},
+		{[]string{"other"}, "viewer"},
+		{nil, "viewer"},
+	}
+	for _, tt := range tests {
+		if got := config.RoleFor(tt.groups); got != tt.want {
+			t.Errorf("RoleFor(%q) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	validRole := func(role string) bool { return role == "admin" || role == "user" }
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantConfig bool
+		wantErr    bool
+	}{
+		{"disabled", map[string]string{}, false, false},
+		{"minimal", map[string]string{"OIDC_ISSUER_URL": "https://idp/", "OIDC_CLIENT_ID": "gobuild"}, true, false},
+		{"no client ID", map[string]string{"OIDC_ISSUER_URL": "https://idp"}, false, true},
+		{"unknown default role", map[string]string{"OIDC_ISSUER_URL": "https://idp", "OIDC_CLIENT_ID": "gobuild", "OIDC_DEFAULT_ROLE": "root"}, false, true},
+		{"unknown group role", map[string]string{"OIDC_ISSUER_URL": "https://idp", "OIDC_CLIENT_ID": "gobuild", "OIDC_GROUP_ROLES": "ops=root"}, false, true},
+		{"malformed group roles", map[string]string{"OIDC_ISSUER_URL": "https://idp", "OIDC_CLIENT_ID": "gobuild", "OIDC_GROUP_ROLES": "ops"}, false, true},
+		{"group roles", map[string]string{"OIDC_ISSUER_URL": "https://idp", "OIDC_CLIENT_ID": "gobuild", "OIDC_GROUP_ROLES": " ops=admin, ,dev=user"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"OIDC_ISSUER_URL", "OIDC_CLIENT_ID", "OIDC_DEFAULT_ROLE", "OIDC_GROUP_ROLES"} {
+				t.Setenv(name, tt.env[name])
+			}
+			config, err := ConfigFromEnv(validRole)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (config != nil) != tt.wantConfig {
+				t.Fatalf("ConfigFromEnv() = %+v, want config %v", config, tt.wantConfig)
+			}
+			if config != nil && config.IssuerURL != "https://idp" {
+				t.Errorf("IssuerURL = %q, want the trailing slash removed", config.IssuerURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// LoginTTL is how long a user has to complete the login at the provider
+const LoginTTL = 10 * time.Minute
+
+var ErrLoginNotFound = errors.New("login not found or expired")
+
+// Login is a started login, identified by its state parameter
+type Login struct {
+	State    string `json:"-"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// LoginStore keeps started logins in Redis until the provider redirects back
+type LoginStore struct {
+	redisClient *redis.Client
+}
+
+func NewLoginStore(redisClient *redis.Client) *LoginStore {
+	return &LoginStore{
+		redisClient: redisClient,
+	}
+}
+
+// Begin starts a login with a new state, nonce and PKCE verifier
+func (s *LoginStore) Begin(ctx context.Context) (*Login, error) {
+	var login Login
+	var err error
+	if login.State, err = randomString(32); err != nil {
+		return nil, err
+	}
+	if login.Nonce, err = randomString(32); err != nil {
+		return nil, err
+	}
+	if login.Verifier, err = randomString(32); err != nil {
+		return nil, err
+	}
+
+	loginJSON, err := json.Marshal(login)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redisClient.Set(ctx, "oidc:login:"+login.State, loginJSON, LoginTTL).Err(); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// Consume returns the login with state and removes it, so a callback cannot be replayed
+func (s *LoginStore) Consume(ctx context.Context, state string) (*Login, error) {
+	pipe := s.redisClient.TxPipeline()
+	get := pipe.Get(ctx, "oidc:login:"+state)
+	pipe.Del(ctx, "oidc:login:"+state)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err == redis.Nil {
+			return nil, ErrLoginNotFound
+		}
+		return nil, err
+	}
+
+	var login Login
+	if err := json.Unmarshal([]byte(get.Val()), &login); err != nil {
+		return nil, err
+	}
+	login.State = state
+	return &login, nil
+}
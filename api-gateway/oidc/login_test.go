@@ -0,0 +1,58 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+func TestLoginStore(t *testing.T) {
+	client := testRedis(t)
+	store := NewLoginStore(client)
+	ctx := context.Background()
+
+	login, err := store.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin() = %v", err)
+	}
+	if login.State == login.Nonce || login.State == login.Verifier || login.Nonce == login.Verifier {
+		t.Errorf("Begin() = %+v, want distinct values", login)
+	}
+	if ttl := client.TTL(ctx, "oidc:login:"+login.State).Val(); ttl <= 0 || ttl > LoginTTL {
+		t.Errorf("TTL = %v, want within %v", ttl, LoginTTL)
+	}
+
+	got, err := store.Consume(ctx, login.State)
+	if err != nil {
+		t.Fatalf("Consume() = %v", err)
+	}
+	if *got != *login {
+		t.Errorf("Consume() = %+v, want %+v", got, login)
+	}
+
+	// A callback cannot be replayed, and unknown states are refused
+	for _, state := range []string{login.State, "unknown", ""} {
+		if _, err := store.Consume(ctx, state); !errors.Is(err, ErrLoginNotFound) {
+			t.Errorf("Consume(%q) = %v, want %v", state, err, ErrLoginNotFound)
+		}
+	}
+}
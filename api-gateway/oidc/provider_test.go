@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gobuild/shared/jwks"
+)
+
+// testProvider is an identity provider that answers the code "code" with an
+// ID token holding claims, if the request carries the expected PKCE verifier
+type testProvider struct {
+	*httptest.Server
+	key      *ecdsa.PrivateKey
+	verifier string
+	claims   jwt.MapClaims
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(metadata{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize?tenant=t1",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, _ := jwks.NewKey("k1", "ES256", &p.key.PublicKey)
+		json.NewEncoder(w).Encode(jwks.Set{Keys: []jwks.Key{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code" || r.PostFormValue("code_verifier") != p.verifier {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, p.claims)
+		token.Header["kid"] = "k1"
+		idToken, err := token.SignedString(p.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{IDToken: idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) config() *Config {
+	return &Config{
+		IssuerURL:   p.URL,
+		ClientID:    "gobuild",
+		RedirectURL: "http://localhost:8081/api/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+		GroupsClaim: "realm_access.roles",
+		DefaultRole: "user",
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const want = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := codeChallenge(verifier); got != want {
+		t.Errorf("codeChallenge() = %q, want %q", got, want)
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		s, err := randomString(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 32 bytes give 43 base64url characters, the longest verifier
+		// RFC 7636 allows is 128
+		if len(s) != 43 {
+			t.Errorf("randomString(32) has length %d, want 43", len(s))
+		}
+		if seen[s] {
+			t.Fatalf("randomString(32) returned %q twice", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newTestProvider(t)
+	provider := NewProvider(p.config())
+	login := &Login{State: "state1", Nonce: "nonce1", Verifier: "verifier1"}
+
+	authURL, err := provider.AuthCodeURL(context.Background(), login)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() = %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/authorize" {
+		t.Errorf("path = %q, want /authorize", u.Path)
+	}
+
+	want := map[string]string{
+		"tenant":                "t1",
+		"response_type":         "code",
+		"client_id":             "gobuild",
+		"redirect_uri":          "http://localhost:8081/api/oidc/callback",
+		"scope":                 "openid email",
+		"state":                 "state1",
+		"nonce":                 "nonce1",
+		"code_challenge":        codeChallenge("verifier1"),
+		"code_challenge_method": "S256",
+	}
+	query := u.Query()
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if query.Has("code_verifier") || query.Has("verifier") {
+		t.Error("the login URL contains the verifier")
+	}
+}
+
+func TestDiscoverChecksIssuer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(metadata{
+			Issuer:                "https://evil.example.com",
+			AuthorizationEndpoint: "https://evil.example.com/authorize",
+			TokenEndpoint:         "https://evil.example.com/token",
+			JWKSURI:               "https://evil.example.com/jwks",
+		})
+	}))
+	defer server.Close()
+
+	provider := NewProvider(&Config{IssuerURL: server.URL, ClientID: "gobuild"})
+	if _, err := provider.AuthCodeURL(context.Background(), &Login{}); err == nil {
+		t.Error("AuthCodeURL() with another issuer succeeded")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newTestProvider(t)
+	provider := NewProvider(p.config())
+	ctx := context.Background()
+	now := time.Now()
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            p.URL,
+			"aud":            "gobuild",
+			"sub":            "subject1",
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+			"nonce":          "nonce1",
+			"email":          "user@example.com",
+			"email_verified": "true",
+			"realm_access":   map[string]interface{}{"roles": []interface{}{"developers", 1}},
+		}
+	}
+	login := &Login{State: "state1", Nonce: "nonce1", Verifier: "verifier1"}
+
+	tests := []struct {
+		name    string
+		modify  func(claims jwt.MapClaims)
+		login   *Login
+		wantErr error
+	}{
+		{name: "valid"},
+		{name: "nonce of another login", login: &Login{Nonce: "other", Verifier: "verifier1"}, wantErr: ErrInvalidIDToken},
+		{name: "no nonce", modify: func(c jwt.MapClaims) { delete(c, "nonce") }, wantErr: ErrInvalidIDToken},
+		{name: "other audience", modify: func(c jwt.MapClaims) { c["aud"] = "other" }, wantErr: ErrInvalidIDToken},
+		{name: "several audiences without azp", modify: func(c jwt.MapClaims) { c["aud"] = []string{"gobuild", "other"} }, wantErr: ErrInvalidIDToken},
+		{name: "other issuer", modify: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, wantErr: ErrInvalidIDToken},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() }, wantErr: ErrInvalidIDToken},
+		{name: "no subject", modify: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: ErrInvalidIDToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.verifier = login.Verifier
+			p.claims = validClaims()
+			if tt.modify != nil {
+				tt.modify(p.claims)
+			}
+			useLogin := login
+			if tt.login != nil {
+				useLogin = tt.login
+			}
+
+			identity, err := provider.Exchange(ctx, "code", useLogin)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Exchange() = %v", err)
+				}
+				want := "{Issuer:" + p.URL + " Subject:subject1 Email:user@example.com EmailVerified:true Groups:[developers]}"
+				if got := fmt.Sprintf("%+v", *identity); got != want {
+					t.Errorf("Exchange() = %s, want %s", got, want)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Exchange() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestExchangeSendsVerifier checks that the code is only redeemed with the
+// verifier of the login it was issued for
+func TestExchangeSendsVerifier(t *testing.T) {
+	p := newTestProvider(t)
+	p.verifier = "verifier1"
+	provider := NewProvider(p.config())
+
+	for _, verifier := range []string{"other", ""} {
+		if _, err := provider.Exchange(context.Background(), "code", &Login{Nonce: "nonce1", Verifier: verifier}); err == nil {
+			t.Errorf("Exchange() with verifier %q succeeded", verifier)
+		}
+	}
+}
+
+func TestLookupClaim(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups":       []interface{}{"a", "b"},
+		"role":         "admin",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"c"}},
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"groups", []string{"a", "b"}},
+		{"role", []string{"admin"}},
+		{"realm_access.roles", []string{"c"}},
+		{"realm_access.missing", nil},
+		{"role.nested", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		if got := stringList(lookupClaim(claims, tt.path)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("stringList(lookupClaim(%q)) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
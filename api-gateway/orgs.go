@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/projects"
+	"gobuild/api-gateway/users"
+)
+
+type CreateOrgRequest struct {
+	Name string `json:"name"`
+}
+
+type InviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// OrgResponse is an organisation together with the user's role in it
+type OrgResponse struct {
+	*users.Organisation
+	Role string `json:"role"`
+}
+
+type MemberResponse struct {
+	*users.Member
+	Email string `json:"email,omitempty"`
+}
+
+type OrgDetailResponse struct {
+	*users.Organisation
+	Members []MemberResponse `json:"members"`
+}
+
+// OrgAPI manages organisations, their members and invitations. Membership
+// changes show up in access tokens once they are refreshed.
+type OrgAPI struct {
+	orgs      *users.OrgStore
+	userStore *users.UserStore
+	projects  *projects.ProjectStore
+}
+
+func NewOrgAPI(orgs *users.OrgStore, userStore *users.UserStore, projectStore *projects.ProjectStore) *OrgAPI {
+	return &OrgAPI{
+		orgs:      orgs,
+		userStore: userStore,
+		projects:  projectStore,
+	}
+}
+
+func (a *OrgAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/orgs", a.CreateOrg).Methods("POST")
+	r.HandleFunc("/api/orgs", a.ListOrgs).Methods("GET")
+	r.HandleFunc("/api/orgs/{orgId}", a.GetOrg).Methods("GET")
+	r.HandleFunc("/api/orgs/{orgId}", a.DeleteOrg).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{orgId}/members/{userId}", a.SetMemberRole).Methods("PUT")
+	r.HandleFunc("/api/orgs/{orgId}/members/{userId}", a.RemoveMember).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{orgId}/invitations", a.Invite).Methods("POST")
+	r.HandleFunc("/api/orgs/{orgId}/invitations", a.ListOrgInvitations).Methods("GET")
+	r.HandleFunc("/api/orgs/{orgId}/invitations/{invitationId}", a.RevokeInvitation).Methods("DELETE")
+
+	r.HandleFunc("/api/invitations", a.ListInvitations).Methods("GET")
+	r.HandleFunc("/api/invitations/{invitationId}/accept", a.AcceptInvitation).Methods("POST")
+	r.HandleFunc("/api/invitations/{invitationId}/decline", a.DeclineInvitation).Methods("POST")
+}
+
+// requireOrgRole checks that the user has at least minRole in the organisation.
+// Organisations of which the user is no member are reported as not found. It
+// writes an error response and returns false otherwise.
+func (a *OrgAPI) requireOrgRole(w http.ResponseWriter, r *http.Request, userClaims *auth.UserClaims, orgID, minRole string) bool {
+	role, err := a.orgs.Role(r.Context(), orgID, userClaims.ID)
+	if err != nil {
+		log.Printf("❌ Failed to load membership in %s: %v", orgID, err)
+		http.Error(w, "Failed to load organisation", http.StatusInternalServerError)
+		return false
+	}
+	if role == "" {
+		http.Error(w, "Organisation not found", http.StatusNotFound)
+		return false
+	}
+	if !users.OrgRoleAtLeast(role, minRole) {
+		http.Error(w, "This requires the "+minRole+" role in the organisation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeOrgError maps organisation store errors to responses
+func writeOrgError(w http.ResponseWriter, err error, action string) {
+	switch err {
+	case users.ErrOrgNotFound, users.ErrNotMember, users.ErrInvitationNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case users.ErrInvalidOrgName, users.ErrInvalidOrgRole:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case users.ErrLastOwner, users.ErrAlreadyMember:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case users.ErrEmailNotVerified:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("❌ Failed to %s: %v", action, err)
+		http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+func (a *OrgAPI) CreateOrg(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	var req CreateOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	org, err := a.orgs.Create(r.Context(), req.Name, userClaims.ID)
+	if err != nil {
+		writeOrgError(w, err, "create organisation")
+		return
+	}
+	log.Printf("🏢 %s created organisation %s (%s)", userClaims.Email, org.Name, org.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(OrgResponse{Organisation: org, Role: users.OrgRoleOwner})
+}
+
+// ListOrgs lists the organisations the user is a member of
+func (a *OrgAPI) ListOrgs(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsRead)
+	if userClaims == nil {
+		return
+	}
+
+	orgIDs, err := a.orgs.OrgIDs(r.Context(), userClaims.ID)
+	if err != nil {
+		writeOrgError(w, err, "list organisations")
+		return
+	}
+
+	list := make([]OrgResponse, 0, len(orgIDs))
+	for _, orgID := range orgIDs {
+		org, err := a.orgs.Get(r.Context(), orgID)
+		if err == users.ErrOrgNotFound {
+			continue
+		}
+		if err != nil {
+			writeOrgError(w, err, "list organisations")
+			return
+		}
+		role, err := a.orgs.Role(r.Context(), orgID, userClaims.ID)
+		if err != nil {
+			writeOrgError(w, err, "list organisations")
+			return
+		}
+		list = append(list, OrgResponse{Organisation: org, Role: role})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetOrg returns an organisation with its members
+func (a *OrgAPI) GetOrg(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsRead)
+	if userClaims == nil {
+		return
+	}
+	orgID := mux.Vars(r)["orgId"]
+	if !a.requireOrgRole(w, r, userClaims, orgID, users.OrgRoleViewer) {
+		return
+	}
+
+	org, err := a.orgs.Get(r.Context(), orgID)
+	if err != nil {
+		writeOrgError(w, err, "load organisation")
+		return
+	}
+	members, err := a.orgs.Members(r.Context(), orgID)
+	if err != nil {
+		writeOrgError(w, err, "load organisation")
+		return
+	}
+
+	resp := OrgDetailResponse{Organisation: org, Members: make([]MemberResponse, 0, len(members))}
+	for _, member := range members {
+		memberResp := MemberResponse{Member: member}
+		if user, err := a.userStore.GetByID(r.Context(), member.UserID); err == nil {
+			memberResp.Email = user.Email
+		}
+		resp.Members = append(resp.Members, memberResp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DeleteOrg deletes an organisation without projects
+func (a *OrgAPI) DeleteOrg(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+	orgID := mux.Vars(r)["orgId"]
+	if !a.requireOrgRole(w, r, userClaims, orgID, users.OrgRoleOwner) {
+		return
+	}
+
+	count, err := a.projects.CountForOrg(r.Context(), orgID)
+	if err != nil {
+		writeOrgError(w, err, "delete organisation")
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Delete or move the organisation's projects first", http.StatusConflict)
+		return
+	}
+
+	if err := a.orgs.Delete(r.Context(), orgID); err != nil {
+		writeOrgError(w, err, "delete organisation")
+		return
+	}
+	log.Printf("🗑️ %s deleted organisation %s", userClaims.Email, orgID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMemberRole changes a member's role; only owners may do this
+func (a *OrgAPI) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	if !a.requireOrgRole(w, r, userClaims, vars["orgId"], users.OrgRoleOwner) {
+		return
+	}
+
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.orgs.SetRole(r.Context(), vars["orgId"], vars["userId"], req.Role); err != nil {
+		writeOrgError(w, err, "change role")
+		return
+	}
+	log.Printf("🏢 %s made %s %s of organisation %s", userClaims.Email, vars["userId"], req.Role, vars["orgId"])
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveMember removes a member; owners may remove anyone, members themselves
+func (a *OrgAPI) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	minRole := users.OrgRoleOwner
+	if vars["userId"] == userClaims.ID {
+		minRole = users.OrgRoleViewer
+	}
+	if !a.requireOrgRole(w, r, userClaims, vars["orgId"], minRole) {
+		return
+	}
+
+	if err := a.orgs.RemoveMember(r.Context(), vars["orgId"], vars["userId"]); err != nil {
+		writeOrgError(w, err, "remove member")
+		return
+	}
+	log.Printf("🏢 %s removed %s from organisation %s", userClaims.Email, vars["userId"], vars["orgId"])
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Invite invites a user by email; the invitation shows up in their GET /api/invitations
+func (a *OrgAPI) Invite(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+	orgID := mux.Vars(r)["orgId"]
+	if !a.requireOrgRole(w, r, userClaims, orgID, users.OrgRoleOwner) {
+		return
+	}
+
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(req.Email, "@") {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = users.OrgRoleViewer
+	}
+
+	invitation, err := a.orgs.Invite(r.Context(), orgID, req.Email, req.Role, userClaims.ID)
+	if err != nil {
+		writeOrgError(w, err, "create invitation")
+		return
+	}
+	log.Printf("✉️ %s invited %s to organisation %s as %s", userClaims.Email, invitation.Email, orgID, invitation.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// ListOrgInvitations lists the pending invitations of an organisation
+func (a *OrgAPI) ListOrgInvitations(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsRead)
+	if userClaims == nil {
+		return
+	}
+	orgID := mux.Vars(r)["orgId"]
+	if !a.requireOrgRole(w, r, userClaims, orgID, users.OrgRoleOwner) {
+		return
+	}
+
+	invitations, err := a.orgs.Invitations(r.Context(), orgID)
+	if err != nil {
+		writeOrgError(w, err, "list invitations")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func (a *OrgAPI) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	if !a.requireOrgRole(w, r, userClaims, vars["orgId"], users.OrgRoleOwner) {
+		return
+	}
+
+	invitation, err := a.orgs.GetInvitation(r.Context(), vars["invitationId"])
+	if err == nil && invitation.OrgID != vars["orgId"] {
+		err = users.ErrInvitationNotFound
+	}
+	if err == nil {
+		err = a.orgs.DeleteInvitation(r.Context(), invitation)
+	}
+	if err != nil {
+		writeOrgError(w, err, "revoke invitation")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invitee loads the user for the invitation endpoints. Invitations go to an
+// email address, so only users who verified theirs get to see them. It writes
+// an error response and returns nil otherwise.
+func (a *OrgAPI) invitee(w http.ResponseWriter, r *http.Request, userClaims *auth.UserClaims) *users.User {
+	user, err := a.userStore.GetByID(r.Context(), userClaims.ID)
+	if err == users.ErrUserNotFound {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load user %s: %v", userClaims.ID, err)
+		http.Error(w, "Failed to load invitations", http.StatusInternalServerError)
+		return nil
+	}
+	if !user.EmailVerified {
+		writeOrgError(w, users.ErrEmailNotVerified, "load invitations")
+		return nil
+	}
+	return user
+}
+
+// ListInvitations lists the pending invitations sent to the user's verified
+// email address
+func (a *OrgAPI) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsRead)
+	if userClaims == nil {
+		return
+	}
+	user := a.invitee(w, r, userClaims)
+	if user == nil {
+		return
+	}
+
+	invitations, err := a.orgs.InvitationsFor(r.Context(), user.Email)
+	if err != nil {
+		writeOrgError(w, err, "list invitations")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// AcceptInvitation makes the user a member. The new team shows up in the
+// access token after the next token refresh.
+func (a *OrgAPI) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	user := a.invitee(w, r, userClaims)
+	if user == nil {
+		return
+	}
+
+	member, err := a.orgs.AcceptInvitation(r.Context(), mux.Vars(r)["invitationId"], user)
+	if err != nil {
+		writeOrgError(w, err, "accept invitation")
+		return
+	}
+	log.Printf("🏢 %s accepted an invitation as %s", user.Email, member.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+func (a *OrgAPI) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeOrgsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	user := a.invitee(w, r, userClaims)
+	if user == nil {
+		return
+	}
+
+	invitation, err := a.orgs.GetInvitation(r.Context(), mux.Vars(r)["invitationId"])
+	if err == nil && !strings.EqualFold(invitation.Email, user.Email) {
+		err = users.ErrInvitationNotFound
+	}
+	if err == nil {
+		err = a.orgs.DeleteInvitation(r.Context(), invitation)
+	}
+	if err != nil {
+		writeOrgError(w, err, "decline invitation")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"gobuild/api-gateway/users"
+)
+
+func TestInvitationsNeedVerifiedEmail(t *testing.T) {
+	g := newTestGateway(t)
+	ctx := context.Background()
+	owner := g.createUser(t, "owner@example.com", "password", true)
+	user := g.createUser(t, "alice@example.com", "password", false)
+	org, err := g.orgs.Create(ctx, "acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := g.orgs.Invite(ctx, org.ID, user.Email, users.OrgRoleViewer, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := g.login(t, user)
+	acceptPath := "/api/invitations/" + invitation.ID + "/accept"
+
+	tests := []struct {
+		method, path string
+	}{
+		{"GET", "/api/invitations"},
+		{"POST", acceptPath},
+		{"POST", "/api/invitations/" + invitation.ID + "/decline"},
+	}
+	for _, tt := range tests {
+		if rec := g.do(t, tt.method, tt.path, token, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s with unverified email = %d, want %d", tt.method, tt.path, rec.Code, http.StatusForbidden)
+		}
+	}
+	if role, err := g.orgs.Role(ctx, org.ID, user.ID); err != nil || role != "" {
+		t.Fatalf("Role() with unverified email = %q, %v, want no membership", role, err)
+	}
+
+	user.EmailVerified = true
+	if err := g.users.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	rec := g.do(t, "GET", "/api/invitations", token, nil)
+	var invitations []*users.Invitation
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&invitations) != nil || len(invitations) != 1 {
+		t.Errorf("GET /api/invitations with verified email = %d %v, want the invitation", rec.Code, invitations)
+	}
+	if rec := g.do(t, "POST", acceptPath, token, nil); rec.Code != http.StatusOK {
+		t.Errorf("POST %s with verified email = %d %s, want %d", acceptPath, rec.Code, rec.Body, http.StatusOK)
+	}
+	if role, err := g.orgs.Role(ctx, org.ID, user.ID); err != nil || role != users.OrgRoleViewer {
+		t.Errorf("Role() after accepting = %q, %v, want %q", role, err, users.OrgRoleViewer)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/projects"
+	"gobuild/api-gateway/secrets"
+	"gobuild/api-gateway/users"
+	"gobuild/shared/access"
+	"gobuild/shared/message"
+	"gobuild/shared/repository"
+	"gobuild/shared/tracing"
+)
+
+// defaultBranch is used for projects created without a default branch
+const defaultBranch = "main"
+
+type ProjectRequest struct {
+	// OrgID creates the project in an organisation; it cannot be changed later
+	OrgID         string            `json:"org_id"`
+	Name          string            `json:"name"`
+	RepositoryURL string            `json:"repository_url"`
+	DefaultBranch string            `json:"default_branch"`
+	Visibility    string            `json:"visibility"`
+	Settings      projects.Settings `json:"settings"`
+}
+
+// ProjectAPI manages projects and serves their build history, which the
+// orchestrator keeps
+type ProjectAPI struct {
+	projects             *projects.ProjectStore
+	orgs                 *users.OrgStore
+	secrets              *secrets.Store
+	repoPolicy           *repository.Policy
+	buildOrchestratorURL string
+}
+
+func NewProjectAPI(projectStore *projects.ProjectStore, orgs *users.OrgStore, secretStore *secrets.Store, repoPolicy *repository.Policy, buildOrchestratorURL string) *ProjectAPI {
+	return &ProjectAPI{
+		projects:             projectStore,
+		orgs:                 orgs,
+		secrets:              secretStore,
+		repoPolicy:           repoPolicy,
+		buildOrchestratorURL: buildOrchestratorURL,
+	}
+}
+
+func (a *ProjectAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/projects", a.CreateProject).Methods("POST")
+	r.HandleFunc("/api/projects", a.ListProjects).Methods("GET")
+	r.HandleFunc("/api/projects/{projectId}", a.GetProject).Methods("GET")
+	r.HandleFunc("/api/projects/{projectId}", a.UpdateProject).Methods("PUT")
+	r.HandleFunc("/api/projects/{projectId}", a.DeleteProject).Methods("DELETE")
+	r.HandleFunc("/api/projects/{projectId}/builds", a.GetProjectBuilds).Methods("GET")
+	r.HandleFunc("/api/projects/{projectId}/branches", a.GetProjectBranches).Methods("GET")
+}
+
+// projectRole returns the user's role for a project. Organisation projects
+// follow the organisation's membership roles, other projects are owned by the
+// user who created them. Admins may manage or at least see every project.
+// Users without access get "".
+func (a *ProjectAPI) projectRole(ctx context.Context, userClaims *auth.UserClaims, project *projects.Project) (string, error) {
+	if userClaims.HasPermission(auth.PermissionManageProjects) {
+		return users.OrgRoleOwner, nil
+	}
+
+	role := ""
+	if project.OrgID != "" {
+		var err error
+		if role, err = a.orgs.Role(ctx, project.OrgID, userClaims.ID); err != nil {
+			return "", err
+		}
+	} else if project.OwnerID == userClaims.ID {
+		role = users.OrgRoleOwner
+	}
+
+	if role == "" && userClaims.HasPermission(auth.PermissionViewAllBuilds) {
+		role = users.OrgRoleViewer
+	}
+	return role, nil
+}
+
+// maintainsProject reports whether the user is at least maintainer of the
+// project. Nobody maintains a deleted project.
+func (a *ProjectAPI) maintainsProject(ctx context.Context, userClaims *auth.UserClaims, projectID string) (bool, error) {
+	project, err := a.projects.Get(ctx, projectID)
+	if err == projects.ErrProjectNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	role, err := a.projectRole(ctx, userClaims, project)
+	return users.OrgRoleAtLeast(role, users.OrgRoleMaintainer), err
+}
+
+// scopedClaims returns the user's claims if the token has scope and writes an
+// error response otherwise
+func scopedClaims(w http.ResponseWriter, r *http.Request, scope string) *auth.UserClaims {
+	userClaims, ok := auth.UserClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if !userClaims.HasScope(scope) {
+		http.Error(w, "Token is missing the "+scope+" scope", http.StatusForbidden)
+		return nil
+	}
+	return userClaims
+}
+
+// loadProject loads a project on which the user has at least minRole; public
+// projects can be read by everyone when minRole is empty. Projects the user
+// cannot see are reported as not found. It writes an error response and
+// returns nil otherwise.
+func (a *ProjectAPI) loadProject(w http.ResponseWriter, r *http.Request, userClaims *auth.UserClaims, projectID, minRole string) *projects.Project {
+	project, err := a.projects.Get(r.Context(), projectID)
+	if err == projects.ErrProjectNotFound {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load project %s: %v", projectID, err)
+		http.Error(w, "Failed to load project", http.StatusInternalServerError)
+		return nil
+	}
+
+	role, err := a.projectRole(r.Context(), userClaims, project)
+	if err != nil {
+		log.Printf("❌ Failed to load membership for project %s: %v", projectID, err)
+		http.Error(w, "Failed to load project", http.StatusInternalServerError)
+		return nil
+	}
+	if role == "" && !project.Public() {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return nil
+	}
+	if minRole != "" && !users.OrgRoleAtLeast(role, minRole) {
+		log.Printf("🚫 %s lacks the %s role on project %s", userClaims.Email, minRole, projectID)
+		http.Error(w, "This requires the "+minRole+" role on the project", http.StatusForbidden)
+		return nil
+	}
+	return project
+}
+
+// apply validates req and copies it onto project
+func (a *ProjectAPI) apply(project *projects.Project, req ProjectRequest) error {
+	repositoryURL, err := a.repoPolicy.Normalize(req.RepositoryURL)
+	if err != nil {
+		return err
+	}
+
+	project.Name = req.Name
+	project.RepositoryURL = repositoryURL
+	project.DefaultBranch = req.DefaultBranch
+	if project.DefaultBranch == "" {
+		project.DefaultBranch = defaultBranch
+	}
+	project.Visibility = req.Visibility
+	if project.Visibility == "" {
+		project.Visibility = projects.VisibilityPrivate
+	}
+	project.Settings = req.Settings
+	return project.Validate()
+}
+
+func (a *ProjectAPI) CreateProject(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	var req ProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.OrgID != "" {
+		role, err := a.orgs.Role(r.Context(), req.OrgID, userClaims.ID)
+		if err != nil {
+			log.Printf("❌ Failed to load membership in %s: %v", req.OrgID, err)
+			http.Error(w, "Failed to create project", http.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			http.Error(w, "Organisation not found", http.StatusNotFound)
+			return
+		}
+		if !users.OrgRoleAtLeast(role, users.OrgRoleMaintainer) {
+			http.Error(w, "Only owners and maintainers can create projects", http.StatusForbidden)
+			return
+		}
+	}
+
+	now := time.Now()
+	project := &projects.Project{
+		ID:        uuid.New().String(),
+		OwnerID:   userClaims.ID,
+		OrgID:     req.OrgID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := a.apply(project, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.projects.Create(r.Context(), project); err != nil {
+		log.Printf("❌ Failed to create project: %v", err)
+		http.Error(w, "Failed to create project", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("📁 %s created project %s for %s", userClaims.Email, project.ID, project.RepositoryURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// ListProjects lists the user's own projects, the projects of the user's
+// organisations and all public projects, by name
+func (a *ProjectAPI) ListProjects(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsRead)
+	if userClaims == nil {
+		return
+	}
+
+	orgIDs, err := a.orgs.OrgIDs(r.Context(), userClaims.ID)
+	if err != nil {
+		log.Printf("❌ Failed to load organisations: %v", err)
+		http.Error(w, "Failed to list projects", http.StatusInternalServerError)
+		return
+	}
+	list, err := a.projects.List(r.Context(), userClaims.ID, orgIDs, true)
+	if err != nil {
+		log.Printf("❌ Failed to list projects: %v", err)
+		http.Error(w, "Failed to list projects", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (a *ProjectAPI) GetProject(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsRead)
+	if userClaims == nil {
+		return
+	}
+
+	project := a.loadProject(w, r, userClaims, mux.Vars(r)["projectId"], "")
+	if project == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// UpdateProject replaces the project's settings. Visibility and build settings
+// apply to builds started afterwards. Only owners may point the project at
+// another repository, its builds get the project's secrets.
+func (a *ProjectAPI) UpdateProject(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	project := a.loadProject(w, r, userClaims, mux.Vars(r)["projectId"], users.OrgRoleMaintainer)
+	if project == nil {
+		return
+	}
+
+	var req ProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	repositoryURL := project.RepositoryURL
+	if err := a.apply(project, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if project.RepositoryURL != repositoryURL {
+		role, err := a.projectRole(r.Context(), userClaims, project)
+		if err != nil {
+			log.Printf("❌ Failed to load membership for project %s: %v", project.ID, err)
+			http.Error(w, "Failed to update project", http.StatusInternalServerError)
+			return
+		}
+		if !users.OrgRoleAtLeast(role, users.OrgRoleOwner) {
+			log.Printf("🚫 %s tried to change the repository of project %s", userClaims.Email, project.ID)
+			http.Error(w, "Only owners can change the repository of a project", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := a.projects.Update(r.Context(), project); err != nil {
+		log.Printf("❌ Failed to update project %s: %v", project.ID, err)
+		http.Error(w, "Failed to update project", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("📁 %s updated project %s", userClaims.Email, project.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// DeleteProject removes the project and its secrets. Its builds stay visible to
+// their owners.
+func (a *ProjectAPI) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	project := a.loadProject(w, r, userClaims, mux.Vars(r)["projectId"], users.OrgRoleOwner)
+	if project == nil {
+		return
+	}
+
+	if err := a.projects.Delete(r.Context(), project); err != nil {
+		log.Printf("❌ Failed to delete project %s: %v", project.ID, err)
+		http.Error(w, "Failed to delete project", http.StatusInternalServerError)
+		return
+	}
+	if err := a.secrets.DeleteAll(r.Context(), project.ID); err != nil {
+		log.Printf("⚠️ Failed to delete secrets of project %s: %v", project.ID, err)
+	}
+	log.Printf("🗑️ %s deleted project %s", userClaims.Email, project.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetProjectBuilds returns the project's build history, newest first; ?offset=
+// and ?limit= page the result
+func (a *ProjectAPI) GetProjectBuilds(w http.ResponseWriter, r *http.Request) {
+	a.proxyHistory(w, r, "builds")
+}
+
+// GetProjectBranches returns the latest build of every branch of the project
+func (a *ProjectAPI) GetProjectBranches(w http.ResponseWriter, r *http.Request) {
+	a.proxyHistory(w, r, "branches")
+}
+
+// proxyHistory checks that the user may see the project and forwards the
+// request to the orchestrator's project history
+func (a *ProjectAPI) proxyHistory(w http.ResponseWriter, r *http.Request, path string) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsRead)
+	if userClaims == nil {
+		return
+	}
+
+	project := a.loadProject(w, r, userClaims, mux.Vars(r)["projectId"], "")
+	if project == nil {
+		return
+	}
+
+	query := url.Values{}
+	for _, param := range []string{"offset", "limit"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			query.Set(param, value)
+		}
+	}
+	historyURL := fmt.Sprintf("%s/api/projects/%s/%s?%s", a.buildOrchestratorURL, url.PathEscape(project.ID), path, query.Encode())
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", historyURL, nil)
+	if err == nil {
+		err = access.SetServiceToken(req, "api-gateway")
+	}
+	if err != nil {
+		log.Printf("❌ Failed to create project history request: %v", err)
+		http.Error(w, "Failed to fetch project history", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := tracing.NewHTTPClient(5 * time.Second).Do(req)
+	if err != nil {
+		log.Printf("❌ Failed to fetch project history from orchestrator: %v", err)
+		http.Error(w, "Failed to fetch project history", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("❌ Orchestrator returned %d for project history: %s", resp.StatusCode, string(body))
+		http.Error(w, "Failed to fetch project history", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+}
+
+var errRepositoryMismatch = errors.New("repository_url does not match the project's repository")
+
+// applyProject fills in what a build of project takes from the project: the
+// repository, the default branch unless one was requested, the settings and
+// the organisation the build is shared with
+func applyProject(buildMsg *message.BuildRequestMessage, project *projects.Project) error {
+	if buildMsg.RepositoryURL != "" && buildMsg.RepositoryURL != project.RepositoryURL {
+		return errRepositoryMismatch
+	}
+	buildMsg.RepositoryURL = project.RepositoryURL
+	if buildMsg.Branch == "" {
+		buildMsg.Branch = project.DefaultBranch
+	}
+	buildMsg.ProjectID = project.ID
+	buildMsg.Public = project.Public()
+	if project.OrgID != "" {
+		buildMsg.SharedWithTeams = []string{project.OrgID}
+	}
+	buildMsg.TimeoutMinutes = project.Settings.TimeoutMinutes
+	return nil
+}
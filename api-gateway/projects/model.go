@@ -0,0 +1,208 @@
+// Package projects stores projects: a repository with its default branch,
+// owner, visibility and build settings
+package projects
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gobuild/shared/repository"
+)
+
+// Visibility of a project's builds
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+// maxTimeoutMinutes caps the build timeout a project can configure
+const maxTimeoutMinutes = 24 * 60
+
+var (
+	ErrProjectNotFound   = errors.New("project not found")
+	ErrInvalidName       = errors.New("project name is required")
+	ErrInvalidBranch     = errors.New("invalid default branch")
+	ErrInvalidVisibility = errors.New("visibility must be private or public")
+	ErrInvalidTimeout    = errors.New("timeout_minutes must be between 0 and 1440")
+)
+
+// Settings control how the builds of a project run
+type Settings struct {
+	// TimeoutMinutes stops builds running longer; 0 means no timeout
+	TimeoutMinutes int `json:"timeout_minutes"`
+}
+
+type Project struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	RepositoryURL string `json:"repository_url"`
+	DefaultBranch string `json:"default_branch"`
+	OwnerID       string `json:"owner_id"`
+	// OrgID is set for projects of an organisation, whose members' roles then apply
+	OrgID      string    `json:"org_id,omitempty"`
+	Visibility string    `json:"visibility"`
+	Settings   Settings  `json:"settings"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Public reports whether every user may see the project and its builds
+func (p *Project) Public() bool {
+	return p.Visibility == VisibilityPublic
+}
+
+// Validate checks the fields a user can set. The repository URL is checked
+// separately against the repository policy.
+func (p *Project) Validate() error {
+	if p.Name == "" {
+		return ErrInvalidName
+	}
+	if !repository.ValidRefName(p.DefaultBranch) {
+		return ErrInvalidBranch
+	}
+	if p.Visibility != VisibilityPrivate && p.Visibility != VisibilityPublic {
+		return ErrInvalidVisibility
+	}
+	if p.Settings.TimeoutMinutes < 0 || p.Settings.TimeoutMinutes > maxTimeoutMinutes {
+		return ErrInvalidTimeout
+	}
+	return nil
+}
+
+type ProjectStore struct {
+	redisClient *redis.Client
+}
+
+func NewProjectStore(redisClient *redis.Client) *ProjectStore {
+	return &ProjectStore{
+		redisClient: redisClient,
+	}
+}
+
+func (s *ProjectStore) save(ctx context.Context, pipe redis.Pipeliner, project *Project) error {
+	projectJSON, err := json.Marshal(project)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, "project:"+project.ID, projectJSON, 0)
+	pipe.SAdd(ctx, "user:projects:"+project.OwnerID, project.ID)
+	if project.OrgID != "" {
+		pipe.SAdd(ctx, "org:projects:"+project.OrgID, project.ID)
+	}
+	if project.Public() {
+		pipe.SAdd(ctx, "projects:public", project.ID)
+	} else {
+		pipe.SRem(ctx, "projects:public", project.ID)
+	}
+	return nil
+}
+
+func (s *ProjectStore) Create(ctx context.Context, project *Project) error {
+	if err := project.Validate(); err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	if err := s.save(ctx, pipe, project); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Update saves changes to a project and sets UpdatedAt
+func (s *ProjectStore) Update(ctx context.Context, project *Project) error {
+	if err := project.Validate(); err != nil {
+		return err
+	}
+	project.UpdatedAt = time.Now()
+
+	pipe := s.redisClient.TxPipeline()
+	if err := s.save(ctx, pipe, project); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *ProjectStore) Get(ctx context.Context, id string) (*Project, error) {
+	projectJSON, err := s.redisClient.Get(ctx, "project:"+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	var project Project
+	if err := json.Unmarshal([]byte(projectJSON), &project); err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// List returns the projects a user created, the projects of orgIDs and, with
+// includePublic, all public projects
+func (s *ProjectStore) List(ctx context.Context, userID string, orgIDs []string, includePublic bool) ([]*Project, error) {
+	ids, err := s.redisClient.SMembers(ctx, "user:projects:"+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, orgID := range orgIDs {
+		orgProjects, err := s.redisClient.SMembers(ctx, "org:projects:"+orgID).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, orgProjects...)
+	}
+	if includePublic {
+		public, err := s.redisClient.SMembers(ctx, "projects:public").Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, public...)
+	}
+
+	seen := make(map[string]bool, len(ids))
+	list := make([]*Project, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		project, err := s.Get(ctx, id)
+		if err == ErrProjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, project)
+	}
+	return list, nil
+}
+
+// CountForOrg returns the number of projects of an organisation
+func (s *ProjectStore) CountForOrg(ctx context.Context, orgID string) (int64, error) {
+	return s.redisClient.SCard(ctx, "org:projects:"+orgID).Result()
+}
+
+func (s *ProjectStore) Delete(ctx context.Context, project *Project) error {
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "project:"+project.ID)
+	pipe.SRem(ctx, "user:projects:"+project.OwnerID, project.ID)
+	pipe.SRem(ctx, "org:projects:"+project.OrgID, project.ID)
+	pipe.SRem(ctx, "projects:public", project.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ForgetOwner drops the index of the projects a deleted user created. Projects
+// of organisations stay with their organisation.
+func (s *ProjectStore) ForgetOwner(ctx context.Context, userID string) error {
+	return s.redisClient.Del(ctx, "user:projects:"+userID).Err()
+}
@@ -0,0 +1,277 @@
+// Package quota limits how fast and how many builds a user may start
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gobuild/api-gateway/auth"
+	"gobuild/shared/model"
+)
+
+// rateWindow is the window BuildsPerMinute is counted in
+const rateWindow = time.Minute
+
+// pendingTimeout is how long a reserved build counts as active while the
+// orchestrator has not stored it yet. The orchestrator stores a build as soon
+// as it reads the request, so a reservation this old belongs to a request that
+// never arrived, e.g. because it was dead-lettered.
+const pendingTimeout = 10 * time.Minute
+
+// activeRetryAfter is suggested to clients waiting for one of their builds to finish
+const activeRetryAfter = 30 * time.Second
+
+var ErrInvalidLimits = errors.New("limits must not be negative")
+
+// Limits of a user; 0 means unlimited
+type Limits struct {
+	BuildsPerMinute int `json:"builds_per_minute"`
+	MaxActiveBuilds int `json:"max_active_builds"`
+}
+
+// LimitError is returned when a request exceeds a limit
+type LimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// slidingWindow records a request in a sorted set of request times unless the
+// limit is reached, and then returns the milliseconds until a slot frees up
+var slidingWindow = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+if redis.call('ZCARD', key) >= limit then
+	local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+	return tonumber(oldest[2]) + window - now
+end
+redis.call('ZADD', key, now, ARGV[4])
+redis.call('PEXPIRE', key, window)
+return 0
+`)
+
+// Store keeps per-user limit overrides and the usage counters in Redis
+type Store struct {
+	redisClient  *redis.Client
+	roleDefaults map[string]Limits
+}
+
+func NewStore(redisClient *redis.Client) *Store {
+	return &Store{
+		redisClient: redisClient,
+		roleDefaults: map[string]Limits{
+			auth.RoleUser: {
+				BuildsPerMinute: getEnvInt("RATE_LIMIT_BUILDS_PER_MINUTE", 10),
+				MaxActiveBuilds: getEnvInt("MAX_ACTIVE_BUILDS", 3),
+			},
+			auth.RoleAdmin: {},
+		},
+	}
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// RoleDefault returns the limits of users with role and no override
+func (s *Store) RoleDefault(role string) Limits {
+	if limits, ok := s.roleDefaults[role]; ok {
+		return limits
+	}
+	return s.roleDefaults[auth.RoleUser]
+}
+
+// Override returns the user's override, or nil if the role defaults apply
+func (s *Store) Override(ctx context.Context, userID string) (*Limits, error) {
+	limitsJSON, err := s.redisClient.Get(ctx, "quota:user:"+userID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var limits Limits
+	if err := json.Unmarshal([]byte(limitsJSON), &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// SetOverride replaces the role defaults for one user
+func (s *Store) SetOverride(ctx context.Context, userID string, limits Limits) error {
+	if limits.BuildsPerMinute < 0 || limits.MaxActiveBuilds < 0 {
+		return ErrInvalidLimits
+	}
+	limitsJSON, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(ctx, "quota:user:"+userID, limitsJSON, 0).Err()
+}
+
+// DeleteOverride makes the role defaults apply to the user again
+func (s *Store) DeleteOverride(ctx context.Context, userID string) error {
+	return s.redisClient.Del(ctx, "quota:user:"+userID).Err()
+}
+
+// Limits returns the limits that apply to the user
+func (s *Store) Limits(ctx context.Context, userID, role string) (Limits, error) {
+	override, err := s.Override(ctx, userID)
+	if err != nil {
+		return Limits{}, err
+	}
+	if override != nil {
+		return *override, nil
+	}
+	return s.RoleDefault(role), nil
+}
+
+// AllowRequest counts a build request against the rate limit. It returns a
+// *LimitError if the user sent too many requests within the last minute.
+func (s *Store) AllowRequest(ctx context.Context, userID, requestID string, limits Limits) error {
+	if limits.BuildsPerMinute == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	wait, err := slidingWindow.Run(ctx, s.redisClient, []string{"quota:rate:" + userID},
+		now, rateWindow.Milliseconds(), limits.BuildsPerMinute, requestID).Int64()
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &LimitError{
+			Reason:     fmt.Sprintf("Rate limit of %d builds per minute exceeded", limits.BuildsPerMinute),
+			RetryAfter: time.Duration(wait) * time.Millisecond,
+		}
+	}
+	return nil
+}
+
+// ReserveBuild counts buildID as active build of the user. It returns a
+// *LimitError if the user already has MaxActiveBuilds unfinished builds.
+func (s *Store) ReserveBuild(ctx context.Context, userID, buildID string, limits Limits) error {
+	key := "quota:active:" + userID
+
+	// Reserve first and count afterwards, so concurrent requests cannot both
+	// take the last slot
+	err := s.redisClient.ZAdd(ctx, key, &redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: buildID,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	if limits.MaxActiveBuilds == 0 {
+		return nil
+	}
+
+	active, err := s.activeBuilds(ctx, key)
+	if err != nil {
+		s.ReleaseBuild(ctx, userID, buildID)
+		return err
+	}
+	if active > limits.MaxActiveBuilds {
+		s.ReleaseBuild(ctx, userID, buildID)
+		return &LimitError{
+			Reason:     fmt.Sprintf("Limit of %d active builds reached, wait for a build to finish", limits.MaxActiveBuilds),
+			RetryAfter: activeRetryAfter,
+		}
+	}
+	return nil
+}
+
+// Admit reserves an active build slot for buildID and counts the request
+// against the rate limit. It returns a *LimitError if either limit is reached;
+// a rejected request uses up neither.
+func (s *Store) Admit(ctx context.Context, userID, buildID string, limits Limits) error {
+	if err := s.ReserveBuild(ctx, userID, buildID, limits); err != nil {
+		return err
+	}
+	if err := s.AllowRequest(ctx, userID, buildID, limits); err != nil {
+		s.ReleaseBuild(ctx, userID, buildID)
+		return err
+	}
+	return nil
+}
+
+// Withdraw undoes Admit for a build that could not be queued
+func (s *Store) Withdraw(ctx context.Context, userID, buildID string) error {
+	pipe := s.redisClient.TxPipeline()
+	pipe.ZRem(ctx, "quota:active:"+userID, buildID)
+	pipe.ZRem(ctx, "quota:rate:"+userID, buildID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ReleaseBuild removes a reservation
+func (s *Store) ReleaseBuild(ctx context.Context, userID, buildID string) error {
+	return s.redisClient.ZRem(ctx, "quota:active:"+userID, buildID).Err()
+}
+
+// activeBuilds counts the reserved builds that have not finished and drops the
+// others from the set. The build status is the one stored by the orchestrator.
+func (s *Store) activeBuilds(ctx context.Context, key string) (int, error) {
+	reserved, err := s.redisClient.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(reserved) == 0 {
+		return 0, nil
+	}
+
+	buildKeys := make([]string, len(reserved))
+	for i, z := range reserved {
+		buildKeys[i] = "build:" + z.Member.(string)
+	}
+	values, err := s.redisClient.MGet(ctx, buildKeys...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	active := 0
+	finished := make([]interface{}, 0)
+	for i, value := range values {
+		buildJSON, ok := value.(string)
+		if !ok {
+			// Not stored by the orchestrator yet, or already expired
+			reservedAt := time.Unix(int64(reserved[i].Score), 0)
+			if time.Since(reservedAt) > pendingTimeout {
+				finished = append(finished, reserved[i].Member)
+			} else {
+				active++
+			}
+			continue
+		}
+
+		var build model.BuildStatus
+		if err := json.Unmarshal([]byte(buildJSON), &build); err != nil || build.Finished() {
+			finished = append(finished, reserved[i].Member)
+			continue
+		}
+		active++
+	}
+
+	if len(finished) > 0 {
+		s.redisClient.ZRem(ctx, key, finished...)
+	}
+	return active, nil
+}
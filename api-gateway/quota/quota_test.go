@@ -0,0 +1,196 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gobuild/api-gateway/auth"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+// unreachableRedis is a client for tests that must not touch Redis
+func unreachableRedis() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+}
+
+func TestRoleDefault(t *testing.T) {
+	t.Setenv("RATE_LIMIT_BUILDS_PER_MINUTE", "5")
+	t.Setenv("MAX_ACTIVE_BUILDS", "-1")
+	store := NewStore(unreachableRedis())
+
+	tests := []struct {
+		role string
+		want Limits
+	}{
+		// Negative values are ignored in favour of the default
+		{auth.RoleUser, Limits{BuildsPerMinute: 5, MaxActiveBuilds: 3}},
+		{auth.RoleAdmin, Limits{}},
+		{"unknown", Limits{BuildsPerMinute: 5, MaxActiveBuilds: 3}},
+	}
+	for _, tt := range tests {
+		if got := store.RoleDefault(tt.role); got != tt.want {
+			t.Errorf("RoleDefault(%q) = %+v, want %+v", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestUnlimitedAndInvalidLimitsSkipRedis(t *testing.T) {
+	store := NewStore(unreachableRedis())
+	ctx := context.Background()
+
+	if err := store.AllowRequest(ctx, "u1", "r1", Limits{}); err != nil {
+		t.Errorf("AllowRequest() without rate limit = %v, want nil", err)
+	}
+	for _, limits := range []Limits{{BuildsPerMinute: -1}, {MaxActiveBuilds: -1}} {
+		if err := store.SetOverride(ctx, "u1", limits); !errors.Is(err, ErrInvalidLimits) {
+			t.Errorf("SetOverride(%+v) = %v, want %v", limits, err, ErrInvalidLimits)
+		}
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	store := NewStore(testRedis(t))
+	ctx := context.Background()
+	limits := Limits{BuildsPerMinute: 3}
+
+	for i := 0; i < 3; i++ {
+		if err := store.AllowRequest(ctx, "u1", fmt.Sprintf("r%d", i), limits); err != nil {
+			t.Fatalf("request %d: AllowRequest() = %v, want nil", i, err)
+		}
+	}
+	err := store.AllowRequest(ctx, "u1", "r3", limits)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("AllowRequest() over the limit = %v, want a *LimitError", err)
+	}
+	if limitErr.RetryAfter <= 0 || limitErr.RetryAfter > rateWindow {
+		t.Errorf("RetryAfter = %v, want within %v", limitErr.RetryAfter, rateWindow)
+	}
+
+	// Other users have their own window
+	if err := store.AllowRequest(ctx, "u2", "r0", limits); err != nil {
+		t.Errorf("AllowRequest() of another user = %v, want nil", err)
+	}
+}
+
+func TestReserveBuild(t *testing.T) {
+	client := testRedis(t)
+	store := NewStore(client)
+	ctx := context.Background()
+	limits := Limits{MaxActiveBuilds: 2}
+
+	tests := []struct {
+		name    string
+		setup   func()
+		buildID string
+		wantErr bool
+	}{
+		{"first", nil, "b1", false},
+		{"second", nil, "b2", false},
+		{"over the limit", nil, "b3", true},
+		{"after a build finished", func() {
+			client.Set(ctx, "build:b1", `{"id":"b1","status":"completed"}`, 0)
+		}, "b3", false},
+		{"running builds count", func() {
+			client.Set(ctx, "build:b2", `{"id":"b2","status":"in-progress"}`, 0)
+		}, "b4", true},
+		{"after a release", func() {
+			store.ReleaseBuild(ctx, "u1", "b3")
+		}, "b4", false},
+		{"request that never reached the orchestrator", func() {
+			client.ZAdd(ctx, "quota:active:u1", &redis.Z{Score: float64(time.Now().Add(-pendingTimeout - time.Minute).Unix()), Member: "b4"})
+		}, "b5", false},
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		err := store.ReserveBuild(ctx, "u1", tt.buildID, limits)
+		var limitErr *LimitError
+		if tt.wantErr != errors.As(err, &limitErr) {
+			t.Errorf("%s: ReserveBuild(%s) = %v, want limit error %v", tt.name, tt.buildID, err, tt.wantErr)
+		}
+	}
+}
+
+// TestAdmit checks that a request rejected by one limit does not use up the
+// other, and that Withdraw returns both
+func TestAdmit(t *testing.T) {
+	client := testRedis(t)
+	store := NewStore(client)
+	ctx := context.Background()
+	limits := Limits{BuildsPerMinute: 2, MaxActiveBuilds: 1}
+
+	if err := store.Admit(ctx, "u1", "b1", limits); err != nil {
+		t.Fatalf("Admit() = %v", err)
+	}
+	var limitErr *LimitError
+	if err := store.Admit(ctx, "u1", "b2", limits); !errors.As(err, &limitErr) {
+		t.Fatalf("Admit() over the active limit = %v, want a *LimitError", err)
+	}
+	if n := client.ZCard(ctx, "quota:rate:u1").Val(); n != 1 {
+		t.Errorf("rate window holds %d requests after a rejection, want 1", n)
+	}
+
+	// b1 could not be queued
+	if err := store.Withdraw(ctx, "u1", "b1"); err != nil {
+		t.Fatalf("Withdraw() = %v", err)
+	}
+	for _, key := range []string{"quota:rate:u1", "quota:active:u1"} {
+		if n := client.ZCard(ctx, key).Val(); n != 0 {
+			t.Errorf("%s holds %d entries after Withdraw, want 0", key, n)
+		}
+	}
+
+	if err := store.Admit(ctx, "u1", "b3", Limits{BuildsPerMinute: 2}); err != nil {
+		t.Fatalf("Admit() = %v", err)
+	}
+	if err := store.Admit(ctx, "u1", "b4", Limits{BuildsPerMinute: 2}); err != nil {
+		t.Fatalf("Admit() = %v", err)
+	}
+	if err := store.Admit(ctx, "u1", "b5", Limits{BuildsPerMinute: 2}); !errors.As(err, &limitErr) {
+		t.Fatalf("Admit() over the rate limit = %v, want a *LimitError", err)
+	}
+	if client.ZScore(ctx, "quota:active:u1", "b5").Err() != redis.Nil {
+		t.Error("a rate limited request holds an active build slot")
+	}
+}
+
+func TestLimitsOverride(t *testing.T) {
+	store := NewStore(testRedis(t))
+	ctx := context.Background()
+
+	override := Limits{BuildsPerMinute: 1, MaxActiveBuilds: 0}
+	if err := store.SetOverride(ctx, "u1", override); err != nil {
+		t.Fatalf("SetOverride() = %v", err)
+	}
+	if got, err := store.Limits(ctx, "u1", auth.RoleUser); err != nil || got != override {
+		t.Errorf("Limits() = %+v, %v, want %+v", got, err, override)
+	}
+	if err := store.DeleteOverride(ctx, "u1"); err != nil {
+		t.Fatalf("DeleteOverride() = %v", err)
+	}
+	if got, err := store.Limits(ctx, "u1", auth.RoleUser); err != nil || got != store.RoleDefault(auth.RoleUser) {
+		t.Errorf("Limits() after DeleteOverride = %+v, %v, want the role default", got, err)
+	}
+}
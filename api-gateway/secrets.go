@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/secrets"
+	"gobuild/api-gateway/users"
+	"gobuild/shared/access"
+	"gobuild/shared/message"
+)
+
+// secretsTokenHeader carries a build's secrets token
+const secretsTokenHeader = "X-Secrets-Token"
+
+type SetSecretRequest struct {
+	Value string `json:"value"`
+}
+
+// SecretAPI manages the build secrets of projects. Values are write-only; only
+// the builder gets them, for a build that is running.
+type SecretAPI struct {
+	secrets              *secrets.Store
+	projects             *ProjectAPI
+	buildOrchestratorURL string
+}
+
+func NewSecretAPI(secretStore *secrets.Store, projectAPI *ProjectAPI, buildOrchestratorURL string) *SecretAPI {
+	return &SecretAPI{
+		secrets:              secretStore,
+		projects:             projectAPI,
+		buildOrchestratorURL: buildOrchestratorURL,
+	}
+}
+
+func (a *SecretAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/projects/{projectId}/secrets", a.ListSecrets).Methods("GET")
+	r.HandleFunc("/api/projects/{projectId}/secrets/{name}", a.SetSecret).Methods("PUT")
+	r.HandleFunc("/api/projects/{projectId}/secrets/{name}", a.DeleteSecret).Methods("DELETE")
+}
+
+// RegisterInternalRoutes adds the endpoints of the internal listener, which
+// only other services reach
+func (a *SecretAPI) RegisterInternalRoutes(r *mux.Router) {
+	r.HandleFunc("/api/internal/builds/{buildId}/secrets", a.ResolveSecrets).Methods("GET")
+}
+
+// issueSecretsToken gives a project build the one-time token its builder
+// fetches the project's secrets with
+func issueSecretsToken(ctx context.Context, secretStore *secrets.Store, buildMsg *message.BuildRequestMessage) error {
+	if buildMsg.ProjectID == "" {
+		return nil
+	}
+	token, err := secretStore.IssueBuildToken(ctx, buildMsg.ID)
+	if err != nil {
+		return err
+	}
+	buildMsg.SecretsToken = token
+	return nil
+}
+
+// revokeSecretsToken invalidates the token of a build that could not be queued
+func revokeSecretsToken(secretStore *secrets.Store, buildMsg *message.BuildRequestMessage) {
+	if err := secretStore.RevokeBuildToken(context.Background(), buildMsg.ID, buildMsg.SecretsToken); err != nil {
+		log.Printf("⚠️ Failed to revoke secrets token of build %s: %v", buildMsg.ID, err)
+	}
+}
+
+// ListSecrets lists the names of a project's secrets
+func (a *SecretAPI) ListSecrets(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsRead)
+	if userClaims == nil {
+		return
+	}
+	project := a.projects.loadProject(w, r, userClaims, mux.Vars(r)["projectId"], users.OrgRoleMaintainer)
+	if project == nil {
+		return
+	}
+
+	list, err := a.secrets.List(r.Context(), project.ID)
+	if err != nil {
+		log.Printf("❌ Failed to list secrets of %s: %v", project.ID, err)
+		http.Error(w, "Failed to list secrets", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// SetSecret creates or replaces a secret. The value is never returned.
+func (a *SecretAPI) SetSecret(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsWrite)
+	if userClaims == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	project := a.projects.loadProject(w, r, userClaims, vars["projectId"], users.OrgRoleMaintainer)
+	if project == nil {
+		return
+	}
+
+	var req SetSecretRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*secrets.MaxValueSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := a.secrets.Set(r.Context(), project.ID, vars["name"], req.Value, userClaims.ID)
+	switch err {
+	case nil:
+	case secrets.ErrDisabled:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case secrets.ErrInvalidName, secrets.ErrReservedName, secrets.ErrValueTooLarge:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		log.Printf("❌ Failed to store secret of %s: %v", project.ID, err)
+		http.Error(w, "Failed to store secret", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🔑 %s set secret %s of project %s", userClaims.Email, vars["name"], project.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *SecretAPI) DeleteSecret(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeProjectsWrite)
+	if userClaims == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	project := a.projects.loadProject(w, r, userClaims, vars["projectId"], users.OrgRoleMaintainer)
+	if project == nil {
+		return
+	}
+
+	err := a.secrets.Delete(r.Context(), project.ID, vars["name"])
+	if err == secrets.ErrSecretNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to delete secret of %s: %v", project.ID, err)
+		http.Error(w, "Failed to delete secret", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🔑 %s deleted secret %s of project %s", userClaims.Email, vars["name"], project.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResolveSecrets returns the decrypted secrets of a running project build to
+// the builder. Besides a builder service token it needs the build's secrets
+// token, which only the builder that got the build job knows and which works
+// once.
+func (a *SecretAPI) ResolveSecrets(w http.ResponseWriter, r *http.Request) {
+	serviceClaims, err := access.ValidateServiceToken(access.TokenFromRequest(r))
+	if err != nil || serviceClaims.ID != "builder" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	buildID := mux.Vars(r)["buildId"]
+
+	valid, err := a.secrets.ConsumeBuildToken(r.Context(), buildID, r.Header.Get(secretsTokenHeader))
+	if err != nil {
+		log.Printf("❌ Failed to check secrets token of build %s: %v", buildID, err)
+		http.Error(w, "Failed to check secrets token", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		log.Printf("⚠️ Rejected secrets request for build %s with an unknown or used token", buildID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	build, err := fetchBuildStatus(r.Context(), a.buildOrchestratorURL, buildID)
+	if err == errBuildNotFound {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to fetch build status from orchestrator: %v", err)
+		http.Error(w, "Failed to fetch build status", http.StatusInternalServerError)
+		return
+	}
+	if build.ProjectID == "" || build.Finished() {
+		http.Error(w, "Build has no secrets", http.StatusConflict)
+		return
+	}
+
+	values, err := a.secrets.Resolve(r.Context(), build.ProjectID)
+	if err == secrets.ErrDisabled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to resolve secrets of %s: %v", build.ProjectID, err)
+		http.Error(w, "Failed to resolve secrets", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🔑 Handed %d secrets of project %s to build %s", len(values), build.ProjectID, buildID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(values)
+}
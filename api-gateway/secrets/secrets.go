@@ -0,0 +1,272 @@
+// Package secrets stores per-project build secrets, encrypted with AES-256-GCM
+// under a master key. Values can only be read back by Resolve for the builder.
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// MaxValueSize limits the size of a secret value
+const MaxValueSize = 64 << 10
+
+// buildTokenTTL is how long a build's secrets token stays valid, as long as
+// its build request is kept in Kafka
+const buildTokenTTL = 7 * 24 * time.Hour
+
+var (
+	ErrDisabled       = errors.New("secrets are disabled, SECRETS_MASTER_KEY is not configured")
+	ErrInvalidName    = errors.New("secret names must be environment variable names like NPM_TOKEN")
+	ErrReservedName   = errors.New("secret name is reserved")
+	ErrValueTooLarge  = errors.New("secret value must not exceed 64 KiB")
+	ErrSecretNotFound = errors.New("secret not found")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Variables a secret must not replace, since they change how the build runs
+var (
+	reservedNames    = map[string]bool{"PATH": true, "HOME": true, "USER": true, "SHELL": true, "PWD": true, "TMPDIR": true, "SERVICE_TOKEN_SECRET": true, "JWT_SECRET": true}
+	reservedPrefixes = []string{"GIT_", "LD_"}
+)
+
+// ValidateName checks that name can be used as environment variable of a build
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return ErrInvalidName
+	}
+	upper := strings.ToUpper(name)
+	if reservedNames[upper] {
+		return ErrReservedName
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return ErrReservedName
+		}
+	}
+	return nil
+}
+
+// Secret describes a stored secret without its value
+type Secret struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by"`
+}
+
+type secretStorage struct {
+	Secret
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type Store struct {
+	redisClient *redis.Client
+	aead        cipher.AEAD
+}
+
+// NewStore creates a store encrypting with masterKey, a 32 byte AES-256 key.
+// Without a key secrets can be listed and deleted but not set or resolved.
+func NewStore(redisClient *redis.Client, masterKey []byte) (*Store, error) {
+	s := &Store{redisClient: redisClient}
+	if masterKey == nil {
+		return s, nil
+	}
+
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MasterKeyFromEnv reads the base64 encoded SECRETS_MASTER_KEY. It returns nil
+// if the variable is not set.
+func MasterKeyFromEnv() ([]byte, error) {
+	encoded := os.Getenv("SECRETS_MASTER_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("SECRETS_MASTER_KEY is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+// Enabled reports whether a master key is configured
+func (s *Store) Enabled() bool {
+	return s.aead != nil
+}
+
+// additionalData binds a ciphertext to its project and name, so it cannot be
+// copied to another secret
+func additionalData(projectID, name string) []byte {
+	return []byte(projectID + "\x00" + name)
+}
+
+// Set encrypts and stores a secret, replacing one with the same name
+func (s *Store) Set(ctx context.Context, projectID, name, value, userID string) error {
+	if !s.Enabled() {
+		return ErrDisabled
+	}
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	stored := secretStorage{
+		Secret: Secret{
+			Name:      name,
+			UpdatedAt: time.Now(),
+			UpdatedBy: userID,
+		},
+		Nonce:      nonce,
+		Ciphertext: s.aead.Seal(nil, nonce, []byte(value), additionalData(projectID, name)),
+	}
+
+	secretJSON, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.HSet(ctx, "project:secrets:"+projectID, name, secretJSON).Err()
+}
+
+func (s *Store) load(ctx context.Context, projectID string) ([]*secretStorage, error) {
+	values, err := s.redisClient.HGetAll(ctx, "project:secrets:"+projectID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*secretStorage, 0, len(values))
+	for _, secretJSON := range values {
+		var stored secretStorage
+		if err := json.Unmarshal([]byte(secretJSON), &stored); err != nil {
+			return nil, err
+		}
+		list = append(list, &stored)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// List returns the secrets of a project by name, without values
+func (s *Store) List(ctx context.Context, projectID string) ([]*Secret, error) {
+	stored, err := s.load(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Secret, len(stored))
+	for i := range stored {
+		list[i] = &stored[i].Secret
+	}
+	return list, nil
+}
+
+// Delete removes a secret
+func (s *Store) Delete(ctx context.Context, projectID, name string) error {
+	deleted, err := s.redisClient.HDel(ctx, "project:secrets:"+projectID, name).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrSecretNotFound
+	}
+	return nil
+}
+
+// DeleteAll removes all secrets of a project
+func (s *Store) DeleteAll(ctx context.Context, projectID string) error {
+	return s.redisClient.Del(ctx, "project:secrets:"+projectID).Err()
+}
+
+// Resolve decrypts all secrets of a project
+func (s *Store) Resolve(ctx context.Context, projectID string) (map[string]string, error) {
+	stored, err := s.load(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) > 0 && !s.Enabled() {
+		return nil, ErrDisabled
+	}
+
+	values := make(map[string]string, len(stored))
+	for _, secret := range stored {
+		value, err := s.aead.Open(nil, secret.Nonce, secret.Ciphertext, additionalData(projectID, secret.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s: %w", secret.Name, err)
+		}
+		values[secret.Name] = string(value)
+	}
+	return values, nil
+}
+
+func buildTokenKey(buildID, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "build:secrets_token:" + buildID + ":" + hex.EncodeToString(sum[:])
+}
+
+// IssueBuildToken creates the token the builder presents to fetch the secrets
+// of a build. It travels with the build request; only its hash is stored.
+func (s *Store) IssueBuildToken(ctx context.Context, buildID string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	if err := s.redisClient.Set(ctx, buildTokenKey(buildID, token), 1, buildTokenTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeBuildToken reports whether token was issued for the build and
+// invalidates it, so the secrets of a build are handed out only once
+func (s *Store) ConsumeBuildToken(ctx context.Context, buildID, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	deleted, err := s.redisClient.Del(ctx, buildTokenKey(buildID, token)).Result()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
+
+// RevokeBuildToken invalidates the token of a build that was not queued
+func (s *Store) RevokeBuildToken(ctx context.Context, buildID, token string) error {
+	if token == "" {
+		return nil
+	}
+	return s.redisClient.Del(ctx, buildTokenKey(buildID, token)).Err()
+}
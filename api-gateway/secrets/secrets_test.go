@@ -0,0 +1,235 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"NPM_TOKEN", nil},
+		{"_private", nil},
+		{"token2", nil},
+		{"2TOKEN", ErrInvalidName},
+		{"NPM-TOKEN", ErrInvalidName},
+		{"", ErrInvalidName},
+		{"A=B", ErrInvalidName},
+		{"PATH", ErrReservedName},
+		{"path", ErrReservedName},
+		{"SERVICE_TOKEN_SECRET", ErrReservedName},
+		{"GIT_SSH_COMMAND", ErrReservedName},
+		{"LD_PRELOAD", ErrReservedName},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); !errors.Is(err, tt.want) {
+			t.Errorf("ValidateName(%q) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMasterKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		enabled bool
+		wantErr bool
+	}{
+		{"unset", "", false, false},
+		{"32 bytes", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)), true, false},
+		{"16 bytes", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)), false, true},
+		{"not base64", "not base64!", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRETS_MASTER_KEY", tt.env)
+			key, err := MasterKeyFromEnv()
+			var store *Store
+			if err == nil {
+				store, err = NewStore(nil, key)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && store.Enabled() != tt.enabled {
+				t.Errorf("Enabled() = %v, want %v", store.Enabled(), tt.enabled)
+			}
+		})
+	}
+}
+
+// TestCiphertextBoundToSecret checks that a ciphertext only decrypts for the
+// project and name it was sealed for, and not under another master key
+func TestCiphertextBoundToSecret(t *testing.T) {
+	store, err := NewStore(nil, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, store.aead.NonceSize())
+	ciphertext := store.aead.Seal(nil, nonce, []byte("s3cret"), additionalData("p1", "TOKEN"))
+	if bytes.Contains(ciphertext, []byte("s3cret")) {
+		t.Fatal("ciphertext contains the plain value")
+	}
+
+	plain, err := store.aead.Open(nil, nonce, ciphertext, additionalData("p1", "TOKEN"))
+	if err != nil || string(plain) != "s3cret" {
+		t.Fatalf("Open() = %q, %v, want the value", plain, err)
+	}
+
+	other, err := NewStore(nil, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		store     *Store
+		projectID string
+		secret    string
+	}{
+		{"other project", store, "p2", "TOKEN"},
+		{"other name", store, "p1", "OTHER"},
+		{"name moved into project", store, "p1\x00TOKEN", ""},
+		{"other master key", other, "p1", "TOKEN"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.store.aead.Open(nil, nonce, ciphertext, additionalData(tt.projectID, tt.secret)); err == nil {
+			t.Errorf("%s: Open() succeeded", tt.name)
+		}
+	}
+}
+
+func TestSetAndResolve(t *testing.T) {
+	client := testRedis(t)
+	store, err := NewStore(client, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "p1", "NPM_TOKEN", "npm-s3cret", "u1"); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	if err := store.Set(ctx, "p1", "PATH", "/tmp", "u1"); !errors.Is(err, ErrReservedName) {
+		t.Errorf("Set(PATH) = %v, want %v", err, ErrReservedName)
+	}
+	if err := store.Set(ctx, "p1", "BIG", strings.Repeat("x", MaxValueSize+1), "u1"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Set() of a large value = %v, want %v", err, ErrValueTooLarge)
+	}
+
+	stored, err := client.HGet(ctx, "project:secrets:p1", "NPM_TOKEN").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "npm-s3cret") {
+		t.Error("Redis holds the plain value")
+	}
+
+	list, err := store.List(ctx, "p1")
+	if err != nil || len(list) != 1 || list[0].Name != "NPM_TOKEN" || list[0].UpdatedBy != "u1" {
+		t.Errorf("List() = %+v, %v, want NPM_TOKEN set by u1", list, err)
+	}
+
+	values, err := store.Resolve(ctx, "p1")
+	if err != nil || values["NPM_TOKEN"] != "npm-s3cret" {
+		t.Errorf("Resolve() = %v, %v, want the value", values, err)
+	}
+
+	// A ciphertext copied to another project does not decrypt
+	client.HSet(ctx, "project:secrets:p2", "NPM_TOKEN", stored)
+	if _, err := store.Resolve(ctx, "p2"); err == nil {
+		t.Error("Resolve() of a copied secret succeeded")
+	}
+
+	disabled, _ := NewStore(client, nil)
+	if _, err := disabled.Resolve(ctx, "p1"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("Resolve() without master key = %v, want %v", err, ErrDisabled)
+	}
+	if err := disabled.Set(ctx, "p1", "OTHER", "v", "u1"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("Set() without master key = %v, want %v", err, ErrDisabled)
+	}
+}
+
+func TestBuildToken(t *testing.T) {
+	store, err := NewStore(testRedis(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	token, err := store.IssueBuildToken(ctx, "b1")
+	if err != nil {
+		t.Fatalf("IssueBuildToken() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		buildID string
+		token   string
+		want    bool
+	}{
+		{"empty token", "b1", "", false},
+		{"wrong token", "b1", "wrong", false},
+		{"token of another build", "b2", token, false},
+		{"valid", "b1", token, true},
+		{"used twice", "b1", token, false},
+	}
+	for _, tt := range tests {
+		if got, err := store.ConsumeBuildToken(ctx, tt.buildID, tt.token); err != nil || got != tt.want {
+			t.Errorf("%s: ConsumeBuildToken() = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRevokeBuildToken(t *testing.T) {
+	store, err := NewStore(testRedis(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	token, err := store.IssueBuildToken(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeBuildToken(ctx, "b1", token); err != nil {
+		t.Fatalf("RevokeBuildToken() = %v", err)
+	}
+	if ok, err := store.ConsumeBuildToken(ctx, "b1", token); ok || err != nil {
+		t.Errorf("ConsumeBuildToken() of a revoked token = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/oidc"
+	"gobuild/api-gateway/users"
+	"gobuild/shared/audit"
+	"gobuild/shared/message"
+)
+
+// oidcStateCookie binds a started login to the browser that started it
+const oidcStateCookie = "gobuild_oidc_state"
+
+var (
+	errIdentityWithoutEmail = errors.New("identity provider returned no email")
+	errEmailNotVerified     = errors.New("an account with this email exists and the identity provider has not verified the email")
+)
+
+// SSOAPI logs users in through an OpenID Connect provider. Users are created
+// on their first login and get the role their groups map to at every login.
+type SSOAPI struct {
+	provider    *oidc.Provider
+	logins      *oidc.LoginStore
+	users       *users.UserStore
+	tokens      *users.TokenStore
+	sessions    *auth.SessionStore
+	issueTokens func(ctx context.Context, user *users.User) (*auth.TokenPair, error)
+	audit       *audit.Recorder
+}
+
+func NewSSOAPI(provider *oidc.Provider, logins *oidc.LoginStore, userStore *users.UserStore, tokens *users.TokenStore, sessions *auth.SessionStore, issueTokens func(ctx context.Context, user *users.User) (*auth.TokenPair, error), recorder *audit.Recorder) *SSOAPI {
+	return &SSOAPI{
+		provider:    provider,
+		logins:      logins,
+		users:       userStore,
+		tokens:      tokens,
+		sessions:    sessions,
+		issueTokens: issueTokens,
+		audit:       recorder,
+	}
+}
+
+func (a *SSOAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/oidc/login", a.Login).Methods("GET")
+	r.HandleFunc("/api/oidc/callback", a.Callback).Methods("GET")
+}
+
+func (a *SSOAPI) stateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.provider.Config().RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Login redirects the browser to the identity provider
+func (a *SSOAPI) Login(w http.ResponseWriter, r *http.Request) {
+	login, err := a.logins.Begin(r.Context())
+	if err != nil {
+		log.Printf("❌ Failed to start SSO login: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := a.provider.AuthCodeURL(r.Context(), login)
+	if err != nil {
+		log.Printf("❌ Identity provider unavailable: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, a.stateCookie(login.State, int(oidc.LoginTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback completes the login after the identity provider redirected back
+func (a *SSOAPI) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		log.Printf("⚠️ SSO login failed at identity provider: %s %s", providerErr, query.Get("error_description"))
+		http.Error(w, "Login failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || cookie.Value != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, a.stateCookie("", -1))
+
+	login, err := a.logins.Consume(r.Context(), state)
+	if err == oidc.ErrLoginNotFound {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load SSO login: %v", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	identity, err := a.provider.Exchange(r.Context(), query.Get("code"), login)
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		log.Printf("⚠️ Rejected ID token: %v", err)
+		a.audit.Record(r, loginFailure("", "sso", "invalid_id_token"))
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to redeem authorization code: %v", err)
+		http.Error(w, "Identity provider error", http.StatusBadGateway)
+		return
+	}
+
+	user, created, err := a.provision(r.Context(), identity)
+	switch err {
+	case nil:
+	case errIdentityWithoutEmail:
+		http.Error(w, "The identity provider did not return an email, check the requested scopes", http.StatusBadRequest)
+		return
+	case errEmailNotVerified:
+		log.Printf("⚠️ SSO login for existing account %s with unverified email", identity.Email)
+		a.audit.Record(r, loginFailure(identity.Email, "sso", "email_not_verified"))
+		http.Error(w, errEmailNotVerified.Error(), http.StatusConflict)
+		return
+	case users.ErrUserDisabled:
+		log.Printf("⚠️ SSO login attempt for disabled user: %s", identity.Email)
+		a.audit.Record(r, loginFailure(identity.Email, "sso", "account_disabled"))
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	default:
+		log.Printf("❌ Failed to provision SSO user %s: %v", identity.Email, err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := a.issueTokens(r.Context(), user)
+	if err != nil {
+		log.Printf("❌ Failed to generate token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	resp := newLoginResponse(user, tokens)
+	log.Printf("✅ User logged in via SSO: %s", user.Email)
+	if created {
+		a.audit.Record(r, message.AuditEventMessage{
+			Action:     audit.ActionRegister,
+			ActorID:    user.ID,
+			ActorEmail: user.Email,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID,
+			Details:    map[string]string{"method": "sso", "issuer": identity.Issuer},
+		})
+	}
+	a.audit.Record(r, loginSuccess(user, "sso"))
+
+	// The fragment never reaches a server, so the tokens stay in the browser
+	if postLoginURL := a.provider.Config().PostLoginURL; postLoginURL != "" {
+		userJSON, err := json.Marshal(resp.User)
+		if err != nil {
+			http.Error(w, "Login failed", http.StatusInternalServerError)
+			return
+		}
+		fragment := url.Values{
+			"token":         {resp.Token},
+			"refresh_token": {resp.RefreshToken},
+			"expires_in":    {strconv.FormatInt(resp.ExpiresIn, 10)},
+			"user":          {string(userJSON)},
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, postLoginURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// provision finds or creates the user of an identity and applies the role its
+// groups map to. An existing password account is only linked if the provider
+// verified the email. If the account's own email was not verified, whoever
+// registered it may not own the email: it loses its password, sessions and
+// personal access tokens before it is linked. created reports whether the
+// user was created.
+func (a *SSOAPI) provision(ctx context.Context, identity *oidc.Identity) (user *users.User, created bool, err error) {
+	role := a.provider.Config().RoleFor(identity.Groups)
+
+	user, err = a.users.GetByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err == users.ErrUserNotFound {
+		if identity.Email == "" {
+			return nil, false, errIdentityWithoutEmail
+		}
+
+		user, err = a.users.GetByEmail(ctx, identity.Email)
+		switch err {
+		case nil:
+			if !identity.EmailVerified {
+				return nil, false, errEmailNotVerified
+			}
+			log.Printf("🔗 Linking SSO identity to existing user %s", user.Email)
+			if !user.EmailVerified {
+				if err := a.takeOver(ctx, user); err != nil {
+					return nil, false, err
+				}
+			}
+		case users.ErrUserNotFound:
+			user = &users.User{
+				ID:            uuid.New().String(),
+				Email:         identity.Email,
+				EmailVerified: identity.EmailVerified,
+				Role:          role,
+				CreatedAt:     time.Now(),
+				UpdatedAt:     time.Now(),
+			}
+			if err := a.users.Create(ctx, user); err != nil {
+				return nil, false, err
+			}
+			created = true
+			log.Printf("✅ Provisioned SSO user %s with role %s", user.Email, user.Role)
+		default:
+			return nil, false, err
+		}
+
+		if err := a.users.LinkIdentity(ctx, identity.Issuer, identity.Subject, user.ID); err != nil {
+			return nil, false, err
+		}
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if user.Disabled {
+		return nil, false, users.ErrUserDisabled
+	}
+	if user.Role != role {
+		log.Printf("👤 SSO groups change role of %s from %s to %s", user.Email, user.Role, role)
+		user.Role = role
+		if err := a.users.Update(ctx, user); err != nil {
+			return nil, false, err
+		}
+	}
+	return user, created, nil
+}
+
+// takeOver hands an account with unverified email to the owner of the email,
+// whom the identity provider vouched for. Every way in that did not need the
+// email is closed.
+func (a *SSOAPI) takeOver(ctx context.Context, user *users.User) error {
+	log.Printf("⚠️ Email of %s was not verified, dropping its password, sessions and personal access tokens", user.Email)
+	user.PasswordHash = ""
+	user.EmailVerified = true
+	if err := a.users.Update(ctx, user); err != nil {
+		return err
+	}
+	if err := a.tokens.RevokeAll(ctx, user.ID); err != nil {
+		return err
+	}
+	return a.sessions.RevokeAllSessions(ctx, user.ID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/oidc"
+	"gobuild/api-gateway/users"
+)
+
+func TestProvisionLinksExistingAccount(t *testing.T) {
+	tests := []struct {
+		name         string
+		verified     bool
+		wantPassword bool
+	}{
+		{"verified account keeps its logins", true, true},
+		{"unverified account is taken over", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t)
+			ctx := context.Background()
+			sso := NewSSOAPI(oidc.NewProvider(&oidc.Config{DefaultRole: auth.RoleUser}), oidc.NewLoginStore(g.redis), g.users, g.tokens, g.sessions, g.issueTokens, g.audit)
+			existing := g.createUser(t, "alice@example.com", "password", tt.verified)
+			session := g.login(t, existing)
+			pat, _, err := g.tokens.Create(ctx, existing.ID, "ci", []string{auth.ScopeBuildsRead}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			identity := &oidc.Identity{Issuer: "https://idp.test", Subject: "s1", Email: existing.Email, EmailVerified: true}
+			user, created, err := sso.provision(ctx, identity)
+			if err != nil || created || user.ID != existing.ID {
+				t.Fatalf("provision() = %+v, %v, %v, want the existing user", user, created, err)
+			}
+			if linked, err := g.users.GetByIdentity(ctx, identity.Issuer, identity.Subject); err != nil || linked.ID != existing.ID {
+				t.Errorf("GetByIdentity() = %+v, %v, want the existing user", linked, err)
+			}
+			if !user.EmailVerified {
+				t.Errorf("provision() left the email unverified")
+			}
+
+			_, err = g.users.Authenticate(ctx, existing.Email, "password")
+			if got := err == nil; got != tt.wantPassword {
+				t.Errorf("Authenticate() with the old password = %v, want success %v", err, tt.wantPassword)
+			}
+			_, err = g.tokens.Authenticate(ctx, pat)
+			if got := err == nil; got != tt.wantPassword {
+				t.Errorf("Authenticate() of a personal access token = %v, want success %v", err, tt.wantPassword)
+			}
+			wantCode := http.StatusOK
+			if !tt.wantPassword {
+				wantCode = http.StatusUnauthorized
+			}
+			if rec := g.do(t, "GET", "/api/account", session, nil); rec.Code != wantCode {
+				t.Errorf("GET /api/account with a session from before = %d, want %d", rec.Code, wantCode)
+			}
+		})
+	}
+}
+
+func TestProvisionRefusesUnverifiedIdentity(t *testing.T) {
+	g := newTestGateway(t)
+	sso := NewSSOAPI(oidc.NewProvider(&oidc.Config{DefaultRole: auth.RoleUser}), oidc.NewLoginStore(g.redis), g.users, g.tokens, g.sessions, g.issueTokens, g.audit)
+	existing := g.createUser(t, "alice@example.com", "password", false)
+
+	identity := &oidc.Identity{Issuer: "https://idp.test", Subject: "s1", Email: existing.Email}
+	if _, _, err := sso.provision(context.Background(), identity); err != errEmailNotVerified {
+		t.Errorf("provision() = %v, want %v", err, errEmailNotVerified)
+	}
+	if _, err := g.users.GetByIdentity(context.Background(), identity.Issuer, identity.Subject); err != users.ErrUserNotFound {
+		t.Errorf("GetByIdentity() = %v, want %v", err, users.ErrUserNotFound)
+	}
+}
@@ -0,0 +1,86 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Purposes of account tokens; a token only works for the purpose it was issued for
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+	PurposeAccountDeletion   = "account_deletion"
+)
+
+var ErrInvalidAccountToken = errors.New("invalid or expired token")
+
+// Account tokens are mailed to users to reset their password, verify their
+// email or confirm the deletion of an account without password. They can be used once; only their SHA-256 hash is stored.
+func accountTokenKey(purpose, hash string) string {
+	return "account_token:" + purpose + ":" + hash
+}
+
+func accountTokensKey(purpose, userID string) string {
+	return "user:account_tokens:" + purpose + ":" + userID
+}
+
+// IssueAccountToken creates a token for purpose that expires after ttl
+func (s *UserStore) IssueAccountToken(ctx context.Context, purpose, userID string, ttl time.Duration) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	hash := hashPersonalToken(token)
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, accountTokenKey(purpose, hash), userID, ttl)
+	pipe.SAdd(ctx, accountTokensKey(purpose, userID), hash)
+	pipe.Expire(ctx, accountTokensKey(purpose, userID), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeAccountToken invalidates a token and returns the ID of its user
+func (s *UserStore) ConsumeAccountToken(ctx context.Context, purpose, token string) (string, error) {
+	hash := hashPersonalToken(token)
+	userID, err := s.redisClient.GetDel(ctx, accountTokenKey(purpose, hash)).Result()
+	if err == redis.Nil {
+		return "", ErrInvalidAccountToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.redisClient.SRem(ctx, accountTokensKey(purpose, userID), hash)
+	return userID, nil
+}
+
+// RevokeAccountTokens invalidates all of the user's tokens for purpose
+func (s *UserStore) RevokeAccountTokens(ctx context.Context, purpose, userID string) error {
+	hashes, err := s.redisClient.SMembers(ctx, accountTokensKey(purpose, userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	for _, hash := range hashes {
+		pipe.Del(ctx, accountTokenKey(purpose, hash))
+	}
+	pipe.Del(ctx, accountTokensKey(purpose, userID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ThrottleAccountMail reports whether a mail for purpose may be sent to the
+// user, allowing one per interval
+func (s *UserStore) ThrottleAccountMail(ctx context.Context, purpose, userID string, interval time.Duration) (bool, error) {
+	return s.redisClient.SetNX(ctx, "account_mail:"+purpose+":"+userID, time.Now().Unix(), interval).Result()
+}
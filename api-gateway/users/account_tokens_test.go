@@ -0,0 +1,133 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// testRedis returns a client for the database given by TEST_REDIS_ADDR, which
+// is emptied first. Tests that need Redis are skipped without it.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() { client.Close() })
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test database: %v", err)
+	}
+	return client
+}
+
+func TestConsumeAccountToken(t *testing.T) {
+	client := testRedis(t)
+	store := NewUserStore(client)
+	ctx := context.Background()
+
+	token, err := store.IssueAccountToken(ctx, PurposePasswordReset, "u1", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueAccountToken() = %v", err)
+	}
+	if keys := client.Keys(ctx, "account_token:*"+token+"*").Val(); len(keys) != 0 {
+		t.Errorf("Redis holds the plain token in %v", keys)
+	}
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		want    string
+		wantErr error
+	}{
+		{"other purpose", PurposeEmailVerification, token, "", ErrInvalidAccountToken},
+		{"unknown token", PurposePasswordReset, "unknown", "", ErrInvalidAccountToken},
+		{"empty token", PurposePasswordReset, "", "", ErrInvalidAccountToken},
+		{"valid", PurposePasswordReset, token, "u1", nil},
+		{"used twice", PurposePasswordReset, token, "", ErrInvalidAccountToken},
+	}
+	for _, tt := range tests {
+		userID, err := store.ConsumeAccountToken(ctx, tt.purpose, tt.token)
+		if userID != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: ConsumeAccountToken() = %q, %v, want %q, %v", tt.name, userID, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if members := client.SCard(ctx, accountTokensKey(PurposePasswordReset, "u1")).Val(); members != 0 {
+		t.Errorf("user's token index holds %d hashes after use, want 0", members)
+	}
+}
+
+func TestAccountTokenExpires(t *testing.T) {
+	store := NewUserStore(testRedis(t))
+	ctx := context.Background()
+
+	token, err := store.IssueAccountToken(ctx, PurposeEmailVerification, "u1", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("IssueAccountToken() = %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := store.ConsumeAccountToken(ctx, PurposeEmailVerification, token); !errors.Is(err, ErrInvalidAccountToken) {
+		t.Errorf("ConsumeAccountToken() of an expired token = %v, want %v", err, ErrInvalidAccountToken)
+	}
+}
+
+func TestRevokeAccountTokens(t *testing.T) {
+	store := NewUserStore(testRedis(t))
+	ctx := context.Background()
+
+	var resets []string
+	for i := 0; i < 2; i++ {
+		token, err := store.IssueAccountToken(ctx, PurposePasswordReset, "u1", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resets = append(resets, token)
+	}
+	verification, _ := store.IssueAccountToken(ctx, PurposeEmailVerification, "u1", time.Hour)
+	otherUser, _ := store.IssueAccountToken(ctx, PurposePasswordReset, "u2", time.Hour)
+
+	// Changing the password invalidates every reset link of the user
+	if err := store.RevokeAccountTokens(ctx, PurposePasswordReset, "u1"); err != nil {
+		t.Fatalf("RevokeAccountTokens() = %v", err)
+	}
+	for _, token := range resets {
+		if _, err := store.ConsumeAccountToken(ctx, PurposePasswordReset, token); !errors.Is(err, ErrInvalidAccountToken) {
+			t.Errorf("ConsumeAccountToken() of a revoked token = %v, want %v", err, ErrInvalidAccountToken)
+		}
+	}
+	if userID, err := store.ConsumeAccountToken(ctx, PurposeEmailVerification, verification); userID != "u1" || err != nil {
+		t.Errorf("ConsumeAccountToken() of another purpose = %q, %v, want u1", userID, err)
+	}
+	if userID, err := store.ConsumeAccountToken(ctx, PurposePasswordReset, otherUser); userID != "u2" || err != nil {
+		t.Errorf("ConsumeAccountToken() of another user = %q, %v, want u2", userID, err)
+	}
+}
+
+func TestThrottleAccountMail(t *testing.T) {
+	store := NewUserStore(testRedis(t))
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		purpose string
+		userID  string
+		want    bool
+	}{
+		{"first mail", PurposePasswordReset, "u1", true},
+		{"second mail", PurposePasswordReset, "u1", false},
+		{"other purpose", PurposeEmailVerification, "u1", true},
+		{"other user", PurposePasswordReset, "u2", true},
+	}
+	for _, tt := range tests {
+		if got, err := store.ThrottleAccountMail(ctx, tt.purpose, tt.userID, time.Minute); err != nil || got != tt.want {
+			t.Errorf("%s: ThrottleAccountMail() = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package users
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func identityKey(issuer, subject string) string {
+	return "user:identity:" + issuer + "|" + subject
+}
+
+// GetByIdentity returns the user linked to the subject of an identity provider
+func (s *UserStore) GetByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	userID, err := s.redisClient.Get(ctx, identityKey(issuer, subject)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return s.GetByID(ctx, userID)
+}
+
+// LinkIdentity links the subject of an identity provider to a user, so later
+// logins find the user even if the email changes
+func (s *UserStore) LinkIdentity(ctx context.Context, issuer, subject, userID string) error {
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, identityKey(issuer, subject), userID, 0)
+	// Deleting the user removes its links
+	pipe.SAdd(ctx, "user:identities:"+userID, identityKey(issuer, subject))
+	_, err := pipe.Exec(ctx)
+	return err
+}
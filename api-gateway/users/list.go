@@ -0,0 +1,115 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ListOptions filters and pages the user list
+type ListOptions struct {
+	Query  string // part of the email, case-insensitive
+	Offset int
+	Limit  int
+}
+
+// List returns matching users, newest first, and the number of all matches
+func (s *UserStore) List(ctx context.Context, opts ListOptions) ([]*User, int, error) {
+	ids, err := s.redisClient.ZRevRange(ctx, "users:by_created", 0, -1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := strings.ToLower(opts.Query)
+	matches := make([]*User, 0)
+
+	const batchSize = 100
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		keys := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, "user:"+id)
+		}
+
+		values, err := s.redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, value := range values {
+			userJSON, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var storageUser userStorage
+			if err := json.Unmarshal([]byte(userJSON), &storageUser); err != nil {
+				continue
+			}
+			if query != "" && !strings.Contains(strings.ToLower(storageUser.Email), query) {
+				continue
+			}
+			matches = append(matches, &User{
+				ID:            storageUser.ID,
+				Email:         storageUser.Email,
+				Role:          storageUser.Role,
+				Disabled:      storageUser.Disabled,
+				EmailVerified: storageUser.EmailVerified,
+				CreatedAt:     storageUser.CreatedAt,
+				UpdatedAt:     storageUser.UpdatedAt,
+			})
+		}
+	}
+
+	total := len(matches)
+	if opts.Offset >= total {
+		return []*User{}, total, nil
+	}
+	matches = matches[opts.Offset:]
+	if opts.Limit > 0 && len(matches) > opts.Limit {
+		matches = matches[:opts.Limit]
+	}
+
+	return matches, total, nil
+}
+
+// IndexExisting adds users that were created before the user list index existed
+// and returns how many were added
+func (s *UserStore) IndexExisting(ctx context.Context) (int, error) {
+	added := 0
+	iter := s.redisClient.Scan(ctx, 0, "user:email:*", 100).Iterator()
+	for iter.Next(ctx) {
+		userID, err := s.redisClient.Get(ctx, iter.Val()).Result()
+		if err != nil {
+			continue
+		}
+
+		_, err = s.redisClient.ZScore(ctx, "users:by_created", userID).Result()
+		if err == nil {
+			continue
+		}
+		if err != redis.Nil {
+			return added, err
+		}
+
+		user, err := s.GetByID(ctx, userID)
+		if err != nil {
+			continue
+		}
+		err = s.redisClient.ZAdd(ctx, "users:by_created", &redis.Z{
+			Score:  float64(user.CreatedAt.Unix()),
+			Member: user.ID,
+		}).Err()
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, iter.Err()
+}
@@ -14,26 +14,44 @@ var (
 	ErrUserNotFound       = errors.New("user not found")
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrUserAlreadyExists  = errors.New("user already exists")
+	ErrUserDisabled       = errors.New("user is disabled")
 )
 
 // User represents a user in the system (API representation)
 type User struct {
-	ID           string    `json:"id"`
-	Email        string    `json:"email"`
-	Password     string    `json:"-"` // Never return passwords in JSON
-	PasswordHash string    `json:"-"` // Never return password hash in JSON
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	Password      string    `json:"-"` // Never return passwords in JSON
+	PasswordHash  string    `json:"-"` // Never return password hash in JSON
+	Role          string    `json:"role"`
+	Disabled      bool      `json:"disabled"`
+	EmailVerified bool      `json:"email_verified"` // Set by verification and reset links or the identity provider
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 type userStorage struct {
-	ID           string    `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"password_hash"`
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	PasswordHash  string    `json:"password_hash"`
+	Role          string    `json:"role"`
+	Disabled      bool      `json:"disabled,omitempty"`
+	EmailVerified bool      `json:"email_verified,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func newUserStorage(user *User) userStorage {
+	return userStorage{
+		ID:            user.ID,
+		Email:         user.Email,
+		PasswordHash:  user.PasswordHash,
+		Role:          user.Role,
+		Disabled:      user.Disabled,
+		EmailVerified: user.EmailVerified,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
 }
 
 type UserStore struct {
@@ -56,24 +74,18 @@ func (s *UserStore) Create(ctx context.Context, user *User) error {
 		return ErrUserAlreadyExists
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	user.PasswordHash = string(hashedPassword)
-	user.Password = "" // Clear plaintext password
-
-	storageUser := userStorage{
-		ID:           user.ID,
-		Email:        user.Email,
-		PasswordHash: user.PasswordHash,
-		Role:         user.Role,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
+	// Users signing in through an identity provider have no password
+	if user.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(hashedPassword)
+		user.Password = "" // Clear plaintext password
 	}
 
 	// Save user to Redis
-	userJSON, err := json.Marshal(storageUser)
+	userJSON, err := json.Marshal(newUserStorage(user))
 	if err != nil {
 		return err
 	}
@@ -82,10 +94,26 @@ func (s *UserStore) Create(ctx context.Context, user *User) error {
 	pipe := s.redisClient.Pipeline()
 	pipe.Set(ctx, "user:"+user.ID, userJSON, 0) // 0 = no expiration
 	pipe.Set(ctx, "user:email:"+user.Email, user.ID, 0)
+	pipe.ZAdd(ctx, "users:by_created", &redis.Z{
+		Score:  float64(user.CreatedAt.Unix()),
+		Member: user.ID,
+	})
 	_, err = pipe.Exec(ctx)
 	return err
 }
 
+// Update saves role, flags and password hash of an existing user
+func (s *UserStore) Update(ctx context.Context, user *User) error {
+	user.UpdatedAt = time.Now()
+
+	userJSON, err := json.Marshal(newUserStorage(user))
+	if err != nil {
+		return err
+	}
+
+	return s.redisClient.Set(ctx, "user:"+user.ID, userJSON, 0).Err()
+}
+
 // GetByEmail retrieves a user by email
 func (s *UserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
 	userID, err := s.redisClient.Get(ctx, "user:email:"+email).Result()
@@ -115,12 +143,14 @@ func (s *UserStore) GetByID(ctx context.Context, id string) (*User, error) {
 	}
 
 	user := &User{
-		ID:           storageUser.ID,
-		Email:        storageUser.Email,
-		PasswordHash: storageUser.PasswordHash,
-		Role:         storageUser.Role,
-		CreatedAt:    storageUser.CreatedAt,
-		UpdatedAt:    storageUser.UpdatedAt,
+		ID:            storageUser.ID,
+		Email:         storageUser.Email,
+		PasswordHash:  storageUser.PasswordHash,
+		Role:          storageUser.Role,
+		Disabled:      storageUser.Disabled,
+		EmailVerified: storageUser.EmailVerified,
+		CreatedAt:     storageUser.CreatedAt,
+		UpdatedAt:     storageUser.UpdatedAt,
 	}
 
 	return user, nil
@@ -132,10 +162,58 @@ func (s *UserStore) Authenticate(ctx context.Context, email, password string) (*
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
-	if err != nil {
-		return nil, ErrInvalidCredentials
+	if err := user.CheckPassword(password); err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, ErrUserDisabled
 	}
 
 	return user, nil
 }
+
+// HasPassword reports whether the user can log in with a password; users
+// created through SSO have none until they reset it
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// CheckPassword returns ErrInvalidCredentials unless password is the user's
+func (u *User) CheckPassword(password string) error {
+	if !u.HasPassword() {
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// SetPassword replaces the user's password
+func (s *UserStore) SetPassword(ctx context.Context, user *User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hashedPassword)
+	return s.Update(ctx, user)
+}
+
+// Delete removes the user, its email and its links to identity providers
+func (s *UserStore) Delete(ctx context.Context, user *User) error {
+	identities, err := s.redisClient.SMembers(ctx, "user:identities:"+user.ID).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "user:"+user.ID, "user:identities:"+user.ID)
+	pipe.Del(ctx, "user:email:"+user.Email)
+	pipe.ZRem(ctx, "users:by_created", user.ID)
+	for _, identity := range identities {
+		pipe.Del(ctx, identity)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,462 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Roles of organisation members, each including the ones below it
+const (
+	OrgRoleOwner      = "owner"      // manages members, invitations and the organisation
+	OrgRoleMaintainer = "maintainer" // creates, changes and builds the organisation's projects
+	OrgRoleViewer     = "viewer"     // sees the organisation's projects, builds and artifacts
+)
+
+var orgRoleRank = map[string]int{
+	OrgRoleViewer:     1,
+	OrgRoleMaintainer: 2,
+	OrgRoleOwner:      3,
+}
+
+// InvitationTTL is how long an invitation can be accepted
+const InvitationTTL = 7 * 24 * time.Hour
+
+var (
+	ErrOrgNotFound        = errors.New("organisation not found")
+	ErrInvalidOrgName     = errors.New("organisation name is required")
+	ErrInvalidOrgRole     = errors.New("role must be owner, maintainer or viewer")
+	ErrNotMember          = errors.New("user is not a member of the organisation")
+	ErrAlreadyMember      = errors.New("user is already a member of the organisation")
+	ErrLastOwner          = errors.New("an organisation needs at least one owner")
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrEmailNotVerified   = errors.New("verify your email address to see and accept invitations")
+)
+
+// ValidOrgRole reports whether role is a membership role
+func ValidOrgRole(role string) bool {
+	return orgRoleRank[role] > 0
+}
+
+// OrgRoleAtLeast reports whether role grants everything min grants. The empty
+// role of non-members grants nothing.
+func OrgRoleAtLeast(role, min string) bool {
+	return role != "" && orgRoleRank[role] >= orgRoleRank[min]
+}
+
+// Organisation groups users who share projects, builds and artifacts. Its ID
+// is the team ID in access tokens and in the builds shared with it.
+type Organisation struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Member struct {
+	UserID   string    `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Invitation lets the user with Email join an organisation with Role
+type Invitation struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// OrgStore keeps organisations, their members and pending invitations
+type OrgStore struct {
+	redisClient *redis.Client
+}
+
+func NewOrgStore(redisClient *redis.Client) *OrgStore {
+	return &OrgStore{
+		redisClient: redisClient,
+	}
+}
+
+// Create creates an organisation with ownerID as its first owner
+func (s *OrgStore) Create(ctx context.Context, name, ownerID string) (*Organisation, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrInvalidOrgName
+	}
+
+	org := &Organisation{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	orgJSON, err := json.Marshal(org)
+	if err != nil {
+		return nil, err
+	}
+	memberJSON, err := json.Marshal(Member{UserID: ownerID, Role: OrgRoleOwner, JoinedAt: org.CreatedAt})
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, "org:"+org.ID, orgJSON, 0)
+	pipe.HSet(ctx, "org:members:"+org.ID, ownerID, memberJSON)
+	pipe.SAdd(ctx, "user:orgs:"+ownerID, org.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (s *OrgStore) Get(ctx context.Context, id string) (*Organisation, error) {
+	orgJSON, err := s.redisClient.Get(ctx, "org:"+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrOrgNotFound
+		}
+		return nil, err
+	}
+
+	var org Organisation
+	if err := json.Unmarshal([]byte(orgJSON), &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// Delete removes an organisation with its memberships and invitations
+func (s *OrgStore) Delete(ctx context.Context, id string) error {
+	members, err := s.redisClient.HKeys(ctx, "org:members:"+id).Result()
+	if err != nil {
+		return err
+	}
+	invitations, err := s.Invitations(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "org:"+id, "org:members:"+id, "org:invitations:"+id)
+	for _, userID := range members {
+		pipe.SRem(ctx, "user:orgs:"+userID, id)
+	}
+	for _, invitation := range invitations {
+		pipe.Del(ctx, "org:invitation:"+invitation.ID)
+		pipe.SRem(ctx, "user:invitations:"+invitation.Email, invitation.ID)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// OrgIDs returns the organisations the user is a member of
+func (s *OrgStore) OrgIDs(ctx context.Context, userID string) ([]string, error) {
+	return s.redisClient.SMembers(ctx, "user:orgs:"+userID).Result()
+}
+
+// Role returns the user's role in the organisation, or "" if the user is no member
+func (s *OrgStore) Role(ctx context.Context, orgID, userID string) (string, error) {
+	member, err := s.member(ctx, orgID, userID)
+	if err == ErrNotMember {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+func (s *OrgStore) member(ctx context.Context, orgID, userID string) (*Member, error) {
+	memberJSON, err := s.redisClient.HGet(ctx, "org:members:"+orgID, userID).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrNotMember
+		}
+		return nil, err
+	}
+
+	var member Member
+	if err := json.Unmarshal([]byte(memberJSON), &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Members returns the members of an organisation
+func (s *OrgStore) Members(ctx context.Context, orgID string) ([]*Member, error) {
+	values, err := s.redisClient.HGetAll(ctx, "org:members:"+orgID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]*Member, 0, len(values))
+	for _, memberJSON := range values {
+		var member Member
+		if err := json.Unmarshal([]byte(memberJSON), &member); err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+	return members, nil
+}
+
+// SetRole changes the role of a member
+func (s *OrgStore) SetRole(ctx context.Context, orgID, userID, role string) error {
+	if !ValidOrgRole(role) {
+		return ErrInvalidOrgRole
+	}
+	member, err := s.member(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member.Role == OrgRoleOwner && role != OrgRoleOwner {
+		if err := s.checkOtherOwner(ctx, orgID, userID); err != nil {
+			return err
+		}
+	}
+
+	member.Role = role
+	memberJSON, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.HSet(ctx, "org:members:"+orgID, userID, memberJSON).Err()
+}
+
+// RemoveMember removes a user from an organisation
+func (s *OrgStore) RemoveMember(ctx context.Context, orgID, userID string) error {
+	member, err := s.member(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member.Role == OrgRoleOwner {
+		if err := s.checkOtherOwner(ctx, orgID, userID); err != nil {
+			return err
+		}
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.HDel(ctx, "org:members:"+orgID, userID)
+	pipe.SRem(ctx, "user:orgs:"+userID, orgID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// LeaveAll removes the user from all organisations and returns the memberships
+// it ended by organisation ID, for Rejoin. It fails with ErrLastOwner, naming
+// the organisation, before removing anything if the user is the only owner of
+// one.
+func (s *OrgStore) LeaveAll(ctx context.Context, userID string) (map[string]*Member, error) {
+	orgIDs, err := s.OrgIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	memberships := make(map[string]*Member, len(orgIDs))
+	for _, orgID := range orgIDs {
+		member, err := s.member(ctx, orgID, userID)
+		if err == ErrNotMember {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		memberships[orgID] = member
+		if member.Role != OrgRoleOwner {
+			continue
+		}
+		if err := s.checkOtherOwner(ctx, orgID, userID); err == ErrLastOwner {
+			org, err := s.Get(ctx, orgID)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %s", ErrLastOwner, org.Name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	for _, orgID := range orgIDs {
+		pipe.HDel(ctx, "org:members:"+orgID, userID)
+	}
+	pipe.Del(ctx, "user:orgs:"+userID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// Rejoin restores the memberships LeaveAll ended, in the organisations that
+// still exist
+func (s *OrgStore) Rejoin(ctx context.Context, userID string, memberships map[string]*Member) error {
+	pipe := s.redisClient.TxPipeline()
+	for orgID, member := range memberships {
+		if _, err := s.Get(ctx, orgID); err == ErrOrgNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		memberJSON, err := json.Marshal(member)
+		if err != nil {
+			return err
+		}
+		pipe.HSet(ctx, "org:members:"+orgID, userID, memberJSON)
+		pipe.SAdd(ctx, "user:orgs:"+userID, orgID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// checkOtherOwner returns ErrLastOwner unless someone besides userID owns the organisation
+func (s *OrgStore) checkOtherOwner(ctx context.Context, orgID, userID string) error {
+	members, err := s.Members(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.UserID != userID && member.Role == OrgRoleOwner {
+			return nil
+		}
+	}
+	return ErrLastOwner
+}
+
+// Invite creates an invitation for email to join the organisation with role
+func (s *OrgStore) Invite(ctx context.Context, orgID, email, role, invitedBy string) (*Invitation, error) {
+	if !ValidOrgRole(role) {
+		return nil, ErrInvalidOrgRole
+	}
+
+	now := time.Now()
+	invitation := &Invitation{
+		ID:        uuid.New().String(),
+		OrgID:     orgID,
+		Email:     strings.ToLower(email),
+		Role:      role,
+		InvitedBy: invitedBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InvitationTTL),
+	}
+	invitationJSON, err := json.Marshal(invitation)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, "org:invitation:"+invitation.ID, invitationJSON, InvitationTTL)
+	pipe.SAdd(ctx, "org:invitations:"+orgID, invitation.ID)
+	pipe.SAdd(ctx, "user:invitations:"+invitation.Email, invitation.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (s *OrgStore) GetInvitation(ctx context.Context, id string) (*Invitation, error) {
+	invitationJSON, err := s.redisClient.Get(ctx, "org:invitation:"+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, err
+	}
+
+	var invitation Invitation
+	if err := json.Unmarshal([]byte(invitationJSON), &invitation); err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// Invitations returns the pending invitations of an organisation
+func (s *OrgStore) Invitations(ctx context.Context, orgID string) ([]*Invitation, error) {
+	return s.invitations(ctx, "org:invitations:"+orgID)
+}
+
+// InvitationsFor returns the pending invitations sent to email
+func (s *OrgStore) InvitationsFor(ctx context.Context, email string) ([]*Invitation, error) {
+	return s.invitations(ctx, "user:invitations:"+strings.ToLower(email))
+}
+
+// invitations loads the invitations in the index set key and drops expired ones from it
+func (s *OrgStore) invitations(ctx context.Context, key string) ([]*Invitation, error) {
+	ids, err := s.redisClient.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	invitations := make([]*Invitation, 0, len(ids))
+	for _, id := range ids {
+		invitation, err := s.GetInvitation(ctx, id)
+		if err == ErrInvitationNotFound {
+			s.redisClient.SRem(ctx, key, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, nil
+}
+
+// DeleteInvitation revokes or declines an invitation
+func (s *OrgStore) DeleteInvitation(ctx context.Context, invitation *Invitation) error {
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "org:invitation:"+invitation.ID)
+	pipe.SRem(ctx, "org:invitations:"+invitation.OrgID, invitation.ID)
+	pipe.SRem(ctx, "user:invitations:"+invitation.Email, invitation.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// AcceptInvitation makes the user a member with the invitation's role. Only
+// the user the invitation was sent to can accept it, once they verified that
+// the email address is theirs.
+func (s *OrgStore) AcceptInvitation(ctx context.Context, id string, user *User) (*Member, error) {
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	invitation, err := s.GetInvitation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		return nil, ErrInvitationNotFound
+	}
+	userID := user.ID
+	if _, err := s.Get(ctx, invitation.OrgID); err != nil {
+		return nil, err
+	}
+	if _, err := s.member(ctx, invitation.OrgID, userID); err != ErrNotMember {
+		if err == nil {
+			err = ErrAlreadyMember
+		}
+		return nil, err
+	}
+
+	member := &Member{UserID: userID, Role: invitation.Role, JoinedAt: time.Now()}
+	memberJSON, err := json.Marshal(member)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.HSet(ctx, "org:members:"+invitation.OrgID, userID, memberJSON)
+	pipe.SAdd(ctx, "user:orgs:"+userID, invitation.OrgID)
+	pipe.Del(ctx, "org:invitation:"+invitation.ID)
+	pipe.SRem(ctx, "org:invitations:"+invitation.OrgID, invitation.ID)
+	pipe.SRem(ctx, "user:invitations:"+invitation.Email, invitation.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
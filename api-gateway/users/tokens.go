@@ -0,0 +1,191 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"gobuild/api-gateway/auth"
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
+// PersonalToken is a named, scoped and expiring token a user creates for CI jobs
+// and scripts. Only the SHA-256 hash of the token itself is stored.
+type PersonalToken struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type personalTokenStorage struct {
+	PersonalToken
+	Hash string `json:"hash"`
+}
+
+type TokenStore struct {
+	redisClient *redis.Client
+}
+
+func NewTokenStore(redisClient *redis.Client) *TokenStore {
+	return &TokenStore{
+		redisClient: redisClient,
+	}
+}
+
+func hashPersonalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new token and returns it in plain text; it cannot be retrieved later
+func (s *TokenStore) Create(ctx context.Context, userID, name string, scopes []string, ttl time.Duration) (string, *PersonalToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	plaintext := auth.PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	stored := personalTokenStorage{
+		PersonalToken: PersonalToken{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			Name:      name,
+			Scopes:    scopes,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		Hash: hashPersonalToken(plaintext),
+	}
+
+	tokenJSON, err := json.Marshal(stored)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Both keys expire together with the token
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, "pat:"+stored.ID, tokenJSON, ttl)
+	pipe.Set(ctx, "pat:hash:"+stored.Hash, stored.ID, ttl)
+	pipe.SAdd(ctx, "user:pats:"+userID, stored.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", nil, err
+	}
+
+	return plaintext, &stored.PersonalToken, nil
+}
+
+func (s *TokenStore) get(ctx context.Context, id string) (*personalTokenStorage, error) {
+	tokenJSON, err := s.redisClient.Get(ctx, "pat:"+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	var stored personalTokenStorage
+	if err := json.Unmarshal([]byte(tokenJSON), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// List returns the user's tokens that have not expired or been revoked
+func (s *TokenStore) List(ctx context.Context, userID string) ([]*PersonalToken, error) {
+	ids, err := s.redisClient.SMembers(ctx, "user:pats:"+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*PersonalToken, 0, len(ids))
+	for _, id := range ids {
+		stored, err := s.get(ctx, id)
+		if err == ErrTokenNotFound {
+			// Expired, drop it from the index
+			s.redisClient.SRem(ctx, "user:pats:"+userID, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &stored.PersonalToken)
+	}
+
+	return tokens, nil
+}
+
+// Revoke deletes a token of the user
+func (s *TokenStore) Revoke(ctx context.Context, userID, id string) error {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if stored.UserID != userID {
+		return ErrTokenNotFound
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "pat:"+id, "pat:hash:"+stored.Hash)
+	pipe.SRem(ctx, "user:pats:"+userID, id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// RevokeAll deletes every token of the user
+func (s *TokenStore) RevokeAll(ctx context.Context, userID string) error {
+	ids, err := s.redisClient.SMembers(ctx, "user:pats:"+userID).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	for _, id := range ids {
+		stored, err := s.get(ctx, id)
+		if err == ErrTokenNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pipe.Del(ctx, "pat:"+id, "pat:hash:"+stored.Hash)
+	}
+	pipe.Del(ctx, "user:pats:"+userID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Authenticate returns the token matching plaintext
+func (s *TokenStore) Authenticate(ctx context.Context, plaintext string) (*PersonalToken, error) {
+	id, err := s.redisClient.Get(ctx, "pat:hash:"+hashPersonalToken(plaintext)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return &stored.PersonalToken, nil
+}
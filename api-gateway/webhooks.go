@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gobuild/api-gateway/auth"
+	"gobuild/api-gateway/projects"
+	"gobuild/api-gateway/quota"
+	"gobuild/api-gateway/secrets"
+	"gobuild/api-gateway/users"
+	"gobuild/api-gateway/webhooks"
+	"gobuild/shared/audit"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/repository"
+)
+
+// maxWebhookBody limits the size of webhook payloads; pushes with many commits stay well below
+const maxWebhookBody = 5 << 20
+
+// CreateWebhookRequest names either a repository or a project whose repository is built
+type CreateWebhookRequest struct {
+	RepositoryURL string `json:"repository_url"`
+	ProjectID     string `json:"project_id"`
+}
+
+type CreateWebhookResponse struct {
+	*webhooks.Hook
+	// Secret is only returned once, configure it as webhook secret (GitHub) or token (GitLab)
+	Secret string `json:"secret"`
+	Path   string `json:"path"`
+}
+
+type WebhookResponse struct {
+	Status     string `json:"status"`
+	BuildID    string `json:"build_id,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	CommitHash string `json:"commit_hash,omitempty"`
+}
+
+// WebhookAPI manages webhooks and turns signed push deliveries into builds
+type WebhookAPI struct {
+	hooks         *webhooks.Store
+	userStore     *users.UserStore
+	projects      *ProjectAPI
+	quotas        *quota.Store
+	repoPolicy    *repository.Policy
+	secrets       *secrets.Store
+	kafkaProducer kafka.Publisher
+	audit         *audit.Recorder
+}
+
+func NewWebhookAPI(hooks *webhooks.Store, userStore *users.UserStore, projectAPI *ProjectAPI, quotas *quota.Store, repoPolicy *repository.Policy, secretStore *secrets.Store, kafkaProducer kafka.Publisher, recorder *audit.Recorder) *WebhookAPI {
+	return &WebhookAPI{
+		hooks:         hooks,
+		userStore:     userStore,
+		projects:      projectAPI,
+		quotas:        quotas,
+		repoPolicy:    repoPolicy,
+		secrets:       secretStore,
+		kafkaProducer: kafkaProducer,
+		audit:         recorder,
+	}
+}
+
+// RegisterRoutes adds the webhook management endpoints and the public receiver
+// below /api/hooks, which AuthMiddleware lets through
+func (a *WebhookAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/webhooks", a.CreateHook).Methods("POST")
+	r.HandleFunc("/api/webhooks", a.ListHooks).Methods("GET")
+	r.HandleFunc("/api/webhooks/{hookId}", a.DeleteHook).Methods("DELETE")
+
+	r.HandleFunc("/api/hooks/{hookId}", a.Receive).Methods("POST")
+}
+
+func (a *WebhookAPI) CreateHook(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeBuildsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ProjectID != "" {
+		project := a.projects.loadProject(w, r, userClaims, req.ProjectID, users.OrgRoleMaintainer)
+		if project == nil {
+			return
+		}
+		req.RepositoryURL = project.RepositoryURL
+	}
+
+	repositoryURL, err := a.repoPolicy.Normalize(req.RepositoryURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hook, secret, err := a.hooks.Create(r.Context(), userClaims.ID, repositoryURL, req.ProjectID)
+	if err != nil {
+		log.Printf("❌ Failed to create webhook: %v", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🪝 %s created webhook %s for %s", userClaims.Email, hook.ID, repositoryURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateWebhookResponse{
+		Hook:   hook,
+		Secret: secret,
+		Path:   "/api/hooks/" + hook.ID,
+	})
+}
+
+func (a *WebhookAPI) ListHooks(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := auth.UserClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	hooks, err := a.hooks.List(r.Context(), userClaims.ID)
+	if err != nil {
+		log.Printf("❌ Failed to list webhooks: %v", err)
+		http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func (a *WebhookAPI) DeleteHook(w http.ResponseWriter, r *http.Request) {
+	userClaims := scopedClaims(w, r, auth.ScopeBuildsWrite)
+	if userClaims == nil {
+		return
+	}
+
+	err := a.hooks.Delete(r.Context(), userClaims.ID, mux.Vars(r)["hookId"])
+	if err == webhooks.ErrHookNotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to delete webhook: %v", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Receive handles a push delivery: it verifies the signature with the hook's
+// secret, drops redeliveries by delivery ID and queues a build of the pushed
+// commit for the hook's owner
+func (a *WebhookAPI) Receive(w http.ResponseWriter, r *http.Request) {
+	hookID := mux.Vars(r)["hookId"]
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	hook, secret, err := a.hooks.GetWithSecret(r.Context(), hookID)
+	if err == webhooks.ErrHookNotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load webhook %s: %v", hookID, err)
+		http.Error(w, "Failed to load webhook", http.StatusInternalServerError)
+		return
+	}
+
+	delivery, err := webhooks.Verify(r.Header, body, secret)
+	if errors.Is(err, webhooks.ErrMissingSignature) || errors.Is(err, webhooks.ErrInvalidSignature) {
+		log.Printf("🚫 Rejected delivery for webhook %s: %v", hookID, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	push, err := webhooks.ParsePush(delivery, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if push == nil {
+		writeWebhookResponse(w, http.StatusOK, WebhookResponse{Status: "ignored"})
+		return
+	}
+
+	claimed, err := a.hooks.ClaimDelivery(r.Context(), hookID, delivery.ID)
+	if err != nil {
+		log.Printf("❌ Failed to record delivery %s: %v", delivery.ID, err)
+		http.Error(w, "Failed to record delivery", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		log.Printf("🔁 Ignoring duplicate delivery %s for webhook %s", delivery.ID, hookID)
+		writeWebhookResponse(w, http.StatusOK, WebhookResponse{Status: "duplicate"})
+		return
+	}
+
+	buildID, ok := a.queueBuild(w, r, hook, push)
+	if !ok {
+		// Let the provider's redelivery try again
+		a.hooks.ReleaseDelivery(context.Background(), hookID, delivery.ID)
+		return
+	}
+
+	log.Printf("🪝 %s push to %s queued build %s", delivery.Provider, push.Ref, buildID)
+	writeWebhookResponse(w, http.StatusAccepted, WebhookResponse{
+		Status:     "queued",
+		BuildID:    buildID,
+		Ref:        push.Ref,
+		CommitHash: push.CommitHash,
+	})
+}
+
+// queueBuild queues a build of push for the hook's owner, subject to the owner's
+// quotas. It writes an error response and returns false if that failed.
+func (a *WebhookAPI) queueBuild(w http.ResponseWriter, r *http.Request, hook *webhooks.Hook, push *webhooks.Push) (string, bool) {
+	owner, err := a.userStore.GetByID(r.Context(), hook.UserID)
+	if err == users.ErrUserNotFound || (err == nil && owner.Disabled) {
+		http.Error(w, "Webhook owner is disabled or deleted", http.StatusForbidden)
+		return "", false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load webhook owner %s: %v", hook.UserID, err)
+		http.Error(w, "Failed to load webhook owner", http.StatusInternalServerError)
+		return "", false
+	}
+
+	// Project hooks follow the project's current repository
+	repositoryURL := hook.RepositoryURL
+	var project *projects.Project
+	if hook.ProjectID != "" {
+		project, err = a.projects.projects.Get(r.Context(), hook.ProjectID)
+		if err == projects.ErrProjectNotFound {
+			http.Error(w, "Webhook project was deleted", http.StatusGone)
+			return "", false
+		}
+		if err != nil {
+			log.Printf("❌ Failed to load webhook project %s: %v", hook.ProjectID, err)
+			http.Error(w, "Failed to load webhook project", http.StatusInternalServerError)
+			return "", false
+		}
+
+		// The owner may have left the project's organisation since
+		ownerClaims := &auth.UserClaims{ID: owner.ID, Email: owner.Email, Role: owner.Role}
+		role, err := a.projects.projectRole(r.Context(), ownerClaims, project)
+		if err != nil {
+			log.Printf("❌ Failed to load webhook owner's role on %s: %v", hook.ProjectID, err)
+			http.Error(w, "Failed to load webhook project", http.StatusInternalServerError)
+			return "", false
+		}
+		if !users.OrgRoleAtLeast(role, users.OrgRoleMaintainer) {
+			http.Error(w, "Webhook owner may no longer build the project", http.StatusForbidden)
+			return "", false
+		}
+		repositoryURL = project.RepositoryURL
+	}
+
+	// The allowlist may have changed since the hook was created
+	repositoryURL, err = a.repoPolicy.Normalize(repositoryURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+
+	buildID := uuid.New().String()
+
+	buildMsg := message.BuildRequestMessage{
+		ID:            buildID,
+		RepositoryURL: repositoryURL,
+		Branch:        push.Name,
+		CommitHash:    push.CommitHash,
+		UserID:        owner.ID,
+		CreatedAt:     time.Now(),
+	}
+	if project != nil {
+		if err := applyProject(&buildMsg, project); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return "", false
+		}
+	}
+	limits, err := a.quotas.Limits(r.Context(), owner.ID, owner.Role)
+	if err != nil {
+		writeQuotaError(w, err)
+		return "", false
+	}
+	if err := a.quotas.Admit(r.Context(), owner.ID, buildID, limits); err != nil {
+		writeQuotaError(w, err)
+		return "", false
+	}
+	if err := issueSecretsToken(r.Context(), a.secrets, &buildMsg); err != nil {
+		log.Printf("❌ Failed to issue secrets token for build %s: %v", buildID, err)
+		a.quotas.Withdraw(context.Background(), owner.ID, buildID)
+		http.Error(w, "Failed to queue build", http.StatusInternalServerError)
+		return "", false
+	}
+
+	sendCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	if err := a.kafkaProducer.SendMessageSync(sendCtx, kafka.TopicBuildRequests, buildID, buildMsg); err != nil {
+		log.Printf("❌ Failed to send build request to Kafka: %v", err)
+		revokeSecretsToken(a.secrets, &buildMsg)
+		a.quotas.Withdraw(context.Background(), owner.ID, buildID)
+		http.Error(w, "Failed to queue build", http.StatusServiceUnavailable)
+		return "", false
+	}
+
+	details := map[string]string{"trigger": "webhook", "webhook_id": hook.ID, "repository_url": repositoryURL}
+	if project != nil {
+		details["project_id"] = project.ID
+	}
+	a.audit.Record(r, message.AuditEventMessage{
+		Action:     audit.ActionBuildSubmit,
+		ActorID:    owner.ID,
+		ActorEmail: owner.Email,
+		TargetType: audit.TargetBuild,
+		TargetID:   buildID,
+		Details:    details,
+	})
+
+	return buildID, true
+}
+
+func writeWebhookResponse(w http.ResponseWriter, status int, resp WebhookResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
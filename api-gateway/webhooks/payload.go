@@ -0,0 +1,147 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gobuild/shared/repository"
+)
+
+// Providers whose webhooks are understood
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+)
+
+var (
+	ErrUnknownProvider   = errors.New("neither a GitHub nor a GitLab webhook")
+	ErrMissingSignature  = errors.New("missing webhook signature")
+	ErrInvalidSignature  = errors.New("invalid webhook signature")
+	ErrMissingDeliveryID = errors.New("missing delivery ID")
+	ErrInvalidPayload    = errors.New("invalid push payload")
+)
+
+// commitHash matches full SHA-1 and SHA-256 object names
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// Delivery describes a webhook request whose signature was verified
+type Delivery struct {
+	Provider string
+	ID       string
+	Event    string
+}
+
+// Push is a pushed branch or tag
+type Push struct {
+	Ref        string // full ref, e.g. refs/heads/main
+	Name       string // branch or tag name
+	Tag        bool
+	CommitHash string
+}
+
+// Verify checks that the request was sent by the provider holding secret.
+// GitHub signs the body with HMAC-SHA256 (X-Hub-Signature-256); GitLab sends
+// the secret itself as X-Gitlab-Token.
+func Verify(header http.Header, body []byte, secret string) (*Delivery, error) {
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return nil, ErrMissingSignature
+		}
+		expected, err := hex.DecodeString(signature)
+		if err != nil {
+			return nil, ErrInvalidSignature
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), expected) {
+			return nil, ErrInvalidSignature
+		}
+		return newDelivery(ProviderGitHub, header.Get("X-GitHub-Delivery"), header.Get("X-GitHub-Event"))
+
+	case header.Get("X-Gitlab-Event") != "":
+		token := header.Get("X-Gitlab-Token")
+		if token == "" {
+			return nil, ErrMissingSignature
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, ErrInvalidSignature
+		}
+		return newDelivery(ProviderGitLab, header.Get("X-Gitlab-Event-UUID"), header.Get("X-Gitlab-Event"))
+	}
+
+	return nil, ErrUnknownProvider
+}
+
+func newDelivery(provider, id, event string) (*Delivery, error) {
+	if id == "" {
+		return nil, ErrMissingDeliveryID
+	}
+	return &Delivery{Provider: provider, ID: id, Event: event}, nil
+}
+
+// pushPayload holds the fields GitHub and GitLab push events have in common
+type pushPayload struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+	// GitHub only; for annotated tags After is the tag object, head_commit the commit
+	Deleted    bool `json:"deleted"`
+	HeadCommit *struct {
+		ID string `json:"id"`
+	} `json:"head_commit"`
+	// GitLab only, null when a branch was deleted
+	CheckoutSHA *string `json:"checkout_sha"`
+}
+
+// ParsePush returns the pushed ref of a push or tag event. It returns nil for
+// other events (e.g. GitHub's ping) and for deleted branches and tags.
+func ParsePush(delivery *Delivery, body []byte) (*Push, error) {
+	switch delivery.Event {
+	case "push", "Push Hook", "Tag Push Hook":
+	default:
+		return nil, nil
+	}
+
+	var payload pushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	if payload.Deleted || strings.Trim(payload.After, "0") == "" {
+		return nil, nil
+	}
+	commit := payload.After
+	if payload.HeadCommit != nil && payload.HeadCommit.ID != "" {
+		commit = payload.HeadCommit.ID
+	}
+	if delivery.Provider == ProviderGitLab && payload.CheckoutSHA != nil {
+		commit = *payload.CheckoutSHA
+	}
+	if !commitHash.MatchString(commit) {
+		return nil, fmt.Errorf("%w: invalid commit hash %q", ErrInvalidPayload, commit)
+	}
+
+	push := &Push{Ref: payload.Ref, CommitHash: commit}
+	if name, ok := strings.CutPrefix(payload.Ref, "refs/heads/"); ok {
+		push.Name = name
+	} else if name, ok := strings.CutPrefix(payload.Ref, "refs/tags/"); ok {
+		push.Name = name
+		push.Tag = true
+	} else {
+		return nil, fmt.Errorf("%w: unsupported ref %q", ErrInvalidPayload, payload.Ref)
+	}
+	if !repository.ValidRefName(push.Name) {
+		return nil, fmt.Errorf("%w: invalid ref %q", ErrInvalidPayload, payload.Ref)
+	}
+
+	return push, nil
+}
@@ -0,0 +1,133 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func githubSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "webhook-secret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		want    *Delivery
+		wantErr error
+	}{
+		{
+			name:   "github",
+			header: map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "d1", "X-Hub-Signature-256": githubSignature(secret, body)},
+			want:   &Delivery{Provider: ProviderGitHub, ID: "d1", Event: "push"},
+		},
+		{
+			name:    "github wrong secret",
+			header:  map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "d1", "X-Hub-Signature-256": githubSignature("other", body)},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "github signature of another body",
+			header:  map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "d1", "X-Hub-Signature-256": githubSignature(secret, []byte(`{}`))},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "github signature not hex",
+			header:  map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "d1", "X-Hub-Signature-256": "sha256=zz"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "github SHA-1 signature only",
+			header:  map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "d1", "X-Hub-Signature": "sha1=0123"},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name:    "github without delivery ID",
+			header:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": githubSignature(secret, body)},
+			wantErr: ErrMissingDeliveryID,
+		},
+		{
+			name:   "gitlab",
+			header: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Event-UUID": "d2", "X-Gitlab-Token": secret},
+			want:   &Delivery{Provider: ProviderGitLab, ID: "d2", Event: "Push Hook"},
+		},
+		{
+			name:    "gitlab wrong token",
+			header:  map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Event-UUID": "d2", "X-Gitlab-Token": "other"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "gitlab without token",
+			header:  map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Event-UUID": "d2"},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name:    "unknown provider",
+			header:  map[string]string{"X-Hub-Signature-256": githubSignature(secret, body)},
+			wantErr: ErrUnknownProvider,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			got, err := Verify(header, body, secret)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.want != nil && *got != *tt.want {
+				t.Errorf("Verify() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePush(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const tagObject = "89abcdef0123456789abcdef0123456789abcdef"
+	github := &Delivery{Provider: ProviderGitHub, ID: "d", Event: "push"}
+	gitlab := &Delivery{Provider: ProviderGitLab, ID: "d", Event: "Tag Push Hook"}
+
+	tests := []struct {
+		name     string
+		delivery *Delivery
+		body     string
+		want     *Push
+		wantErr  error
+	}{
+		{"branch", github, `{"ref":"refs/heads/main","after":"` + commit + `"}`, &Push{Ref: "refs/heads/main", Name: "main", CommitHash: commit}, nil},
+		{"annotated tag uses the head commit", github, `{"ref":"refs/tags/v1","after":"` + tagObject + `","head_commit":{"id":"` + commit + `"}}`, &Push{Ref: "refs/tags/v1", Name: "v1", Tag: true, CommitHash: commit}, nil},
+		{"gitlab tag uses checkout_sha", gitlab, `{"ref":"refs/tags/v1","after":"` + tagObject + `","checkout_sha":"` + commit + `"}`, &Push{Ref: "refs/tags/v1", Name: "v1", Tag: true, CommitHash: commit}, nil},
+		{"deleted branch", github, `{"ref":"refs/heads/main","after":"0000000000000000000000000000000000000000","deleted":true}`, nil, nil},
+		{"ping", &Delivery{Provider: ProviderGitHub, ID: "d", Event: "ping"}, `{}`, nil, nil},
+		{"option as branch", github, `{"ref":"refs/heads/--upload-pack=x","after":"` + commit + `"}`, nil, ErrInvalidPayload},
+		{"malformed branch", github, `{"ref":"refs/heads/a..b","after":"` + commit + `"}`, nil, ErrInvalidPayload},
+		{"other ref", github, `{"ref":"refs/notes/commits","after":"` + commit + `"}`, nil, ErrInvalidPayload},
+		{"invalid commit", github, `{"ref":"refs/heads/main","after":"--help"}`, nil, ErrInvalidPayload},
+		{"invalid JSON", github, `{`, nil, ErrInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePush(tt.delivery, []byte(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParsePush() error = %v, want %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("ParsePush() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Package webhooks stores webhook registrations and verifies and parses the
+// push events GitHub and GitLab deliver to them
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// deliveryTTL is how long delivery IDs are remembered to drop redeliveries
+const deliveryTTL = 7 * 24 * time.Hour
+
+var ErrHookNotFound = errors.New("webhook not found")
+
+// Hook triggers builds of a repository, or of a project's repository, for its
+// owner. The secret is only returned when the hook is created.
+type Hook struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	RepositoryURL string    `json:"repository_url"`
+	ProjectID     string    `json:"project_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type hookStorage struct {
+	Hook
+	Secret string `json:"secret"`
+}
+
+type Store struct {
+	redisClient *redis.Client
+}
+
+func NewStore(redisClient *redis.Client) *Store {
+	return &Store{
+		redisClient: redisClient,
+	}
+}
+
+// Create registers a hook and returns it together with its secret. projectID
+// may be empty.
+func (s *Store) Create(ctx context.Context, userID, repositoryURL, projectID string) (*Hook, string, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+
+	stored := hookStorage{
+		Hook: Hook{
+			ID:            uuid.New().String(),
+			UserID:        userID,
+			RepositoryURL: repositoryURL,
+			ProjectID:     projectID,
+			CreatedAt:     time.Now(),
+		},
+		Secret: hex.EncodeToString(secretBytes),
+	}
+
+	hookJSON, err := json.Marshal(stored)
+	if err != nil {
+		return nil, "", err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(ctx, "webhook:"+stored.ID, hookJSON, 0)
+	pipe.SAdd(ctx, "user:webhooks:"+userID, stored.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, "", err
+	}
+
+	return &stored.Hook, stored.Secret, nil
+}
+
+func (s *Store) get(ctx context.Context, id string) (*hookStorage, error) {
+	hookJSON, err := s.redisClient.Get(ctx, "webhook:"+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrHookNotFound
+		}
+		return nil, err
+	}
+
+	var stored hookStorage
+	if err := json.Unmarshal([]byte(hookJSON), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// GetWithSecret returns a hook and its secret for verifying a delivery
+func (s *Store) GetWithSecret(ctx context.Context, id string) (*Hook, string, error) {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	return &stored.Hook, stored.Secret, nil
+}
+
+// List returns the hooks of a user
+func (s *Store) List(ctx context.Context, userID string) ([]*Hook, error) {
+	ids, err := s.redisClient.SMembers(ctx, "user:webhooks:"+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]*Hook, 0, len(ids))
+	for _, id := range ids {
+		stored, err := s.get(ctx, id)
+		if err == ErrHookNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, &stored.Hook)
+	}
+	return hooks, nil
+}
+
+// Delete removes a hook of the user
+func (s *Store) Delete(ctx context.Context, userID, id string) error {
+	stored, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if stored.UserID != userID {
+		return ErrHookNotFound
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(ctx, "webhook:"+id)
+	pipe.SRem(ctx, "user:webhooks:"+userID, id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeleteAll removes all hooks of the user
+func (s *Store) DeleteAll(ctx context.Context, userID string) error {
+	ids, err := s.redisClient.SMembers(ctx, "user:webhooks:"+userID).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.redisClient.TxPipeline()
+	for _, id := range ids {
+		pipe.Del(ctx, "webhook:"+id)
+	}
+	pipe.Del(ctx, "user:webhooks:"+userID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ClaimDelivery records a delivery ID and reports false if it was seen before
+func (s *Store) ClaimDelivery(ctx context.Context, hookID, deliveryID string) (bool, error) {
+	return s.redisClient.SetNX(ctx, "webhook:delivery:"+hookID+":"+deliveryID, time.Now().Unix(), deliveryTTL).Result()
+}
+
+// ReleaseDelivery forgets a delivery ID, so a redelivery is processed again
+func (s *Store) ReleaseDelivery(ctx context.Context, hookID, deliveryID string) error {
+	return s.redisClient.Del(ctx, "webhook:delivery:"+hookID+":"+deliveryID).Err()
+}
@@ -0,0 +1,647 @@
+// Package orchestrator keeps the state of every build in Redis. It queues build
+// requests as jobs for the builders and records the progress they report.
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/model"
+	"gobuild/shared/tracing"
+)
+
+// maxProjectHistory is the number of builds kept in a project's history
+const maxProjectHistory = 1000
+
+// recordProjectBuild keeps a project's build history and its latest build per
+// branch. Unlike build:<id> both never expire. A branch only moves to a build
+// created no earlier than its current one, so late updates of older builds
+// do not replace newer builds.
+var recordProjectBuild = redis.NewScript(`
+local history, historyBuilds, branches, branchCreated = KEYS[1], KEYS[2], KEYS[3], KEYS[4]
+local id, created, build, branch = ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4]
+local keep = tonumber(ARGV[5])
+
+redis.call('ZADD', history, created, id)
+redis.call('HSET', historyBuilds, id, build)
+local old = redis.call('ZRANGE', history, 0, -keep - 1)
+if #old > 0 then
+	redis.call('ZREM', history, unpack(old))
+	redis.call('HDEL', historyBuilds, unpack(old))
+end
+
+if branch ~= '' then
+	local current = tonumber(redis.call('HGET', branchCreated, branch))
+	if not current or created >= current then
+		redis.call('HSET', branches, branch, build)
+		redis.call('HSET', branchCreated, branch, created)
+	end
+end
+return 0
+`)
+
+// forgetProjectBuild removes a build from a project's history and drops the
+// branches whose latest build it is
+var forgetProjectBuild = redis.NewScript(`
+local history, historyBuilds, branches, branchCreated = KEYS[1], KEYS[2], KEYS[3], KEYS[4]
+local id = ARGV[1]
+
+redis.call('ZREM', history, id)
+redis.call('HDEL', historyBuilds, id)
+local entries = redis.call('HGETALL', branches)
+for i = 1, #entries, 2 do
+	if cjson.decode(entries[i + 1]).id == id then
+		redis.call('HDEL', branches, entries[i])
+		redis.call('HDEL', branchCreated, entries[i])
+	end
+end
+return 0
+`)
+
+// deletedMarkerTTL is how long deleted users and builds stay marked, so that
+// events still in flight for them are dropped instead of recreating them
+const deletedMarkerTTL = 7 * 24 * time.Hour
+
+// buildIndexRetention is how long builds stay in the listing indexes. Build
+// keys expire a day after their last update, so older entries are dead.
+const buildIndexRetention = 7 * 24 * time.Hour
+
+var (
+	errBuildNotFound = errors.New("build not found")
+	errBuildDeleted  = errors.New("build deleted")
+)
+
+// ProjectBuildsResponse is a page of a project's build history, newest first
+type ProjectBuildsResponse struct {
+	Builds []*model.BuildStatus `json:"builds"`
+	Total  int64                `json:"total"`
+	Offset int                  `json:"offset"`
+	Limit  int                  `json:"limit"`
+}
+
+type BuildOrchestrator struct {
+	mutex         sync.RWMutex
+	kafkaProducer kafka.Publisher
+	redisClient   *redis.Client
+	storageURL    string
+}
+
+func NewBuildOrchestrator(kafkaProducer kafka.Publisher, redisClient *redis.Client, storageURL string) *BuildOrchestrator {
+	return &BuildOrchestrator{
+		kafkaProducer: kafkaProducer,
+		redisClient:   redisClient,
+		storageURL:    storageURL,
+	}
+}
+
+// ProcessBuildRequest creates a new build
+func (bo *BuildOrchestrator) ProcessBuildRequest(ctx context.Context, buildReq message.BuildRequestMessage) error {
+	tracing.Logf(ctx, "🔄 Processing build request: %s for repo: %s", buildReq.ID, buildReq.RepositoryURL)
+
+	deleted, err := bo.redisClient.Exists(ctx, "user:deleted:"+buildReq.UserID).Result()
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("⏭️ Dropping build request %s of deleted user %s", buildReq.ID, buildReq.UserID)
+		return nil
+	}
+
+	// Create build status
+	buildStatus := &model.BuildStatus{
+		ID:              buildReq.ID,
+		RepositoryURL:   buildReq.RepositoryURL,
+		Branch:          buildReq.Branch,
+		CommitHash:      buildReq.CommitHash,
+		UserID:          buildReq.UserID,
+		Status:          "queued",
+		Message:         "Build queued for processing",
+		CreatedAt:       buildReq.CreatedAt,
+		UpdatedAt:       time.Now(),
+		ProjectID:       buildReq.ProjectID,
+		Public:          buildReq.Public,
+		SharedWithTeams: buildReq.SharedWithTeams,
+	}
+
+	// Store in Redis (single source of truth)
+	if err := bo.storeBuildStatus(ctx, buildStatus); err != nil {
+		log.Printf("❌ Failed to store build status: %v", err)
+		return err
+	}
+
+	// Send status update via Kafka
+	statusMsg := message.BuildStatusMessage{
+		BuildID:   buildStatus.ID,
+		Status:    buildStatus.Status,
+		Message:   buildStatus.Message,
+		UpdatedAt: buildStatus.UpdatedAt,
+	}
+	if err := bo.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, buildStatus.ID, statusMsg); err != nil {
+		log.Printf("❌ Failed to send status update: %v", err)
+		return err
+	}
+
+	// Forward to builder and wait for the ack, so the request offset is only
+	// committed once the job is safely stored
+	sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := bo.kafkaProducer.SendMessageSync(sendCtx, kafka.TopicBuildJobs, buildReq.ID, buildReq); err != nil {
+		log.Printf("❌ Failed to send to build-jobs topic: %v", err)
+		return err
+	}
+
+	log.Printf("✅ Build %s created and queued", buildReq.ID)
+	return nil
+}
+
+// ProcessBuildStatus updates build status
+func (bo *BuildOrchestrator) ProcessBuildStatus(ctx context.Context, statusMsg message.BuildStatusMessage) error {
+	tracing.Logf(ctx, "📊 Processing build status update: %s - %s", statusMsg.BuildID, statusMsg.Status)
+
+	// Get existing build
+	buildStatus, err := bo.getBuildStatus(ctx, statusMsg.BuildID)
+	if err == errBuildDeleted {
+		log.Printf("⏭️ Ignoring status %s of deleted build %s", statusMsg.Status, statusMsg.BuildID)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to get build status: %v", err)
+		return err
+	}
+
+	// Cancelled builds keep their status, the builder may still report before it stops
+	if buildStatus.Status == "cancelled" {
+		log.Printf("⏭️ Ignoring status %s of cancelled build %s", statusMsg.Status, statusMsg.BuildID)
+		return nil
+	}
+
+	// Update fields
+	buildStatus.Status = statusMsg.Status
+	buildStatus.Message = statusMsg.Message
+	buildStatus.UpdatedAt = statusMsg.UpdatedAt
+
+	// Set StartedAt if transitioning to in-progress
+	if statusMsg.Status == "in-progress" && buildStatus.StartedAt == nil {
+		now := time.Now()
+		buildStatus.StartedAt = &now
+	}
+
+	// Store updated status
+	if err := bo.storeBuildStatus(ctx, buildStatus); err != nil {
+		log.Printf("❌ Failed to update build status: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// ProcessBuildCompletion handles build completion
+func (bo *BuildOrchestrator) ProcessBuildCompletion(ctx context.Context, completionMsg message.BuildCompletionMessage) error {
+	tracing.Logf(ctx, "🏁 Processing build completion: %s - %s", completionMsg.BuildID, completionMsg.Status)
+	log.Printf("📦 Artifact URL: %s", completionMsg.ArtifactURL)
+
+	buildStatus, err := bo.getBuildStatus(ctx, completionMsg.BuildID)
+	if err == errBuildDeleted {
+		log.Printf("⏭️ Ignoring completion %s of deleted build %s", completionMsg.Status, completionMsg.BuildID)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to get build status: %v", err)
+		return err
+	}
+
+	if buildStatus.Status == "cancelled" {
+		log.Printf("⏭️ Ignoring completion %s of cancelled build %s", completionMsg.Status, completionMsg.BuildID)
+		return nil
+	}
+
+	buildStatus.Status = completionMsg.Status
+	buildStatus.ArtifactURL = completionMsg.ArtifactURL
+	buildStatus.UpdatedAt = completionMsg.CompletedAt
+	buildStatus.CompletedAt = &completionMsg.CompletedAt
+	buildStatus.Duration = completionMsg.Duration
+
+	if err := bo.storeBuildStatus(ctx, buildStatus); err != nil {
+		log.Printf("❌ Failed to store updated build status: %v", err)
+		return err
+	}
+
+	// Send status update
+	statusUpdate := message.BuildStatusMessage{
+		BuildID:   completionMsg.BuildID,
+		Status:    completionMsg.Status,
+		Message:   fmt.Sprintf("Build %s", completionMsg.Status),
+		UpdatedAt: completionMsg.CompletedAt,
+	}
+
+	return bo.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, completionMsg.BuildID, statusUpdate)
+}
+
+// ProcessBuildCancel marks a build as cancelled unless it already finished.
+// Builders read the cancel event themselves and stop or skip the build.
+func (bo *BuildOrchestrator) ProcessBuildCancel(ctx context.Context, cancelMsg message.BuildCancelMessage) error {
+	tracing.Logf(ctx, "🛑 Processing build cancellation: %s", cancelMsg.BuildID)
+
+	buildStatus, err := bo.getBuildStatus(ctx, cancelMsg.BuildID)
+	if err == errBuildDeleted {
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ Failed to get build status: %v", err)
+		return err
+	}
+
+	if buildStatus.Finished() {
+		log.Printf("⏭️ Build %s already finished with %s, not cancelling", cancelMsg.BuildID, buildStatus.Status)
+		return nil
+	}
+
+	buildStatus.Status = "cancelled"
+	buildStatus.Message = "Build cancelled"
+	buildStatus.UpdatedAt = cancelMsg.RequestedAt
+	buildStatus.CompletedAt = &cancelMsg.RequestedAt
+	if buildStatus.StartedAt != nil {
+		buildStatus.Duration = cancelMsg.RequestedAt.Sub(*buildStatus.StartedAt).Milliseconds()
+	}
+
+	if err := bo.storeBuildStatus(ctx, buildStatus); err != nil {
+		log.Printf("❌ Failed to store cancelled build status: %v", err)
+		return err
+	}
+
+	statusUpdate := message.BuildStatusMessage{
+		BuildID:   cancelMsg.BuildID,
+		Status:    buildStatus.Status,
+		Message:   buildStatus.Message,
+		UpdatedAt: cancelMsg.RequestedAt,
+	}
+	return bo.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, cancelMsg.BuildID, statusUpdate)
+}
+
+// storeBuildStatus stores build status in Redis with proper locking and publishes
+// the new state to the compacted build-state topic
+func (bo *BuildOrchestrator) storeBuildStatus(ctx context.Context, buildStatus *model.BuildStatus) error {
+	key := fmt.Sprintf("build:%s", buildStatus.ID)
+
+	// Use Redis transaction for atomic update
+	pipe := bo.redisClient.TxPipeline()
+
+	buildJSON, err := json.Marshal(buildStatus)
+	if err != nil {
+		return err
+	}
+
+	pipe.Set(ctx, key, buildJSON, 24*time.Hour)
+
+	// Sorted sets by creation time list the builds page by page: all of them
+	// for admins, the user's own, those shared with a team and public ones
+	byDate := &redis.Z{
+		Score:  float64(buildStatus.CreatedAt.Unix()),
+		Member: buildStatus.ID,
+	}
+	indexes := []string{"builds:by_date"}
+	for _, team := range buildStatus.SharedWithTeams {
+		indexes = append(indexes, "team:builds:"+team)
+	}
+	if buildStatus.Public {
+		indexes = append(indexes, "builds:public")
+	}
+	expired := strconv.FormatInt(time.Now().Add(-buildIndexRetention).Unix(), 10)
+	for _, index := range indexes {
+		pipe.ZAdd(ctx, index, byDate)
+		pipe.ZRemRangeByScore(ctx, index, "-inf", "("+expired)
+	}
+
+	// The user's builds, and the projects of those, are removed when the user
+	// is deleted, so this index is not trimmed
+	if buildStatus.UserID != "" {
+		pipe.ZAdd(ctx, "user:builds:"+buildStatus.UserID, byDate)
+		if buildStatus.ProjectID != "" {
+			pipe.HSet(ctx, "user:build_projects:"+buildStatus.UserID, buildStatus.ID, buildStatus.ProjectID)
+		}
+	}
+
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if buildStatus.ProjectID != "" {
+		if err := bo.recordProjectBuild(ctx, buildStatus, buildJSON); err != nil {
+			return err
+		}
+	}
+
+	stateMsg := message.BuildStateMessage{BuildStatus: *buildStatus}
+	return bo.kafkaProducer.SendMessage(ctx, kafka.TopicBuildState, buildStatus.ID, stateMsg)
+}
+
+func (bo *BuildOrchestrator) recordProjectBuild(ctx context.Context, buildStatus *model.BuildStatus, buildJSON []byte) error {
+	projectID := buildStatus.ProjectID
+	keys := []string{
+		"project:history:" + projectID,
+		"project:history:builds:" + projectID,
+		"project:branches:" + projectID,
+		"project:branches:created:" + projectID,
+	}
+	return recordProjectBuild.Run(ctx, bo.redisClient, keys,
+		buildStatus.ID, buildStatus.CreatedAt.UnixMilli(), buildJSON, buildStatus.Branch, maxProjectHistory).Err()
+}
+
+// ProcessUserDeletion removes all builds of a deleted user: running builds are
+// cancelled, artifacts deleted and the builds dropped from project histories
+// and the build-state topic. Builds stored before the per-user index existed
+// are not found.
+func (bo *BuildOrchestrator) ProcessUserDeletion(ctx context.Context, deletedMsg message.UserDeletedMessage) error {
+	tracing.Logf(ctx, "🗑️ Processing deletion of user %s", deletedMsg.UserID)
+
+	// Build requests still queued for the user are dropped from now on
+	if err := bo.redisClient.Set(ctx, "user:deleted:"+deletedMsg.UserID, deletedMsg.DeletedAt.Unix(), deletedMarkerTTL).Err(); err != nil {
+		return err
+	}
+
+	builds, err := bo.redisClient.ZRange(ctx, "user:builds:"+deletedMsg.UserID, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	projects, err := bo.redisClient.HGetAll(ctx, "user:build_projects:"+deletedMsg.UserID).Result()
+	if err != nil {
+		return err
+	}
+	for _, buildID := range builds {
+		if err := bo.deleteBuild(ctx, buildID, projects[buildID], deletedMsg); err != nil {
+			log.Printf("❌ Failed to delete build %s: %v", buildID, err)
+			return err
+		}
+	}
+
+	if err := bo.redisClient.Del(ctx, "user:builds:"+deletedMsg.UserID, "user:build_projects:"+deletedMsg.UserID).Err(); err != nil {
+		return err
+	}
+	log.Printf("✅ Deleted %d builds of user %s", len(builds), deletedMsg.UserID)
+	return nil
+}
+
+// deleteBuild removes a build and its artifacts. It can be repeated, so a
+// failed user deletion is simply retried.
+func (bo *BuildOrchestrator) deleteBuild(ctx context.Context, buildID, projectID string, deletedMsg message.UserDeletedMessage) error {
+	buildStatus, err := bo.getBuildStatus(ctx, buildID)
+	if err != nil && err != errBuildDeleted && !errors.Is(err, errBuildNotFound) {
+		return err
+	}
+
+	// Mark first, so later status updates of the build are ignored
+	if err := bo.redisClient.Set(ctx, "build:deleted:"+buildID, deletedMsg.DeletedAt.Unix(), deletedMarkerTTL).Err(); err != nil {
+		return err
+	}
+	if buildStatus != nil && !buildStatus.Finished() {
+		cancelMsg := message.BuildCancelMessage{
+			BuildID:     buildID,
+			RequestedBy: deletedMsg.UserID,
+			RequestedAt: time.Now(),
+		}
+		if err := bo.kafkaProducer.SendMessage(ctx, kafka.TopicBuildCancellations, buildID, cancelMsg); err != nil {
+			return err
+		}
+	}
+
+	if err := bo.deleteArtifacts(ctx, buildID); err != nil {
+		return err
+	}
+
+	pipe := bo.redisClient.TxPipeline()
+	pipe.Del(ctx, "build:"+buildID)
+	pipe.ZRem(ctx, "builds:by_date", buildID)
+	if buildStatus != nil {
+		for _, team := range buildStatus.SharedWithTeams {
+			pipe.ZRem(ctx, "team:builds:"+team, buildID)
+		}
+		pipe.ZRem(ctx, "builds:public", buildID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if projectID != "" {
+		keys := []string{
+			"project:history:" + projectID,
+			"project:history:builds:" + projectID,
+			"project:branches:" + projectID,
+			"project:branches:created:" + projectID,
+		}
+		if err := forgetProjectBuild.Run(ctx, bo.redisClient, keys, buildID).Err(); err != nil {
+			return err
+		}
+	}
+
+	// A tombstone removes the build from the compacted build-state topic
+	return bo.kafkaProducer.SendRaw(kafka.TopicBuildState, []byte(buildID), nil, nil)
+}
+
+// deleteArtifacts asks the storage service to delete the artifacts of a build
+func (bo *BuildOrchestrator) deleteArtifacts(ctx context.Context, buildID string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/artifacts/%s", bo.storageURL, buildID), nil)
+	if err != nil {
+		return err
+	}
+	if err := access.SetServiceToken(req, "build-orchestrator"); err != nil {
+		return err
+	}
+
+	resp, err := tracing.NewHTTPClient(10 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("storage returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GetProjectBuilds returns a page of a project's build history, newest first
+func (bo *BuildOrchestrator) GetProjectBuilds(ctx context.Context, projectID string, offset, limit int) (*ProjectBuildsResponse, error) {
+	resp := &ProjectBuildsResponse{
+		Builds: []*model.BuildStatus{},
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	total, err := bo.redisClient.ZCard(ctx, "project:history:"+projectID).Result()
+	if err != nil {
+		return nil, err
+	}
+	resp.Total = total
+
+	ids, err := bo.redisClient.ZRevRange(ctx, "project:history:"+projectID, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil || len(ids) == 0 {
+		return resp, err
+	}
+	values, err := bo.redisClient.HMGet(ctx, "project:history:builds:"+projectID, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	resp.Builds = decodeBuilds(values)
+	return resp, nil
+}
+
+// GetProjectBranches returns the latest build of each branch of a project, by branch name
+func (bo *BuildOrchestrator) GetProjectBranches(ctx context.Context, projectID string) ([]*model.BuildStatus, error) {
+	branches, err := bo.redisClient.HGetAll(ctx, "project:branches:"+projectID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0, len(branches))
+	for _, buildJSON := range branches {
+		values = append(values, buildJSON)
+	}
+	builds := decodeBuilds(values)
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Branch < builds[j].Branch
+	})
+	return builds, nil
+}
+
+// decodeBuilds decodes the build JSON values of a Redis reply and skips missing ones
+func decodeBuilds(values []interface{}) []*model.BuildStatus {
+	builds := make([]*model.BuildStatus, 0, len(values))
+	for _, value := range values {
+		buildJSON, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var build model.BuildStatus
+		if err := json.Unmarshal([]byte(buildJSON), &build); err != nil {
+			log.Printf("⚠️ Skipping undecodable build: %v", err)
+			continue
+		}
+		builds = append(builds, &build)
+	}
+	return builds
+}
+
+// getBuildStatus retrieves build status from Redis
+func (bo *BuildOrchestrator) getBuildStatus(ctx context.Context, buildID string) (*model.BuildStatus, error) {
+	key := fmt.Sprintf("build:%s", buildID)
+
+	buildJSON, err := bo.redisClient.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			deleted, err := bo.redisClient.Exists(ctx, "build:deleted:"+buildID).Result()
+			if err == nil && deleted > 0 {
+				return nil, errBuildDeleted
+			}
+			return nil, fmt.Errorf("%w: %s", errBuildNotFound, buildID)
+		}
+		return nil, err
+	}
+
+	var buildStatus model.BuildStatus
+	if err := json.Unmarshal([]byte(buildJSON), &buildStatus); err != nil {
+		return nil, err
+	}
+
+	return &buildStatus, nil
+}
+
+// GetBuildJob retrieves a build for API requests
+func (bo *BuildOrchestrator) GetBuildJob(ctx context.Context, buildID string) (*model.BuildStatus, error) {
+	return bo.getBuildStatus(ctx, buildID)
+}
+
+// Topics are the topics the orchestrator consumes
+var Topics = []string{kafka.TopicBuildRequests, kafka.TopicBuildStatus, kafka.TopicBuildCompletions, kafka.TopicBuildCancellations, kafka.TopicUserDeletions}
+
+// Dispatcher returns a dispatcher that hands the events of Topics to the orchestrator
+func (bo *BuildOrchestrator) Dispatcher() *kafka.Dispatcher {
+	dispatcher := kafka.NewDispatcher()
+	kafka.On(dispatcher, func(ctx context.Context, buildReq message.BuildRequestMessage) error {
+		tracing.Logf(ctx, "📬 Received build request: %s", buildReq.ID)
+		return bo.ProcessBuildRequest(ctx, buildReq)
+	})
+	kafka.On(dispatcher, func(ctx context.Context, completionMsg message.BuildCompletionMessage) error {
+		tracing.Logf(ctx, "🏁 Received completion: %s - %s", completionMsg.BuildID, completionMsg.Status)
+		return bo.ProcessBuildCompletion(ctx, completionMsg)
+	})
+	kafka.On(dispatcher, bo.ProcessBuildStatus)
+	kafka.On(dispatcher, bo.ProcessBuildCancel)
+	kafka.On(dispatcher, bo.ProcessUserDeletion)
+	return dispatcher
+}
+
+// RegisterRoutes adds the build and project history endpoints to r, whose
+// requests must already be authenticated by access.Middleware
+func (bo *BuildOrchestrator) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/builds/{buildId}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		buildID := vars["buildId"]
+
+		job, err := bo.GetBuildJob(r.Context(), buildID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// Builds of other users are reported as missing so IDs cannot be probed
+		claims, _ := access.ClaimsFromContext(r.Context())
+		if !claims.CanViewBuild(job) {
+			http.Error(w, fmt.Sprintf("build not found: %s", buildID), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}).Methods("GET")
+
+	// Project history is only readable by services and admins; the gateway
+	// checks whether the user may see the project
+	projects := r.PathPrefix("/api/projects/{projectId}").Subrouter()
+	projects.Use(access.RequireAdminOrService)
+
+	projects.HandleFunc("/builds", func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if offset < 0 {
+			offset = 0
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > 100 {
+			limit = 50
+		}
+
+		resp, err := bo.GetProjectBuilds(r.Context(), mux.Vars(r)["projectId"], offset, limit)
+		if err != nil {
+			log.Printf("❌ Failed to load project builds: %v", err)
+			http.Error(w, "Failed to load project builds", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}).Methods("GET")
+
+	projects.HandleFunc("/branches", func(w http.ResponseWriter, r *http.Request) {
+		builds, err := bo.GetProjectBranches(r.Context(), mux.Vars(r)["projectId"])
+		if err != nil {
+			log.Printf("❌ Failed to load project branches: %v", err)
+			http.Error(w, "Failed to load project branches", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(builds)
+	}).Methods("GET")
+}
@@ -15,6 +15,12 @@ else
   docker-compose down
 fi
 
+# The services refuse to start without a service token secret. Service tokens
+# live for minutes, so a fresh one per start is fine.
+if [ -z "$SERVICE_TOKEN_SECRET" ]; then
+  export SERVICE_TOKEN_SECRET=$(openssl rand -hex 32)
+fi
+
 docker build -t gobuild-dependencies:latest -f dependencies.Dockerfile .
 
 docker-compose up --build
@@ -0,0 +1,558 @@
+// Package build runs the build jobs: it checks out a repository, builds it and
+// uploads the artifact, reporting progress and logs on the way.
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/repository"
+	"gobuild/shared/tracing"
+)
+
+// Builder executes build jobs
+type Builder struct {
+	id            string
+	workDir       string
+	kafkaProducer kafka.Publisher
+	storageURL    string
+	gatewayURL    string
+	cancellations kafka.StateLookup[message.BuildCancelMessage]
+	repoPolicy    *repository.Policy
+
+	// running maps the IDs of the builds running here to their cancel function
+	running      map[string]context.CancelFunc
+	runningMutex sync.Mutex
+}
+
+// NewBuilder creates a new Builder
+func NewBuilder(id, workDir, storageURL, gatewayURL string, kafkaProducer kafka.Publisher, cancellations kafka.StateLookup[message.BuildCancelMessage], repoPolicy *repository.Policy) *Builder {
+	return &Builder{
+		id:            id,
+		workDir:       workDir,
+		kafkaProducer: kafkaProducer,
+		storageURL:    storageURL,
+		gatewayURL:    gatewayURL,
+		cancellations: cancellations,
+		repoPolicy:    repoPolicy,
+		running:       make(map[string]context.CancelFunc),
+	}
+}
+
+func (b *Builder) sendLogLines(ctx context.Context, buildID string, logContent string) {
+	lines := strings.Split(strings.TrimSpace(logContent), "\n")
+	for _, line := range lines {
+		if line != "" {
+			b.sendLog(ctx, buildID, line)
+		}
+	}
+}
+
+// ConsumeJobs runs the build jobs of the subscriber until ctx is cancelled.
+// It subscribes to build-jobs, not build-requests, which the orchestrator handles.
+func (b *Builder) ConsumeJobs(ctx context.Context, jobs kafka.Subscriber) error {
+	if err := jobs.Subscribe([]string{kafka.TopicBuildJobs}); err != nil {
+		return err
+	}
+
+	dispatcher := kafka.NewDispatcher()
+	kafka.On(dispatcher, func(ctx context.Context, buildReq message.BuildRequestMessage) error {
+		tracing.Logf(ctx, "📨 Received build job: %s", buildReq.ID)
+		return b.ProcessBuildJob(ctx, buildReq)
+	})
+	return jobs.ConsumeMessages(ctx, dispatcher.HandleMessage)
+}
+
+// ProcessBuildJob processes a build job
+func (b *Builder) ProcessBuildJob(ctx context.Context, buildReq message.BuildRequestMessage) error {
+	// Registered before checking for a cancellation, so none gets lost in between
+	ctx, done := b.startBuild(ctx, buildReq.ID)
+	defer done()
+
+	if _, cancelled := b.cancellations.Get(buildReq.ID); cancelled {
+		tracing.Logf(ctx, "⏭️ Skipping cancelled build: %s", buildReq.ID)
+		return nil
+	}
+
+	// Project builds may be limited in time; the build is killed like a cancelled one
+	if buildReq.TimeoutMinutes > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, time.Duration(buildReq.TimeoutMinutes)*time.Minute,
+			fmt.Errorf("build exceeded its timeout of %d minutes", buildReq.TimeoutMinutes))
+		defer cancelTimeout()
+	}
+
+	tracing.Logf(ctx, "🔨 Processing build request: %s for repo: %s", buildReq.ID, buildReq.RepositoryURL)
+
+	// Send initial status update
+	statusMsg := message.BuildStatusMessage{
+		BuildID:   buildReq.ID,
+		Status:    "in-progress",
+		Message:   "Build started",
+		UpdatedAt: time.Now(),
+	}
+	// Send to build-status topic (orchestrator will consume this)
+	if err := b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, buildReq.ID, statusMsg); err != nil {
+		return err
+	}
+
+	// Send initial log
+	b.sendLogLines(ctx, buildReq.ID, "Build started")
+	b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Repository: %s", buildReq.RepositoryURL))
+	if buildReq.Branch != "" {
+		b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Branch: %s", buildReq.Branch))
+	}
+
+	// Send status update: in-progress
+	statusMsg = message.BuildStatusMessage{
+		BuildID:   buildReq.ID,
+		Status:    "in-progress",
+		Message:   "Build started",
+		UpdatedAt: time.Now(),
+	}
+	err := b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, buildReq.ID, statusMsg)
+	if err != nil {
+		log.Printf("❌ Failed to send status update: %v", err)
+		return err
+	}
+
+	// Secrets are resolved when the build runs, so they are never part of a
+	// job; the job only carries the one-time token to fetch them
+	if buildReq.ProjectID != "" {
+		secrets, err := b.fetchSecrets(ctx, buildReq.ID, buildReq.SecretsToken)
+		if err != nil {
+			return b.failBuild(ctx, buildReq.ID, "Failed to resolve secrets: "+err.Error())
+		}
+		ctx = withSecrets(ctx, secrets)
+		if len(secrets) > 0 {
+			b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Injecting %d secrets", len(secrets)))
+		}
+	}
+
+	// Checked again here, jobs don't necessarily come through the gateway
+	repositoryURL, err := b.repoPolicy.Normalize(buildReq.RepositoryURL)
+	if err != nil {
+		return b.failBuild(ctx, buildReq.ID, "Repository URL rejected: "+err.Error())
+	}
+
+	buildDir := filepath.Join(b.workDir, buildReq.ID)
+	err = os.MkdirAll(buildDir, 0755)
+	if err != nil {
+		log.Printf("❌ Failed to create build directory: %v", err)
+		return b.failBuild(ctx, buildReq.ID, fmt.Sprintf("Failed to create build directory: %v", err))
+	}
+
+	// Clean up build directory when done
+	defer func() {
+		if err := os.RemoveAll(buildDir); err != nil {
+			log.Printf("⚠️ Failed to clean up build directory: %v", err)
+		}
+	}()
+
+	b.sendLogLines(ctx, buildReq.ID, "Cloning repository...")
+
+	cloneCmd := command(ctx, "", "git", "clone", "--", repositoryURL, buildDir)
+	cloneCmd.Env = append(cloneCmd.Env,
+		"GIT_TERMINAL_PROMPT=0", // Disable interactive prompts
+		// Keeps git, including submodules, to the allowed transports
+		"GIT_ALLOW_PROTOCOL="+b.repoPolicy.GitProtocols())
+
+	var cloneOutput bytes.Buffer
+	cloneCmd.Stdout = &cloneOutput
+	cloneCmd.Stderr = &cloneOutput
+
+	if err := cloneCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("Clone failed: %s", err.Error())
+		b.sendLogLines(ctx, buildReq.ID, errorMsg)
+		b.sendLogLines(ctx, buildReq.ID, cloneOutput.String())
+		return b.failBuild(ctx, buildReq.ID, "Failed to clone repository: "+err.Error())
+	}
+
+	// Log successful clone
+	b.sendLogLines(ctx, buildReq.ID, "Repository cloned successfully")
+	b.sendLogLines(ctx, buildReq.ID, cloneOutput.String())
+
+	// Checkout specific branch if specified
+	if buildReq.Branch != "" && buildReq.Branch != "main" && buildReq.Branch != "master" {
+		if !repository.ValidRefName(buildReq.Branch) {
+			return b.failBuild(ctx, buildReq.ID, "Invalid branch: "+buildReq.Branch)
+		}
+		b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Checking out branch: %s", buildReq.Branch))
+
+		// "--" ends the revisions, so the branch is never read as a path
+		checkoutCmd := command(ctx, buildDir, "git", "checkout", buildReq.Branch, "--")
+
+		var checkoutOutput bytes.Buffer
+		checkoutCmd.Stdout = &checkoutOutput
+		checkoutCmd.Stderr = &checkoutOutput
+
+		if err := checkoutCmd.Run(); err != nil {
+			errorMsg := fmt.Sprintf("Checkout failed: %s", err.Error())
+			b.sendLogLines(ctx, buildReq.ID, errorMsg)
+			b.sendLogLines(ctx, buildReq.ID, checkoutOutput.String())
+			return b.failBuild(ctx, buildReq.ID, "Failed to checkout branch: "+err.Error())
+		}
+
+		b.sendLogLines(ctx, buildReq.ID, "Branch checked out successfully")
+		b.sendLogLines(ctx, buildReq.ID, checkoutOutput.String())
+	}
+
+	// Pin the build to the requested commit, the branch may have moved on since
+	if buildReq.CommitHash != "" {
+		if !repository.ValidCommitHash(buildReq.CommitHash) {
+			return b.failBuild(ctx, buildReq.ID, "Invalid commit hash: "+buildReq.CommitHash)
+		}
+		b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Checking out commit: %s", buildReq.CommitHash))
+
+		commitCmd := command(ctx, buildDir, "git", "checkout", "--detach", buildReq.CommitHash)
+
+		var commitOutput bytes.Buffer
+		commitCmd.Stdout = &commitOutput
+		commitCmd.Stderr = &commitOutput
+
+		if err := commitCmd.Run(); err != nil {
+			b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Checkout failed: %s", err.Error()))
+			b.sendLogLines(ctx, buildReq.ID, commitOutput.String())
+			return b.failBuild(ctx, buildReq.ID, "Failed to checkout commit: "+err.Error())
+		}
+	}
+
+	// Execute build process
+	if err := b.executeBuild(ctx, buildReq, buildDir); err != nil {
+		return b.failBuild(ctx, buildReq.ID, err.Error())
+	}
+
+	// Create and upload artifact
+	if err := b.createAndUploadArtifact(ctx, buildReq, buildDir); err != nil {
+		return b.failBuild(ctx, buildReq.ID, "Failed to create artifact: "+err.Error())
+	}
+
+	b.sendLogLines(ctx, buildReq.ID, "Build completed successfully!")
+
+	statusMsg = message.BuildStatusMessage{
+		BuildID:   buildReq.ID,
+		Status:    "completed",
+		Message:   "Build completed successfully",
+		UpdatedAt: time.Now(),
+	}
+	return b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, buildReq.ID, statusMsg)
+}
+
+// executeBuild runs the appropriate build command based on project type
+func (b *Builder) executeBuild(ctx context.Context, buildReq message.BuildRequestMessage, buildDir string) error {
+	buildFilePath := filepath.Join(buildDir, "build.sh")
+
+	if _, err := os.Stat(buildFilePath); os.IsNotExist(err) {
+		projectType := b.detectProjectType(buildDir)
+		return b.buildByProjectType(ctx, buildReq, buildDir, projectType)
+	} else {
+		return b.runBuildScript(ctx, buildReq, buildDir)
+	}
+}
+
+// buildByProjectType builds based on detected project type
+func (b *Builder) buildByProjectType(ctx context.Context, buildReq message.BuildRequestMessage, buildDir, projectType string) error {
+	switch projectType {
+	case "node":
+		return b.buildNodeProject(ctx, buildReq, buildDir)
+	case "go":
+		return b.buildGoProject(ctx, buildReq, buildDir)
+	default:
+		return fmt.Errorf("unknown project type: %s, no build script found", projectType)
+	}
+}
+
+// buildNodeProject builds a Node.js project
+func (b *Builder) buildNodeProject(ctx context.Context, buildReq message.BuildRequestMessage, buildDir string) error {
+	b.sendLogLines(ctx, buildReq.ID, "Detected Node.js project")
+
+	packageManager := b.detectNodePackageManager(buildDir)
+	if packageManager == "unknown" {
+		packageManager = "npm"
+	}
+
+	b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Using package manager: %s", packageManager))
+
+	// Install dependencies
+	b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Running %s install...", packageManager))
+	installCmd := command(ctx, buildDir, packageManager, "install")
+	installCmd.Env = append(installCmd.Env, secretEnv(ctx)...)
+
+	var installOutput bytes.Buffer
+	installCmd.Stdout = &installOutput
+	installCmd.Stderr = &installOutput
+
+	if err := installCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("%s install failed: %s", packageManager, err.Error())
+		b.sendLogLines(ctx, buildReq.ID, errorMsg)
+		b.sendLogLines(ctx, buildReq.ID, installOutput.String())
+		return fmt.Errorf("failed to install dependencies: %s", err.Error())
+	}
+
+	b.sendLogLines(ctx, buildReq.ID, "Dependencies installed successfully")
+	b.sendLogLines(ctx, buildReq.ID, installOutput.String())
+
+	// Build project
+	b.sendLogLines(ctx, buildReq.ID, fmt.Sprintf("Running %s run build...", packageManager))
+	buildCmd := command(ctx, buildDir, packageManager, "run", "build")
+	buildCmd.Env = append(buildCmd.Env, secretEnv(ctx)...)
+
+	var buildOutput bytes.Buffer
+	buildCmd.Stdout = &buildOutput
+	buildCmd.Stderr = &buildOutput
+
+	if err := buildCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("%s build failed: %s", packageManager, err.Error())
+		b.sendLogLines(ctx, buildReq.ID, errorMsg)
+		b.sendLogLines(ctx, buildReq.ID, buildOutput.String())
+		return fmt.Errorf("failed to build project: %s", err.Error())
+	}
+
+	b.sendLogLines(ctx, buildReq.ID, "Project built successfully")
+	b.sendLogLines(ctx, buildReq.ID, buildOutput.String())
+
+	return nil
+}
+
+// buildGoProject builds a Go project
+func (b *Builder) buildGoProject(ctx context.Context, buildReq message.BuildRequestMessage, buildDir string) error {
+	b.sendLog(ctx, buildReq.ID, "Detected Go project, running go build")
+
+	goBuildCmd := command(ctx, buildDir, "go", "build", "-o", "app")
+
+	var buildOutput bytes.Buffer
+	goBuildCmd.Stdout = &buildOutput
+	goBuildCmd.Stderr = &buildOutput
+
+	if err := goBuildCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("go build failed: %s\nOutput: %s", err.Error(), buildOutput.String())
+		b.sendLog(ctx, buildReq.ID, errorMsg)
+		return fmt.Errorf("failed to build project: %s", err.Error())
+	}
+
+	b.sendLog(ctx, buildReq.ID, fmt.Sprintf("Go project built successfully\n%s", buildOutput.String()))
+
+	return nil
+}
+
+// runBuildScript executes a custom build script
+func (b *Builder) runBuildScript(ctx context.Context, buildReq message.BuildRequestMessage, buildDir string) error {
+	b.sendLog(ctx, buildReq.ID, "Executing build script")
+
+	buildCmd := command(ctx, buildDir, "/bin/sh", "build.sh")
+	buildCmd.Env = append(buildCmd.Env, secretEnv(ctx)...)
+
+	var buildOutput bytes.Buffer
+	buildCmd.Stdout = &buildOutput
+	buildCmd.Stderr = &buildOutput
+
+	if err := buildCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("Build script failed: %s\nOutput: %s", err.Error(), buildOutput.String())
+		b.sendLog(ctx, buildReq.ID, errorMsg)
+		return fmt.Errorf("build script failed: %s", err.Error())
+	}
+
+	b.sendLog(ctx, buildReq.ID, fmt.Sprintf("Build script completed successfully\n%s", buildOutput.String()))
+
+	return nil
+}
+
+// createAndUploadArtifact creates a tar.gz of the build and uploads it
+func (b *Builder) createAndUploadArtifact(ctx context.Context, buildReq message.BuildRequestMessage, buildDir string) error {
+	b.sendLog(ctx, buildReq.ID, "Creating artifact...")
+
+	// Create a temporary artifact file with unique name
+	timestamp := time.Now().Format("20060102-150405")
+	tempArtifactPath := filepath.Join(b.workDir, fmt.Sprintf("%s-%s.tar.gz", buildReq.ID, timestamp))
+
+	tarCmd := command(ctx, buildDir, "tar", "-czf", tempArtifactPath, ".")
+
+	var tarOutput bytes.Buffer
+	tarCmd.Stdout = &tarOutput
+	tarCmd.Stderr = &tarOutput
+
+	if err := tarCmd.Run(); err != nil {
+		errorMsg := fmt.Sprintf("Failed to create artifact: %s\nOutput: %s", err.Error(), tarOutput.String())
+		b.sendLog(ctx, buildReq.ID, errorMsg)
+		return fmt.Errorf("failed to create artifact: %s", err.Error())
+	}
+
+	// Clean up temporary artifact when done
+	defer os.Remove(tempArtifactPath)
+
+	// Upload artifact to storage service
+	b.sendLog(ctx, buildReq.ID, "Uploading artifact to storage...")
+
+	if err := b.uploadArtifact(ctx, buildReq.ID, tempArtifactPath, buildReq.CreatedAt); err != nil {
+		b.sendLog(ctx, buildReq.ID, fmt.Sprintf("Failed to upload artifact: %v", err))
+		return fmt.Errorf("failed to upload artifact: %s", err.Error())
+	}
+
+	b.sendLog(ctx, buildReq.ID, "Artifact uploaded successfully")
+
+	return nil
+}
+
+// uploadArtifact uploads the artifact to the storage service
+func (b *Builder) uploadArtifact(ctx context.Context, buildID, artifactPath string, startTime time.Time) error {
+	log.Printf("📦 Uploading artifact %s to storage service...", artifactPath)
+	// Open the artifact file
+	file, err := os.Open(artifactPath)
+	if err != nil {
+		return fmt.Errorf("failed to open artifact file: %v", err)
+	}
+	defer file.Close()
+
+	// Create a buffer to store our request body
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	// Create a form file field
+	part, err := writer.CreateFormFile("artifact", fmt.Sprintf("%s.tar.gz", buildID))
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %v", err)
+	}
+
+	// Copy the file content to the form field
+	_, err = io.Copy(part, file)
+	if err != nil {
+		return fmt.Errorf("failed to copy file content: %v", err)
+	}
+
+	// Close the multipart writer
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close multipart writer: %v", err)
+	}
+
+	// Create the HTTP request
+	url := fmt.Sprintf("%s/artifacts/%s", b.storageURL, buildID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &requestBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	// Set the content type header
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if err := access.SetServiceToken(req, "builder"); err != nil {
+		return fmt.Errorf("failed to create service token: %v", err)
+	}
+
+	// Send the request
+	client := tracing.NewHTTPClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload artifact: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("storage service returned status %d: %s", resp.StatusCode, string(body))
+	} else {
+		artifactURL := fmt.Sprintf("%s/artifacts/%s", b.storageURL, buildID)
+
+		// Create and send build completion message via Kafka
+		completionMessage := message.BuildCompletionMessage{
+			BuildID:     buildID,
+			Status:      "success",
+			ArtifactURL: artifactURL,
+			Duration:    time.Since(startTime).Milliseconds(),
+			CompletedAt: time.Now(),
+		}
+
+		err = b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildCompletions, buildID, completionMessage)
+		if err != nil {
+			log.Printf("⚠️ Failed to send build completion message: %v", err)
+		} else {
+			log.Printf("📤 Sent build completion message for build %s", buildID)
+		}
+
+		return nil
+	}
+}
+
+// failBuild handles build failures. A build that failed because it was cancelled
+// is not reported as failed, the orchestrator already marked it as cancelled.
+// A build that ran into its timeout fails with the timeout as reason.
+func (b *Builder) failBuild(ctx context.Context, buildID, errorMsg string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		errorMsg = context.Cause(ctx).Error()
+	} else if ctx.Err() != nil {
+		tracing.Logf(ctx, "🛑 Build %s cancelled", buildID)
+		b.sendLogLines(ctx, buildID, "Build cancelled")
+		return nil
+	}
+
+	errorMsg = maskSecrets(ctx, errorMsg)
+	tracing.Logf(ctx, "❌ Build failed for %s: %s", buildID, errorMsg)
+
+	// Send failure log
+	b.sendLogLines(ctx, buildID, fmt.Sprintf("Build failed: %s", errorMsg))
+
+	// Send completion message
+	completionMsg := message.BuildCompletionMessage{
+		BuildID:     buildID,
+		Status:      "failure",
+		ArtifactURL: "",
+		Duration:    0,
+		CompletedAt: time.Now(),
+	}
+	err := b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildCompletions, buildID, completionMsg)
+	if err != nil {
+		return err
+	}
+
+	// Send status update
+	statusMsg := message.BuildStatusMessage{
+		BuildID:   buildID,
+		Status:    "failed",
+		Message:   errorMsg,
+		UpdatedAt: time.Now(),
+	}
+	return b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildStatus, buildID, statusMsg)
+}
+
+// detectProjectType attempts to determine the type of project in the directory
+func (b *Builder) detectProjectType(dir string) string {
+	// Check for package.json (Node.js)
+	if _, err := os.Stat(filepath.Join(dir, "package.json")); !os.IsNotExist(err) {
+		return "node"
+	}
+
+	// Check for go.mod (Go)
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); !os.IsNotExist(err) {
+		return "go"
+	}
+
+	return "unknown"
+}
+
+func (b *Builder) detectNodePackageManager(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, "pnpm-lock.yaml")); !os.IsNotExist(err) {
+		return "pnpm"
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "package-lock.json")); !os.IsNotExist(err) {
+		return "npm"
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "yarn.lock")); !os.IsNotExist(err) {
+		return "yarn"
+	}
+
+	return "unknown"
+}
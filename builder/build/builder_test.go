@@ -0,0 +1,117 @@
+package build
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/repository"
+)
+
+// cancelledBuilds stands in for the build-cancellations view
+type cancelledBuilds map[string]message.BuildCancelMessage
+
+func (c cancelledBuilds) Get(buildID string) (message.BuildCancelMessage, bool) {
+	msg, ok := c[buildID]
+	return msg, ok
+}
+
+// TestBuilderOnMemoryBus runs the builder against an in-memory bus: a cancelled
+// job is skipped, a job with a rejected repository publishes its statuses and
+// completion, which another consumer group receives in order.
+func TestBuilderOnMemoryBus(t *testing.T) {
+	bus := kafka.NewMemoryBus(3)
+	cancelled := cancelledBuilds{"cancelled-build": {BuildID: "cancelled-build"}}
+	policy := repository.NewPolicy([]string{"https"}, []string{"github.com"})
+	builder := NewBuilder("builder-test", t.TempDir(), "http://storage.invalid", "http://gateway.invalid", bus.Publisher(), cancelled, policy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := builder.ConsumeJobs(ctx, bus.Subscriber("builder")); err != nil {
+			t.Errorf("ConsumeJobs() = %v", err)
+		}
+	}()
+
+	var mu sync.Mutex
+	statuses := make(map[string][]string)
+	completions := make(map[string]string)
+	done := make(chan struct{})
+	finished := false
+	// finishedLocked signals once the rejected build failed and completed
+	finishedLocked := func() {
+		got := statuses["rejected-build"]
+		_, completed := completions["rejected-build"]
+		if !finished && completed && len(got) > 0 && got[len(got)-1] == "failed" {
+			finished = true
+			close(done)
+		}
+	}
+	dashboard := kafka.NewDispatcher()
+	kafka.On(dashboard, func(ctx context.Context, msg message.BuildStatusMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses[msg.BuildID] = append(statuses[msg.BuildID], msg.Status)
+		finishedLocked()
+		return nil
+	})
+	kafka.On(dashboard, func(ctx context.Context, msg message.BuildCompletionMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		completions[msg.BuildID] = msg.Status
+		finishedLocked()
+		return nil
+	})
+	subscriber := bus.Subscriber("status-dashboard-api")
+	if err := subscriber.Subscribe([]string{kafka.TopicBuildStatus, kafka.TopicBuildCompletions}); err != nil {
+		t.Fatalf("Subscribe() = %v", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		subscriber.ConsumeMessages(ctx, dashboard.HandleMessage)
+	}()
+
+	// Both jobs share a key, so the cancelled one is handled first
+	publisher := bus.Publisher()
+	for _, job := range []message.BuildRequestMessage{
+		{ID: "cancelled-build", RepositoryURL: "https://github.com/example/app.git", CreatedAt: time.Now()},
+		{ID: "rejected-build", RepositoryURL: "ftp://example.com/app.git", CreatedAt: time.Now()},
+	} {
+		if err := publisher.SendMessage(ctx, kafka.TopicBuildJobs, "jobs", job); err != nil {
+			t.Fatalf("SendMessage() = %v", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rejected build did not fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, status := range statuses["rejected-build"] {
+		last := i == len(statuses["rejected-build"])-1
+		if (last && status != "failed") || (!last && status != "in-progress") {
+			t.Errorf("statuses of rejected build = %v, want in-progress until failed", statuses["rejected-build"])
+			break
+		}
+	}
+	if got := completions["rejected-build"]; got != "failure" {
+		t.Errorf("completion of rejected build = %q, want failure", got)
+	}
+	if got, ok := statuses["cancelled-build"]; ok {
+		t.Errorf("cancelled build published statuses %v", got)
+	}
+}
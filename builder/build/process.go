@@ -0,0 +1,77 @@
+package build
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// builderOnlyEnv are variables of the builder that builds must not see. With
+// the service token secret a build script could mint service tokens.
+var builderOnlyEnv = map[string]bool{
+	"SERVICE_TOKEN_SECRET": true,
+	"JWT_SECRET":           true,
+}
+
+// buildEnv returns the builder's environment without builderOnlyEnv
+func buildEnv() []string {
+	env := make([]string, 0)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !builderOnlyEnv[name] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// command creates a command in dir that is killed together with every process
+// it started as soon as ctx is cancelled
+func command(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = buildEnv()
+
+	// Own process group, so build tools and their children can be killed at once
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait for orphans that still hold the output pipes open
+	cmd.WaitDelay = 5 * time.Second
+
+	return cmd
+}
+
+// startBuild registers a running build so Cancel can stop it. The returned
+// function must be called once the build is done.
+func (b *Builder) startBuild(ctx context.Context, buildID string) (context.Context, func()) {
+	buildCtx, cancel := context.WithCancel(ctx)
+
+	b.runningMutex.Lock()
+	b.running[buildID] = cancel
+	b.runningMutex.Unlock()
+
+	return buildCtx, func() {
+		b.runningMutex.Lock()
+		delete(b.running, buildID)
+		b.runningMutex.Unlock()
+		cancel()
+	}
+}
+
+// Cancel stops the build if it runs on this builder
+func (b *Builder) Cancel(buildID string) {
+	b.runningMutex.Lock()
+	cancel, ok := b.running[buildID]
+	b.runningMutex.Unlock()
+
+	if ok {
+		log.Printf("🛑 Cancelling running build %s", buildID)
+		cancel()
+	}
+}
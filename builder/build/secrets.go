@@ -0,0 +1,122 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/tracing"
+)
+
+// secretMask replaces secret values in log output
+const secretMask = "***"
+
+// buildSecrets are the secrets of a running build
+type buildSecrets struct {
+	env    []string
+	masker *strings.Replacer
+}
+
+type secretsContextKey struct{}
+
+// withSecrets returns a context carrying the build's secrets for secretEnv and maskSecrets
+func withSecrets(ctx context.Context, secrets map[string]string) context.Context {
+	names := make([]string, 0, len(secrets))
+	values := make([]string, 0, len(secrets))
+	for name, value := range secrets {
+		names = append(names, name)
+		if value == "" {
+			continue
+		}
+		values = append(values, value)
+		// Logs are sent line by line, so lines of multi-line values are masked too
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" && line != value {
+				values = append(values, line)
+			}
+		}
+	}
+	sort.Strings(names)
+	// Longer values first, so a value containing another one is masked as a whole
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	s := &buildSecrets{env: make([]string, 0, len(names))}
+	for _, name := range names {
+		s.env = append(s.env, name+"="+secrets[name])
+	}
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, secretMask)
+	}
+	s.masker = strings.NewReplacer(pairs...)
+
+	return context.WithValue(ctx, secretsContextKey{}, s)
+}
+
+// secretEnv returns the build's secrets as environment variables
+func secretEnv(ctx context.Context) []string {
+	if s, ok := ctx.Value(secretsContextKey{}).(*buildSecrets); ok {
+		return s.env
+	}
+	return nil
+}
+
+// maskSecrets replaces the build's secret values in text
+func maskSecrets(ctx context.Context, text string) string {
+	if s, ok := ctx.Value(secretsContextKey{}).(*buildSecrets); ok {
+		return s.masker.Replace(text)
+	}
+	return text
+}
+
+// sendLog publishes a log entry of a build with its secrets masked
+func (b *Builder) sendLog(ctx context.Context, buildID, entry string) {
+	logMsg := message.BuildLogMessage{
+		BuildID:   buildID,
+		LogEntry:  maskSecrets(ctx, entry),
+		Timestamp: time.Now(),
+	}
+	b.kafkaProducer.SendMessage(ctx, kafka.TopicBuildLogs, buildID, logMsg)
+}
+
+// fetchSecrets resolves the secrets of a project build at the gateway, which
+// only hands them out once per build and while the build is running
+func (b *Builder) fetchSecrets(ctx context.Context, buildID, token string) (map[string]string, error) {
+	url := fmt.Sprintf("%s/api/internal/builds/%s/secrets", b.gatewayURL, buildID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := access.SetServiceToken(req, "builder"); err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Secrets-Token", token)
+
+	resp, err := tracing.NewHTTPClient(10 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("gateway returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var secrets map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
@@ -0,0 +1,52 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	ctx := withSecrets(context.Background(), map[string]string{
+		"NPM_TOKEN": "npm-abc",
+		"TOKEN":     "abc",
+		"EMPTY":     "",
+		"KEY":       "-----BEGIN KEY-----\nMIIBOgIBAAJB\n-----END KEY-----",
+	})
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"npm token npm-abc", "npm token ***"},
+		{"token abc", "token ***"},
+		// The longer value is masked as a whole, not as npm-***
+		{"npm-abcabc", "******"},
+		{"MIIBOgIBAAJB", "***"},
+		{"  MIIBOgIBAAJB  ", "  ***  "},
+		{"-----BEGIN KEY-----\nMIIBOgIBAAJB\n-----END KEY-----", "***"},
+		{"nothing secret", "nothing secret"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := maskSecrets(ctx, tt.text); got != tt.want {
+			t.Errorf("maskSecrets(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if got := maskSecrets(context.Background(), "abc"); got != "abc" {
+		t.Errorf("maskSecrets() without secrets = %q, want it unchanged", got)
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	ctx := withSecrets(context.Background(), map[string]string{"B": "2", "A": "1", "EMPTY": ""})
+
+	want := []string{"A=1", "B=2", "EMPTY="}
+	if got := secretEnv(ctx); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("secretEnv() = %q, want %q", got, want)
+	}
+	if got := secretEnv(context.Background()); got != nil {
+		t.Errorf("secretEnv() without secrets = %q, want nil", got)
+	}
+}
@@ -1,585 +1,156 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"gobuild/builder/build"
+	"gobuild/shared/access"
 	"gobuild/shared/kafka"
 	"gobuild/shared/message"
+	"gobuild/shared/repository"
+	"gobuild/shared/tracing"
 )
 
-// Builder executes build jobs
-type Builder struct {
-	id            string
-	workDir       string
-	kafkaProducer *kafka.Producer
-	storageURL    string
-}
-
-// NewBuilder creates a new Builder
-func NewBuilder(id, workDir, storageURL string, kafkaProducer *kafka.Producer) *Builder {
-	return &Builder{
-		id:            id,
-		workDir:       workDir,
-		kafkaProducer: kafkaProducer,
-		storageURL:    storageURL,
-	}
-}
-
-func (b *Builder) sendLogLines(buildID string, logContent string) {
-	lines := strings.Split(strings.TrimSpace(logContent), "\n")
-	for _, line := range lines {
-		if line != "" {
-			// Send to Kafka
-			logMsg := message.BuildLogMessage{
-				BuildID:   buildID,
-				LogEntry:  line,
-				Timestamp: time.Now(),
-			}
-			b.kafkaProducer.SendMessage("build-logs", buildID, logMsg)
-		}
-	}
-}
-
-// ProcessBuildJob processes a build job
-func (b *Builder) ProcessBuildJob(buildReq message.BuildRequestMessage) error {
-	log.Printf("🔨 Processing build request: %s for repo: %s", buildReq.ID, buildReq.RepositoryURL)
-
-	// Send initial status update
-	statusMsg := message.BuildStatusMessage{
-		BuildID:   buildReq.ID,
-		Status:    "in-progress",
-		Message:   "Build started",
-		UpdatedAt: time.Now(),
-	}
-	// Send to build-status topic (orchestrator will consume this)
-	if err := b.kafkaProducer.SendMessage("build-status", buildReq.ID, statusMsg); err != nil {
-		return err
-	}
-
-	// Send initial log
-	b.sendLogLines(buildReq.ID, "Build started")
-	b.sendLogLines(buildReq.ID, fmt.Sprintf("Repository: %s", buildReq.RepositoryURL))
-	if buildReq.Branch != "" {
-		b.sendLogLines(buildReq.ID, fmt.Sprintf("Branch: %s", buildReq.Branch))
-	}
-
-	// Send status update: in-progress
-	statusMsg = message.BuildStatusMessage{
-		BuildID:   buildReq.ID,
-		Status:    "in-progress",
-		Message:   "Build started",
-		UpdatedAt: time.Now(),
-	}
-	err := b.kafkaProducer.SendMessage("build-status", buildReq.ID, statusMsg)
-	if err != nil {
-		log.Printf("❌ Failed to send status update: %v", err)
-		return err
-	}
-
-	buildDir := filepath.Join(b.workDir, buildReq.ID)
-	err = os.MkdirAll(buildDir, 0755)
-	if err != nil {
-		log.Printf("❌ Failed to create build directory: %v", err)
-		return b.failBuild(buildReq.ID, fmt.Sprintf("Failed to create build directory: %v", err))
-	}
-
-	// Clean up build directory when done
-	defer func() {
-		if err := os.RemoveAll(buildDir); err != nil {
-			log.Printf("⚠️ Failed to clean up build directory: %v", err)
-		}
-	}()
-
-	b.sendLogLines(buildReq.ID, "Cloning repository...")
-
-	cloneCmd := exec.Command("git", "clone", buildReq.RepositoryURL, buildDir)
-	cloneCmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Disable interactive prompts
-
-	var cloneOutput bytes.Buffer
-	cloneCmd.Stdout = &cloneOutput
-	cloneCmd.Stderr = &cloneOutput
-
-	if err := cloneCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("Clone failed: %s", err.Error())
-		b.sendLogLines(buildReq.ID, errorMsg)
-		b.sendLogLines(buildReq.ID, cloneOutput.String())
-		return b.failBuild(buildReq.ID, "Failed to clone repository: "+err.Error())
-	}
-
-	// Log successful clone
-	b.sendLogLines(buildReq.ID, "Repository cloned successfully")
-	b.sendLogLines(buildReq.ID, cloneOutput.String())
-
-	// Checkout specific branch if specified
-	if buildReq.Branch != "" && buildReq.Branch != "main" && buildReq.Branch != "master" {
-		b.sendLogLines(buildReq.ID, fmt.Sprintf("Checking out branch: %s", buildReq.Branch))
-
-		checkoutCmd := exec.Command("git", "checkout", buildReq.Branch)
-		checkoutCmd.Dir = buildDir
-
-		var checkoutOutput bytes.Buffer
-		checkoutCmd.Stdout = &checkoutOutput
-		checkoutCmd.Stderr = &checkoutOutput
-
-		if err := checkoutCmd.Run(); err != nil {
-			errorMsg := fmt.Sprintf("Checkout failed: %s", err.Error())
-			b.sendLogLines(buildReq.ID, errorMsg)
-			b.sendLogLines(buildReq.ID, checkoutOutput.String())
-			return b.failBuild(buildReq.ID, "Failed to checkout branch: "+err.Error())
-		}
-
-		b.sendLogLines(buildReq.ID, "Branch checked out successfully")
-		b.sendLogLines(buildReq.ID, checkoutOutput.String())
-	}
-
-	// Execute build process
-	if err := b.executeBuild(buildReq, buildDir); err != nil {
-		return b.failBuild(buildReq.ID, err.Error())
-	}
-
-	// Create and upload artifact
-	if err := b.createAndUploadArtifact(buildReq, buildDir); err != nil {
-		return b.failBuild(buildReq.ID, "Failed to create artifact: "+err.Error())
-	}
-
-	b.sendLogLines(buildReq.ID, "Build completed successfully!")
-
-	statusMsg = message.BuildStatusMessage{
-		BuildID:   buildReq.ID,
-		Status:    "completed",
-		Message:   "Build completed successfully",
-		UpdatedAt: time.Now(),
-	}
-	return b.kafkaProducer.SendMessage("build-status", buildReq.ID, statusMsg)
-}
-
-// executeBuild runs the appropriate build command based on project type
-func (b *Builder) executeBuild(buildReq message.BuildRequestMessage, buildDir string) error {
-	buildFilePath := filepath.Join(buildDir, "build.sh")
-
-	if _, err := os.Stat(buildFilePath); os.IsNotExist(err) {
-		projectType := b.detectProjectType(buildDir)
-		return b.buildByProjectType(buildReq, buildDir, projectType)
-	} else {
-		return b.runBuildScript(buildReq, buildDir)
-	}
-}
-
-// buildByProjectType builds based on detected project type
-func (b *Builder) buildByProjectType(buildReq message.BuildRequestMessage, buildDir, projectType string) error {
-	switch projectType {
-	case "node":
-		return b.buildNodeProject(buildReq, buildDir)
-	case "go":
-		return b.buildGoProject(buildReq, buildDir)
-	default:
-		return fmt.Errorf("unknown project type: %s, no build script found", projectType)
-	}
-}
-
-// buildNodeProject builds a Node.js project
-func (b *Builder) buildNodeProject(buildReq message.BuildRequestMessage, buildDir string) error {
-	b.sendLogLines(buildReq.ID, "Detected Node.js project")
-
-	packageManager := b.detectNodePackageManager(buildDir)
-	if packageManager == "unknown" {
-		packageManager = "npm"
-	}
-
-	b.sendLogLines(buildReq.ID, fmt.Sprintf("Using package manager: %s", packageManager))
-
-	// Install dependencies
-	b.sendLogLines(buildReq.ID, fmt.Sprintf("Running %s install...", packageManager))
-	installCmd := exec.Command(packageManager, "install")
-	installCmd.Dir = buildDir
-
-	var installOutput bytes.Buffer
-	installCmd.Stdout = &installOutput
-	installCmd.Stderr = &installOutput
-
-	if err := installCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("%s install failed: %s", packageManager, err.Error())
-		b.sendLogLines(buildReq.ID, errorMsg)
-		b.sendLogLines(buildReq.ID, installOutput.String())
-		return fmt.Errorf("failed to install dependencies: %s", err.Error())
-	}
-
-	b.sendLogLines(buildReq.ID, "Dependencies installed successfully")
-	b.sendLogLines(buildReq.ID, installOutput.String())
-
-	// Build project
-	b.sendLogLines(buildReq.ID, fmt.Sprintf("Running %s run build...", packageManager))
-	buildCmd := exec.Command(packageManager, "run", "build")
-	buildCmd.Dir = buildDir
-
-	var buildOutput bytes.Buffer
-	buildCmd.Stdout = &buildOutput
-	buildCmd.Stderr = &buildOutput
-
-	if err := buildCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("%s build failed: %s", packageManager, err.Error())
-		b.sendLogLines(buildReq.ID, errorMsg)
-		b.sendLogLines(buildReq.ID, buildOutput.String())
-		return fmt.Errorf("failed to build project: %s", err.Error())
-	}
-
-	b.sendLogLines(buildReq.ID, "Project built successfully")
-	b.sendLogLines(buildReq.ID, buildOutput.String())
-
-	return nil
-}
-
-// buildGoProject builds a Go project
-func (b *Builder) buildGoProject(buildReq message.BuildRequestMessage, buildDir string) error {
-	logMsg := message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  "Detected Go project, running go build",
-		Timestamp: time.Now(),
-	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-
-	goBuildCmd := exec.Command("go", "build", "-o", "app")
-	goBuildCmd.Dir = buildDir
-
-	var buildOutput bytes.Buffer
-	goBuildCmd.Stdout = &buildOutput
-	goBuildCmd.Stderr = &buildOutput
-
-	if err := goBuildCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("go build failed: %s\nOutput: %s", err.Error(), buildOutput.String())
-		logMsg := message.BuildLogMessage{
-			BuildID:   buildReq.ID,
-			LogEntry:  errorMsg,
-			Timestamp: time.Now(),
-		}
-		b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-		return fmt.Errorf("failed to build project: %s", err.Error())
-	}
-
-	logMsg = message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  fmt.Sprintf("Go project built successfully\n%s", buildOutput.String()),
-		Timestamp: time.Now(),
-	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-
-	return nil
-}
-
-// runBuildScript executes a custom build script
-func (b *Builder) runBuildScript(buildReq message.BuildRequestMessage, buildDir string) error {
-	logMsg := message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  "Executing build script",
-		Timestamp: time.Now(),
-	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-
-	buildCmd := exec.Command("/bin/sh", "build.sh")
-	buildCmd.Dir = buildDir
-
-	var buildOutput bytes.Buffer
-	buildCmd.Stdout = &buildOutput
-	buildCmd.Stderr = &buildOutput
-
-	if err := buildCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("Build script failed: %s\nOutput: %s", err.Error(), buildOutput.String())
-		logMsg := message.BuildLogMessage{
-			BuildID:   buildReq.ID,
-			LogEntry:  errorMsg,
-			Timestamp: time.Now(),
-		}
-		b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-		return fmt.Errorf("build script failed: %s", err.Error())
-	}
-
-	logMsg = message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  fmt.Sprintf("Build script completed successfully\n%s", buildOutput.String()),
-		Timestamp: time.Now(),
-	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-
-	return nil
-}
-
-// createAndUploadArtifact creates a tar.gz of the build and uploads it
-func (b *Builder) createAndUploadArtifact(buildReq message.BuildRequestMessage, buildDir string) error {
-	logMsg := message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  "Creating artifact...",
-		Timestamp: time.Now(),
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8083"
 	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-
-	// Create a temporary artifact file with unique name
-	timestamp := time.Now().Format("20060102-150405")
-	tempArtifactPath := filepath.Join(b.workDir, fmt.Sprintf("%s-%s.tar.gz", buildReq.ID, timestamp))
 
-	tarCmd := exec.Command("tar", "-czf", tempArtifactPath, ".")
-	tarCmd.Dir = buildDir
-
-	var tarOutput bytes.Buffer
-	tarCmd.Stdout = &tarOutput
-	tarCmd.Stderr = &tarOutput
-
-	if err := tarCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("Failed to create artifact: %s\nOutput: %s", err.Error(), tarOutput.String())
-		logMsg := message.BuildLogMessage{
-			BuildID:   buildReq.ID,
-			LogEntry:  errorMsg,
-			Timestamp: time.Now(),
-		}
-		b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-		return fmt.Errorf("failed to create artifact: %s", err.Error())
+	// Service tokens signed with a missing or well-known secret could be forged
+	if err := access.CheckServiceSecret(); err != nil {
+		log.Fatalf("❌ Refusing to start: %v", err)
 	}
 
-	// Clean up temporary artifact when done
-	defer os.Remove(tempArtifactPath)
-
-	// Upload artifact to storage service
-	logMsg = message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  "Uploading artifact to storage...",
-		Timestamp: time.Now(),
+	storageURL := os.Getenv("STORAGE_URL")
+	if storageURL == "" {
+		storageURL = "http://storage:8084"
 	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
 
-	if err := b.uploadArtifact(buildReq.ID, tempArtifactPath, buildReq.CreatedAt); err != nil {
-		logMsg := message.BuildLogMessage{
-			BuildID:   buildReq.ID,
-			LogEntry:  fmt.Sprintf("Failed to upload artifact: %v", err),
-			Timestamp: time.Now(),
-		}
-		b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
-		return fmt.Errorf("failed to upload artifact: %s", err.Error())
+	// The gateway hands out the secrets of project builds on its internal port
+	gatewayURL := os.Getenv("GATEWAY_URL")
+	if gatewayURL == "" {
+		gatewayURL = "http://api-gateway:8091"
 	}
 
-	logMsg = message.BuildLogMessage{
-		BuildID:   buildReq.ID,
-		LogEntry:  "Artifact uploaded successfully",
-		Timestamp: time.Now(),
+	// Number of builds this instance runs at the same time
+	buildWorkers, err := strconv.Atoi(os.Getenv("BUILD_WORKERS"))
+	if err != nil || buildWorkers < 1 {
+		buildWorkers = 2
 	}
-	b.kafkaProducer.SendMessage("build-logs", buildReq.ID, logMsg)
 
-	return nil
-}
+	log.Println("🚀 Starting Builder Service...")
 
-// uploadArtifact uploads the artifact to the storage service
-func (b *Builder) uploadArtifact(buildID, artifactPath string, startTime time.Time) error {
-	log.Printf("📦 Uploading artifact %s to storage service...", artifactPath)
-	// Open the artifact file
-	file, err := os.Open(artifactPath)
+	shutdownTracing, err := tracing.Init("builder")
 	if err != nil {
-		return fmt.Errorf("failed to open artifact file: %v", err)
+		log.Fatalf("❌ Failed to initialise tracing: %v", err)
 	}
-	defer file.Close()
-
-	// Create a buffer to store our request body
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
 
-	// Create a form file field
-	part, err := writer.CreateFormFile("artifact", fmt.Sprintf("%s.tar.gz", buildID))
-	if err != nil {
-		return fmt.Errorf("failed to create form file: %v", err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Copy the file content to the form field
-	_, err = io.Copy(part, file)
+	workDir := "/app/work"
+	err = os.MkdirAll(workDir, 0755)
 	if err != nil {
-		return fmt.Errorf("failed to copy file content: %v", err)
+		log.Fatalf("❌ Failed to create work directory: %v", err)
 	}
 
-	// Close the multipart writer
-	err = writer.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close multipart writer: %v", err)
+	if err := kafka.EnsureTopics(ctx, "kafka:29092", kafka.Topics); err != nil {
+		log.Fatalf("❌ Failed to ensure Kafka topics: %v", err)
 	}
+	log.Println("✅ Kafka topics ensured")
 
-	// Create the HTTP request
-	url := fmt.Sprintf("%s/artifacts/%s", b.storageURL, buildID)
-	req, err := http.NewRequest("POST", url, &requestBody)
+	var kafkaProducer kafka.Publisher
+	kafkaProducer, err = kafka.NewProducer("kafka:29092")
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		log.Fatalf("❌ Failed to create Kafka producer: %v", err)
 	}
+	log.Println("✅ Kafka producer created")
 
-	// Set the content type header
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	// Send the request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to upload artifact: %v", err)
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "unknown"
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("storage service returned status %d: %s", resp.StatusCode, string(body))
-	} else {
-		artifactURL := fmt.Sprintf("%s/artifacts/%s", b.storageURL, buildID)
-
-		// Create and send build completion message via Kafka
-		completionMessage := message.BuildCompletionMessage{
-			BuildID:     buildID,
-			Status:      "success",
-			ArtifactURL: artifactURL,
-			Duration:    time.Since(startTime).Milliseconds(),
-			CompletedAt: time.Now(),
-		}
+	cancellations := kafka.NewBuildCancelView("kafka:29092")
+	builder := build.NewBuilder(fmt.Sprintf("builder-%s", hostname), workDir, storageURL, gatewayURL, kafkaProducer, cancellations, repository.PolicyFromEnv())
+	cancellations.OnUpdate(func(buildID string, _ message.BuildCancelMessage) {
+		builder.Cancel(buildID)
+	})
 
-		err = b.kafkaProducer.SendMessage("build-completions", buildID, completionMessage)
-		if err != nil {
-			log.Printf("⚠️ Failed to send build completion message: %v", err)
-		} else {
-			log.Printf("📤 Sent build completion message for build %s", buildID)
+	// Cancelled builds are known before the first job is taken, so queued jobs
+	// that were cancelled while this builder was down are skipped too
+	go func() {
+		if err := cancellations.Run(ctx); err != nil {
+			log.Printf("❌ Cancellation view stopped: %v", err)
+			stop()
 		}
-
-		return nil
-	}
-}
-
-// failBuild handles build failures
-func (b *Builder) failBuild(buildID, errorMsg string) error {
-	log.Printf("❌ Build failed for %s: %s", buildID, errorMsg)
-
-	// Send failure log
-	b.sendLogLines(buildID, fmt.Sprintf("Build failed: %s", errorMsg))
-
-	// Send completion message
-	completionMsg := message.BuildCompletionMessage{
-		BuildID:     buildID,
-		Status:      "failure",
-		ArtifactURL: "",
-		Duration:    0,
-		CompletedAt: time.Now(),
-	}
-	err := b.kafkaProducer.SendMessage("build-completions", buildID, completionMsg)
-	if err != nil {
-		return err
-	}
-
-	// Send status update
-	statusMsg := message.BuildStatusMessage{
-		BuildID:   buildID,
-		Status:    "failed",
-		Message:   errorMsg,
-		UpdatedAt: time.Now(),
-	}
-	return b.kafkaProducer.SendMessage("build-status", buildID, statusMsg)
-}
-
-// detectProjectType attempts to determine the type of project in the directory
-func (b *Builder) detectProjectType(dir string) string {
-	// Check for package.json (Node.js)
-	if _, err := os.Stat(filepath.Join(dir, "package.json")); !os.IsNotExist(err) {
-		return "node"
-	}
-
-	// Check for go.mod (Go)
-	if _, err := os.Stat(filepath.Join(dir, "go.mod")); !os.IsNotExist(err) {
-		return "go"
-	}
-
-	return "unknown"
-}
-
-func (b *Builder) detectNodePackageManager(dir string) string {
-	if _, err := os.Stat(filepath.Join(dir, "pnpm-lock.yaml")); !os.IsNotExist(err) {
-		return "pnpm"
-	}
-
-	if _, err := os.Stat(filepath.Join(dir, "package-lock.json")); !os.IsNotExist(err) {
-		return "npm"
-	}
-
-	if _, err := os.Stat(filepath.Join(dir, "yarn.lock")); !os.IsNotExist(err) {
-		return "yarn"
-	}
-
-	return "unknown"
-}
-
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8083"
-	}
-
-	storageURL := os.Getenv("STORAGE_URL")
-	if storageURL == "" {
-		storageURL = "http://storage:8084"
-	}
-
-	log.Println("🚀 Starting Builder Service...")
-
-	workDir := "/app/work"
-	err := os.MkdirAll(workDir, 0755)
-	if err != nil {
-		log.Fatalf("❌ Failed to create work directory: %v", err)
-	}
-
-	kafkaProducer, err := kafka.NewProducer("kafka:29092")
-	if err != nil {
-		log.Fatalf("❌ Failed to create Kafka producer: %v", err)
+	}()
+	if err := cancellations.WaitReady(ctx); err != nil {
+		log.Fatalf("❌ Failed to load build cancellations: %v", err)
 	}
-	defer kafkaProducer.Close()
-	log.Println("✅ Kafka producer created")
+	log.Println("✅ Build cancellations loaded")
 
-	kafkaConsumer, err := kafka.NewConsumer("kafka:29092", "builder")
+	var kafkaConsumer kafka.Subscriber
+	kafkaConsumer, err = kafka.NewConsumer("kafka:29092", "builder",
+		kafka.WithManualCommit(3, 2*time.Second),
+		kafka.WithDeadLetterQueue(kafkaProducer),
+		// One queued job per worker, the rest stays in Kafka for other builders
+		kafka.WithWorkers(buildWorkers, 1))
 	if err != nil {
 		log.Fatalf("❌ Failed to create Kafka consumer: %v", err)
 	}
-	defer kafkaConsumer.Close()
 	log.Println("✅ Kafka consumer created")
 
-	// Subscribe to build-jobs topic (not build-requests to avoid loop)
-	err = kafkaConsumer.Subscribe([]string{"build-jobs"})
-	if err != nil {
-		log.Fatalf("❌ Failed to subscribe to topics: %v", err)
-	}
-	log.Println("✅ Subscribed to build-jobs topic")
-
-	hostname, _ := os.Hostname()
-	if hostname == "" {
-		hostname = "unknown"
-	}
-	builder := NewBuilder(fmt.Sprintf("builder-%s", hostname), workDir, storageURL, kafkaProducer)
-
+	consumerDone := make(chan struct{})
 	go func() {
+		defer close(consumerDone)
 		log.Println("🎧 Starting to consume messages from build-jobs...")
-		kafkaConsumer.ConsumeMessages(func(key, value []byte) error {
-			log.Printf("📨 Received message with key: %s", string(key))
-
-			var buildReq message.BuildRequestMessage
-			if err := kafka.UnmarshalMessage(value, &buildReq); err != nil {
-				log.Printf("❌ Failed to unmarshal build request: %v", err)
-				return err
-			}
-
-			return builder.ProcessBuildJob(buildReq)
-		})
+		if err := builder.ConsumeJobs(ctx, kafkaConsumer); err != nil {
+			log.Printf("❌ Kafka consumer stopped: %v", err)
+			stop()
+		}
 	}()
 
 	r := mux.NewRouter()
+	r.Use(tracing.Middleware)
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	log.Printf("🌐 Builder Service is running on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		log.Printf("🌐 Builder Service is running on port %s...", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("❌ HTTP server failed: %v", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("🛑 Shutting down Builder Service, waiting for the running build...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ HTTP server shutdown: %v", err)
+	}
+
+	// Let the current build finish so its status and completion events are published
+	<-consumerDone
+	kafkaConsumer.Close()
+	kafkaProducer.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("⚠️ Failed to flush traces: %v", err)
+	}
+	log.Println("👋 Builder Service stopped")
 }
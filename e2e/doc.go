@@ -0,0 +1,4 @@
+// Package e2e runs the build orchestrator, the builder, the notification
+// service and the status dashboard API together in one process, on an
+// in-memory bus and an in-memory Redis, and follows builds through all of them.
+package e2e
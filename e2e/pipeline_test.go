@@ -0,0 +1,288 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gobuild/build-orchestrator/orchestrator"
+	"gobuild/builder/build"
+	"gobuild/notification/notifier"
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/model"
+	"gobuild/shared/repository"
+	"gobuild/status-dashboard-api/dashboard"
+)
+
+// stateView stands in for a StateView on the in-memory bus
+type stateView[T message.Event] struct {
+	mu    sync.RWMutex
+	state map[string]T
+}
+
+func newStateView[T message.Event]() *stateView[T] {
+	return &stateView[T]{state: make(map[string]T)}
+}
+
+func (v *stateView[T]) Get(key string) (T, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	event, ok := v.state[key]
+	return event, ok
+}
+
+// handle applies a message of the view's topic, a tombstone removes its key
+func (v *stateView[T]) handle(ctx context.Context, key []byte, value []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if value == nil {
+		delete(v.state, string(key))
+		return nil
+	}
+	env, err := message.ParseEnvelope(value)
+	if err != nil {
+		return err
+	}
+	var event T
+	if err := env.Decode(&event); err != nil {
+		return err
+	}
+	v.state[string(key)] = event
+	return nil
+}
+
+// pipeline is every service a build passes through, wired to one bus and one Redis
+type pipeline struct {
+	bus           *kafka.MemoryBus
+	builds        *stateView[message.BuildStateMessage]
+	dashboard     *httptest.Server
+	notifications *httptest.Server
+}
+
+func newPipeline(t *testing.T) *pipeline {
+	t.Helper()
+	t.Setenv("SERVICE_TOKEN_SECRET", "e2e-service-secret")
+
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+	bus := kafka.NewMemoryBus(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	consume := func(subscriber kafka.Subscriber, topics []string, handler kafka.MessageHandler) {
+		t.Helper()
+		if err := subscriber.Subscribe(topics); err != nil {
+			t.Fatalf("Subscribe() = %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subscriber.ConsumeMessages(ctx, handler)
+		}()
+	}
+
+	buildOrchestrator := orchestrator.NewBuildOrchestrator(bus.Publisher(), redisClient, "http://storage.invalid")
+	consume(bus.Subscriber("build-orchestrator"), orchestrator.Topics, buildOrchestrator.Dispatcher().HandleMessage)
+
+	cancellations := newStateView[message.BuildCancelMessage]()
+	consume(bus.Subscriber("builder-cancellations"), []string{kafka.TopicBuildCancellations}, cancellations.handle)
+	policy := repository.NewPolicy([]string{"https"}, []string{"github.com"})
+	builder := build.NewBuilder("builder-e2e", t.TempDir(), "http://storage.invalid", "http://gateway.invalid", bus.Publisher(), cancellations, policy)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		builder.ConsumeJobs(ctx, bus.Subscriber("builder"))
+	}()
+
+	builds := newStateView[message.BuildStateMessage]()
+	consume(bus.Subscriber("notification-builds"), []string{kafka.TopicBuildState}, builds.handle)
+	notificationService := notifier.NewNotificationService(builds)
+	consume(bus.Subscriber("notification"), notifier.Topics, notificationService.Dispatcher().HandleMessage)
+	notifications := httptest.NewServer(http.HandlerFunc(notificationService.HandleWebSocket))
+	t.Cleanup(func() {
+		notificationService.CloseAll()
+		notifications.Close()
+	})
+
+	api := dashboard.NewStatusDashboardAPI(redisClient)
+	consume(bus.Subscriber("status-dashboard-api"), dashboard.Topics, api.Dispatcher().HandleMessage)
+	router := mux.NewRouter()
+	router.Use(access.Middleware)
+	api.RegisterRoutes(router)
+	dashboardServer := httptest.NewServer(router)
+	t.Cleanup(dashboardServer.Close)
+
+	return &pipeline{bus: bus, builds: builds, dashboard: dashboardServer, notifications: notifications}
+}
+
+// serviceToken returns a token that sees every build
+func serviceToken(t *testing.T) string {
+	t.Helper()
+	token, err := access.NewServiceToken("e2e")
+	if err != nil {
+		t.Fatalf("NewServiceToken() = %v", err)
+	}
+	return token
+}
+
+// subscribe connects to the notification service for the events of a build.
+// It returns once the service registered the client, so no event is missed.
+func (p *pipeline) subscribe(t *testing.T, buildID string) <-chan map[string]interface{} {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(p.notifications.URL, "http") + "/ws?clientId=e2e&buildId=" + buildID + "&access_token=" + serviceToken(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The service reads, and so answers pings, only after registering the client
+	registered := make(chan struct{})
+	conn.SetPongHandler(func(string) error {
+		close(registered)
+		conn.SetPongHandler(nil)
+		return nil
+	})
+	if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteControl() = %v", err)
+	}
+
+	events := make(chan map[string]interface{}, 100)
+	go func() {
+		defer close(events)
+		for {
+			var event map[string]interface{}
+			if err := conn.ReadJSON(&event); err != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notification service did not register the client")
+	}
+	return events
+}
+
+// getBuild reads a build from the dashboard
+func (p *pipeline) getBuild(t *testing.T, buildID string) (int, *model.BuildStatus, []string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", p.dashboard.URL+"/api/builds/"+buildID, nil)
+	req.Header.Set("Authorization", "Bearer "+serviceToken(t))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/builds/%s = %v", buildID, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		*model.BuildStatus
+		Logs []string `json:"logs"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("GET /api/builds/%s returned %v", buildID, err)
+		}
+	}
+	return resp.StatusCode, body.BuildStatus, body.Logs
+}
+
+// TestBuildPipeline follows a build request from the orchestrator through the
+// builder, which rejects its repository, to the clients of the notification
+// service and the status dashboard.
+func TestBuildPipeline(t *testing.T) {
+	p := newPipeline(t)
+	events := p.subscribe(t, "rejected-build")
+
+	request := message.BuildRequestMessage{
+		ID:            "rejected-build",
+		RepositoryURL: "ftp://example.com/app.git",
+		Branch:        "main",
+		UserID:        "u1",
+		CreatedAt:     time.Now(),
+	}
+	if err := p.bus.Publisher().SendMessage(context.Background(), kafka.TopicBuildRequests, request.ID, request); err != nil {
+		t.Fatalf("SendMessage() = %v", err)
+	}
+
+	// Status events of a build share a partition, so they arrive in order
+	var statuses []string
+	var logs []string
+	var completion map[string]interface{}
+	timeout := time.After(5 * time.Second)
+	for completion == nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("the notification service closed the connection")
+			}
+			if event["buildId"] != request.ID {
+				t.Errorf("received an event of build %v, want only %s", event["buildId"], request.ID)
+			}
+			switch event["type"] {
+			case "status":
+				statuses = append(statuses, event["status"].(string))
+			case "log":
+				logs = append(logs, event["log"].(string))
+			case "completion":
+				completion = event
+			}
+		case <-timeout:
+			t.Fatalf("no completion was pushed, statuses %v", statuses)
+		}
+	}
+	if completion["status"] != "failure" {
+		t.Errorf("pushed completion = %v, want failure", completion["status"])
+	}
+	if len(statuses) < 2 || statuses[0] != "queued" || statuses[1] != "in-progress" {
+		t.Errorf("pushed statuses = %v, want queued, then in-progress", statuses)
+	}
+	if len(logs) == 0 || logs[0] != "Build started" {
+		t.Errorf("pushed logs = %v, want Build started first", logs)
+	}
+
+	// The orchestrator stores the completion while the event is being pushed
+	deadline := time.Now().Add(5 * time.Second)
+	var status int
+	var stored *model.BuildStatus
+	var storedLogs []string
+	for {
+		status, stored, storedLogs = p.getBuild(t, request.ID)
+		if status == http.StatusOK && stored.Finished() && len(storedLogs) > 0 && strings.HasPrefix(storedLogs[len(storedLogs)-1], "Build failed: ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /api/builds/%s = %d, %+v, logs %v, want the failed build", request.ID, status, stored, storedLogs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if stored.UserID != request.UserID || stored.Branch != request.Branch || stored.StartedAt == nil {
+		t.Errorf("GET /api/builds/%s = %+v, want the request's user and branch and a start time", request.ID, stored)
+	}
+	if state, ok := p.builds.Get(request.ID); !ok || state.UserID != request.UserID {
+		t.Errorf("build state of %s = %+v, %v, want it owned by %s", request.ID, state, ok, request.UserID)
+	}
+
+	if status, _, _ := p.getBuild(t, "unknown-build"); status != http.StatusNotFound {
+		t.Errorf("GET /api/builds/unknown-build = %d, want %d", status, http.StatusNotFound)
+	}
+}
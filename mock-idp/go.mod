@@ -0,0 +1,5 @@
+module gobuild/mock-idp
+
+go 1.24.3
+
+require github.com/golang-jwt/jwt/v5 v5.2.2
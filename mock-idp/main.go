@@ -0,0 +1,323 @@
+// mock-idp is a minimal OpenID Connect provider for trying out and testing SSO
+// login locally. It signs in whoever enters an email, with the groups entered
+// alongside it. Never use it outside of development.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// codeTTL is how long an authorization code can be redeemed
+const codeTTL = time.Minute
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// authorization is an issued authorization code waiting to be redeemed
+type authorization struct {
+	ClientID      string
+	RedirectURI   string
+	CodeChallenge string
+	Nonce         string
+	Email         string
+	Groups        []string
+	ExpiresAt     time.Time
+}
+
+type IdP struct {
+	// issuer is the URL services use; publicURL the one browsers use, which
+	// differs inside docker compose
+	issuer       string
+	publicURL    string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	keyID        string
+
+	mu    sync.Mutex
+	codes map[string]*authorization
+}
+
+func NewIdP(issuer, publicURL, clientID, clientSecret string) (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	return &IdP{
+		issuer:       issuer,
+		publicURL:    publicURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		key:          key,
+		keyID:        kid,
+		codes:        make(map[string]*authorization),
+	}, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *IdP) Discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.publicURL + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+	})
+}
+
+func (p *IdP) JWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock IdP</title></head>
+<body style="font-family: sans-serif; max-width: 24rem; margin: 4rem auto">
+<h2>Mock IdP login</h2>
+<form method="POST" action="authorize">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<p><label>Email<br><input name="email" value="{{.Email}}" required></label></p>
+<p><label>Groups (comma separated)<br><input name="groups" value="{{.Groups}}"></label></p>
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// Authorize shows the login form on GET and issues an authorization code on POST
+func (p *IdP) Authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("client_id") != p.clientID {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("response_type") != "code" {
+		http.Error(w, "Only response_type=code is supported", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("code_challenge") == "" || r.Form.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with code_challenge_method=S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, map[string]interface{}{
+			"Params": r.URL.Query(),
+			"Email":  getEnv("MOCK_IDP_EMAIL", "dev@example.com"),
+			"Groups": os.Getenv("MOCK_IDP_GROUPS"),
+		})
+		return
+	}
+
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	var groups []string
+	for _, group := range strings.Split(r.PostForm.Get("groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	code, err := randomString(32)
+	if err != nil {
+		http.Error(w, "Failed to issue code", http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.codes[code] = &authorization{
+		ClientID:      p.clientID,
+		RedirectURI:   redirectURI.String(),
+		CodeChallenge: r.Form.Get("code_challenge"),
+		Nonce:         r.Form.Get("nonce"),
+		Email:         email,
+		Groups:        groups,
+		ExpiresAt:     time.Now().Add(codeTTL),
+	}
+	p.mu.Unlock()
+	log.Printf("🔑 Signed in %s with groups %v", email, groups)
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	if state := r.Form.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// Token redeems an authorization code for an ID token
+func (p *IdP) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	auth, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || time.Now().After(auth.ExpiresAt) || auth.ClientID != clientID {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != auth.RedirectURI {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.CodeChallenge {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	// The subject stays the same for an email across restarts
+	subject := sha256.Sum256([]byte(auth.Email))
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            hex.EncodeToString(subject[:16]),
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          auth.Email,
+		"email_verified": true,
+		"groups":         auth.Groups,
+	}
+	if auth.Nonce != "" {
+		claims["nonce"] = auth.Nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+	accessToken, err := randomString(32)
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func main() {
+	log.Println("🚀 Starting Mock IdP...")
+
+	port := getEnv("PORT", "9000")
+	issuer := strings.TrimSuffix(getEnv("MOCK_IDP_ISSUER", "http://localhost:"+port), "/")
+	publicURL := strings.TrimSuffix(getEnv("MOCK_IDP_PUBLIC_URL", issuer), "/")
+
+	idp, err := NewIdP(issuer, publicURL,
+		getEnv("MOCK_IDP_CLIENT_ID", "gobuild"),
+		getEnv("MOCK_IDP_CLIENT_SECRET", "gobuild-secret"))
+	if err != nil {
+		log.Fatalf("❌ Failed to create signing key: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.Discovery)
+	mux.HandleFunc("GET /jwks", idp.JWKS)
+	mux.HandleFunc("GET /authorize", idp.Authorize)
+	mux.HandleFunc("POST /authorize", idp.Authorize)
+	mux.HandleFunc("POST /token", idp.Token)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("✅ Mock IdP listening on port %s with issuer %s", port, issuer)
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
@@ -0,0 +1,238 @@
+// Package notifier pushes the status, logs and completion of builds to the
+// WebSocket clients allowed to see them.
+package notifier
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/tracing"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type WebSocketClient struct {
+	conn     *websocket.Conn
+	buildID  string
+	clientID string
+	claims   *access.Claims
+}
+type NotificationService struct {
+	clients      map[string]*WebSocketClient
+	clientsMutex sync.RWMutex
+	upgrader     websocket.Upgrader
+	// builds knows the owner of every build, events are only sent to clients allowed to see the build
+	builds kafka.StateLookup[message.BuildStateMessage]
+}
+
+func NewNotificationService(builds kafka.StateLookup[message.BuildStateMessage]) *NotificationService {
+	return &NotificationService{
+		clients: make(map[string]*WebSocketClient),
+		builds:  builds,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Allow all origins for this example
+			},
+		},
+	}
+}
+func (ns *NotificationService) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Browsers cannot set headers on WebSockets, so the token usually comes as access_token query parameter
+	claims, err := access.Authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Upgrade the HTTP connection to a WebSocket connection
+	conn, err := ns.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+
+	buildID := r.URL.Query().Get("buildId")
+	clientID := r.URL.Query().Get("clientId")
+
+	if clientID == "" {
+		log.Printf("Missing clientId")
+		conn.Close()
+		return
+	}
+
+	client := &WebSocketClient{
+		conn:     conn,
+		buildID:  buildID, // Can be empty to receive all build updates
+		clientID: clientID,
+		claims:   claims,
+	}
+
+	ns.clientsMutex.Lock()
+	ns.clients[clientID] = client
+	ns.clientsMutex.Unlock()
+
+	defer func() {
+		ns.clientsMutex.Lock()
+		delete(ns.clients, clientID)
+		ns.clientsMutex.Unlock()
+		conn.Close()
+	}()
+
+	// The token is only checked here, so the connection must not outlive it.
+	// Clients reconnect with a refreshed token.
+	if claims.ExpiresAt != nil {
+		expiry := time.AfterFunc(time.Until(claims.ExpiresAt.Time), func() {
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+			conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			conn.Close()
+		})
+		defer expiry.Stop()
+	}
+
+	// Keep the connection alive and handle ping/pong
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			break
+		}
+
+		// Handle ping messages
+		if messageType == websocket.PingMessage {
+			conn.WriteMessage(websocket.PongMessage, message)
+		}
+	}
+}
+
+// wantsBuild reports whether client subscribed to the build and may see it.
+// Builds not yet in the state view are only sent to admins and services.
+func (ns *NotificationService) wantsBuild(client *WebSocketClient, buildID string) bool {
+	if client.buildID != "" && client.buildID != buildID {
+		return false
+	}
+	if client.claims.SeesAllBuilds() {
+		return true
+	}
+	state, ok := ns.builds.Get(buildID)
+	return ok && client.claims.CanViewBuild(&state.BuildStatus)
+}
+
+// BroadcastBuildStatus broadcasts a build status update to all connected clients
+func (ns *NotificationService) BroadcastBuildStatus(statusMsg message.BuildStatusMessage) {
+	ns.clientsMutex.RLock()
+	defer ns.clientsMutex.RUnlock()
+
+	message := map[string]interface{}{
+		"type":    "status",
+		"buildId": statusMsg.BuildID,
+		"status":  statusMsg.Status,
+		"message": statusMsg.Message,
+		"time":    statusMsg.UpdatedAt,
+	}
+
+	for clientID, client := range ns.clients {
+		// Send to clients that are interested in this build or all builds
+		if ns.wantsBuild(client, statusMsg.BuildID) {
+			err := client.conn.WriteJSON(message)
+			if err != nil {
+				log.Printf("Failed to send message to client %s: %v", clientID, err)
+				// Client will be cleaned up by the connection handler
+			}
+		}
+	}
+
+}
+
+// BroadcastBuildLog broadcasts a build log entry to all connected clients
+func (ns *NotificationService) BroadcastBuildLog(logMsg message.BuildLogMessage) {
+	ns.clientsMutex.RLock()
+	defer ns.clientsMutex.RUnlock()
+
+	logMessage := map[string]interface{}{
+		"type":    "log",
+		"buildId": logMsg.BuildID,
+		"log":     logMsg.LogEntry,
+		"time":    logMsg.Timestamp,
+	}
+
+	for clientID, client := range ns.clients {
+		// Send to clients that are interested in this build or all builds
+		if ns.wantsBuild(client, logMsg.BuildID) {
+			err := client.conn.WriteJSON(logMessage)
+			if err != nil {
+				log.Printf("Failed to send logMessage to client %s: %v", clientID, err)
+				// Client will be cleaned up by the connection handler
+			}
+		}
+	}
+}
+
+func (ns *NotificationService) BroadcastBuildCompletion(completionMsg message.BuildCompletionMessage) {
+	ns.clientsMutex.RLock()
+	defer ns.clientsMutex.RUnlock()
+
+	buildMessage := map[string]interface{}{
+		"type":        "completion",
+		"buildId":     completionMsg.BuildID,
+		"status":      completionMsg.Status,
+		"artifactUrl": completionMsg.ArtifactURL,
+		"duration":    completionMsg.Duration,
+		"time":        completionMsg.CompletedAt,
+	}
+
+	for clientID, client := range ns.clients {
+		// Send to clients that are interested in this build or all builds
+		if ns.wantsBuild(client, completionMsg.BuildID) {
+			err := client.conn.WriteJSON(buildMessage)
+			if err != nil {
+				log.Printf("Failed to send buildMessage to client %s: %v", clientID, err)
+				// Client will be cleaned up by the connection handler
+			}
+		}
+	}
+
+	log.Printf("Broadcasted completion for build %s to %d clients", completionMsg.BuildID, len(ns.clients))
+}
+
+// CloseAll sends a close frame to every connected client and closes the connection
+func (ns *NotificationService) CloseAll() {
+	ns.clientsMutex.RLock()
+	defer ns.clientsMutex.RUnlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, client := range ns.clients {
+		client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		client.conn.Close()
+	}
+}
+
+// Topics are the topics whose events are pushed to the clients
+var Topics = []string{kafka.TopicBuildStatus, kafka.TopicBuildLogs, kafka.TopicBuildCompletions}
+
+// Dispatcher returns a dispatcher that broadcasts the events of Topics
+func (ns *NotificationService) Dispatcher() *kafka.Dispatcher {
+	dispatcher := kafka.NewDispatcher()
+	kafka.On(dispatcher, func(ctx context.Context, statusMsg message.BuildStatusMessage) error {
+		ns.BroadcastBuildStatus(statusMsg)
+		return nil
+	})
+	kafka.On(dispatcher, func(ctx context.Context, logMsg message.BuildLogMessage) error {
+		if logMsg.LogEntry != "" {
+			ns.BroadcastBuildLog(logMsg)
+		}
+		return nil
+	})
+	kafka.On(dispatcher, func(ctx context.Context, completionMsg message.BuildCompletionMessage) error {
+		tracing.Logf(ctx, "✅ Received completion message for build: %s - Status: %s - ArtifactURL: %s",
+			completionMsg.BuildID, completionMsg.Status, completionMsg.ArtifactURL)
+		ns.BroadcastBuildCompletion(completionMsg)
+		return nil
+	})
+	return dispatcher
+}
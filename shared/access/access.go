@@ -0,0 +1,258 @@
+// Package access verifies the access tokens issued by the api-gateway in the
+// other services, mints service tokens and decides who may see a build.
+package access
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gobuild/shared/jwks"
+	"gobuild/shared/model"
+)
+
+// Roles with access to every build
+const (
+	RoleAdmin = "admin"
+	// RoleService is used by service tokens for calls between services
+	RoleService = "service"
+)
+
+// serviceTokenTTL is the lifetime of a service token, one is minted per call
+const serviceTokenTTL = 5 * time.Minute
+
+// Algorithms of access tokens (signed by the api-gateway, verified through its
+// JWKS) and of service tokens (signed with the secret shared by the services)
+var (
+	accessTokenMethods = []string{"EdDSA", "RS256"}
+	serviceTokenMethod = jwt.SigningMethodHS256
+)
+
+// placeholderServiceSecret is the example secret earlier setups shipped with
+const placeholderServiceSecret = "your-service-secret-change-in-production"
+
+var (
+	keySet = jwks.NewRemoteSet(getEnv("JWKS_URL", "http://api-gateway:8081/.well-known/jwks.json"))
+
+	ErrMissingToken             = errors.New("missing access token")
+	ErrInvalidToken             = errors.New("invalid access token")
+	ErrNoServiceSecret          = errors.New("SERVICE_TOKEN_SECRET is not set")
+	ErrPlaceholderServiceSecret = errors.New("SERVICE_TOKEN_SECRET is still the example value")
+)
+
+// CheckServiceSecret reports an error unless a real service token secret is
+// configured. Services that call each other refuse to start without one, since
+// whoever knows the secret can mint tokens that see every build. Without it
+// service tokens are neither issued nor accepted.
+func CheckServiceSecret() error {
+	switch string(serviceSecret()) {
+	case "":
+		return ErrNoServiceSecret
+	case placeholderServiceSecret:
+		return ErrPlaceholderServiceSecret
+	}
+	return nil
+}
+
+// serviceSecret signs service tokens; JWT_SECRET is its former name. It is read
+// on every use, so services started in-process by tests can set it.
+func serviceSecret() []byte {
+	return []byte(getEnv("SERVICE_TOKEN_SECRET", os.Getenv("JWT_SECRET")))
+}
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Claims are the claims of an access token issued by the api-gateway or of a service token
+type Claims struct {
+	ID    string   `json:"id"`
+	Email string   `json:"email"`
+	Role  string   `json:"role"`
+	Teams []string `json:"teams,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ValidateToken checks signature and expiry of an access or service token.
+// Access tokens are verified with the api-gateway's published keys. Revocation
+// is only checked by the api-gateway, so a revoked token keeps working here
+// until it expires.
+func ValidateToken(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() == serviceTokenMethod.Alg() {
+			return serviceSecret(), CheckServiceSecret()
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keySet.Key(ctx, kid, token.Method.Alg())
+	}, jwt.WithValidMethods(append([]string{serviceTokenMethod.Alg()}, accessTokenMethods...)))
+	if err != nil {
+		return nil, errors.Join(ErrInvalidToken, err)
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	// Every service holds the shared secret, so it must only make service
+	// tokens, and the api-gateway never signs them
+	if (token.Method.Alg() == serviceTokenMethod.Alg()) != (claims.Role == RoleService) {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// ValidateServiceToken checks a service token, for the api-gateway which
+// verifies its own access tokens
+func ValidateServiceToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return serviceSecret(), CheckServiceSecret()
+	}, jwt.WithValidMethods([]string{serviceTokenMethod.Alg()}))
+	if err != nil {
+		return nil, errors.Join(ErrInvalidToken, err)
+	}
+	if !token.Valid || claims.Role != RoleService {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// NewServiceToken returns a short-lived token that gives the calling service access to every build
+func NewServiceToken(service string) (string, error) {
+	if err := CheckServiceSecret(); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		ID:   service,
+		Role: RoleService,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(serviceTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    service,
+			Subject:   service,
+		},
+	}
+	return jwt.NewWithClaims(serviceTokenMethod, claims).SignedString(serviceSecret())
+}
+
+// SetServiceToken authenticates an outgoing request as service
+func SetServiceToken(req *http.Request, service string) error {
+	token, err := NewServiceToken(service)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// TokenFromRequest returns the bearer token of the Authorization header or, for
+// WebSockets and download links which cannot set headers, the access_token query parameter
+func TokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.Split(header, " ")
+		if len(parts) == 2 && parts[0] == "Bearer" {
+			return parts[1]
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// Authenticate validates the token of the request
+func Authenticate(r *http.Request) (*Claims, error) {
+	token := TokenFromRequest(r)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	return ValidateToken(r.Context(), token)
+}
+
+// Middleware rejects requests without a valid token and stores the claims in
+// the request context. OPTIONS requests and /health are let through.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := Authenticate(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims)))
+	})
+}
+
+// RequireAdmin only lets admins through; it must run after Middleware
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok || claims.Role != RoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdminOrService only lets admins and other services through; it must run after Middleware
+func RequireAdminOrService(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok || !claims.SeesAllBuilds() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "accessClaims"
+
+func ContextWithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// SeesAllBuilds reports whether the claims belong to an admin or a service
+func (c *Claims) SeesAllBuilds() bool {
+	return c.Role == RoleAdmin || c.Role == RoleService
+}
+
+// CanViewBuild reports whether the claims allow reading build, its logs and its artifact
+func (c *Claims) CanViewBuild(build *model.BuildStatus) bool {
+	return c.SeesAllBuilds() || build.Public || IsOwnerOrTeamMember(c.ID, c.Teams, build)
+}
+
+// IsOwnerOrTeamMember reports whether the user started the build or is in a team it is shared with
+func IsOwnerOrTeamMember(userID string, teams []string, build *model.BuildStatus) bool {
+	if userID != "" && build.UserID == userID {
+		return true
+	}
+	for _, shared := range build.SharedWithTeams {
+		for _, team := range teams {
+			if shared == team {
+				return true
+			}
+		}
+	}
+	return false
+}
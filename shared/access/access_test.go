@@ -0,0 +1,93 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// withServiceSecret sets the service token secret for the duration of a test
+func withServiceSecret(t *testing.T, secret string) {
+	t.Helper()
+	t.Setenv("SERVICE_TOKEN_SECRET", secret)
+	t.Setenv("JWT_SECRET", "")
+}
+
+func TestCheckServiceSecret(t *testing.T) {
+	tests := []struct {
+		secret string
+		want   error
+	}{
+		{"", ErrNoServiceSecret},
+		{placeholderServiceSecret, ErrPlaceholderServiceSecret},
+		{"0f6c2d9e4b1a", nil},
+	}
+	for _, tt := range tests {
+		withServiceSecret(t, tt.secret)
+		if err := CheckServiceSecret(); !errors.Is(err, tt.want) {
+			t.Errorf("CheckServiceSecret() with %q = %v, want %v", tt.secret, err, tt.want)
+		}
+	}
+}
+
+func TestServiceToken(t *testing.T) {
+	withServiceSecret(t, "0f6c2d9e4b1a")
+
+	token, err := NewServiceToken("builder")
+	if err != nil {
+		t.Fatalf("NewServiceToken() = %v", err)
+	}
+	claims, err := ValidateServiceToken(token)
+	if err != nil || claims.ID != "builder" || claims.Role != RoleService {
+		t.Errorf("ValidateServiceToken() = %+v, %v, want the builder's claims", claims, err)
+	}
+	if _, err := ValidateToken(context.Background(), token); err != nil {
+		t.Errorf("ValidateToken() = %v, want nil", err)
+	}
+
+	// Tokens minted before the secret was removed or while it was the
+	// placeholder are not accepted
+	for _, secret := range []string{"", placeholderServiceSecret} {
+		withServiceSecret(t, secret)
+		if _, err := NewServiceToken("builder"); err == nil {
+			t.Errorf("NewServiceToken() with %q succeeded", secret)
+		}
+		if _, err := ValidateServiceToken(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("ValidateServiceToken() with %q = %v, want %v", secret, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestServiceSecretOnlyMakesServiceTokens(t *testing.T) {
+	withServiceSecret(t, "0f6c2d9e4b1a")
+	sign := func(secret string, claims Claims) string {
+		t.Helper()
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Minute))
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"admin role", sign("0f6c2d9e4b1a", Claims{ID: "u1", Role: RoleAdmin})},
+		{"user role", sign("0f6c2d9e4b1a", Claims{ID: "u1", Role: "user"})},
+		{"other secret", sign("other", Claims{ID: "builder", Role: RoleService})},
+		{"placeholder secret", sign(placeholderServiceSecret, Claims{ID: "builder", Role: RoleService})},
+	}
+	for _, tt := range tests {
+		if _, err := ValidateToken(context.Background(), tt.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: ValidateToken() = %v, want %v", tt.name, err, ErrInvalidToken)
+		}
+		if _, err := ValidateServiceToken(tt.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: ValidateServiceToken() = %v, want %v", tt.name, err, ErrInvalidToken)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package audit publishes audit log entries of security-relevant and
+// build-control actions to the audit topic, where the gateway stores them.
+package audit
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionRegister         = "user.register"
+	ActionLogin            = "user.login"
+	ActionTokenCreate      = "token.create"
+	ActionBuildSubmit      = "build.submit"
+	ActionBuildCancel      = "build.cancel"
+	ActionArtifactDownload = "artifact.download"
+
+	ActionPasswordChange       = "user.password_change"
+	ActionPasswordResetRequest = "user.password_reset_request"
+	ActionPasswordReset        = "user.password_reset"
+	ActionEmailVerify          = "user.email_verify"
+	ActionAccountDelete        = "user.delete"
+)
+
+// Outcomes of an action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Target types
+const (
+	TargetUser     = "user"
+	TargetToken    = "token"
+	TargetBuild    = "build"
+	TargetArtifact = "artifact"
+)
+
+// Recorder publishes audit entries of one service
+type Recorder struct {
+	publisher kafka.Publisher
+	service   string
+	// trustProxy takes the client IP from X-Forwarded-For
+	trustProxy bool
+}
+
+// NewRecorder creates a recorder for service. With AUDIT_TRUST_PROXY=true the
+// client IP is the last X-Forwarded-For entry, as added by a reverse proxy.
+func NewRecorder(publisher kafka.Publisher, service string) *Recorder {
+	return &Recorder{
+		publisher:  publisher,
+		service:    service,
+		trustProxy: os.Getenv("AUDIT_TRUST_PROXY") == "true",
+	}
+}
+
+// ClientIP returns the IP address the request came from
+func (rec *Recorder) ClientIP(r *http.Request) string {
+	if rec.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Record completes event with the request's IP and user agent and publishes
+// it. Publishing does not block the request; failures are only logged.
+func (rec *Recorder) Record(r *http.Request, event message.AuditEventMessage) {
+	event.ID = uuid.New().String()
+	event.IP = rec.ClientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.Service = rec.service
+	event.Timestamp = time.Now()
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+
+	// The request context may be cancelled before the message is produced
+	ctx := context.WithoutCancel(r.Context())
+	if err := rec.publisher.SendMessage(ctx, kafka.TopicAuditEvents, event.ID, event); err != nil {
+		log.Printf("Failed to publish audit event %s %s: %v", event.Action, event.ID, err)
+	}
+}
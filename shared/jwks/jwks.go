@@ -0,0 +1,228 @@
+// Package jwks converts public keys to and from JSON Web Keys and fetches the
+// key set another service publishes, so tokens can be verified without
+// holding the signing key.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"gobuild/shared/tracing"
+)
+
+const (
+	// maxAge is how long a fetched key set is used before it is fetched again
+	maxAge = 10 * time.Minute
+	// minRefetchInterval limits how often unknown key IDs refetch the key set
+	minRefetchInterval = 30 * time.Second
+)
+
+// Key is a public JSON Web Key
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Set is a JSON Web Key Set as served at /.well-known/jwks.json
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// NewKey describes an RSA, ECDSA or Ed25519 public key used to sign with alg
+func NewKey(kid, alg string, publicKey crypto.PublicKey) (Key, error) {
+	key := Key{Kid: kid, Use: "sig", Alg: alg}
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = encode(pub.N.Bytes())
+		key.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key.Kty = "EC"
+		key.Crv = pub.Curve.Params().Name
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key.X = encode(pub.X.FillBytes(make([]byte, size)))
+		key.Y = encode(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = encode(pub)
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	return key, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// PublicKey converts the JWK to an RSA, ECDSA or Ed25519 public key
+func (k *Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+type remoteKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// RemoteSet is a key set fetched from a URL. It is fetched on first use, again
+// after maxAge and when a token names a key it does not know yet, which
+// happens after the publisher rotated its keys.
+type RemoteSet struct {
+	url        string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]remoteKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func NewRemoteSet(url string) *RemoteSet {
+	return &RemoteSet{
+		url:        url,
+		httpClient: tracing.NewHTTPClient(10 * time.Second),
+	}
+}
+
+// Key returns the public key with kid that signs tokens with alg
+func (s *RemoteSet) Key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, ok := s.keys[kid]
+	stale := time.Since(s.fetchedAt) > maxAge
+	if (!ok || stale) && time.Since(s.attemptedAt) > minRefetchInterval {
+		s.attemptedAt = time.Now()
+		if err := s.fetch(ctx); err != nil {
+			// Keep using the keys we have while the publisher is unreachable
+			log.Printf("Failed to fetch key set from %s: %v", s.url, err)
+		} else {
+			cached, ok = s.keys[kid]
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if cached.alg != "" && cached.alg != alg {
+		return nil, fmt.Errorf("key %q is not used with %s", kid, alg)
+	}
+	return cached.key, nil
+}
+
+func (s *RemoteSet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("key set returned %d", resp.StatusCode)
+	}
+	var set Set
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]remoteKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = remoteKey{alg: jwk.Alg, key: key}
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
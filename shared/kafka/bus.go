@@ -0,0 +1,37 @@
+package kafka
+
+import (
+	"context"
+
+	"gobuild/shared/message"
+)
+
+// Publisher sends events to topics. It is implemented by Producer and by the
+// in-memory MemoryBus, so service logic does not depend on a running broker.
+type Publisher interface {
+	SendMessage(ctx context.Context, topic string, key string, event message.Event) error
+	SendMessageSync(ctx context.Context, topic string, key string, event message.Event) error
+	SendRaw(topic string, key []byte, value []byte, headers map[string]string) error
+	Close()
+}
+
+// Subscriber receives messages from topics as a member of a consumer group.
+// It is implemented by Consumer and by the in-memory MemoryBus.
+type Subscriber interface {
+	Subscribe(topics []string) error
+	ConsumeMessages(ctx context.Context, handler MessageHandler) error
+	Close()
+}
+
+// StateLookup returns the latest event of a key. It is implemented by StateView,
+// tests can use a map instead.
+type StateLookup[T message.Event] interface {
+	Get(key string) (T, bool)
+}
+
+var (
+	_ Publisher                               = (*Producer)(nil)
+	_ Subscriber                              = (*Consumer)(nil)
+	_ StateLookup[message.BuildStateMessage]  = (*StateView[message.BuildStateMessage])(nil)
+	_ StateLookup[message.BuildCancelMessage] = (*StateView[message.BuildCancelMessage])(nil)
+)
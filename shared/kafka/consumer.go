@@ -1,34 +1,147 @@
 package kafka
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel/codes"
+	"gobuild/shared/tracing"
 )
 
-type MessageHandler func(key []byte, value []byte) error
+// MessageHandler handles one message. ctx carries the trace context and request
+// ID of the producer and is not cancelled when the consumer is stopped.
+type MessageHandler func(ctx context.Context, key []byte, value []byte) error
+
+// ErrPermanent matches errors that retrying cannot fix, like a malformed
+// message. The consumer dead-letters such messages without retrying, so they
+// do not hold up the messages behind them.
+var ErrPermanent = errors.New("permanent error")
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string        { return e.err.Error() }
+func (e *permanentError) Unwrap() error        { return e.err }
+func (e *permanentError) Is(target error) bool { return target == ErrPermanent }
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
 
 type Consumer struct {
 	consumer *kafka.Consumer
+	groupID  string
+	options  consumerOptions
+	// pool is only set while ConsumeMessages runs with workers
+	pool *workerPool
+}
+
+type consumerOptions struct {
+	manualCommit    bool
+	maxRetries      int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	deadLetter      Publisher
+	workers         int
+	queueSize       int
 }
 
-func NewConsumer(bootstrapServers, groupID string) (*Consumer, error) {
-	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+// ConsumerOption configures optional Consumer behaviour
+type ConsumerOption func(*consumerOptions)
+
+// WithManualCommit enables at-least-once processing: the offset of a message is
+// only committed after the handler succeeded. A failing handler is retried up to
+// maxRetries times with exponential backoff starting at retryBackoff. It must be
+// combined with WithDeadLetterQueue, so a message that still fails is committed
+// only once it is safely in the dead-letter topic.
+func WithManualCommit(maxRetries int, retryBackoff time.Duration) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.manualCommit = true
+		o.maxRetries = maxRetries
+		o.retryBackoff = retryBackoff
+	}
+}
+
+// WithRetries retries a failing handler up to maxRetries times without changing the commit mode
+func WithRetries(maxRetries int, retryBackoff time.Duration) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.maxRetries = maxRetries
+		o.retryBackoff = retryBackoff
+	}
+}
+
+// WithDeadLetterQueue publishes messages whose handler still fails after all
+// retries to the topic's dead-letter topic (see DeadLetterTopic)
+func WithDeadLetterQueue(producer Publisher) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.deadLetter = producer
+	}
+}
+
+// WithMaxRetryBackoff caps the delay between two handler retries
+func WithMaxRetryBackoff(maxRetryBackoff time.Duration) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.maxRetryBackoff = maxRetryBackoff
+	}
+}
+
+// WithWorkers handles messages on a pool of workers instead of one at a time.
+// Messages with the same key always go to the same worker, so they keep their
+// order. Each worker queues up to queueSize messages; when the pool is full the
+// assigned partitions are paused until workers catch up.
+func WithWorkers(workers, queueSize int) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.workers = workers
+		o.queueSize = queueSize
+	}
+}
+
+func NewConsumer(bootstrapServers, groupID string, opts ...ConsumerOption) (*Consumer, error) {
+	options := consumerOptions{
+		retryBackoff:    time.Second,
+		maxRetryBackoff: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.manualCommit && options.deadLetter == nil {
+		return nil, errors.New("manual commit requires a dead-letter queue, failed messages would be lost")
+	}
+
+	config := &kafka.ConfigMap{
 		"bootstrap.servers":  bootstrapServers,
 		"group.id":           groupID,
 		"auto.offset.reset":  "earliest",
 		"enable.auto.commit": "true",
-	})
+	}
+	if options.manualCommit {
+		config.SetKey("enable.auto.commit", "false")
+		config.SetKey("enable.auto.offset.store", "false")
+	}
+	if options.workers > 0 {
+		// Messages finish out of order, offsets are stored once everything before them is done
+		config.SetKey("enable.auto.offset.store", "false")
+		if options.queueSize < 1 {
+			options.queueSize = 1
+		}
+	}
+
+	c, err := kafka.NewConsumer(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Consumer{consumer: c}, nil
+	return &Consumer{consumer: c, groupID: groupID, options: options}, nil
 }
 
 func (c *Consumer) Subscribe(topics []string) error {
@@ -37,7 +150,7 @@ func (c *Consumer) Subscribe(topics []string) error {
 
 	var err error
 	for i := 0; i < maxRetries; i++ {
-		err = c.consumer.SubscribeTopics(topics, nil)
+		err = c.consumer.SubscribeTopics(topics, c.rebalanceCallback)
 		if err == nil {
 			log.Printf("Successfully subscribed to topics: %v", topics)
 			return nil
@@ -56,16 +169,19 @@ func (c *Consumer) Subscribe(topics []string) error {
 	return err
 }
 
-func (c *Consumer) ConsumeMessages(handler MessageHandler) {
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+// ConsumeMessages polls and handles messages until ctx is cancelled or a fatal
+// Kafka error occurs. A message that is being handled when ctx is cancelled is
+// finished before ConsumeMessages returns.
+func (c *Consumer) ConsumeMessages(ctx context.Context, handler MessageHandler) error {
+	if c.options.workers > 0 {
+		return c.consumeParallel(ctx, handler)
+	}
 
-	run := true
-	for run {
+	for {
 		select {
-		case sig := <-sigchan:
-			log.Printf("Caught signal %v: terminating\n", sig)
-			run = false
+		case <-ctx.Done():
+			log.Println("Stopping consumer: context cancelled")
+			return nil
 		default:
 			ev := c.consumer.Poll(100)
 			if ev == nil {
@@ -74,26 +190,157 @@ func (c *Consumer) ConsumeMessages(handler MessageHandler) {
 
 			switch e := ev.(type) {
 			case *kafka.Message:
-				err := handler(e.Key, e.Value)
-				if err != nil {
-					log.Printf("Error processing message: %v\n", err)
-				}
+				c.processMessage(ctx, e, handler)
 			case kafka.Error:
-				// Don't stop on topic subscription errors, as they may be resolved later
-				isTopicError := e.Code() == kafka.ErrUnknownTopicOrPart ||
-					e.Code() == kafka.ErrBadMsg ||
-					e.Code() == kafka.ErrTimedOut
-				if isTopicError {
-					log.Printf("Kafka error: %v\n", e)
-				} else if e.Code() == kafka.ErrAllBrokersDown {
-					log.Printf("Fatal Kafka error: %v\n", e)
-					run = false
+				if err := checkKafkaError(e); err != nil {
+					return err
 				}
 			}
 		}
 	}
 }
 
+// checkKafkaError logs e and returns an error if consuming cannot continue
+func checkKafkaError(e kafka.Error) error {
+	// Don't stop on topic subscription errors, as they may be resolved later
+	isTopicError := e.Code() == kafka.ErrUnknownTopicOrPart ||
+		e.Code() == kafka.ErrBadMsg ||
+		e.Code() == kafka.ErrTimedOut
+	if isTopicError {
+		log.Printf("Kafka error: %v\n", e)
+	} else if e.Code() == kafka.ErrAllBrokersDown {
+		log.Printf("Fatal Kafka error: %v\n", e)
+		return fmt.Errorf("fatal kafka error: %w", e)
+	}
+	return nil
+}
+
+// processResult tells the caller of handleMessage what to do with the offset
+type processResult int
+
+const (
+	// resultDone means the message was handled or dead-lettered and can be committed
+	resultDone processResult = iota
+	// resultAbandoned means retries were cut short by shutdown; nothing is committed
+	resultAbandoned
+	// resultRewind means the message could not be dead-lettered and must be redelivered
+	resultRewind
+	// resultDiscarded means a worker skipped the message because a rewind redelivers it
+	resultDiscarded
+)
+
+// processMessage handles msg and commits the offset afterwards when manual commits
+// are enabled. Nothing is committed while the handler is running, so a crash leads
+// to redelivery.
+func (c *Consumer) processMessage(ctx context.Context, msg *kafka.Message, handler MessageHandler) {
+	switch c.handleMessage(ctx, msg, handler) {
+	case resultDone:
+		if c.options.manualCommit {
+			c.commitMessage(msg)
+		}
+	case resultRewind:
+		c.rewind(msg)
+	}
+}
+
+// handleMessage runs the handler with retries and dead-letters the message if it
+// still fails; permanent errors are not retried. Pending retries are abandoned
+// when ctx is cancelled.
+func (c *Consumer) handleMessage(ctx context.Context, msg *kafka.Message, handler MessageHandler) processResult {
+	backoff := c.options.retryBackoff
+
+	// The handler must be able to finish after shutdown started, so it only
+	// inherits values from ctx, not its cancellation
+	msgCtx, span := startConsumerSpan(context.WithoutCancel(ctx), *msg.TopicPartition.Topic, headerMap(msg.Headers))
+	defer span.End()
+
+	var err error
+	attempts := 0
+	for attempts <= c.options.maxRetries {
+		attempts++
+		err = handler(msgCtx, msg.Key, msg.Value)
+		if err == nil || errors.Is(err, ErrPermanent) {
+			break
+		}
+
+		if attempts <= c.options.maxRetries {
+			log.Printf("Error processing message from %s (attempt %d/%d): %v, retrying in %v...",
+				msg.TopicPartition, attempts, c.options.maxRetries+1, err, backoff)
+			select {
+			case <-ctx.Done():
+				log.Printf("Abandoning retries for %s: context cancelled\n", msg.TopicPartition)
+				return resultAbandoned
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > c.options.maxRetryBackoff {
+				backoff = c.options.maxRetryBackoff
+			}
+		}
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		tracing.Logf(msgCtx, "Error processing message from %s after %d attempts: %v\n", msg.TopicPartition, attempts, err)
+
+		if c.options.deadLetter != nil {
+			if dlqErr := c.sendToDeadLetter(msg, err, attempts); dlqErr != nil {
+				log.Printf("Failed to dead-letter message from %s: %v, rewinding\n", msg.TopicPartition, dlqErr)
+				return resultRewind
+			}
+		}
+	}
+
+	return resultDone
+}
+
+// rewind seeks back to msg so it is delivered again by the next poll
+func (c *Consumer) rewind(msg *kafka.Message) {
+	if err := c.consumer.Seek(msg.TopicPartition, 0); err != nil {
+		log.Printf("Failed to seek back to %s: %v\n", msg.TopicPartition, err)
+	}
+}
+
+// commitMessage stores and synchronously commits the offset following msg
+func (c *Consumer) commitMessage(msg *kafka.Message) {
+	if _, err := c.consumer.StoreMessage(msg); err != nil {
+		log.Printf("Failed to store offset for %s: %v\n", msg.TopicPartition, err)
+		return
+	}
+
+	if _, err := c.consumer.Commit(); err != nil && !isNoOffsetError(err) {
+		log.Printf("Failed to commit offset for %s: %v\n", msg.TopicPartition, err)
+	}
+}
+
+// rebalanceCallback commits stored offsets before partitions are taken away
+func (c *Consumer) rebalanceCallback(consumer *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		log.Printf("Assigned partitions: %v", e.Partitions)
+		if c.pool != nil {
+			c.pool.assigned()
+		}
+	case kafka.RevokedPartitions:
+		log.Printf("Revoked partitions: %v", e.Partitions)
+		if c.pool != nil {
+			c.pool.revoked(e.Partitions)
+		}
+		if c.options.manualCommit && !consumer.AssignmentLost() {
+			if _, err := consumer.Commit(); err != nil && !isNoOffsetError(err) {
+				log.Printf("Failed to commit offsets on revoke: %v\n", err)
+			}
+		}
+	}
+	return nil
+}
+
+func isNoOffsetError(err error) bool {
+	kafkaErr, ok := err.(kafka.Error)
+	return ok && kafkaErr.Code() == kafka.ErrNoOffset
+}
+
 // UnmarshalMessage unmarshals a Kafka message value into the provided struct
 func UnmarshalMessage(value []byte, v interface{}) error {
 	return json.Unmarshal(value, v)
@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"gobuild/shared/message"
+)
+
+// EventHandler handles a single, already validated event envelope
+type EventHandler func(ctx context.Context, env *message.Envelope) error
+
+// Dispatcher routes enveloped messages to a handler per event type
+type Dispatcher struct {
+	handlers map[message.EventType]EventHandler
+}
+
+// NewDispatcher creates an empty dispatcher
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[message.EventType]EventHandler),
+	}
+}
+
+// Handle registers the handler for an event type, replacing any previous one
+func (d *Dispatcher) Handle(eventType message.EventType, handler EventHandler) {
+	d.handlers[eventType] = handler
+}
+
+// On registers a typed handler; the event type is taken from T
+func On[T message.Event](d *Dispatcher, handler func(context.Context, T) error) {
+	var zero T
+	d.Handle(zero.EventType(), func(ctx context.Context, env *message.Envelope) error {
+		var msg T
+		if err := env.Decode(&msg); err != nil {
+			return Permanent(fmt.Errorf("failed to decode %s event %s: %w", env.Type, env.EventID, err))
+		}
+		return handler(ctx, msg)
+	})
+}
+
+// HandleMessage is a MessageHandler that validates the envelope and dispatches it.
+// Malformed, unknown or newer-version messages are rejected with a permanent
+// error, since redelivering them cannot help.
+func (d *Dispatcher) HandleMessage(ctx context.Context, key []byte, value []byte) error {
+	env, err := message.ParseEnvelope(value)
+	if err != nil {
+		return Permanent(fmt.Errorf("rejected message with key %q: %w", string(key), err))
+	}
+
+	handler, ok := d.handlers[env.Type]
+	if !ok {
+		// Known event type that this service is not interested in
+		return nil
+	}
+
+	return handler(ctx, env)
+}
@@ -0,0 +1,93 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"gobuild/shared/message"
+)
+
+func TestDispatcherErrors(t *testing.T) {
+	handlerErr := errors.New("redis unavailable")
+	d := NewDispatcher()
+	On(d, func(ctx context.Context, msg message.BuildStatusMessage) error {
+		if msg.Status == "fail" {
+			return handlerErr
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name          string
+		value         string
+		wantErr       error
+		wantPermanent bool
+	}{
+		{"handled", `{"event_id":"1","type":"build.status","version":1,"payload":{"build_id":"b"}}`, nil, false},
+		{"not handled by this service", `{"event_id":"1","type":"build.log","version":1,"payload":{"build_id":"b"}}`, nil, false},
+		{"handler failure is retried", `{"event_id":"1","type":"build.status","version":1,"payload":{"status":"fail"}}`, handlerErr, false},
+		{"malformed envelope", `build b failed`, message.ErrMalformedEnvelope, true},
+		{"newer version", `{"event_id":"1","type":"build.status","version":2,"payload":{"build_id":"b"}}`, message.ErrUnsupportedVersion, true},
+		{"payload does not decode", `{"event_id":"1","type":"build.status","version":1,"payload":{"build_id":1}}`, nil, true},
+	}
+	for _, tt := range tests {
+		err := d.HandleMessage(context.Background(), []byte("b"), []byte(tt.value))
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: HandleMessage() = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && !tt.wantPermanent && err != nil {
+			t.Errorf("%s: HandleMessage() = %v, want nil", tt.name, err)
+		}
+		if errors.Is(err, ErrPermanent) != tt.wantPermanent {
+			t.Errorf("%s: HandleMessage() = %v, want permanent %v", tt.name, err, tt.wantPermanent)
+		}
+	}
+}
+
+// TestPermanentErrorSkipsRetries checks that a message failing with a
+// permanent error is dead-lettered after the first attempt
+func TestPermanentErrorSkipsRetries(t *testing.T) {
+	bus := NewMemoryBus(1)
+	c := &Consumer{
+		groupID: "test",
+		options: consumerOptions{manualCommit: true, maxRetries: 5, retryBackoff: time.Hour, deadLetter: bus.Publisher()},
+	}
+	topic := TopicBuildStatus
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 7}, Key: []byte("b"), Value: []byte("not an envelope")}
+
+	calls := 0
+	handler := func(ctx context.Context, key, value []byte) error {
+		calls++
+		return Permanent(errors.New("malformed"))
+	}
+	done := make(chan processResult, 1)
+	go func() { done <- c.handleMessage(context.Background(), msg, handler) }()
+
+	select {
+	case result := <-done:
+		if result != resultDone || calls != 1 {
+			t.Errorf("handleMessage() = %v after %d calls, want resultDone after 1", result, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleMessage() retried a permanent error")
+	}
+
+	dlq := bus.Subscriber("inspector")
+	if err := dlq.Subscribe([]string{DeadLetterTopic(topic)}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got string
+	dlq.ConsumeMessages(ctx, func(ctx context.Context, key, value []byte) error {
+		got = string(value)
+		cancel()
+		return nil
+	})
+	if got != "not an envelope" {
+		t.Errorf("dead-letter topic holds %q, want the message", got)
+	}
+}
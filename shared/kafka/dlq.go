@@ -0,0 +1,262 @@
+package kafka
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+const deadLetterSuffix = ".dlq"
+
+// Headers attached to every dead-lettered message
+const (
+	HeaderDLQOriginalTopic     = "dlq-original-topic"
+	HeaderDLQOriginalPartition = "dlq-original-partition"
+	HeaderDLQOriginalOffset    = "dlq-original-offset"
+	HeaderDLQConsumerGroup     = "dlq-consumer-group"
+	HeaderDLQError             = "dlq-error"
+	HeaderDLQAttempts          = "dlq-attempts"
+	HeaderDLQFailedAt          = "dlq-failed-at"
+)
+
+// DeadLetterTopic returns the dead-letter topic for a topic, e.g. build-jobs.dlq
+func DeadLetterTopic(topic string) string {
+	if strings.HasSuffix(topic, deadLetterSuffix) {
+		return topic
+	}
+	return topic + deadLetterSuffix
+}
+
+// DeadLetter is a message that was parked on a dead-letter topic
+type DeadLetter struct {
+	Topic             string            `json:"topic"`
+	Partition         int32             `json:"partition"`
+	Offset            int64             `json:"offset"`
+	Key               string            `json:"key"`
+	Value             string            `json:"value"`
+	OriginalTopic     string            `json:"original_topic"`
+	OriginalPartition int32             `json:"original_partition"`
+	OriginalOffset    int64             `json:"original_offset"`
+	ConsumerGroup     string            `json:"consumer_group"`
+	Error             string            `json:"error"`
+	Attempts          int               `json:"attempts"`
+	FailedAt          time.Time         `json:"failed_at"`
+	Headers           map[string]string `json:"headers,omitempty"`
+}
+
+// sendToDeadLetter publishes msg unchanged to its dead-letter topic, with the
+// failure details in the headers
+func (c *Consumer) sendToDeadLetter(msg *kafka.Message, handlerErr error, attempts int) error {
+	topic := *msg.TopicPartition.Topic
+
+	headers := make(map[string]string, len(msg.Headers)+7)
+	for _, h := range msg.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	headers[HeaderDLQOriginalTopic] = topic
+	headers[HeaderDLQOriginalPartition] = strconv.Itoa(int(msg.TopicPartition.Partition))
+	headers[HeaderDLQOriginalOffset] = strconv.FormatInt(int64(msg.TopicPartition.Offset), 10)
+	headers[HeaderDLQConsumerGroup] = c.groupID
+	headers[HeaderDLQError] = handlerErr.Error()
+	headers[HeaderDLQAttempts] = strconv.Itoa(attempts)
+	headers[HeaderDLQFailedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	dlqTopic := DeadLetterTopic(topic)
+	if err := c.options.deadLetter.SendRaw(dlqTopic, msg.Key, msg.Value, headers); err != nil {
+		return err
+	}
+
+	log.Printf("☠️ Moved message from %s to %s after %d attempts", msg.TopicPartition, dlqTopic, attempts)
+	return nil
+}
+
+func newDeadLetter(msg *kafka.Message) DeadLetter {
+	dl := DeadLetter{
+		Topic:     *msg.TopicPartition.Topic,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Key:       string(msg.Key),
+		Value:     string(msg.Value),
+		Headers:   make(map[string]string),
+	}
+
+	for _, h := range msg.Headers {
+		value := string(h.Value)
+		switch h.Key {
+		case HeaderDLQOriginalTopic:
+			dl.OriginalTopic = value
+		case HeaderDLQOriginalPartition:
+			p, _ := strconv.ParseInt(value, 10, 32)
+			dl.OriginalPartition = int32(p)
+		case HeaderDLQOriginalOffset:
+			dl.OriginalOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderDLQConsumerGroup:
+			dl.ConsumerGroup = value
+		case HeaderDLQError:
+			dl.Error = value
+		case HeaderDLQAttempts:
+			dl.Attempts, _ = strconv.Atoi(value)
+		case HeaderDLQFailedAt:
+			dl.FailedAt, _ = time.Parse(time.RFC3339Nano, value)
+		default:
+			dl.Headers[h.Key] = value
+		}
+	}
+
+	return dl
+}
+
+// ReadDeadLetters returns up to limit messages from the dead-letter topic of topic
+// without committing anything, so inspecting is free of side effects
+func ReadDeadLetters(bootstrapServers, topic string, limit int) ([]DeadLetter, error) {
+	dlqTopic := DeadLetterTopic(topic)
+	deadLetters := make([]DeadLetter, 0)
+
+	err := scanTopic(bootstrapServers, dlqTopic, "", func(msg *kafka.Message) (bool, error) {
+		deadLetters = append(deadLetters, newDeadLetter(msg))
+		return limit <= 0 || len(deadLetters) < limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// RedriveDeadLetters republishes every not yet re-driven dead letter of topic to
+// its original topic. Progress is committed under a dedicated consumer group, so
+// each dead letter is only re-driven once.
+func RedriveDeadLetters(bootstrapServers string, producer Publisher, topic string) (int, error) {
+	dlqTopic := DeadLetterTopic(topic)
+	redriven := 0
+
+	err := scanTopic(bootstrapServers, dlqTopic, dlqTopic+"-redrive", func(msg *kafka.Message) (bool, error) {
+		dl := newDeadLetter(msg)
+		target := dl.OriginalTopic
+		if target == "" {
+			target = strings.TrimSuffix(dlqTopic, deadLetterSuffix)
+		}
+
+		if err := producer.SendRaw(target, msg.Key, msg.Value, dl.Headers); err != nil {
+			return false, fmt.Errorf("failed to re-drive %s to %s: %w", msg.TopicPartition, target, err)
+		}
+		redriven++
+		return true, nil
+	})
+	if err != nil {
+		return redriven, err
+	}
+
+	log.Printf("🔁 Re-drove %d messages from %s", redriven, dlqTopic)
+	return redriven, nil
+}
+
+// scanTopic reads topic up to its current end and calls fn for each message.
+// With an empty groupID all partitions are read from the beginning and nothing is
+// committed; otherwise reading starts at the group's committed offsets and each
+// message is committed once fn accepted it. fn returns false to stop early.
+func scanTopic(bootstrapServers, topic, groupID string, fn func(msg *kafka.Message) (bool, error)) error {
+	commit := groupID != ""
+	if !commit {
+		groupID = topic + "-inspect"
+	}
+
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  bootstrapServers,
+		"group.id":           groupID,
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": "false",
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	metadata, err := c.GetMetadata(&topic, false, 5000)
+	if err != nil {
+		return err
+	}
+	topicMetadata, ok := metadata.Topics[topic]
+	if !ok || topicMetadata.Error.Code() == kafka.ErrUnknownTopicOrPart {
+		// Nothing has been dead-lettered yet
+		return nil
+	}
+
+	partitions := make([]kafka.TopicPartition, 0, len(topicMetadata.Partitions))
+	for _, p := range topicMetadata.Partitions {
+		partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: p.ID, Offset: kafka.OffsetBeginning})
+	}
+
+	if commit {
+		committed, err := c.Committed(partitions, 5000)
+		if err != nil {
+			return err
+		}
+		for i := range partitions {
+			if committed[i].Offset >= 0 {
+				partitions[i].Offset = committed[i].Offset
+			}
+		}
+	}
+
+	// Only read what is there right now, new dead letters are left for the next run
+	remaining := make(map[int32]int64)
+	for _, p := range partitions {
+		low, high, err := c.QueryWatermarkOffsets(topic, p.Partition, 5000)
+		if err != nil {
+			return err
+		}
+		start := low
+		if p.Offset >= 0 && int64(p.Offset) > start {
+			start = int64(p.Offset)
+		}
+		if start < high {
+			remaining[p.Partition] = high
+		}
+	}
+
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	if err := c.Assign(partitions); err != nil {
+		return err
+	}
+
+	for len(remaining) > 0 {
+		msg, err := c.ReadMessage(10 * time.Second)
+		if err != nil {
+			return err
+		}
+
+		high, ok := remaining[msg.TopicPartition.Partition]
+		if !ok {
+			continue
+		}
+
+		more, err := fn(msg)
+		if err != nil {
+			return err
+		}
+
+		if commit {
+			if _, err := c.CommitMessage(msg); err != nil {
+				return err
+			}
+		}
+
+		if int64(msg.TopicPartition.Offset)+1 >= high {
+			delete(remaining, msg.TopicPartition.Partition)
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"gobuild/shared/message"
+	"gobuild/shared/tracing"
+)
+
+// MemoryBus is an in-process message bus with Kafka-like semantics: topics are
+// split into partitions, messages with the same key always land in the same
+// partition, and every consumer group sees each message once, in partition order.
+// It lets services run together without any external infrastructure.
+type MemoryBus struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string][][]memoryMessage
+	groups     map[string]*memoryGroup
+	// changed is closed and replaced whenever a message is published
+	changed chan struct{}
+}
+
+type memoryMessage struct {
+	key     []byte
+	value   []byte
+	headers map[string]string
+}
+
+type memoryGroup struct {
+	// next offset and in-flight flag per topic and partition
+	offsets  map[string][]int
+	inFlight map[string][]bool
+}
+
+// NewMemoryBus creates an empty bus; every topic gets the given number of partitions
+func NewMemoryBus(partitions int) *MemoryBus {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBus{
+		partitions: partitions,
+		topics:     make(map[string][][]memoryMessage),
+		groups:     make(map[string]*memoryGroup),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Publisher returns a Publisher that writes to the bus
+func (b *MemoryBus) Publisher() Publisher {
+	return &memoryPublisher{bus: b}
+}
+
+// Subscriber returns a Subscriber that joins the given consumer group
+func (b *MemoryBus) Subscriber(groupID string) Subscriber {
+	return &memorySubscriber{bus: b, groupID: groupID}
+}
+
+// topicLocked returns the partitions of a topic, creating it on first use
+func (b *MemoryBus) topicLocked(topic string) [][]memoryMessage {
+	partitions, ok := b.topics[topic]
+	if !ok {
+		partitions = make([][]memoryMessage, b.partitions)
+		b.topics[topic] = partitions
+	}
+	return partitions
+}
+
+func (b *MemoryBus) groupLocked(groupID, topic string) *memoryGroup {
+	group, ok := b.groups[groupID]
+	if !ok {
+		group = &memoryGroup{
+			offsets:  make(map[string][]int),
+			inFlight: make(map[string][]bool),
+		}
+		b.groups[groupID] = group
+	}
+	if _, ok := group.offsets[topic]; !ok {
+		group.offsets[topic] = make([]int, b.partitions)
+		group.inFlight[topic] = make([]bool, b.partitions)
+	}
+	return group
+}
+
+func (b *MemoryBus) publish(topic string, msg memoryMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	partitions := b.topicLocked(topic)
+	partition := 0
+	if len(msg.key) > 0 {
+		partition = hashKey(msg.key, b.partitions)
+	}
+	partitions[partition] = append(partitions[partition], msg)
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+type memoryPublisher struct {
+	bus *MemoryBus
+}
+
+func (p *memoryPublisher) SendMessage(ctx context.Context, topic string, key string, event message.Event) error {
+	value, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	p.bus.publish(topic, memoryMessage{key: []byte(key), value: value, headers: tracing.InjectHeaders(ctx)})
+	return nil
+}
+
+// SendMessageSync is the same as SendMessage, publishing to memory cannot fail later
+func (p *memoryPublisher) SendMessageSync(ctx context.Context, topic string, key string, event message.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.SendMessage(ctx, topic, key, event)
+}
+
+func (p *memoryPublisher) SendRaw(topic string, key []byte, value []byte, headers map[string]string) error {
+	p.bus.publish(topic, memoryMessage{key: key, value: value, headers: headers})
+	return nil
+}
+
+func (p *memoryPublisher) Close() {}
+
+type memorySubscriber struct {
+	bus     *MemoryBus
+	groupID string
+	topics  []string
+}
+
+func (s *memorySubscriber) Subscribe(topics []string) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	for _, topic := range topics {
+		s.bus.topicLocked(topic)
+		s.bus.groupLocked(s.groupID, topic)
+	}
+	s.topics = append(s.topics, topics...)
+	return nil
+}
+
+// claimLocked finds the next message of a partition that no other member of the
+// group is currently handling and marks that partition as in flight
+func (s *memorySubscriber) claimLocked() (topic string, partition int, msg memoryMessage, ok bool) {
+	group := s.bus.groups[s.groupID]
+	for _, topic := range s.topics {
+		partitions := s.bus.topics[topic]
+		for p := range partitions {
+			offset := group.offsets[topic][p]
+			if group.inFlight[topic][p] || offset >= len(partitions[p]) {
+				continue
+			}
+			group.inFlight[topic][p] = true
+			return topic, p, partitions[p][offset], true
+		}
+	}
+	return "", 0, memoryMessage{}, false
+}
+
+// ConsumeMessages handles messages until ctx is cancelled. Handler errors are
+// logged and the message is skipped, like the auto-commit Consumer does.
+func (s *memorySubscriber) ConsumeMessages(ctx context.Context, handler MessageHandler) error {
+	for {
+		s.bus.mu.Lock()
+		topic, partition, msg, ok := s.claimLocked()
+		changed := s.bus.changed
+		s.bus.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-changed:
+				continue
+			}
+		}
+
+		msgCtx, span := startConsumerSpan(context.WithoutCancel(ctx), topic, msg.headers)
+		if err := handler(msgCtx, msg.key, msg.value); err != nil {
+			tracing.Logf(msgCtx, "Error processing message from %s[%d]: %v\n", topic, partition, err)
+		}
+		span.End()
+
+		s.bus.mu.Lock()
+		group := s.bus.groups[s.groupID]
+		group.offsets[topic][partition]++
+		group.inFlight[topic][partition] = false
+		// Wake up other members waiting for this partition
+		close(s.bus.changed)
+		s.bus.changed = make(chan struct{})
+		s.bus.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *memorySubscriber) Close() {}
@@ -0,0 +1,186 @@
+package kafka_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+)
+
+// statusLog records the build statuses a consumer group saw, per build
+type statusLog struct {
+	mu       sync.Mutex
+	statuses map[string][]string
+	count    int
+	done     chan struct{}
+	expected int
+}
+
+func newStatusLog(expected int) *statusLog {
+	return &statusLog{statuses: make(map[string][]string), done: make(chan struct{}), expected: expected}
+}
+
+func (l *statusLog) record(_ context.Context, msg message.BuildStatusMessage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.statuses[msg.BuildID] = append(l.statuses[msg.BuildID], msg.Status)
+	l.count++
+	if l.count == l.expected {
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *statusLog) wait(t *testing.T, name string) {
+	t.Helper()
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		t.Fatalf("%s saw %d of %d statuses", name, l.count, l.expected)
+	}
+}
+
+func consume(t *testing.T, ctx context.Context, wg *sync.WaitGroup, subscriber kafka.Subscriber, topics []string, dispatcher *kafka.Dispatcher) {
+	t.Helper()
+	if err := subscriber.Subscribe(topics); err != nil {
+		t.Fatalf("Subscribe(%v) = %v", topics, err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		subscriber.ConsumeMessages(ctx, dispatcher.HandleMessage)
+	}()
+}
+
+// TestMemoryBusPipeline runs the request, job and status flow between the
+// services on one MemoryBus: the orchestrator turns requests into jobs, two
+// builders share the jobs and every group sees each build's statuses in order.
+func TestMemoryBusPipeline(t *testing.T) {
+	const builds = 50
+	steps := []string{"in-progress", "completed"}
+
+	bus := kafka.NewMemoryBus(4)
+	publisher := bus.Publisher()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	orchestratorLog := newStatusLog(builds * len(steps))
+	orchestrator := kafka.NewDispatcher()
+	kafka.On(orchestrator, func(ctx context.Context, req message.BuildRequestMessage) error {
+		return publisher.SendMessage(ctx, kafka.TopicBuildJobs, req.ID, req)
+	})
+	kafka.On(orchestrator, orchestratorLog.record)
+	consume(t, ctx, &wg, bus.Subscriber("build-orchestrator"), []string{kafka.TopicBuildRequests, kafka.TopicBuildStatus}, orchestrator)
+
+	var jobsMu sync.Mutex
+	jobs := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		builder := kafka.NewDispatcher()
+		kafka.On(builder, func(ctx context.Context, req message.BuildRequestMessage) error {
+			jobsMu.Lock()
+			jobs[req.ID]++
+			jobsMu.Unlock()
+			for _, status := range steps {
+				msg := message.BuildStatusMessage{BuildID: req.ID, Status: status, UpdatedAt: time.Now()}
+				if err := publisher.SendMessage(ctx, kafka.TopicBuildStatus, req.ID, msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		consume(t, ctx, &wg, bus.Subscriber("builder"), []string{kafka.TopicBuildJobs}, builder)
+	}
+
+	notificationLog := newStatusLog(builds * len(steps))
+	notification := kafka.NewDispatcher()
+	kafka.On(notification, notificationLog.record)
+	consume(t, ctx, &wg, bus.Subscriber("notification"), []string{kafka.TopicBuildStatus}, notification)
+
+	for i := 0; i < builds; i++ {
+		req := message.BuildRequestMessage{ID: fmt.Sprintf("build-%d", i), CreatedAt: time.Now()}
+		if err := publisher.SendMessageSync(ctx, kafka.TopicBuildRequests, req.ID, req); err != nil {
+			t.Fatalf("SendMessageSync() = %v", err)
+		}
+	}
+
+	orchestratorLog.wait(t, "build-orchestrator")
+	notificationLog.wait(t, "notification")
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if len(jobs) != builds {
+		t.Errorf("builders ran %d builds, want %d", len(jobs), builds)
+	}
+	for id, runs := range jobs {
+		if runs != 1 {
+			t.Errorf("build %s ran %d times, want once", id, runs)
+		}
+	}
+	for name, log := range map[string]*statusLog{"build-orchestrator": orchestratorLog, "notification": notificationLog} {
+		for id, statuses := range log.statuses {
+			if fmt.Sprint(statuses) != fmt.Sprint(steps) {
+				t.Errorf("%s saw statuses %v of %s, want %v", name, statuses, id, steps)
+			}
+		}
+	}
+}
+
+// TestMemoryBusKeyOrder checks that messages with the same key reach a group
+// in the order they were published
+func TestMemoryBusKeyOrder(t *testing.T) {
+	bus := kafka.NewMemoryBus(3)
+	publisher := bus.Publisher()
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i%5)
+		if err := publisher.SendRaw("topic", []byte(key), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatalf("SendRaw() = %v", err)
+		}
+	}
+
+	subscriber := bus.Subscriber("group")
+	if err := subscriber.Subscribe([]string{"topic"}); err != nil {
+		t.Fatalf("Subscribe() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seen := make(map[string][]int)
+	received := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscriber.ConsumeMessages(ctx, func(ctx context.Context, key, value []byte) error {
+			var i int
+			fmt.Sscan(string(value), &i)
+			seen[string(key)] = append(seen[string(key)], i)
+			if received++; received == 30 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("received %d of 30 messages", received)
+	}
+	for key, values := range seen {
+		for j := 1; j < len(values); j++ {
+			if values[j] < values[j-1] {
+				t.Errorf("messages of %s arrived as %v", key, values)
+				break
+			}
+		}
+	}
+}
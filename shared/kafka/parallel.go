@@ -0,0 +1,419 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// hashKey maps key to one of n buckets
+func hashKey(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func topicPartitionOf(msg *kafka.Message) topicPartition {
+	return topicPartition{topic: *msg.TopicPartition.Topic, partition: msg.TopicPartition.Partition}
+}
+
+// partitionOffsets tracks the messages of one partition that were handed to
+// workers. Offsets are only committable up to the first message that is not
+// done yet, no matter in which order the workers finish.
+type partitionOffsets struct {
+	pending []kafka.Offset
+	done    map[kafka.Offset]bool
+}
+
+func (po *partitionOffsets) track(offset kafka.Offset) {
+	po.pending = append(po.pending, offset)
+	po.done[offset] = false
+}
+
+// complete marks offset as done and returns the new commit offset if it advanced
+func (po *partitionOffsets) complete(offset kafka.Offset) (kafka.Offset, bool) {
+	if _, ok := po.done[offset]; !ok {
+		// Dropped by a rewind, the message will be delivered again
+		return 0, false
+	}
+	po.done[offset] = true
+
+	var next kafka.Offset
+	advanced := false
+	for len(po.pending) > 0 && po.done[po.pending[0]] {
+		next = po.pending[0] + 1
+		delete(po.done, po.pending[0])
+		po.pending = po.pending[1:]
+		advanced = true
+	}
+	return next, advanced
+}
+
+// rewind forgets offset and everything after it, those messages are delivered again
+func (po *partitionOffsets) rewind(offset kafka.Offset) {
+	for i, o := range po.pending {
+		if o >= offset {
+			for _, dropped := range po.pending[i:] {
+				delete(po.done, dropped)
+			}
+			po.pending = po.pending[:i]
+			return
+		}
+	}
+}
+
+type workerResult struct {
+	msg    *kafka.Message
+	result processResult
+}
+
+// workerPool runs handlers for a Consumer started WithWorkers. Everything except
+// run, claim and raiseBarrier is only called from the polling goroutine,
+// including the rebalance callback.
+type workerPool struct {
+	consumer *Consumer
+	queues   []chan *kafka.Message
+	results  chan workerResult
+	wg       sync.WaitGroup
+
+	// mu guards live and barriers, which workers check before starting a message
+	mu sync.Mutex
+	// live holds the polled messages that are queued or running. A rewind
+	// removes the ones it redelivers, workers skip those.
+	live map[*kafka.Message]bool
+	// barriers holds per partition the offset of a failed message whose rewind
+	// the polling goroutine has not applied yet; workers skip later messages
+	barriers map[topicPartition]kafka.Offset
+
+	offsets map[topicPartition]*partitionOffsets
+	// parked messages were polled but their worker's queue was full
+	parked []*kafka.Message
+	// inFlight counts messages that were polled and not yet reported back
+	inFlight int
+	limit    int
+	paused   bool
+}
+
+func newWorkerPool(c *Consumer) *workerPool {
+	p := &workerPool{
+		consumer: c,
+		queues:   make([]chan *kafka.Message, c.options.workers),
+		results:  make(chan workerResult, c.options.workers),
+		offsets:  make(map[topicPartition]*partitionOffsets),
+		live:     make(map[*kafka.Message]bool),
+		barriers: make(map[topicPartition]kafka.Offset),
+		limit:    c.options.workers * c.options.queueSize,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *kafka.Message, c.options.queueSize)
+	}
+	return p
+}
+
+// consumeParallel is ConsumeMessages for a Consumer started WithWorkers. On return
+// all workers have finished and the offsets of completed messages are stored.
+func (c *Consumer) consumeParallel(ctx context.Context, handler MessageHandler) error {
+	pool := newWorkerPool(c)
+	c.pool = pool
+	defer func() { c.pool = nil }()
+
+	for _, queue := range pool.queues {
+		pool.wg.Add(1)
+		go pool.run(ctx, queue, handler)
+	}
+
+	var err error
+	for err == nil {
+		pool.collect()
+		pool.dispatch()
+		pool.applyBackpressure()
+
+		if ctx.Err() != nil {
+			log.Println("Stopping consumer: context cancelled")
+			break
+		}
+
+		switch e := c.consumer.Poll(100).(type) {
+		case *kafka.Message:
+			pool.accept(e)
+		case kafka.Error:
+			err = checkKafkaError(e)
+		}
+	}
+
+	pool.shutdown()
+	return err
+}
+
+// run handles the messages of one queue in order
+func (p *workerPool) run(ctx context.Context, queue <-chan *kafka.Message, handler MessageHandler) {
+	defer p.wg.Done()
+	for msg := range queue {
+		if ctx.Err() != nil {
+			// Queued but not started, leave it for the next consumer
+			p.results <- workerResult{msg: msg, result: resultAbandoned}
+			continue
+		}
+		if !p.claim(msg) {
+			p.results <- workerResult{msg: msg, result: resultDiscarded}
+			continue
+		}
+
+		result := p.consumer.handleMessage(ctx, msg, handler)
+		if result == resultRewind {
+			// Before the next message of this queue, which may have the same key
+			p.raiseBarrier(msg)
+		}
+		p.results <- workerResult{msg: msg, result: result}
+	}
+}
+
+// claim reports whether a worker may start msg, which it may not once a rewind
+// of its partition will deliver it again
+func (p *workerPool) claim(msg *kafka.Message) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.live[msg] {
+		return false
+	}
+	barrier, ok := p.barriers[topicPartitionOf(msg)]
+	return !ok || msg.TopicPartition.Offset < barrier
+}
+
+// raiseBarrier stops workers from starting messages after msg in its partition
+// until the polling goroutine has applied the rewind to msg
+func (p *workerPool) raiseBarrier(msg *kafka.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.live[msg] {
+		// Already covered by the rewind to an earlier message
+		return
+	}
+	tp := topicPartitionOf(msg)
+	if barrier, ok := p.barriers[tp]; !ok || msg.TopicPartition.Offset < barrier {
+		p.barriers[tp] = msg.TopicPartition.Offset
+	}
+}
+
+// release forgets msg once its worker reported back and returns whether it was
+// still live, that is not discarded by a rewind
+func (p *workerPool) release(msg *kafka.Message) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	live := p.live[msg]
+	delete(p.live, msg)
+	return live
+}
+
+// discardFrom drops the barrier of a partition and discards its live messages
+// from offset on; they are delivered again after the rewind
+func (p *workerPool) discardFrom(tp topicPartition, offset kafka.Offset) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.barriers, tp)
+	for msg := range p.live {
+		if topicPartitionOf(msg) == tp && msg.TopicPartition.Offset >= offset {
+			delete(p.live, msg)
+		}
+	}
+}
+
+// accept tracks a polled message and hands it to the worker for its key.
+// Messages without a key are spread by partition, keeping partition order.
+func (p *workerPool) accept(msg *kafka.Message) {
+	tp := topicPartitionOf(msg)
+	po, ok := p.offsets[tp]
+	if !ok {
+		po = &partitionOffsets{done: make(map[kafka.Offset]bool)}
+		p.offsets[tp] = po
+	}
+	po.track(msg.TopicPartition.Offset)
+
+	p.mu.Lock()
+	p.live[msg] = true
+	p.mu.Unlock()
+
+	p.inFlight++
+	p.parked = append(p.parked, msg)
+	p.dispatch()
+}
+
+func (p *workerPool) queueFor(msg *kafka.Message) chan *kafka.Message {
+	key := msg.Key
+	if len(key) == 0 {
+		key = []byte(fmt.Sprintf("%s/%d", *msg.TopicPartition.Topic, msg.TopicPartition.Partition))
+	}
+	return p.queues[hashKey(key, len(p.queues))]
+}
+
+// dispatch moves parked messages to their workers, in order, until a queue is full
+func (p *workerPool) dispatch() {
+	for len(p.parked) > 0 {
+		select {
+		case p.queueFor(p.parked[0]) <- p.parked[0]:
+			p.parked = p.parked[1:]
+		default:
+			return
+		}
+	}
+}
+
+// applyBackpressure pauses fetching while the pool is full, polling continues so
+// the consumer stays in the group and keeps receiving rebalance events
+func (p *workerPool) applyBackpressure() {
+	full := len(p.parked) > 0 || p.inFlight >= p.limit
+	if full == p.paused {
+		return
+	}
+
+	assignment, err := p.consumer.consumer.Assignment()
+	if err != nil || len(assignment) == 0 {
+		return
+	}
+
+	if full {
+		err = p.consumer.consumer.Pause(assignment)
+	} else {
+		err = p.consumer.consumer.Resume(assignment)
+	}
+	if err != nil {
+		log.Printf("Failed to pause or resume %v: %v\n", assignment, err)
+		return
+	}
+	p.paused = full
+}
+
+// collect processes all results the workers have reported so far
+func (p *workerPool) collect() {
+	for {
+		select {
+		case r := <-p.results:
+			p.complete(r)
+		default:
+			return
+		}
+	}
+}
+
+func (p *workerPool) complete(r workerResult) {
+	p.inFlight--
+	if !p.release(r.msg) {
+		// Discarded by a rewind, which also forgot its offset
+		return
+	}
+
+	tp := topicPartitionOf(r.msg)
+	if r.result == resultRewind {
+		// Later messages of the partition that are queued or already running
+		// must not count, they are delivered again after the failed one
+		p.discardFrom(tp, r.msg.TopicPartition.Offset)
+	}
+	po, ok := p.offsets[tp]
+	if !ok {
+		// The partition was revoked meanwhile
+		return
+	}
+
+	switch r.result {
+	case resultDone:
+		if next, ok := po.complete(r.msg.TopicPartition.Offset); ok {
+			p.storeOffset(tp, next)
+		}
+	case resultRewind:
+		po.rewind(r.msg.TopicPartition.Offset)
+		p.dropParked(func(msg *kafka.Message) bool {
+			return topicPartitionOf(msg) == tp && msg.TopicPartition.Offset >= r.msg.TopicPartition.Offset
+		})
+		p.consumer.rewind(r.msg)
+	}
+}
+
+// storeOffset stores the offset to commit for a partition and commits right away
+// in manual commit mode; otherwise the auto-commit picks it up
+func (p *workerPool) storeOffset(tp topicPartition, offset kafka.Offset) {
+	topic := tp.topic
+	stored := []kafka.TopicPartition{{Topic: &topic, Partition: tp.partition, Offset: offset}}
+	if _, err := p.consumer.consumer.StoreOffsets(stored); err != nil {
+		log.Printf("Failed to store offset for %s: %v\n", stored[0], err)
+		return
+	}
+
+	if p.consumer.options.manualCommit {
+		if _, err := p.consumer.consumer.Commit(); err != nil && !isNoOffsetError(err) {
+			log.Printf("Failed to commit offset for %s: %v\n", stored[0], err)
+		}
+	}
+}
+
+func (p *workerPool) dropParked(drop func(msg *kafka.Message) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := p.parked[:0]
+	for _, msg := range p.parked {
+		if drop(msg) {
+			p.inFlight--
+			delete(p.live, msg)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	p.parked = kept
+}
+
+// assigned is called on rebalance; newly assigned partitions start unpaused
+func (p *workerPool) assigned() {
+	p.paused = false
+}
+
+// revoked stores what has completed and forgets the revoked partitions. Messages
+// of those partitions that are still queued or running may also be handled by
+// the new owner, which at-least-once delivery allows.
+func (p *workerPool) revoked(partitions []kafka.TopicPartition) {
+	p.collect()
+
+	revoked := make(map[topicPartition]bool, len(partitions))
+	for _, tp := range partitions {
+		key := topicPartition{topic: *tp.Topic, partition: tp.Partition}
+		revoked[key] = true
+		delete(p.offsets, key)
+	}
+	p.mu.Lock()
+	for tp := range revoked {
+		delete(p.barriers, tp)
+	}
+	p.mu.Unlock()
+	p.dropParked(func(msg *kafka.Message) bool {
+		return revoked[topicPartitionOf(msg)]
+	})
+	p.paused = false
+}
+
+// shutdown stops the workers after their current message and records the results
+func (p *workerPool) shutdown() {
+	p.dropParked(func(*kafka.Message) bool { return true })
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	go func() {
+		p.wg.Wait()
+		close(p.results)
+	}()
+	for r := range p.results {
+		p.complete(r)
+	}
+}
@@ -0,0 +1,180 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+func TestPartitionOffsets(t *testing.T) {
+	type step struct {
+		op     string // track, complete or rewind
+		offset kafka.Offset
+		// Expected result of complete
+		commit   kafka.Offset
+		advanced bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "track", offset: 11},
+				{op: "complete", offset: 10, commit: 11, advanced: true},
+				{op: "complete", offset: 11, commit: 12, advanced: true},
+			},
+		},
+		{
+			name: "out of order waits for the first pending offset",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "track", offset: 11},
+				{op: "track", offset: 12},
+				{op: "complete", offset: 12},
+				{op: "complete", offset: 11},
+				{op: "complete", offset: 10, commit: 13, advanced: true},
+			},
+		},
+		{
+			name: "gaps in offsets",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "track", offset: 15},
+				{op: "complete", offset: 15},
+				{op: "complete", offset: 10, commit: 16, advanced: true},
+			},
+		},
+		{
+			name: "rewind forgets the offset and later ones",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "track", offset: 11},
+				{op: "track", offset: 12},
+				{op: "complete", offset: 10, commit: 11, advanced: true},
+				{op: "rewind", offset: 11},
+				// Completions of dropped messages do not count
+				{op: "complete", offset: 12},
+				{op: "complete", offset: 11},
+				// Redelivered after the rewind
+				{op: "track", offset: 11},
+				{op: "track", offset: 12},
+				{op: "complete", offset: 12},
+				{op: "complete", offset: 11, commit: 13, advanced: true},
+			},
+		},
+		{
+			name: "rewind before all pending offsets",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "track", offset: 11},
+				{op: "rewind", offset: 5},
+				{op: "complete", offset: 10},
+				{op: "complete", offset: 11},
+			},
+		},
+		{
+			name: "rewind after all pending offsets keeps them",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "rewind", offset: 20},
+				{op: "complete", offset: 10, commit: 11, advanced: true},
+			},
+		},
+		{
+			name: "unknown offset",
+			steps: []step{
+				{op: "track", offset: 10},
+				{op: "complete", offset: 99},
+				{op: "complete", offset: 10, commit: 11, advanced: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			po := &partitionOffsets{done: make(map[kafka.Offset]bool)}
+			for i, s := range tt.steps {
+				switch s.op {
+				case "track":
+					po.track(s.offset)
+				case "rewind":
+					po.rewind(s.offset)
+				case "complete":
+					commit, advanced := po.complete(s.offset)
+					if commit != s.commit || advanced != s.advanced {
+						t.Errorf("step %d: complete(%d) = %d, %v, want %d, %v", i, s.offset, commit, advanced, s.commit, s.advanced)
+					}
+				}
+			}
+		})
+	}
+}
+
+func testMessage(partition int32, offset kafka.Offset) *kafka.Message {
+	topic := "topic"
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+}
+
+// TestWorkerPoolRewind checks that once a message asks for a rewind, later
+// messages of its partition are neither started nor counted, while other
+// partitions carry on
+func TestWorkerPoolRewind(t *testing.T) {
+	p := &workerPool{
+		live:     make(map[*kafka.Message]bool),
+		barriers: make(map[topicPartition]kafka.Offset),
+	}
+	failed, queued, running, before, other := testMessage(0, 11), testMessage(0, 12), testMessage(0, 13), testMessage(0, 10), testMessage(1, 12)
+	for _, msg := range []*kafka.Message{before, failed, queued, running, other} {
+		p.live[msg] = true
+	}
+
+	if !p.claim(running) {
+		t.Fatal("claim() = false before the rewind")
+	}
+	p.raiseBarrier(failed)
+
+	tests := []struct {
+		name string
+		msg  *kafka.Message
+		want bool
+	}{
+		{"earlier offset", before, true},
+		{"failed message", failed, false},
+		{"later offset", queued, false},
+		{"other partition", other, true},
+	}
+	for _, tt := range tests {
+		if got := p.claim(tt.msg); got != tt.want {
+			t.Errorf("claim(%s) = %v after raiseBarrier, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The polling goroutine applies the rewind when the failed message reports back
+	if !p.release(failed) {
+		t.Fatal("release(failed) = false, want true")
+	}
+	p.discardFrom(topicPartitionOf(failed), failed.TopicPartition.Offset)
+
+	if p.release(running) {
+		t.Error("release() of a message running during the rewind = true, its completion must be ignored")
+	}
+	if p.claim(queued) {
+		t.Error("claim() of a discarded message = true")
+	}
+	if !p.claim(before) || !p.claim(other) {
+		t.Error("claim() of messages not covered by the rewind = false")
+	}
+	if _, ok := p.barriers[topicPartitionOf(failed)]; ok {
+		t.Error("barrier still set after the rewind")
+	}
+
+	// A redelivered message of the partition is accepted again
+	redelivered := testMessage(0, 11)
+	p.live[redelivered] = true
+	if !p.claim(redelivered) {
+		t.Error("claim() of a redelivered message = false")
+	}
+}
@@ -1,22 +1,34 @@
 package kafka
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel/codes"
+	"gobuild/shared/message"
+	"gobuild/shared/tracing"
 )
 
+// closeFlushTimeout bounds how long Close waits for queued messages to be delivered
+const closeFlushTimeout = 10 * time.Second
+
 // Producer wraps the Kafka producer
 type Producer struct {
 	producer *kafka.Producer
 }
 
-// NewProducer creates a new Kafka producer
+// NewProducer creates a new idempotent Kafka producer
 func NewProducer(bootstrapServers string) (*Producer, error) {
 	log.Printf("🔧 Creating Kafka producer with servers: %s", bootstrapServers)
 	p, err := kafka.NewProducer(&kafka.ConfigMap{
 		"bootstrap.servers": bootstrapServers,
+		// Idempotence implies acks=all and keeps per-partition ordering on retries
+		"enable.idempotence": true,
+		"acks":               "all",
 	})
 	if err != nil {
 		return nil, err
@@ -37,20 +49,40 @@ func NewProducer(bootstrapServers string) (*Producer, error) {
 	return &Producer{producer: p}, nil
 }
 
-// SendMessage sends a message to the specified topic
-func (p *Producer) SendMessage(topic string, key string, value interface{}) error {
+// encodeEvent wraps the event in a versioned envelope and marshals it
+func encodeEvent(event message.Event) ([]byte, error) {
+	envelope, err := message.NewEnvelope(event)
+	if err != nil {
+		log.Printf("❌ Failed to create envelope for %s event: %v", event.EventType(), err)
+		return nil, err
+	}
 
-	jsonValue, err := json.Marshal(value)
+	jsonValue, err := json.Marshal(envelope)
 	if err != nil {
 		log.Printf("❌ Failed to marshal message: %v", err)
-		log.Printf("❌ 📤 Message content: %s", string(jsonValue))
+		return nil, err
+	}
+
+	return jsonValue, nil
+}
+
+// SendMessage wraps the event in a versioned envelope and queues it for the specified topic.
+// Delivery failures are only reported in the log; use SendMessageSync when the caller
+// needs to know the message was persisted.
+func (p *Producer) SendMessage(ctx context.Context, topic string, key string, event message.Event) error {
+	jsonValue, err := encodeEvent(event)
+	if err != nil {
 		return err
 	}
 
+	ctx, span := startProducerSpan(ctx, topic, event.EventType())
+	defer span.End()
+
 	err = p.producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Key:            []byte(key),
 		Value:          jsonValue,
+		Headers:        kafkaHeaders(tracing.InjectHeaders(ctx)),
 	}, nil)
 
 	if err != nil {
@@ -62,8 +94,84 @@ func (p *Producer) SendMessage(topic string, key string, value interface{}) erro
 	return nil
 }
 
-// Close closes the producer
+// SendMessageSync is like SendMessage but waits until the broker acknowledged the
+// message or ctx is done
+func (p *Producer) SendMessageSync(ctx context.Context, topic string, key string, event message.Event) error {
+	jsonValue, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startProducerSpan(ctx, topic, event.EventType())
+	defer span.End()
+
+	err = p.produceAndWait(ctx, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          jsonValue,
+		Headers:        kafkaHeaders(tracing.InjectHeaders(ctx)),
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// SendRaw publishes an already encoded value with headers and waits for the broker acknowledgement
+func (p *Producer) SendRaw(topic string, key []byte, value []byte, headers map[string]string) error {
+	return p.produceAndWait(context.Background(), &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            key,
+		Value:          value,
+		Headers:        kafkaHeaders(headers),
+	})
+}
+
+// produceAndWait produces msg with its own delivery channel and waits for the report
+func (p *Producer) produceAndWait(ctx context.Context, msg *kafka.Message) error {
+	topic := *msg.TopicPartition.Topic
+
+	// Buffered so the delivery report never blocks librdkafka if we stop waiting
+	deliveryChan := make(chan kafka.Event, 1)
+	if err := p.producer.Produce(msg, deliveryChan); err != nil {
+		log.Printf("❌ Failed to produce message to %s: %v", topic, err)
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for delivery to %s: %w", topic, ctx.Err())
+	case ev := <-deliveryChan:
+		delivered, ok := ev.(*kafka.Message)
+		if !ok {
+			return fmt.Errorf("unexpected delivery event for %s: %v", topic, ev)
+		}
+		if delivered.TopicPartition.Error != nil {
+			log.Printf("❌ Failed to deliver message to %s: %v", topic, delivered.TopicPartition.Error)
+			return delivered.TopicPartition.Error
+		}
+	}
+
+	return nil
+}
+
+// Flush waits up to timeout for all queued messages to be delivered and
+// returns the number of messages that are still outstanding
+func (p *Producer) Flush(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	remaining := p.producer.Len()
+	for remaining > 0 && time.Now().Before(deadline) {
+		remaining = p.producer.Flush(int(time.Until(deadline).Milliseconds()))
+	}
+	return remaining
+}
+
+// Close flushes queued messages (bounded by closeFlushTimeout) and closes the producer
 func (p *Producer) Close() {
 	log.Println("🔒 Closing Kafka producer")
+	if remaining := p.Flush(closeFlushTimeout); remaining > 0 {
+		log.Printf("⚠️ %d messages were not delivered before closing the producer", remaining)
+	}
 	p.producer.Close()
 }
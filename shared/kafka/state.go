@@ -0,0 +1,202 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"gobuild/shared/message"
+)
+
+// StateView materialises a compacted topic into an in-memory map from message
+// key to the latest event. A message without value (tombstone) removes its key.
+// Every instance reads all partitions from the beginning and commits nothing.
+type StateView[T message.Event] struct {
+	bootstrapServers string
+	topic            string
+
+	mu    sync.RWMutex
+	state map[string]T
+
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	onUpdate func(key string, event T)
+}
+
+// NewStateView creates a view of topic; call Run to fill and update it
+func NewStateView[T message.Event](bootstrapServers, topic string) *StateView[T] {
+	return &StateView[T]{
+		bootstrapServers: bootstrapServers,
+		topic:            topic,
+		state:            make(map[string]T),
+		ready:            make(chan struct{}),
+	}
+}
+
+// OnUpdate registers fn to be called with every event applied to the view,
+// including those read while catching up. It must be called before Run.
+func (v *StateView[T]) OnUpdate(fn func(key string, event T)) {
+	v.onUpdate = fn
+}
+
+// NewBuildStateView creates a view of the latest state of every build
+func NewBuildStateView(bootstrapServers string) *StateView[message.BuildStateMessage] {
+	return NewStateView[message.BuildStateMessage](bootstrapServers, TopicBuildState)
+}
+
+// NewBuildCancelView creates a view of the cancelled builds of the last days
+func NewBuildCancelView(bootstrapServers string) *StateView[message.BuildCancelMessage] {
+	return NewStateView[message.BuildCancelMessage](bootstrapServers, TopicBuildCancellations)
+}
+
+// Run reads the topic and keeps the view up to date until ctx is cancelled.
+// The view becomes ready once everything that existed at start has been read.
+func (v *StateView[T]) Run(ctx context.Context) error {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  v.bootstrapServers,
+		"group.id":           v.topic + "-view",
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": "false",
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	metadata, err := c.GetMetadata(&v.topic, false, 5000)
+	if err != nil {
+		return err
+	}
+	topicMetadata, ok := metadata.Topics[v.topic]
+	if !ok || topicMetadata.Error.Code() != kafka.ErrNoError {
+		return fmt.Errorf("topic %s is not available: %v", v.topic, topicMetadata.Error)
+	}
+
+	partitions := make([]kafka.TopicPartition, 0, len(topicMetadata.Partitions))
+	remaining := make(map[int32]int64)
+	for _, p := range topicMetadata.Partitions {
+		partitions = append(partitions, kafka.TopicPartition{Topic: &v.topic, Partition: p.ID, Offset: kafka.OffsetBeginning})
+
+		low, high, err := c.QueryWatermarkOffsets(v.topic, p.ID, 5000)
+		if err != nil {
+			return err
+		}
+		if low < high {
+			remaining[p.ID] = high
+		}
+	}
+
+	if err := c.Assign(partitions); err != nil {
+		return err
+	}
+	if len(remaining) == 0 {
+		v.markReady()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		switch e := c.Poll(100).(type) {
+		case *kafka.Message:
+			v.apply(e)
+
+			if high, ok := remaining[e.TopicPartition.Partition]; ok && int64(e.TopicPartition.Offset)+1 >= high {
+				delete(remaining, e.TopicPartition.Partition)
+				if len(remaining) == 0 {
+					log.Printf("State view of %s is ready with %d entries", v.topic, v.Len())
+					v.markReady()
+				}
+			}
+		case kafka.Error:
+			if err := checkKafkaError(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (v *StateView[T]) apply(msg *kafka.Message) {
+	key := string(msg.Key)
+
+	if msg.Value == nil {
+		v.mu.Lock()
+		delete(v.state, key)
+		v.mu.Unlock()
+		return
+	}
+
+	env, err := message.ParseEnvelope(msg.Value)
+	if err != nil {
+		log.Printf("Skipping message %s in state view: %v\n", msg.TopicPartition, err)
+		return
+	}
+	var event T
+	if env.Type != event.EventType() {
+		log.Printf("Skipping %s event %s in state view of %s\n", env.Type, env.EventID, v.topic)
+		return
+	}
+	if err := env.Decode(&event); err != nil {
+		log.Printf("Skipping message %s in state view: %v\n", msg.TopicPartition, err)
+		return
+	}
+
+	v.mu.Lock()
+	v.state[key] = event
+	v.mu.Unlock()
+
+	if v.onUpdate != nil {
+		v.onUpdate(key, event)
+	}
+}
+
+func (v *StateView[T]) markReady() {
+	v.readyOnce.Do(func() { close(v.ready) })
+}
+
+// Ready is closed once the view has caught up with the topic
+func (v *StateView[T]) Ready() <-chan struct{} {
+	return v.ready
+}
+
+// WaitReady blocks until the view has caught up or ctx is done
+func (v *StateView[T]) WaitReady(ctx context.Context) error {
+	select {
+	case <-v.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns the latest event for key
+func (v *StateView[T]) Get(key string) (T, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	event, ok := v.state[key]
+	return event, ok
+}
+
+// Snapshot returns a copy of the current state
+func (v *StateView[T]) Snapshot() map[string]T {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	snapshot := make(map[string]T, len(v.state))
+	for key, event := range v.state {
+		snapshot[key] = event
+	}
+	return snapshot
+}
+
+// Len returns the number of keys in the view
+func (v *StateView[T]) Len() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.state)
+}
@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// Topic names used by the services
+const (
+	TopicBuildRequests    = "build-requests"
+	TopicBuildStatus      = "build-status"
+	TopicBuildLogs        = "build-logs"
+	TopicBuildCompletions = "build-completions"
+	TopicBuildJobs        = "build-jobs"
+	// TopicBuildState is compacted and holds the latest BuildStateMessage per build ID
+	TopicBuildState = "build-state"
+	// TopicBuildCancellations is compacted, so a builder that starts late still
+	// knows which of the queued jobs were cancelled
+	TopicBuildCancellations = "build-cancellations"
+	// TopicAuditEvents carries audit log entries until the gateway stored them
+	TopicAuditEvents = "audit-events"
+	// TopicUserDeletions carries deleted accounts whose builds and artifacts are removed
+	TopicUserDeletions = "user-deletions"
+)
+
+const (
+	CleanupPolicyDelete  = "delete"
+	CleanupPolicyCompact = "compact"
+	// CleanupPolicyCompactDelete compacts and also drops messages older than the retention
+	CleanupPolicyCompactDelete = "compact,delete"
+)
+
+// TopicConfig declares how a topic should look on the broker
+type TopicConfig struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	Retention         time.Duration // -1 keeps messages forever
+	CleanupPolicy     string
+}
+
+func (t TopicConfig) brokerConfig() map[string]string {
+	retention := int64(-1)
+	if t.Retention > 0 {
+		retention = t.Retention.Milliseconds()
+	}
+	return map[string]string{
+		"retention.ms":   strconv.FormatInt(retention, 10),
+		"cleanup.policy": t.CleanupPolicy,
+	}
+}
+
+// deadLetterTopicConfig derives the dead-letter topic of a registered topic
+func deadLetterTopicConfig(t TopicConfig) TopicConfig {
+	return TopicConfig{
+		Name:              DeadLetterTopic(t.Name),
+		Partitions:        1,
+		ReplicationFactor: t.ReplicationFactor,
+		Retention:         30 * 24 * time.Hour,
+		CleanupPolicy:     CleanupPolicyDelete,
+	}
+}
+
+// Topics is the registry of all topics, including their dead-letter topics
+var Topics = append(withDeadLetterTopics([]TopicConfig{
+	{Name: TopicBuildRequests, Partitions: 5, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	{Name: TopicBuildStatus, Partitions: 5, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	{Name: TopicBuildLogs, Partitions: 5, ReplicationFactor: 1, Retention: 3 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	{Name: TopicBuildCompletions, Partitions: 5, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	{Name: TopicBuildJobs, Partitions: 5, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	// Same retention as build-jobs, older jobs cannot be queued anymore
+	{Name: TopicBuildCancellations, Partitions: 5, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyCompactDelete},
+	{Name: TopicAuditEvents, Partitions: 5, ReplicationFactor: 1, Retention: 30 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+	{Name: TopicUserDeletions, Partitions: 1, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupPolicyDelete},
+}),
+	// Only read with a StateView, which never dead-letters
+	TopicConfig{Name: TopicBuildState, Partitions: 5, ReplicationFactor: 1, Retention: -1, CleanupPolicy: CleanupPolicyCompact},
+)
+
+func withDeadLetterTopics(topics []TopicConfig) []TopicConfig {
+	result := make([]TopicConfig, 0, len(topics)*2)
+	result = append(result, topics...)
+	for _, t := range topics {
+		result = append(result, deadLetterTopicConfig(t))
+	}
+	return result
+}
+
+// EnsureTopics creates missing topics and reconciles retention and cleanup
+// policy of existing ones. Their partition count is never changed: adding
+// partitions would move keys to other partitions and break per-key ordering, so a
+// mismatch is only logged and has to be migrated by hand. Every service calls
+// this on start, concurrent calls are safe.
+func EnsureTopics(ctx context.Context, bootstrapServers string, topics []TopicConfig) error {
+	admin, err := kafka.NewAdminClient(&kafka.ConfigMap{
+		"bootstrap.servers": bootstrapServers,
+	})
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	maxRetries := 15
+	retryDelay := time.Second * 2
+
+	var metadata *kafka.Metadata
+	for i := 0; i < maxRetries; i++ {
+		metadata, err = admin.GetMetadata(nil, true, 5000)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to fetch cluster metadata: %v, retrying in %v... (attempt %d/%d)",
+			err, retryDelay, i+1, maxRetries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var toCreate []kafka.TopicSpecification
+	var toAlter []kafka.ConfigResource
+
+	for _, t := range topics {
+		existing, ok := metadata.Topics[t.Name]
+		if !ok || existing.Error.Code() == kafka.ErrUnknownTopicOrPart {
+			toCreate = append(toCreate, kafka.TopicSpecification{
+				Topic:             t.Name,
+				NumPartitions:     t.Partitions,
+				ReplicationFactor: t.ReplicationFactor,
+				Config:            t.brokerConfig(),
+			})
+			continue
+		}
+
+		if len(existing.Partitions) != t.Partitions {
+			log.Printf("⚠️ Topic %s has %d partitions, registry declares %d; leaving it unchanged to keep per-key ordering",
+				t.Name, len(existing.Partitions), t.Partitions)
+		}
+
+		toAlter = append(toAlter, kafka.ConfigResource{
+			Type: kafka.ResourceTopic,
+			Name: t.Name,
+			Config: kafka.StringMapToIncrementalConfigEntries(t.brokerConfig(), map[string]kafka.AlterConfigOpType{
+				"retention.ms":   kafka.AlterConfigOpTypeSet,
+				"cleanup.policy": kafka.AlterConfigOpTypeSet,
+			}),
+		})
+	}
+
+	if len(toCreate) > 0 {
+		results, err := admin.CreateTopics(ctx, toCreate)
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			switch code := res.Error.Code(); code {
+			case kafka.ErrNoError:
+				log.Printf("✅ Created topic %s", res.Topic)
+			case kafka.ErrTopicAlreadyExists:
+				// Another service created it concurrently
+			default:
+				return fmt.Errorf("failed to create topic %s: %w", res.Topic, res.Error)
+			}
+		}
+	}
+
+	if len(toAlter) > 0 {
+		results, err := admin.IncrementalAlterConfigs(ctx, toAlter)
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			if res.Error.Code() != kafka.ErrNoError {
+				return fmt.Errorf("failed to update config of topic %s: %w", res.Name, res.Error)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gobuild/shared/message"
+	"gobuild/shared/tracing"
+)
+
+// startProducerSpan starts the span whose context is injected into the message headers
+func startProducerSpan(ctx context.Context, topic string, eventType message.EventType) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "send "+topic,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("messaging.event_type", string(eventType)),
+		))
+}
+
+// startConsumerSpan continues the producer's trace from the message headers
+func startConsumerSpan(ctx context.Context, topic string, headers map[string]string) (context.Context, trace.Span) {
+	ctx = tracing.ExtractHeaders(ctx, headers)
+	return tracing.Tracer().Start(ctx, "process "+topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.source.name", topic),
+		))
+}
+
+func kafkaHeaders(headers map[string]string) []kafka.Header {
+	result := make([]kafka.Header, 0, len(headers))
+	for k, v := range headers {
+		result = append(result, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return result
+}
+
+func headerMap(headers []kafka.Header) map[string]string {
+	result := make(map[string]string, len(headers))
+	for _, h := range headers {
+		result[h.Key] = string(h.Value)
+	}
+	return result
+}
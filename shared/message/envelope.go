@@ -0,0 +1,110 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType identifies the kind of payload carried by an Envelope
+type EventType string
+
+const (
+	EventBuildRequest    EventType = "build.request"
+	EventBuildStatus     EventType = "build.status"
+	EventBuildLog        EventType = "build.log"
+	EventBuildCompletion EventType = "build.completion"
+	EventBuildState      EventType = "build.state"
+	EventBuildCancel     EventType = "build.cancel"
+	EventAudit           EventType = "audit.event"
+	EventUserDeleted     EventType = "user.deleted"
+)
+
+// SchemaVersion is the newest envelope schema version this code understands
+const SchemaVersion = 1
+
+var (
+	ErrMalformedEnvelope  = errors.New("malformed event envelope")
+	ErrUnknownEventType   = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+var knownEventTypes = map[EventType]bool{
+	EventBuildRequest:    true,
+	EventBuildStatus:     true,
+	EventBuildLog:        true,
+	EventBuildCompletion: true,
+	EventBuildState:      true,
+	EventBuildCancel:     true,
+	EventAudit:           true,
+	EventUserDeleted:     true,
+}
+
+// Event is implemented by every message that can be published on the bus
+type Event interface {
+	EventType() EventType
+}
+
+func (BuildRequestMessage) EventType() EventType    { return EventBuildRequest }
+func (BuildStatusMessage) EventType() EventType     { return EventBuildStatus }
+func (BuildLogMessage) EventType() EventType        { return EventBuildLog }
+func (BuildCompletionMessage) EventType() EventType { return EventBuildCompletion }
+func (BuildStateMessage) EventType() EventType      { return EventBuildState }
+func (BuildCancelMessage) EventType() EventType     { return EventBuildCancel }
+func (AuditEventMessage) EventType() EventType      { return EventAudit }
+func (UserDeletedMessage) EventType() EventType     { return EventUserDeleted }
+
+// Envelope wraps every Kafka message with explicit type and version metadata
+type Envelope struct {
+	EventID   string          `json:"event_id"`
+	Type      EventType       `json:"type"`
+	Version   int             `json:"version"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope wraps an event in an envelope using the current schema version
+func NewEnvelope(event Event) (*Envelope, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		EventID:   uuid.NewString(),
+		Type:      event.EventType(),
+		Version:   SchemaVersion,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}, nil
+}
+
+// ParseEnvelope decodes and validates a raw Kafka message value
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedEnvelope, err)
+	}
+
+	if env.Type == "" || env.Version == 0 || len(env.Payload) == 0 {
+		return nil, fmt.Errorf("%w: missing type, version or payload", ErrMalformedEnvelope)
+	}
+
+	if !knownEventTypes[env.Type] {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEventType, env.Type)
+	}
+
+	if env.Version < 1 || env.Version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %s v%d (supported up to v%d)", ErrUnsupportedVersion, env.Type, env.Version, SchemaVersion)
+	}
+
+	return &env, nil
+}
+
+// Decode unmarshals the envelope payload into the provided struct
+func (e *Envelope) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
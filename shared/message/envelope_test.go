@@ -0,0 +1,72 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"current version", `{"event_id":"1","type":"build.status","version":1,"payload":{"build_id":"b"}}`, nil},
+		{"newer version", `{"event_id":"1","type":"build.status","version":2,"payload":{"build_id":"b"}}`, ErrUnsupportedVersion},
+		{"negative version", `{"event_id":"1","type":"build.status","version":-1,"payload":{"build_id":"b"}}`, ErrUnsupportedVersion},
+		{"missing version", `{"event_id":"1","type":"build.status","payload":{"build_id":"b"}}`, ErrMalformedEnvelope},
+		{"missing type", `{"event_id":"1","version":1,"payload":{"build_id":"b"}}`, ErrMalformedEnvelope},
+		{"missing payload", `{"event_id":"1","type":"build.status","version":1}`, ErrMalformedEnvelope},
+		{"unknown type", `{"event_id":"1","type":"build.unknown","version":1,"payload":{}}`, ErrUnknownEventType},
+		{"not JSON", `build b failed`, ErrMalformedEnvelope},
+		{"message without envelope", `{"build_id":"b","status":"failed"}`, ErrMalformedEnvelope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := ParseEnvelope([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseEnvelope() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && env == nil {
+				t.Fatal("ParseEnvelope() returned no envelope")
+			}
+		})
+	}
+}
+
+func TestNewEnvelopeRoundTrip(t *testing.T) {
+	event := BuildStatusMessage{BuildID: "b", Status: "completed"}
+	env, err := NewEnvelope(event)
+	if err != nil {
+		t.Fatalf("NewEnvelope() = %v", err)
+	}
+	if env.EventID == "" || env.Type != EventBuildStatus || env.Version != SchemaVersion {
+		t.Errorf("NewEnvelope() = %+v, want an event ID, type %s and version %d", env, EventBuildStatus, SchemaVersion)
+	}
+
+	other, err := NewEnvelope(event)
+	if err != nil {
+		t.Fatalf("NewEnvelope() = %v", err)
+	}
+	if other.EventID == env.EventID {
+		t.Errorf("two envelopes share the event ID %s", env.EventID)
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	parsed, err := ParseEnvelope(data)
+	if err != nil {
+		t.Fatalf("ParseEnvelope() = %v", err)
+	}
+	var decoded BuildStatusMessage
+	if err := parsed.Decode(&decoded); err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+	if decoded.BuildID != event.BuildID || decoded.Status != event.Status {
+		t.Errorf("Decode() = %+v, want %+v", decoded, event)
+	}
+}
@@ -2,6 +2,8 @@ package message
 
 import (
 	"time"
+
+	"gobuild/shared/model"
 )
 
 type BuildRequestMessage struct {
@@ -11,11 +13,19 @@ type BuildRequestMessage struct {
 	CommitHash    string    `json:"commit_hash"`
 	UserID        string    `json:"user_id"`
 	CreatedAt     time.Time `json:"created_at"`
+	// Set for builds of a project, taken from the project when the build is requested
+	ProjectID       string   `json:"project_id,omitempty"`
+	Public          bool     `json:"public,omitempty"`
+	TimeoutMinutes  int      `json:"timeout_minutes,omitempty"`
+	SharedWithTeams []string `json:"shared_with_teams,omitempty"`
+	// SecretsToken is the one-time token with which the builder fetches the
+	// secrets of a project build from the gateway
+	SecretsToken string `json:"secrets_token,omitempty"`
 }
 
 type BuildStatusMessage struct {
 	BuildID   string    `json:"build_id"`
-	Status    string    `json:"status"` // queued, in-progress, completed, failed
+	Status    string    `json:"status"` // queued, in-progress, completed, failed, cancelled
 	Message   string    `json:"message"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -33,3 +43,42 @@ type BuildCompletionMessage struct {
 	Duration    int64     `json:"duration"` // in milliseconds
 	CompletedAt time.Time `json:"completed_at"`
 }
+
+// BuildCancelMessage asks to stop a build. It is published to a compacted
+// topic keyed by build ID.
+type BuildCancelMessage struct {
+	BuildID     string    `json:"build_id"`
+	RequestedBy string    `json:"requested_by"` // user ID
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// BuildStateMessage carries the full current state of a build. It is published
+// to a compacted topic keyed by build ID, so the latest state per build is kept.
+type BuildStateMessage struct {
+	model.BuildStatus
+}
+
+// AuditEventMessage records a security-relevant or build-control action for
+// the audit log
+type AuditEventMessage struct {
+	ID      string `json:"id"`
+	Action  string `json:"action"`  // e.g. user.login, build.cancel
+	Outcome string `json:"outcome"` // success or failure
+	// The actor is unknown for failed logins, which only carry the email tried
+	ActorID    string            `json:"actor_id,omitempty"`
+	ActorEmail string            `json:"actor_email,omitempty"`
+	IP         string            `json:"ip,omitempty"`
+	UserAgent  string            `json:"user_agent,omitempty"`
+	TargetType string            `json:"target_type,omitempty"` // user, token, build or artifact
+	TargetID   string            `json:"target_id,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	Service    string            `json:"service"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// UserDeletedMessage announces a deleted account, whose builds and artifacts
+// the services then remove
+type UserDeletedMessage struct {
+	UserID    string    `json:"user_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
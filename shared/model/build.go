@@ -11,7 +11,7 @@ type BuildStatus struct {
 	Branch        string     `json:"branch,omitempty"`
 	CommitHash    string     `json:"commit_hash,omitempty"`
 	UserID        string     `json:"user_id"`
-	Status        string     `json:"status"` // queued, in-progress, completed, failed
+	Status        string     `json:"status"` // queued, in-progress, completed, failed, cancelled
 	Message       string     `json:"message,omitempty"`
 	ArtifactURL   string     `json:"artifact_url,omitempty"`
 	CreatedAt     time.Time  `json:"created_at"`
@@ -19,4 +19,20 @@ type BuildStatus struct {
 	StartedAt     *time.Time `json:"started_at,omitempty"`
 	CompletedAt   *time.Time `json:"completed_at,omitempty"`
 	Duration      int64      `json:"duration,omitempty"` // in milliseconds
+	// SharedWithTeams lists the teams whose members may see the build besides its owner
+	SharedWithTeams []string `json:"shared_with_teams,omitempty"`
+	// ProjectID is set for builds of a project
+	ProjectID string `json:"project_id,omitempty"`
+	// Public builds belong to a public project and every user may see them
+	Public bool `json:"public,omitempty"`
+}
+
+// Finished reports whether the build reached a final status. The builder reports
+// completed/failed as status and success/failure as completion.
+func (b *BuildStatus) Finished() bool {
+	switch b.Status {
+	case "completed", "failed", "success", "failure", "cancelled":
+		return true
+	}
+	return false
 }
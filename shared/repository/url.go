@@ -0,0 +1,217 @@
+// Package repository parses and normalises repository URLs and checks them
+// against the allowlist of schemes and hosts builds may be cloned from.
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidURL        = errors.New("invalid repository URL")
+	ErrSchemeNotAllowed  = errors.New("repository URL scheme not allowed")
+	ErrHostNotAllowed    = errors.New("repository host not allowed")
+	ErrCredentialsInURL  = errors.New("repository URL must not contain credentials")
+	errMissingRepository = errors.New("path does not name a repository")
+)
+
+// Defaults used when REPO_ALLOWED_SCHEMES or REPO_ALLOWED_HOSTS are not set
+const (
+	DefaultSchemes = "https"
+	DefaultHosts   = "github.com,gitlab.com,bitbucket.org"
+)
+
+// commitHash matches abbreviated and full SHA-1 and SHA-256 object names
+var commitHash = regexp.MustCompile(`^[0-9a-fA-F]{7,64}$`)
+
+// ValidCommitHash reports whether s looks like a commit hash
+func ValidCommitHash(s string) bool {
+	return commitHash.MatchString(s)
+}
+
+// maxRefNameLength bounds branch and tag names; git itself has no limit
+const maxRefNameLength = 255
+
+// ValidRefName reports whether name is a valid branch or tag name by the rules
+// of git check-ref-format --branch. Names starting with "-" are rejected as
+// well, so a name can never be taken for an option of git.
+func ValidRefName(name string) bool {
+	if name == "" || len(name) > maxRefNameLength || name == "@" || name == "HEAD" ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// scpLike matches the short SSH form git@host:owner/repo.git
+var scpLike = regexp.MustCompile(`^([A-Za-z0-9._-]+)@([A-Za-z0-9.-]+):([^/].*)$`)
+
+// Policy decides which repository URLs are accepted
+type Policy struct {
+	schemes map[string]bool
+	// hosts holds exact host names; an entry "*.example.com" allows all subdomains of example.com
+	hosts []string
+}
+
+func NewPolicy(schemes, hosts []string) *Policy {
+	p := &Policy{schemes: make(map[string]bool)}
+	for _, scheme := range schemes {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			p.schemes[scheme] = true
+		}
+	}
+	for _, host := range hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			p.hosts = append(p.hosts, host)
+		}
+	}
+	return p
+}
+
+// PolicyFromEnv reads the comma-separated REPO_ALLOWED_SCHEMES and REPO_ALLOWED_HOSTS
+func PolicyFromEnv() *Policy {
+	return NewPolicy(
+		strings.Split(getEnv("REPO_ALLOWED_SCHEMES", DefaultSchemes), ","),
+		strings.Split(getEnv("REPO_ALLOWED_HOSTS", DefaultHosts), ","),
+	)
+}
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Normalize parses raw, checks it against the policy and returns it in canonical
+// form: lower-case scheme and host, the short SSH form rewritten to ssh://, no
+// trailing slash. The error explains why a URL was rejected.
+func (p *Policy) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("%w: URL is empty", ErrInvalidURL)
+	}
+	if strings.HasPrefix(raw, "-") {
+		return "", fmt.Errorf("%w: URL must not start with '-'", ErrInvalidURL)
+	}
+	for _, r := range raw {
+		if r < 0x20 || r == 0x7f || r == ' ' {
+			return "", fmt.Errorf("%w: URL contains whitespace or control characters", ErrInvalidURL)
+		}
+	}
+	// Remote helper syntax such as ext::sh -c ... runs arbitrary commands
+	if strings.Contains(raw, "::") {
+		return "", fmt.Errorf("%w: git transport syntax (<transport>::) is not allowed", ErrInvalidURL)
+	}
+
+	if m := scpLike.FindStringSubmatch(raw); m != nil && !strings.Contains(raw, "://") {
+		raw = fmt.Sprintf("ssh://%s@%s/%s", m[1], m[2], m[3])
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if u.Scheme == "" {
+		return "", fmt.Errorf("%w: URL needs a scheme such as https://, local paths are not allowed", ErrInvalidURL)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !p.schemes[u.Scheme] {
+		return "", fmt.Errorf("%w: %s (allowed: %s)", ErrSchemeNotAllowed, u.Scheme, strings.Join(p.allowedSchemes(), ", "))
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("%w: URL has no host", ErrInvalidURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%w: query strings and fragments are not allowed", ErrInvalidURL)
+	}
+
+	// Only the plain SSH user is accepted, tokens would end up in logs and build status
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword || u.Scheme != "ssh" {
+			return "", ErrCredentialsInURL
+		}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if !p.hostAllowed(host) {
+		return "", fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = host
+	}
+
+	repoPath, err := cleanPath(u.Path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	u.Path = repoPath
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+// cleanPath rejects relative segments and returns the path without trailing slash
+func cleanPath(p string) (string, error) {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return "", errors.New("path must not contain . or .. segments")
+		}
+	}
+	cleaned := strings.TrimSuffix(path.Clean("/"+p), "/")
+	if cleaned == "" {
+		return "", errMissingRepository
+	}
+	return cleaned, nil
+}
+
+func (p *Policy) hostAllowed(host string) bool {
+	for _, allowed := range p.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowedSchemes() []string {
+	schemes := make([]string, 0, len(p.schemes))
+	for scheme := range p.schemes {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// GitProtocols returns the allowed schemes in the format of GIT_ALLOW_PROTOCOL,
+// which also stops git from following other transports, e.g. in submodules
+func (p *Policy) GitProtocols() string {
+	return strings.Join(p.allowedSchemes(), ":")
+}
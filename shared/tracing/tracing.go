@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestIDHeader carries the request ID on HTTP requests and responses
+	RequestIDHeader = "X-Request-ID"
+	// requestIDKey carries the request ID in Kafka message headers
+	requestIDKey = "x-request-id"
+
+	tracerName = "gobuild"
+)
+
+type contextKey string
+
+const requestIDContextKey contextKey = "requestID"
+
+// Init installs the global tracer provider and the W3C trace context propagator.
+// TRACING_EXPORTER selects where spans go: "none" (default) only propagates
+// context, "otlp" sends them to a collector, "stdout" and "file" (path in
+// TRACING_FILE) write them as JSON for debugging. The OTLP exporter is
+// configured with the standard OTEL_EXPORTER_OTLP_* variables, e.g.
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_PROTOCOL ("http/protobuf"
+// by default, or "grpc"). The returned function flushes and stops the exporter.
+func Init(serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter := getEnv("TRACING_EXPORTER", "none"); exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = newOTLPExporter()
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f io.Writer
+		f, err = os.OpenFile(getEnv("TRACING_FILE", "/tmp/traces.json"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return nil, fmt.Errorf("unknown TRACING_EXPORTER %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// newOTLPExporter creates an OTLP exporter for the protocol in
+// OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or OTEL_EXPORTER_OTLP_PROTOCOL. The
+// exporters read endpoint, headers and TLS settings from the environment.
+func newOTLPExporter() (sdktrace.SpanExporter, error) {
+	protocol := getEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf"))
+	// The exporters only start connecting in the background, so Init does not
+	// block on a collector that is not up yet
+	ctx := context.Background()
+	switch protocol {
+	case "http/protobuf":
+		return otlptracehttp.New(ctx)
+	case "grpc":
+		return otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, use http/protobuf or grpc", protocol)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Tracer returns the tracer used by all gobuild services
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// NewRequestID returns a new random request ID
+func NewRequestID() string {
+	return uuid.New().String()
+}
+
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// InjectHeaders returns the trace context and request ID of ctx as message headers
+func InjectHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		carrier[requestIDKey] = requestID
+	}
+	return carrier
+}
+
+// ExtractHeaders restores the trace context and request ID from message headers
+func ExtractHeaders(ctx context.Context, headers map[string]string) context.Context {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+	if requestID := headers[requestIDKey]; requestID != "" {
+		ctx = ContextWithRequestID(ctx, requestID)
+	}
+	return ctx
+}
+
+// Logf logs like log.Printf, prefixed with the trace and request ID of ctx
+// so log lines of one build can be correlated across services
+func Logf(ctx context.Context, format string, args ...interface{}) {
+	prefix := ""
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.HasTraceID() {
+		prefix += "trace=" + spanCtx.TraceID().String() + " "
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		prefix += "req=" + requestID + " "
+	}
+	if prefix != "" {
+		format = "[" + prefix[:len(prefix)-1] + "] " + format
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,402 @@
+// Package dashboard serves the builds of the status dashboard from the
+// orchestrator's Redis keys and stores their logs.
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"gobuild/shared/access"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/model"
+)
+
+type BuildStatus struct {
+	ID            string    `json:"id"`
+	RepositoryURL string    `json:"repository_url"`
+	Branch        string    `json:"branch,omitempty"`
+	CommitHash    string    `json:"commit_hash,omitempty"`
+	Status        string    `json:"status"`
+	Message       string    `json:"message,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	ArtifactURL   string    `json:"artifact_url,omitempty"`
+	Logs          []string  `json:"logs,omitempty"`
+}
+
+type StatusDashboardAPI struct {
+	redisClient *redis.Client
+}
+
+func NewStatusDashboardAPI(redisClient *redis.Client) *StatusDashboardAPI {
+	return &StatusDashboardAPI{
+		redisClient: redisClient,
+	}
+}
+
+// maxListedBuilds is the largest page GetBuilds returns, and its default size
+const maxListedBuilds = 100
+
+// GetBuilds returns a page of the newest builds the caller may see, selected
+// by ?offset= and ?limit=; ?team= only returns the builds shared with that team.
+// Builds are read from the orchestrator's indexes, so a user's request only
+// touches their own, their teams' and public builds.
+func (api *StatusDashboardAPI) GetBuilds(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	claims, _ := access.ClaimsFromContext(r.Context())
+	team := r.URL.Query().Get("team")
+
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var indexes []string
+	switch {
+	case team != "":
+		if !claims.SeesAllBuilds() && !slices.Contains(claims.Teams, team) {
+			http.Error(w, "Not a member of this team", http.StatusForbidden)
+			return
+		}
+		indexes = []string{"team:builds:" + team}
+	case claims.SeesAllBuilds():
+		indexes = []string{"builds:by_date"}
+	default:
+		indexes = []string{"user:builds:" + claims.ID, "builds:public"}
+		for _, member := range claims.Teams {
+			indexes = append(indexes, "team:builds:"+member)
+		}
+	}
+
+	buildIDs, err := api.newestBuildIDs(ctx, indexes, offset, limit)
+	if err != nil {
+		log.Printf("Failed to get build IDs: %v", err)
+		http.Error(w, "Failed to list builds", http.StatusInternalServerError)
+		return
+	}
+
+	builds := make([]*model.BuildStatus, 0, len(buildIDs))
+	for _, buildID := range buildIDs {
+		buildJSON, err := api.redisClient.Get(ctx, "build:"+buildID).Result()
+		if err != nil {
+			continue
+		}
+
+		var build model.BuildStatus
+		if err := json.Unmarshal([]byte(buildJSON), &build); err != nil {
+			continue
+		}
+		if !claims.CanViewBuild(&build) {
+			continue
+		}
+
+		builds = append(builds, &build)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(builds)
+}
+
+// pageParams parses ?offset= and ?limit=, limiting a page to maxListedBuilds
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	limit = maxListedBuilds
+	if value := r.URL.Query().Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+		limit = min(limit, maxListedBuilds)
+	}
+	return offset, limit, nil
+}
+
+// newestBuildIDs returns one page of the builds in the given indexes, newest
+// first. Only the first offset+limit entries of each index are read.
+func (api *StatusDashboardAPI) newestBuildIDs(ctx context.Context, indexes []string, offset, limit int) ([]string, error) {
+	end := int64(offset + limit - 1)
+	if len(indexes) == 1 {
+		return api.redisClient.ZRevRange(ctx, indexes[0], int64(offset), end).Result()
+	}
+
+	pipe := api.redisClient.Pipeline()
+	results := make([]*redis.ZSliceCmd, len(indexes))
+	for i, index := range indexes {
+		results[i] = pipe.ZRevRangeWithScores(ctx, index, 0, end)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// A build shared with several teams is in several indexes
+	seen := make(map[string]bool)
+	var merged []redis.Z
+	for _, result := range results {
+		for _, entry := range result.Val() {
+			id := entry.Member.(string)
+			if !seen[id] {
+				seen[id] = true
+				merged = append(merged, entry)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Score > merged[j].Score })
+
+	buildIDs := make([]string, 0, limit)
+	for i := offset; i < len(merged) && i < offset+limit; i++ {
+		buildIDs = append(buildIDs, merged[i].Member.(string))
+	}
+	return buildIDs, nil
+}
+
+func (api *StatusDashboardAPI) GetBuild(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	buildID := vars["buildId"]
+
+	ctx := context.Background()
+
+	buildJSON, err := api.redisClient.Get(ctx, "build:"+buildID).Result()
+	if err != nil {
+		if err == redis.Nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to retrieve build %s: %v", buildID, err)
+		http.Error(w, "Failed to retrieve build", http.StatusInternalServerError)
+		return
+	}
+
+	var build model.BuildStatus
+	if err := json.Unmarshal([]byte(buildJSON), &build); err != nil {
+		log.Printf("Failed to parse build data for %s: %v", buildID, err)
+		http.Error(w, "Failed to parse build data", http.StatusInternalServerError)
+		return
+	}
+
+	// Builds of other users are reported as missing so IDs cannot be probed
+	claims, _ := access.ClaimsFromContext(r.Context())
+	if !claims.CanViewBuild(&build) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+
+	// Get logs for this build
+	logs, err := api.redisClient.LRange(ctx, "logs:"+buildID, 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get logs for build %s: %v", buildID, err)
+	}
+
+	// Add logs to response
+	response := struct {
+		*model.BuildStatus
+		Logs []string `json:"logs,omitempty"`
+	}{
+		BuildStatus: &build,
+		Logs:        logs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ProcessBuildStatus processes a build status update
+func (api *StatusDashboardAPI) ProcessBuildStatus(statusMsg message.BuildStatusMessage) {
+	ctx := context.Background()
+
+	// Get existing build data
+	var build BuildStatus
+	buildFound := false
+
+	// Try build:status:* first
+	buildJSON, err := api.redisClient.Get(ctx, "build:status:"+statusMsg.BuildID).Result()
+	if err == nil {
+		err = json.Unmarshal([]byte(buildJSON), &build)
+		if err == nil {
+			buildFound = true
+		}
+	}
+
+	// Try regular build:* key
+	if !buildFound {
+		buildJSON, err = api.redisClient.Get(ctx, "build:"+statusMsg.BuildID).Result()
+		if err == nil {
+			// Try to parse as BuildJob structure
+			var buildJob struct {
+				ID            string    `json:"id"`
+				RepositoryURL string    `json:"repository_url"`
+				Branch        string    `json:"branch"`
+				CommitHash    string    `json:"commit_hash"`
+				UserID        string    `json:"user_id"`
+				Status        string    `json:"status"`
+				CreatedAt     time.Time `json:"created_at"`
+				UpdatedAt     time.Time `json:"updated_at"`
+			}
+
+			err = json.Unmarshal([]byte(buildJSON), &buildJob)
+			if err == nil {
+				build = BuildStatus{
+					ID:            buildJob.ID,
+					RepositoryURL: buildJob.RepositoryURL,
+					Branch:        buildJob.Branch,
+					CommitHash:    buildJob.CommitHash,
+					Status:        buildJob.Status,
+					CreatedAt:     buildJob.CreatedAt,
+					UpdatedAt:     buildJob.UpdatedAt,
+				}
+				buildFound = true
+			}
+		}
+	}
+
+	// If still not found, create minimal build
+	if !buildFound {
+		build = BuildStatus{
+			ID:        statusMsg.BuildID,
+			Status:    statusMsg.Status,
+			Message:   statusMsg.Message,
+			CreatedAt: statusMsg.UpdatedAt,
+			UpdatedAt: statusMsg.UpdatedAt,
+		}
+	} else {
+		// Update existing build
+		build.Status = statusMsg.Status
+		build.Message = statusMsg.Message
+		build.UpdatedAt = statusMsg.UpdatedAt
+	}
+
+	// Save the updated build to Redis
+	buildJSONBytes, err := json.Marshal(build)
+	if err != nil {
+		log.Printf("Failed to marshal build %s: %v", statusMsg.BuildID, err)
+		return
+	}
+
+	err = api.redisClient.Set(ctx, "build:status:"+statusMsg.BuildID, buildJSONBytes, 24*time.Hour).Err()
+	if err != nil {
+		log.Printf("Failed to save build %s: %v", statusMsg.BuildID, err)
+		return
+	}
+}
+
+// ProcessBuildLog stores build logs (still needed for log storage)
+func (api *StatusDashboardAPI) ProcessBuildLog(logMsg message.BuildLogMessage) {
+	ctx := context.Background()
+
+	err := api.redisClient.RPush(ctx, "logs:"+logMsg.BuildID, logMsg.LogEntry).Err()
+	if err != nil {
+		log.Printf("Failed to save log entry for build %s: %v", logMsg.BuildID, err)
+		return
+	}
+
+	// Set expiry on logs
+	api.redisClient.Expire(ctx, "logs:"+logMsg.BuildID, 24*time.Hour)
+}
+
+// ProcessBuildCompletion processes a build completion message
+func (api *StatusDashboardAPI) ProcessBuildCompletion(completionMsg message.BuildCompletionMessage) {
+	ctx := context.Background()
+
+	// Get existing build data
+	var build BuildStatus
+	buildFound := false
+
+	// Try build:status:* first
+	buildJSON, err := api.redisClient.Get(ctx, "build:status:"+completionMsg.BuildID).Result()
+	if err == nil {
+		err = json.Unmarshal([]byte(buildJSON), &build)
+		if err == nil {
+			buildFound = true
+		}
+	}
+
+	// Try regular build:* key
+	if !buildFound {
+		buildJSON, err = api.redisClient.Get(ctx, "build:"+completionMsg.BuildID).Result()
+		if err != nil {
+			log.Printf("Failed to get build %s: %v", completionMsg.BuildID, err)
+			return
+		}
+
+		// Try to parse as BuildJob structure
+		var buildJob struct {
+			ID            string    `json:"id"`
+			RepositoryURL string    `json:"repository_url"`
+			Branch        string    `json:"branch"`
+			CommitHash    string    `json:"commit_hash"`
+			UserID        string    `json:"user_id"`
+			Status        string    `json:"status"`
+			CreatedAt     time.Time `json:"created_at"`
+			UpdatedAt     time.Time `json:"updated_at"`
+		}
+
+		err = json.Unmarshal([]byte(buildJSON), &buildJob)
+		if err != nil {
+			log.Printf("Failed to unmarshal build %s: %v", completionMsg.BuildID, err)
+			return
+		}
+
+		build = BuildStatus{
+			ID:            buildJob.ID,
+			RepositoryURL: buildJob.RepositoryURL,
+			Branch:        buildJob.Branch,
+			CommitHash:    buildJob.CommitHash,
+			Status:        buildJob.Status,
+			CreatedAt:     buildJob.CreatedAt,
+			UpdatedAt:     buildJob.UpdatedAt,
+		}
+	}
+
+	// Update with completion data
+	build.Status = completionMsg.Status
+	build.UpdatedAt = completionMsg.CompletedAt
+	build.ArtifactURL = completionMsg.ArtifactURL
+
+	buildJSONBytes, err := json.Marshal(build)
+	if err != nil {
+		log.Printf("Failed to marshal build %s: %v", completionMsg.BuildID, err)
+		return
+	}
+
+	err = api.redisClient.Set(ctx, "build:status:"+completionMsg.BuildID, buildJSONBytes, 24*time.Hour).Err()
+	if err != nil {
+		log.Printf("Failed to save build %s: %v", completionMsg.BuildID, err)
+		return
+	}
+
+	log.Printf("Updated build completion: %s - %s", completionMsg.BuildID, completionMsg.Status)
+}
+
+// Topics are the topics the dashboard consumes
+var Topics = []string{kafka.TopicBuildStatus, kafka.TopicBuildLogs, kafka.TopicBuildCompletions}
+
+// Dispatcher returns a dispatcher that stores the logs of Topics. Build state is
+// read from the orchestrator's Redis keys, only logs are stored here.
+func (api *StatusDashboardAPI) Dispatcher() *kafka.Dispatcher {
+	dispatcher := kafka.NewDispatcher()
+	kafka.On(dispatcher, func(ctx context.Context, logMsg message.BuildLogMessage) error {
+		api.ProcessBuildLog(logMsg)
+		return nil
+	})
+	return dispatcher
+}
+
+// RegisterRoutes adds the build endpoints to r, whose requests must already be
+// authenticated by access.Middleware
+func (api *StatusDashboardAPI) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/api/builds", api.GetBuilds).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}", api.GetBuild).Methods("GET")
+}
@@ -12,7 +12,7 @@ import {
 import { Badge } from "@/components/ui/badge";
 import { Button } from "@/components/ui/button";
 import { Alert, AlertDescription, AlertTitle } from "@/components/ui/alert";
-import { ArrowLeft, Download, RefreshCw } from "lucide-react";
+import { ArrowLeft, Download, RefreshCw, XCircle } from "lucide-react";
 
 type BuildStatus = {
   id: string;
@@ -83,8 +83,9 @@ export default function BuildDetailsPage({ params }: PageProps) {
   // Set up WebSocket connection for live updates
   useEffect(() => {
     const clientId = `build-details-${buildId}-${Date.now()}`;
+    const token = localStorage.getItem("authToken") ?? "";
     const ws = new WebSocket(
-      `ws://localhost:8085/ws?clientId=${clientId}&buildId=${buildId}`,
+      `ws://localhost:8085/ws?clientId=${clientId}&buildId=${buildId}&access_token=${token}`,
     );
 
     ws.onopen = () => {
@@ -164,6 +165,17 @@ export default function BuildDetailsPage({ params }: PageProps) {
     }
   }, [build?.logs]);
 
+  const cancelBuild = async () => {
+    const token = localStorage.getItem("authToken");
+    const response = await fetch(`http://localhost:8081/api/builds/${buildId}`, {
+      method: "DELETE",
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+    });
+    if (!response.ok) {
+      console.error("Failed to cancel build:", await response.text());
+    }
+  };
+
   const getStatusColor = (status: string) => {
     switch (status) {
       case "completed":
@@ -176,6 +188,8 @@ export default function BuildDetailsPage({ params }: PageProps) {
       case "failed":
       case "failure":
         return "bg-red-500";
+      case "cancelled":
+        return "bg-gray-700";
       default:
         return "bg-gray-500";
     }
@@ -240,14 +254,22 @@ export default function BuildDetailsPage({ params }: PageProps) {
             <h1 className="text-3xl font-bold mb-2">Build Details</h1>
             <p className="text-gray-600">ID: {build.id}</p>
           </div>
-          <Badge
-            className={`${getStatusColor(build.status)} text-white px-4 py-2`}
-          >
-            <span className="flex items-center gap-2">
-              {getStatusIcon(build.status)}
-              {build.status}
-            </span>
-          </Badge>
+          <div className="flex items-center gap-4">
+            {(build.status === "queued" || build.status === "in-progress") && (
+              <Button variant="destructive" onClick={cancelBuild}>
+                <XCircle className="w-4 h-4 mr-2" />
+                Cancel Build
+              </Button>
+            )}
+            <Badge
+              className={`${getStatusColor(build.status)} text-white px-4 py-2`}
+            >
+              <span className="flex items-center gap-2">
+                {getStatusIcon(build.status)}
+                {build.status}
+              </span>
+            </Badge>
+          </div>
         </div>
       </div>
 
@@ -305,7 +327,8 @@ export default function BuildDetailsPage({ params }: PageProps) {
             </div>
             {build.status === "completed" ||
             build.status === "success" ||
-            build.status === "failed" ? (
+            build.status === "failed" ||
+            build.status === "cancelled" ? (
               <div>
                 <span className="font-semibold">Duration:</span>{" "}
                 {(() => {
@@ -362,7 +385,7 @@ export default function BuildDetailsPage({ params }: PageProps) {
           <Button asChild size="lg">
             {/*doing a replace here is a not so good workaround and could/will cause problems on other systems, but I don't want to fetch it from the backend first then load it here and download it for the user..*/}
             <a
-              href={build.artifact_url.replace("storage", "localhost")}
+              href={`${build.artifact_url.replace("storage", "localhost")}?access_token=${typeof window !== "undefined" ? (localStorage.getItem("authToken") ?? "") : ""}`}
               target="_blank"
               rel="noopener noreferrer"
             >
@@ -55,6 +55,16 @@ export default function Dashboard() {
 
   // Check if user is already logged in
   useEffect(() => {
+    // After an SSO login the gateway passes the tokens in the URL fragment
+    const fragment = new URLSearchParams(window.location.hash.slice(1));
+    const ssoToken = fragment.get("token");
+    const ssoUser = fragment.get("user");
+    if (ssoToken && ssoUser) {
+      localStorage.setItem("authToken", ssoToken);
+      localStorage.setItem("user", ssoUser);
+      window.history.replaceState(null, "", window.location.pathname);
+    }
+
     const storedUser = localStorage.getItem("user");
     if (storedUser) {
       try {
@@ -95,8 +105,9 @@ export default function Dashboard() {
 
   // Set up WebSocket connection
   useEffect(() => {
+    const token = localStorage.getItem("authToken") ?? "";
     const ws = new WebSocket(
-      "ws://localhost:8085/ws?clientId=dashboard-ui&buildId=",
+      `ws://localhost:8085/ws?clientId=dashboard-ui&buildId=&access_token=${token}`,
     );
 
     ws.onopen = () => {
@@ -432,6 +443,24 @@ export default function Dashboard() {
                       Need an account?
                     </Button>
                   </div>
+                  <Button
+                    variant="outline"
+                    className="w-full"
+                    onClick={() => {
+                      window.location.href = "http://localhost:8081/api/oidc/login";
+                    }}
+                  >
+                    Sign in with SSO
+                  </Button>
+                  <Button
+                    variant="link"
+                    className="w-full"
+                    onClick={() => {
+                      window.location.href = "/reset-password";
+                    }}
+                  >
+                    Forgot your password?
+                  </Button>
                   <Button
                     variant="ghost"
                     className="w-full"
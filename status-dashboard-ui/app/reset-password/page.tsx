@@ -0,0 +1,149 @@
+"use client";
+
+import { useEffect, useState } from "react";
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card";
+import { Button } from "@/components/ui/button";
+import { Input } from "@/components/ui/input";
+import { Label } from "@/components/ui/label";
+import { Alert, AlertDescription } from "@/components/ui/alert";
+
+// Requests a password reset mail, or with ?token= from that mail sets the new password
+export default function ResetPasswordPage() {
+  const [token, setToken] = useState("");
+  const [email, setEmail] = useState("");
+  const [password, setPassword] = useState("");
+  const [confirmation, setConfirmation] = useState("");
+  const [error, setError] = useState("");
+  const [done, setDone] = useState("");
+
+  useEffect(() => {
+    setToken(new URLSearchParams(window.location.search).get("token") || "");
+  }, []);
+
+  const requestReset = async () => {
+    try {
+      setError("");
+      const response = await fetch(
+        "http://localhost:8081/api/account/password-reset",
+        {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ email }),
+        }
+      );
+      if (!response.ok) {
+        const message = await response.text();
+        throw new Error(message || "Failed to request password reset");
+      }
+      setDone("If an account exists for this address, we sent it a link to reset the password.");
+    } catch (error: any) {
+      setError(error.message);
+    }
+  };
+
+  const confirmReset = async () => {
+    if (password !== confirmation) {
+      setError("The passwords do not match");
+      return;
+    }
+    try {
+      setError("");
+      const response = await fetch(
+        "http://localhost:8081/api/account/password-reset/confirm",
+        {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ token, new_password: password }),
+        }
+      );
+      if (!response.ok) {
+        const message = await response.text();
+        throw new Error(message || "Failed to reset password");
+      }
+      setDone("Your password was changed. You can log in with it now.");
+    } catch (error: any) {
+      setError(error.message);
+    }
+  };
+
+  return (
+    <div className="container mx-auto p-4 flex justify-center">
+      <Card className="w-full max-w-md mt-16">
+        <CardHeader>
+          <CardTitle>Reset password</CardTitle>
+          <CardDescription>
+            {token
+              ? "Choose a new password for your account."
+              : "We will send you a link to choose a new password."}
+          </CardDescription>
+        </CardHeader>
+        <CardContent className="space-y-4">
+          {error && (
+            <Alert variant="destructive">
+              <AlertDescription>{error}</AlertDescription>
+            </Alert>
+          )}
+          {done ? (
+            <div className="space-y-4">
+              <Alert>
+                <AlertDescription>{done}</AlertDescription>
+              </Alert>
+              <Button className="w-full" onClick={() => (window.location.href = "/")}>
+                Back to the dashboard
+              </Button>
+            </div>
+          ) : token ? (
+            <div className="space-y-4">
+              <div className="space-y-2">
+                <Label htmlFor="new-password">New password</Label>
+                <Input
+                  id="new-password"
+                  type="password"
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                />
+              </div>
+              <div className="space-y-2">
+                <Label htmlFor="confirm-password">Repeat new password</Label>
+                <Input
+                  id="confirm-password"
+                  type="password"
+                  value={confirmation}
+                  onChange={(e) => setConfirmation(e.target.value)}
+                />
+              </div>
+              <Button
+                className="w-full"
+                onClick={confirmReset}
+                disabled={!password || !confirmation}
+              >
+                Set password
+              </Button>
+            </div>
+          ) : (
+            <div className="space-y-4">
+              <div className="space-y-2">
+                <Label htmlFor="reset-email">Email</Label>
+                <Input
+                  id="reset-email"
+                  type="email"
+                  value={email}
+                  onChange={(e) => setEmail(e.target.value)}
+                />
+              </div>
+              <Button className="w-full" onClick={requestReset} disabled={!email}>
+                Send reset link
+              </Button>
+            </div>
+          )}
+        </CardContent>
+      </Card>
+    </div>
+  );
+}
@@ -216,7 +216,10 @@ export default function ThroughputTestPage() {
 
   const fetchBuildStatuses = async () => {
     try {
-      const response = await fetch("http://localhost:8086/api/builds");
+      const token = localStorage.getItem("authToken");
+      const response = await fetch("http://localhost:8086/api/builds", {
+        headers: token ? { Authorization: `Bearer ${token}` } : {},
+      });
       if (!response.ok) {
         throw new Error("Failed to fetch builds");
       }
@@ -424,8 +427,9 @@ export default function ThroughputTestPage() {
     if (!isRunning) return;
 
     const clientId = `throughput-test-${Date.now()}`;
+    const token = localStorage.getItem("authToken") ?? "";
     const ws = new WebSocket(
-      `ws://localhost:8085/ws?clientId=${clientId}&buildId=`,
+      `ws://localhost:8085/ws?clientId=${clientId}&buildId=&access_token=${token}`,
     );
 
     ws.onopen = () => {
@@ -2,6 +2,9 @@ module gobuild/storage
 
 go 1.24.3
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	gobuild/shared v0.0.0
+)
 
 replace gobuild/shared => ../shared
@@ -1,27 +1,74 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"gobuild/shared/access"
+	"gobuild/shared/audit"
+	"gobuild/shared/kafka"
+	"gobuild/shared/message"
+	"gobuild/shared/model"
+	"gobuild/shared/tracing"
 )
 
+var errBuildNotFound = errors.New("build not found")
+
 type StorageService struct {
-	artifactsDir string
+	artifactsDir         string
+	buildOrchestratorURL string
+	audit                *audit.Recorder
 }
 
-func NewStorageService(artifactsDir string) *StorageService {
+func NewStorageService(artifactsDir, buildOrchestratorURL string, recorder *audit.Recorder) *StorageService {
 	return &StorageService{
-		artifactsDir: artifactsDir,
+		artifactsDir:         artifactsDir,
+		buildOrchestratorURL: buildOrchestratorURL,
+		audit:                recorder,
 	}
 }
 
+// fetchBuild asks the orchestrator who started a build
+func (s *StorageService) fetchBuild(ctx context.Context, buildID string) (*model.BuildStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/builds/%s", s.buildOrchestratorURL, buildID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := access.SetServiceToken(req, "storage"); err != nil {
+		return nil, err
+	}
+
+	resp, err := tracing.NewHTTPClient(5 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBuildNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("orchestrator returned %d", resp.StatusCode)
+	}
+
+	var build model.BuildStatus
+	if err := json.NewDecoder(resp.Body).Decode(&build); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
 func (s *StorageService) GetArtifact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	buildID := vars["buildId"]
@@ -31,6 +78,22 @@ func (s *StorageService) GetArtifact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Users only get artifacts of builds they may see; artifacts of other
+	// users' builds are reported as missing
+	claims, _ := access.ClaimsFromContext(r.Context())
+	if !claims.SeesAllBuilds() {
+		build, err := s.fetchBuild(r.Context(), buildID)
+		if err == errBuildNotFound || (err == nil && !claims.CanViewBuild(build)) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up build %s: %v", buildID, err)
+			http.Error(w, "Failed to look up build", http.StatusBadGateway)
+			return
+		}
+	}
+
 	// Look for any file that starts with the buildID
 	pattern := filepath.Join(s.artifactsDir, fmt.Sprintf("%s*.tar.gz", buildID))
 	matches, err := filepath.Glob(pattern)
@@ -43,12 +106,25 @@ func (s *StorageService) GetArtifact(w http.ResponseWriter, r *http.Request) {
 	artifactPath := matches[0]
 	filename := filepath.Base(artifactPath)
 
+	// Downloads through the gateway are recorded there, with the user who asked
+	if claims.Role != access.RoleService {
+		s.audit.Record(r, message.AuditEventMessage{
+			Action:     audit.ActionArtifactDownload,
+			ActorID:    claims.ID,
+			ActorEmail: claims.Email,
+			TargetType: audit.TargetArtifact,
+			TargetID:   buildID,
+			Details:    map[string]string{"file": filename},
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/gzip")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
 
 	http.ServeFile(w, r, artifactPath)
 }
 
+// UploadArtifact stores the artifact of a build; only services (the builder) may upload
 func (s *StorageService) UploadArtifact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	buildID := vars["buildId"]
@@ -58,6 +134,12 @@ func (s *StorageService) UploadArtifact(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	claims, _ := access.ClaimsFromContext(r.Context())
+	if claims.Role != access.RoleService {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	err := r.ParseMultipartForm(32 << 20) // 32MB max
 	if err != nil {
 		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
@@ -93,30 +175,111 @@ func (s *StorageService) UploadArtifact(w http.ResponseWriter, r *http.Request)
 	log.Printf("✅ Successfully uploaded artifact: %s", filename)
 }
 
+// DeleteArtifacts removes all artifacts of a build; only services (the
+// orchestrator, when their user is deleted) may delete
+func (s *StorageService) DeleteArtifacts(w http.ResponseWriter, r *http.Request) {
+	buildID := mux.Vars(r)["buildId"]
+
+	claims, _ := access.ClaimsFromContext(r.Context())
+	if claims.Role != access.RoleService {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.artifactsDir, fmt.Sprintf("%s*.tar.gz", buildID)))
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+	for _, artifactPath := range matches {
+		if err := os.Remove(artifactPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete artifact %s: %v", artifactPath, err)
+			http.Error(w, "Failed to delete artifact", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted artifact: %s", filepath.Base(artifactPath))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8083"
 	}
 
+	// Service tokens signed with a missing or well-known secret could be forged
+	if err := access.CheckServiceSecret(); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
 	artifactsDir := "/app/artifacts"
 	err := os.MkdirAll(artifactsDir, 0755)
 	if err != nil {
 		log.Fatalf("Failed to create artifacts directory: %v", err)
 	}
 
-	storage := NewStorageService(artifactsDir)
+	shutdownTracing, err := tracing.Init("storage")
+	if err != nil {
+		log.Fatalf("Failed to initialise tracing: %v", err)
+	}
+
+	buildOrchestratorURL := os.Getenv("BUILD_ORCHESTRATOR_URL")
+	if buildOrchestratorURL == "" {
+		buildOrchestratorURL = "http://build-orchestrator:8082"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := kafka.EnsureTopics(ctx, "kafka:29092", kafka.Topics); err != nil {
+		log.Fatalf("Failed to ensure Kafka topics: %v", err)
+	}
+	var kafkaProducer kafka.Publisher
+	kafkaProducer, err = kafka.NewProducer("kafka:29092")
+	if err != nil {
+		log.Fatalf("Failed to create Kafka producer: %v", err)
+	}
+
+	storage := NewStorageService(artifactsDir, buildOrchestratorURL, audit.NewRecorder(kafkaProducer, "storage"))
 
 	r := mux.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Use(access.Middleware)
 
 	r.HandleFunc("/artifacts/{buildId}", storage.GetArtifact).Methods("GET")
 
 	r.HandleFunc("/artifacts/{buildId}", storage.UploadArtifact).Methods("POST")
 
+	r.HandleFunc("/artifacts/{buildId}", storage.DeleteArtifacts).Methods("DELETE")
+
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	log.Printf("Storage Service is running on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		log.Printf("Storage Service is running on port %s...", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP server failed: %v", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down Storage Service...")
+
+	// Give running uploads and downloads time to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	// Flush the audit events of the last downloads
+	kafkaProducer.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
+	log.Println("Storage Service stopped")
 }